@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/core"
+	"gorm.io/gorm"
+)
+
+//go:embed admin.html
+var adminUI []byte
+
+const maxRecentErrors = 50
+
+type errorEntry struct {
+	Component string    `json:"component"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+var (
+	recentErrorsMu sync.Mutex
+	recentErrors   = []errorEntry{}
+)
+
+// reportError logs err and keeps it in the recent error list shown on the admin dashboard.
+func reportError(component string, err error) {
+	slog.Error("operation failed", "component", component, "error", err)
+
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+
+	recentErrors = append(recentErrors, errorEntry{
+		Component: component,
+		Message:   err.Error(),
+		Time:      time.Now(),
+	})
+	if len(recentErrors) > maxRecentErrors {
+		recentErrors = recentErrors[len(recentErrors)-maxRecentErrors:]
+	}
+}
+
+func getRecentErrors() []errorEntry {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+
+	errors := make([]errorEntry, len(recentErrors))
+	for i, entry := range recentErrors {
+		errors[len(recentErrors)-1-i] = entry
+	}
+	return errors
+}
+
+func analyticsKey(day time.Time) string {
+	return "ccsearch:analytics:queries:" + day.UTC().Format("2006-01-02")
+}
+
+// recordQuery counts a search query for the admin query analytics.
+func recordQuery(ctx context.Context, rdb *redis.Client, query string) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return
+	}
+
+	key := analyticsKey(time.Now())
+	pipe := rdb.Pipeline()
+	pipe.ZIncrBy(ctx, key, 1, query)
+	pipe.Expire(ctx, key, 8*24*time.Hour)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		reportError("analytics", err)
+	}
+}
+
+// Roles of the admin API keys. Readers may only use the GET routes, e.g. the stats and
+// the status, while admins may also run the destructive operations.
+const (
+	adminRoleRead  = "read"
+	adminRoleAdmin = "admin"
+)
+
+type adminKey struct {
+	name  string
+	role  string
+	token string
+}
+
+var adminKeys = []adminKey{}
+
+// setupAdminKeys reads ADMIN_API_KEYS, a comma separated list of name:role:key entries,
+// e.g. "grafana:read:s3cret,ops:admin:t0ken". The ADMIN_TOKEN is a key with the admin
+// role.
+func setupAdminKeys() error {
+	keys := []adminKey{}
+	if admin_token != "" {
+		keys = append(keys, adminKey{name: "ADMIN_TOKEN", role: adminRoleAdmin, token: admin_token})
+	}
+
+	for _, entry := range strings.Split(os.Getenv("ADMIN_API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return fmt.Errorf("invalid ADMIN_API_KEYS entry: expected name:role:key")
+		}
+		if parts[1] != adminRoleRead && parts[1] != adminRoleAdmin {
+			return fmt.Errorf("invalid ADMIN_API_KEYS role of %s: %s", parts[0], parts[1])
+		}
+		keys = append(keys, adminKey{name: parts[0], role: parts[1], token: parts[2]})
+	}
+
+	adminKeys = keys
+	return nil
+}
+
+// findAdminKey returns the key matching token, comparing every key in constant time.
+func findAdminKey(token string) (adminKey, bool) {
+	var found adminKey
+	ok := false
+	for _, key := range adminKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key.token)) == 1 {
+			found, ok = key, true
+		}
+	}
+	return found, ok
+}
+
+// adminAuth requires one of the admin API keys as a bearer token, and the admin role for
+// anything but reads. The operations are logged with the name of their key. The admin
+// API is disabled entirely when no key is configured.
+func adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(adminKeys) == 0 {
+			return respondError(c, http.StatusForbidden, codeForbidden, "admin api is disabled")
+		}
+
+		token, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if !found {
+			return respondError(c, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+		}
+		key, ok := findAdminKey(token)
+		if !ok {
+			return respondError(c, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+		}
+
+		method := c.Request().Method
+		if method != http.MethodGet && method != http.MethodHead {
+			if key.role != adminRoleAdmin {
+				return respondError(c, http.StatusForbidden, codeForbidden, "the key is read-only")
+			}
+			adminLog.Info("admin operation", "method", method, "path", c.Path(), "key", key.name)
+		}
+
+		return next(c)
+	}
+}
+
+func getLatestCommitID(db *gorm.DB) (uint, error) {
+	var latest uint
+	err := db.Model(&core.CommitLog{}).Select("COALESCE(MAX(id), 0)").Scan(&latest).Error
+	return latest, err
+}
+
+func setupAdmin(e *echo.Echo, db *gorm.DB, rdb *redis.Client, backend searchBackend, index searchIndex) {
+
+	e.GET("/admin/ui", func(c echo.Context) error {
+		return c.HTMLBlob(http.StatusOK, adminUI)
+	})
+
+	admin := e.Group("/admin", adminAuth)
+
+	admin.GET("/stats", func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		latest, err := getLatestCommitID(db)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		stats, err := index.GetStats()
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		// the summary follows the pipeline furthest behind, and the latest batch of any
+		pipelines := pipelineStatuses(ctx, latest)
+		lag := uint(0)
+		cursor := latest
+		indexedLastHour := int64(0)
+		var lastBatch *batchStatus
+		for _, p := range pipelines {
+			lag = max(lag, p.Lag)
+			cursor = min(cursor, p.Checkpoint)
+			indexedLastHour += p.IndexedLastHour
+			if p.LastBatch != nil && (lastBatch == nil || p.LastBatch.FinishedAt.After(lastBatch.FinishedAt)) {
+				lastBatch = p.LastBatch
+			}
+		}
+		summary := echo.Map{
+			"latestCommit":    latest,
+			"cursor":          cursor,
+			"lag":             lag,
+			"indexedLastHour": indexedLastHour,
+			"documents":       stats.NumberOfDocuments,
+			"isIndexing":      stats.IsIndexing,
+			"indexerRunning":  isIndexerRunning(),
+			"pipelines":       pipelines,
+		}
+		if lastBatch != nil {
+			summary["lastBatchAt"] = lastBatch.FinishedAt
+			summary["lastBatchMs"] = lastBatch.DurationMs
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": summary})
+	})
+
+	admin.GET("/status", statusHandler(db, rdb, backend))
+
+	setupFeatureRoutes(admin)
+	setupMaintenanceRoutes(admin)
+	setupLogLevelRoutes(admin)
+	setupJobRoutes(admin)
+	setupModerationRoutes(admin)
+	setupBlocklistRoutes(admin)
+	setupShardRoutes(admin)
+	setupReportRoutes(admin, rdb)
+	setupSkippedRoutes(admin)
+	setupDeadLetterRoutes(admin, rdb)
+	setupWebhookRoutes(admin)
+
+	admin.GET("/errors", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": getRecentErrors()})
+	})
+
+	admin.GET("/analytics", func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		days := 7
+		daysStr := c.QueryParam("days")
+		if daysStr != "" {
+			days, _ = strconv.Atoi(daysStr)
+		}
+		if days <= 0 || days > 7 {
+			days = 7
+		}
+
+		keys := []string{}
+		daily := []echo.Map{}
+		for i := 0; i < days; i++ {
+			day := time.Now().AddDate(0, 0, -i)
+			key := analyticsKey(day)
+			keys = append(keys, key)
+
+			counts, err := rdb.ZRangeWithScores(ctx, key, 0, -1).Result()
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			total := 0.0
+			for _, count := range counts {
+				total += count.Score
+			}
+			daily = append(daily, echo.Map{
+				"date":     day.UTC().Format("2006-01-02"),
+				"searches": int64(total),
+			})
+		}
+
+		top, err := rdb.ZUnionWithScores(ctx, redis.ZStore{Keys: keys}).Result()
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		queries := []echo.Map{}
+		for i := len(top) - 1; i >= 0 && len(queries) < 50; i-- {
+			queries = append(queries, echo.Map{
+				"query": top[i].Member,
+				"count": int64(top[i].Score),
+			})
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"status": "ok",
+			"content": echo.Map{
+				"daily":      daily,
+				"topQueries": queries,
+			},
+		})
+	})
+
+	admin.POST("/reindex", func(c echo.Context) error {
+		targets := getPipelines()
+		name := c.QueryParam("pipeline")
+		if name != "" {
+			p := getPipeline(name)
+			if p == nil {
+				return respondFieldError(c, http.StatusNotFound, codeNotFound, "pipeline", "unknown pipeline")
+			}
+			targets = []*pipeline{p}
+		}
+
+		for _, p := range targets {
+			err := p.resetCursor(c.Request().Context())
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			adminLog.Info("reindex requested, cursor reset", "pipeline", p.name)
+			// start the backfill now rather than at the next interval; on a follower the
+			// leader picks it up on its own schedule
+			jobs.runNow("index_" + p.name)
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+
+	admin.GET("/reindex/status", func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		latest, err := getLatestCommitID(db)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		statuses := []reindexStatus{}
+		for _, p := range getPipelines() {
+			status, err := p.reindexStatus(ctx, latest)
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			statuses = append(statuses, status)
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": statuses})
+	})
+
+	admin.POST("/purge", func(c echo.Context) error {
+		var request struct {
+			Signer string `json:"signer"`
+			All    bool   `json:"all"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		// wiping the index takes an explicit all, never an empty or misspelled body
+		if request.Signer == "" && !request.All {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "signer", "signer is required, or all to purge every document")
+		}
+		if request.Signer != "" && request.All {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "all", "signer and all are exclusive")
+		}
+
+		// the documents of a signer are spread over the message indexes, their shards
+		// included, and the profile and timeline indexes
+		indexes := signerIndexes()
+		if request.All {
+			indexes = messageIndexes()
+		}
+		taskUids := []int64{}
+		for _, index := range indexes {
+			var task *meilisearch.TaskInfo
+			if request.Signer != "" {
+				task, err = index.DeleteDocumentsByFilter(fmt.Sprintf("signer = %s", quoteFilter(request.Signer)))
+			} else {
+				task, err = index.DeleteAllDocuments()
+			}
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			taskUids = append(taskUids, task.TaskUID)
+		}
+		adminLog.Info("purge requested", "signer", request.Signer, "all", request.All, "indexes", len(indexes))
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{"taskUids": taskUids}})
+	})
+}
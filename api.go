@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const apiPrefix = "/v1"
+
+// legacySunset is announced in the Sunset header of the unversioned routes when
+// LEGACY_API_SUNSET is set to a date (2006-01-02).
+var legacySunset time.Time
+
+// legacyAPI marks a response of an unversioned route as deprecated and points to its
+// versioned successor.
+func legacyAPI(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Response().Header()
+		header.Set("Deprecation", "true")
+		header.Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", apiPrefix, c.Request().URL.Path))
+		if !legacySunset.IsZero() {
+			header.Set("Sunset", legacySunset.UTC().Format(http.TimeFormat))
+		}
+		return next(c)
+	}
+}
+
+// setupAPI registers the public API under /v1. The routes that existed before
+// versioning stay available at their original path as deprecated aliases.
+func setupAPI(e *echo.Echo, rdb *redis.Client, index searchIndex) error {
+	if value := os.Getenv("LEGACY_API_SUNSET"); value != "" {
+		sunset, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return fmt.Errorf("invalid LEGACY_API_SUNSET: %s", value)
+		}
+		legacySunset = sunset
+	}
+	err := setupSuggest()
+	if err != nil {
+		return err
+	}
+	if value := os.Getenv("SEARCH_MAX_LIMIT"); value != "" {
+		maxLimit, err := strconv.Atoi(value)
+		if err != nil || maxLimit <= 0 {
+			return fmt.Errorf("invalid SEARCH_MAX_LIMIT: %s", value)
+		}
+		searchMaxLimit = maxLimit
+	}
+
+	timeline := searchGuard(func(c echo.Context) error {
+		timeline := c.Param("id")
+		if timeline == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "id", "timeline is empty")
+		}
+
+		allowed, err := policies.canRead(c.Request().Context(), timeline, requesterFrom(c))
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		if !allowed {
+			return respondFieldError(c, http.StatusForbidden, codeForbidden, "id", "timeline is not readable")
+		}
+
+		defaults, err := timelineSettings.get(timeline)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		return searchMessages(c, rdb, index, []string{fmt.Sprintf("timelines = %s", quoteFilter(timeline))}, defaults)
+	})
+
+	thread := searchGuard(func(c echo.Context) error {
+		rootId := c.Param("rootId")
+		if rootId == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "rootId", "rootId is empty")
+		}
+
+		scope := []string{fmt.Sprintf("threadRoot = %s", quoteFilter(rootId))}
+		if policies.enabled {
+			// a thread may span timelines, so only messages readable by anyone are served
+			scope = append(scope, "restricted != true")
+		}
+
+		return searchMessages(c, rdb, index, scope, searchDefaults{})
+	})
+
+	hashtag := searchGuard(func(c echo.Context) error {
+		tag := strings.ToLower(strings.TrimPrefix(c.Param("tag"), "#"))
+		if !hashtagNamePattern.MatchString(tag) {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "tag", "tag is not a hashtag")
+		}
+
+		scope := []string{fmt.Sprintf("hashtags = %s", quoteFilter(tag))}
+		if policies.enabled {
+			// a hashtag spans timelines, so only messages readable by anyone are served
+			scope = append(scope, "restricted != true")
+		}
+
+		return searchMessages(c, rdb, index, scope, searchDefaults{browse: true})
+	})
+
+	mention := searchGuard(func(c echo.Context) error {
+		ccid := c.Param("ccid")
+		if !ccidPattern.MatchString(ccid) {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "ccid", "ccid is not a CCID")
+		}
+
+		scope := []string{fmt.Sprintf("mentions = %s", quoteFilter(ccid))}
+		if policies.enabled {
+			// mentions span timelines, so only messages readable by anyone are served
+			scope = append(scope, "restricted != true")
+		}
+
+		return searchMessages(c, rdb, index, scope, searchDefaults{browse: true})
+	})
+
+	global := searchGuard(func(c echo.Context) error {
+		scope := []string{}
+		if policies.enabled {
+			// only messages readable by anyone are served across timelines
+			scope = append(scope, "restricted != true")
+		}
+
+		return searchMessages(c, rdb, index, scope, searchDefaults{})
+	})
+
+	trends := func(c echo.Context) error {
+		if !features.enabled(c.Request().Context(), featureTrends) {
+			return respondError(c, http.StatusNotFound, codeFeatureDisabled, "trends are disabled")
+		}
+
+		limitStr := c.QueryParam("limit")
+		limit := 20
+		if limitStr != "" {
+			limit, _ = strconv.Atoi(limitStr)
+		}
+		if limit <= 0 || limit > trendsSize {
+			limit = trendsSize
+		}
+
+		timeline := c.QueryParam("timeline")
+		if timeline != "" {
+			allowed, err := policies.canRead(c.Request().Context(), timeline, requesterFrom(c))
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			if !allowed {
+				return respondFieldError(c, http.StatusForbidden, codeForbidden, "timeline", "timeline is not readable")
+			}
+		}
+
+		trends, err := getTrends(c.Request().Context(), rdb, timeline)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		if len(trends) > limit {
+			trends = trends[:limit]
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": trends})
+	}
+
+	v1 := e.Group(apiPrefix, authenticate, limitRequests)
+	v1.GET("/search", global)
+	v1.GET("/timeline/:id", timeline)
+	v1.GET("/thread/:rootId/search", thread)
+	v1.GET("/hashtags/:tag", hashtag)
+	v1.GET("/mentions/:ccid", mention)
+	v1.GET("/trends/messages", trends)
+	v1.GET("/trends/hashtags", hashtagTrendsHandler(rdb))
+	v1.GET("/related", relatedHandler(rdb))
+	v1.GET("/profiles", searchGuard(profilesHandler))
+	v1.GET("/timelines", searchGuard(timelinesHandler))
+	v1.GET("/suggest", searchGuard(suggestHandler(index)))
+	v1.GET("/autocomplete", searchGuard(autocompleteHandler))
+	v1.GET("/subscribe", subscribeHandler)
+	v1.GET("/stream", streamHandler)
+	setupTimelineSettingsRoutes(v1)
+
+	e.GET("/timeline/:id", legacyAPI(timeline), authenticate, limitRequests)
+	e.GET("/thread/:rootId/search", legacyAPI(thread), authenticate, limitRequests)
+	e.GET("/trends/messages", legacyAPI(trends), authenticate, limitRequests)
+
+	return nil
+}
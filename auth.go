@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/totegamma/concurrent/x/jwt"
+	"gorm.io/gorm"
+)
+
+// requesterKey holds the requester verified by authenticate in the echo context.
+const requesterKey = "requester"
+
+// authVerifier verifies the JWTs that Concurrent clients sign with their CCID, as the
+// core API does, so that the API can be reached without the gateway. It is enabled by
+// AUTH_AUDIENCE, the domain the tokens must be issued for, usually the FQDN of the node.
+// The cc-requester headers of the gateway are only trusted with AUTH_TRUST_GATEWAY=true,
+// and only from the TRUSTED_PROXIES, since anyone reaching the service could set them.
+type authVerifier struct {
+	db           *gorm.DB
+	audience     string
+	trustGateway bool
+}
+
+var auth = &authVerifier{}
+
+func setupAuth(db *gorm.DB) error {
+	verifier := &authVerifier{db: db, audience: os.Getenv("AUTH_AUDIENCE")}
+	if value := os.Getenv("AUTH_TRUST_GATEWAY"); value != "" {
+		trust, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid AUTH_TRUST_GATEWAY: %s", value)
+		}
+		verifier.trustGateway = trust
+	}
+	if verifier.trustGateway && len(trustedProxies) == 0 {
+		return fmt.Errorf("AUTH_TRUST_GATEWAY needs TRUSTED_PROXIES, the address of the gateway")
+	}
+
+	auth = verifier
+	return nil
+}
+
+func (a *authVerifier) enabled() bool {
+	return a.audience != ""
+}
+
+// verify checks the signature, the expiry and the audience of a token, and resolves its
+// issuer against the entities of the node: its own users are local, anyone else remote.
+// Tokens signed with a subkey are not supported.
+func (a *authVerifier) verify(ctx context.Context, token string) (requester, error) {
+	claims, err := jwt.Validate(token)
+	if err != nil {
+		return guest, fmt.Errorf("invalid token: %w", err)
+	}
+	if claims.Audience != a.audience {
+		return guest, fmt.Errorf("the token is not issued for %s", a.audience)
+	}
+	if !ccidPattern.MatchString(claims.Issuer) {
+		return guest, fmt.Errorf("the token must be signed by a CCID")
+	}
+
+	r := requester{Type: requesterRemoteUser, CCID: claims.Issuer}
+	var entity struct {
+		Domain string
+		Tag    string
+	}
+	err = a.db.WithContext(ctx).Raw("SELECT domain, tag FROM entities WHERE id = ?", claims.Issuer).Scan(&entity).Error
+	if err != nil {
+		return guest, err
+	}
+	r.Domain = entity.Domain
+	if entity.Domain == a.audience {
+		r.Type = requesterLocalUser
+		for _, tag := range strings.Split(entity.Tag, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				r.Tags = append(r.Tags, tag)
+			}
+		}
+	}
+	return r, nil
+}
+
+// authenticate verifies the bearer token of a request, when there is one, and makes its
+// issuer the requester. Requests without a token are guests.
+func authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !auth.enabled() {
+			return next(c)
+		}
+		token, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if !found {
+			return next(c)
+		}
+
+		r, err := auth.verify(c.Request().Context(), token)
+		if err != nil {
+			return respondError(c, http.StatusUnauthorized, codeUnauthorized, err.Error())
+		}
+		c.Set(requesterKey, r)
+		return next(c)
+	}
+}
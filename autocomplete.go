@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultCompletionLimit = 10
+	maxCompletionLimit     = 20
+	// usageHalfLife is the time after which a use counts half as much toward the rank of
+	// a completion.
+	usageHalfLife = 7 * 24 * time.Hour
+)
+
+// usageEpoch is the reference of the usage scores. A use weighs 2^((t - epoch) / half
+// life), so the scores of the recent uses grow instead of the old ones having to decay,
+// and the ranks stay comparable without rewriting every document.
+var usageEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var completionSettings = indexSettings{
+	filterable: []string{"username"},
+	sortable:   []string{"usage"},
+	searchable: []string{"name", "username"},
+}
+
+// hashtagCompletion and userCompletion are the documents of the auxiliary indexes.
+// They are written as partial updates, and the usage of a user is left out of the
+// updates of its profile so that they keep it.
+type hashtagCompletion struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Usage float64 `json:"usage"`
+}
+
+type userCompletion struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username,omitempty"`
+	Usage    *float64 `json:"usage,omitempty"`
+}
+
+type completion struct {
+	Value    string `json:"value"`
+	CCID     string `json:"ccid,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// completionIndexes keeps the hashtags and the users seen while indexing in two small
+// indexes next to MEILISEARCH_IDX, ranked by their recent usage, to complete what a
+// client is typing. The usage is counted in redis and copied to the documents.
+type completionIndexes struct {
+	rdb      *redis.Client
+	hashtags searchIndex
+	users    searchIndex
+}
+
+var completions *completionIndexes
+
+func setupCompletions(backend searchBackend, rdb *redis.Client) error {
+	c := &completionIndexes{rdb: rdb}
+	for _, target := range []struct {
+		uid   string
+		index *searchIndex
+	}{
+		{meilisearch_idx + "-hashtags", &c.hashtags},
+		{meilisearch_idx + "-users", &c.users},
+	} {
+		primary, err := backend.openIndex(target.uid)
+		if err != nil {
+			return err
+		}
+		*target.index = replicated(primary, target.uid)
+		err = (*target.index).ensureSettings(completionSettings)
+		if err != nil {
+			return err
+		}
+	}
+	completions = c
+	return nil
+}
+
+func usageWeight(t time.Time) float64 {
+	return math.Exp2(float64(t.Sub(usageEpoch)) / float64(usageHalfLife))
+}
+
+// hashtagID makes a document ID of a hashtag, which may hold letters the engines don't
+// accept in IDs.
+func hashtagID(tag string) string {
+	sum := sha256.Sum256([]byte(tag))
+	return hex.EncodeToString(sum[:16])
+}
+
+// bump adds the uses to the usage scores of a redis key and returns the new scores.
+func (c *completionIndexes) bump(ctx context.Context, key string, uses map[string]float64) (map[string]float64, error) {
+	pipe := c.rdb.Pipeline()
+	results := map[string]*redis.FloatCmd{}
+	for member, weight := range uses {
+		results[member] = pipe.ZIncrBy(ctx, key, weight, member)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scores := map[string]float64{}
+	for member, result := range results {
+		scores[member] = result.Val()
+	}
+	return scores, nil
+}
+
+// recordMessages counts the hashtags, mentions and authors of the indexed messages.
+// Hidden, spam and restricted messages don't count, so that completions don't leak them.
+func (c *completionIndexes) recordMessages(ctx context.Context, records []messageRecord) {
+	if !features.enabled(ctx, featureAutocomplete) {
+		return
+	}
+
+	tags := map[string]float64{}
+	users := map[string]float64{}
+	for _, record := range records {
+		if record.Hidden || record.Spam || record.Flagged || record.Restricted {
+			continue
+		}
+		weight := usageWeight(time.UnixMilli(record.SignedAt))
+		for _, tag := range record.Hashtags {
+			tags[tag] += weight
+		}
+		for _, ccid := range record.Mentions {
+			users[ccid] += weight
+		}
+		users[record.Signer] += weight
+	}
+
+	if len(tags) > 0 {
+		scores, err := c.bump(ctx, "ccsearch:completions:hashtags", tags)
+		if err != nil {
+			reportError("autocomplete", err)
+			return
+		}
+		documents := []hashtagCompletion{}
+		for tag, score := range scores {
+			documents = append(documents, hashtagCompletion{ID: hashtagID(tag), Name: tag, Usage: score})
+		}
+		_, err = c.hashtags.UpdateDocumentsWithContext(ctx, documents)
+		if err != nil {
+			reportError("autocomplete", err)
+		}
+	}
+
+	if len(users) > 0 {
+		scores, err := c.bump(ctx, "ccsearch:completions:users", users)
+		if err != nil {
+			reportError("autocomplete", err)
+			return
+		}
+		documents := []userCompletion{}
+		for ccid, score := range scores {
+			documents = append(documents, userCompletion{ID: ccid, Usage: &score})
+		}
+		_, err = c.users.UpdateDocumentsWithContext(ctx, documents)
+		if err != nil {
+			reportError("autocomplete", err)
+		}
+	}
+}
+
+// recordProfiles keeps the usernames of the indexed profiles. Users are only completed
+// once their profile is known.
+func (c *completionIndexes) recordProfiles(ctx context.Context, records []profileRecord) {
+	if !features.enabled(ctx, featureAutocomplete) {
+		return
+	}
+
+	documents := []userCompletion{}
+	for _, record := range records {
+		if record.Username == "" {
+			continue
+		}
+		documents = append(documents, userCompletion{ID: record.Signer, Username: record.Username})
+	}
+	if len(documents) == 0 {
+		return
+	}
+	_, err := c.users.UpdateDocumentsWithContext(ctx, documents)
+	if err != nil {
+		reportError("autocomplete", err)
+	}
+}
+
+// autocompleteHandler serves GET /v1/autocomplete?q=&type=hashtag|user, completing the
+// last word being typed with the hashtags or the usernames used the most lately.
+func autocompleteHandler(c echo.Context) error {
+	if completions == nil || !features.enabled(c.Request().Context(), featureAutocomplete) {
+		return respondError(c, http.StatusNotFound, codeFeatureDisabled, "autocomplete is disabled")
+	}
+
+	kind := c.QueryParam("type")
+	query := strings.TrimSpace(c.QueryParam("q"))
+	switch kind {
+	case "hashtag":
+		query = strings.ToLower(strings.TrimPrefix(query, "#"))
+	case "user":
+		query = strings.TrimPrefix(query, "@")
+	case "":
+		return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "type", "type is empty")
+	default:
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "type", "type must be hashtag or user")
+	}
+	if query == "" {
+		return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "q", "query is empty")
+	}
+
+	limit := defaultCompletionLimit
+	if value := c.QueryParam("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "limit", "limit must be a positive integer")
+		}
+		limit = min(parsed, maxCompletionLimit)
+	}
+
+	index := completions.hashtags
+	request := &meilisearch.SearchRequest{
+		Limit: int64(limit),
+		Sort:  []string{"usage:desc"},
+	}
+	if kind == "user" {
+		index = completions.users
+		request.Filter = []string{"username EXISTS"}
+	}
+
+	search, err := index.SearchWithContext(c.Request().Context(), query, request)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+
+	results := []completion{}
+	for _, hit := range search.Hits {
+		hitDoc, ok := hit.(map[string]any)
+		if !ok {
+			continue
+		}
+		result := completion{}
+		if kind == "hashtag" {
+			name, _ := hitDoc["name"].(string)
+			result.Value = "#" + name
+		} else {
+			result.CCID, _ = hitDoc["id"].(string)
+			result.Username, _ = hitDoc["username"].(string)
+			result.Value = "@" + result.CCID
+		}
+		results = append(results, result)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": results})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// searchBackend is the engine holding the indexes, chosen with SEARCH_BACKEND:
+// "meilisearch" (the default), "opensearch" or "postgres".
+type searchBackend interface {
+	// index returns an index, without checking that it exists.
+	index(uid string) searchIndex
+	// openIndex returns an index, creating it when it is missing.
+	openIndex(uid string) (searchIndex, error)
+	// deleteIndex deletes an index with its documents.
+	deleteIndex(uid string) error
+	health(ctx context.Context) error
+}
+
+// searchIndex is an index of a search backend, with the calls the service makes, which
+// every backend implements in full. Requests and responses keep the types of the
+// Meilisearch client, the first backend.
+type searchIndex interface {
+	AddDocuments(documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error)
+	AddDocumentsWithContext(ctx context.Context, documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error)
+	UpdateDocuments(documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error)
+	UpdateDocumentsWithContext(ctx context.Context, documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error)
+	DeleteDocuments(identifiers []string) (*meilisearch.TaskInfo, error)
+	DeleteDocumentsWithContext(ctx context.Context, identifiers []string) (*meilisearch.TaskInfo, error)
+	DeleteDocumentsByFilter(filter interface{}) (*meilisearch.TaskInfo, error)
+	DeleteDocumentsByFilterWithContext(ctx context.Context, filter interface{}) (*meilisearch.TaskInfo, error)
+	DeleteAllDocuments() (*meilisearch.TaskInfo, error)
+	DeleteAllDocumentsWithContext(ctx context.Context) (*meilisearch.TaskInfo, error)
+	GetDocument(identifier string, request *meilisearch.DocumentQuery, documentPtr interface{}) error
+	GetDocumentWithContext(ctx context.Context, identifier string, request *meilisearch.DocumentQuery, documentPtr interface{}) error
+	GetDocuments(param *meilisearch.DocumentsQuery, resp *meilisearch.DocumentsResult) error
+	GetDocumentsWithContext(ctx context.Context, param *meilisearch.DocumentsQuery, resp *meilisearch.DocumentsResult) error
+	Search(query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error)
+	SearchWithContext(ctx context.Context, query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error)
+	GetStats() (*meilisearch.StatsIndex, error)
+	GetStatsWithContext(ctx context.Context) (*meilisearch.StatsIndex, error)
+	WaitForTask(taskUID int64, interval time.Duration) (*meilisearch.Task, error)
+	WaitForTaskWithContext(ctx context.Context, taskUID int64, interval time.Duration) (*meilisearch.Task, error)
+
+	// ensureSettings makes the settings of the index match the given ones.
+	ensureSettings(settings indexSettings) error
+	// settingsDrift lists the settings of the index that differ from the given ones,
+	// without changing them.
+	settingsDrift(settings indexSettings) ([]string, error)
+}
+
+// searchBackendName is the SEARCH_BACKEND in use.
+var searchBackendName = "meilisearch"
+
+func newSearchBackend(client meilisearch.ServiceManager) (searchBackend, error) {
+	name := os.Getenv("SEARCH_BACKEND")
+	switch name {
+	case "", "meilisearch":
+		return &meilisearchBackend{client: client}, nil
+	case "opensearch", "postgres":
+		if os.Getenv("MEILISEARCH_REPLICAS") != "" {
+			return nil, fmt.Errorf("MEILISEARCH_REPLICAS needs SEARCH_BACKEND=meilisearch")
+		}
+		searchBackendName = name
+		if name == "postgres" {
+			return newPostgresBackend()
+		}
+		return newOpensearchBackend()
+	}
+	return nil, fmt.Errorf("invalid SEARCH_BACKEND: %s (expected meilisearch, opensearch or postgres)", name)
+}
+
+type meilisearchBackend struct {
+	client meilisearch.ServiceManager
+}
+
+// meilisearchIndex is an index of the Meilisearch client, which has every call of
+// searchIndex but the settings.
+type meilisearchIndex struct {
+	meilisearch.IndexManager
+}
+
+func (b *meilisearchBackend) index(uid string) searchIndex {
+	return &meilisearchIndex{b.client.Index(uid)}
+}
+
+func (b *meilisearchBackend) openIndex(uid string) (searchIndex, error) {
+	_, err := b.client.GetIndex(uid)
+	if err != nil {
+		_, err = b.client.CreateIndex(&meilisearch.IndexConfig{
+			Uid: uid,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.index(uid), nil
+}
+
+func (b *meilisearchBackend) deleteIndex(uid string) error {
+	_, err := b.client.DeleteIndex(uid)
+	return err
+}
+
+func (b *meilisearchBackend) health(ctx context.Context) error {
+	_, err := b.client.HealthWithContext(ctx)
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/totegamma/concurrent/core"
+)
+
+// backfillWorkers is the number of pages a pipeline transforms at once while it is far
+// behind the commit log, e.g. on the first start or after a reindex. 1 keeps the
+// pipelines serial.
+var backfillWorkers = 1
+
+// loadBackfillWorkers reads BACKFILL_WORKERS.
+func loadBackfillWorkers() (int, error) {
+	value := os.Getenv("BACKFILL_WORKERS")
+	if value == "" {
+		return 1, nil
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 || workers > 64 {
+		return 0, fmt.Errorf("invalid BACKFILL_WORKERS: %s (expected 1 to 64)", value)
+	}
+	return workers, nil
+}
+
+// backfillRange is the share of one worker: the commits with after < ID <= until.
+type backfillRange struct {
+	after   uint
+	until   uint
+	commits []core.CommitLog
+	batch   batchTransformer
+	err     error
+}
+
+// backfill transforms the commits after lastKey in ranges of pageSize IDs, one per
+// worker, then writes the ranges in order, checkpointing after each, so that a delete
+// still lands after the message it removes. The thread roots of a range are resolved
+// again against the earlier ranges, which weren't in the index yet when it was
+// transformed. It returns the new cursor.
+func (p *pipeline) backfill(ctx context.Context, lastKey, latest uint, pageSize int) (uint, error) {
+	start := time.Now()
+
+	ranges := []*backfillRange{}
+	for i := 0; i < backfillWorkers; i++ {
+		after := lastKey + uint(i*pageSize)
+		if after >= latest {
+			break
+		}
+		ranges = append(ranges, &backfillRange{
+			after: after,
+			until: min(after+uint(pageSize), latest),
+			batch: transformers[p.transform].newBatch(p),
+		})
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r.err = p.db.WithContext(ctx).Where("id > ? AND id <= ?", r.after, r.until).Order("id").Find(&r.commits).Error
+			if r.err != nil {
+				return
+			}
+			if len(r.commits) > 0 {
+				p.transformCommits(ctx, r.batch, r.commits)
+			}
+		}()
+	}
+	wg.Wait()
+	earlier := map[string]string{}
+	for _, r := range ranges {
+		rebaser, ok := r.batch.(threadRebaser)
+		if !ok {
+			break
+		}
+		rebaser.rebaseThreads(earlier)
+		maps.Copy(earlier, rebaser.roots())
+	}
+	indexerLog.Debug("transformed backfill ranges", "pipeline", p.name, "after", lastKey, "ranges", len(ranges), "duration", time.Since(start))
+
+	batchStart := start
+	for _, r := range ranges {
+		if r.err != nil {
+			return lastKey, r.err
+		}
+		// the ranges written so far stay, and the new leader goes on from the cursor
+		if !leading() {
+			return lastKey, errLostLeadership
+		}
+
+		written, err := p.writeBatch(ctx, r.batch, r.batch.documents(ctx), r.commits)
+		if err != nil {
+			return lastKey, err
+		}
+		err = applyBatch(ctx, r.batch)
+		if err != nil {
+			return lastKey, err
+		}
+		r.batch.finish(ctx)
+
+		lastKey = r.until
+		p.rdb.Set(ctx, p.cursorKey, lastKey, 0)
+		p.recordBatch(time.Since(batchStart), len(r.commits), written, lastKey)
+		batchStart = time.Now()
+	}
+
+	indexerLog.Info("backfilled", "pipeline", p.name, "cursor", lastKey)
+	return lastKey, nil
+}
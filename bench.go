@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/core"
+	"gorm.io/gorm"
+)
+
+var benchWords = []string{
+	"concurrent", "search", "timeline", "message", "federation", "domain", "profile",
+	"coffee", "music", "photo", "travel", "weather", "morning", "night", "release",
+	"update", "bug", "feature", "game", "book", "cat", "dog", "rain", "sunny",
+	"検索", "タイムライン", "メッセージ", "おはよう", "こんばんは", "ねこ",
+}
+
+const (
+	benchSigner     = "con1benchbenchbenchbenchbenchbenchbenchbench"
+	benchTimelines  = 8
+	benchTextLength = 24
+)
+
+// benchRequest is one entry of the query mix, picked with a probability proportional to
+// its weight.
+type benchRequest struct {
+	weight int
+	path   string
+}
+
+type benchResult struct {
+	latency time.Duration
+	err     bool
+}
+
+// runBench implements `cc-search bench`. It seeds synthetic commits into the commit log,
+// waits for the running indexer to catch up with them, then drives the search API with
+// a query mix and reports throughput and latency percentiles.
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	commits := flags.Int("commits", 0, "synthetic commits to insert into the commit log (0 skips seeding)")
+	pipeline := flags.String("pipeline", "", "pipeline whose cursor is watched while indexing (default: the messages pipeline)")
+	indexTimeout := flags.Duration("index-timeout", 30*time.Minute, "how long to wait for the indexer to catch up")
+	apiURL := flags.String("url", "http://localhost:8000", "base URL of the cc-search API")
+	mixFile := flags.String("mix", "", "query mix file: one `[weight] path?query` per line (default: single words on the synthetic timelines)")
+	duration := flags.Duration("duration", 30*time.Second, "how long to run queries (0 skips querying)")
+	concurrency := flags.Int("concurrency", 8, "concurrent clients")
+	seed := flags.Uint64("seed", 1, "random seed of the synthetic data")
+	flags.Parse(args)
+
+	random := rand.New(rand.NewPCG(*seed, *seed))
+	runID := strconv.FormatInt(time.Now().Unix(), 36)
+
+	timelines := make([]string, benchTimelines)
+	for i := range timelines {
+		timelines[i] = fmt.Sprintf("tbench%s%0*d", runID, 26-len("bench"+runID), i)
+	}
+
+	if *commits > 0 {
+		err := benchIndexing(*commits, *pipeline, *indexTimeout, timelines, random)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *duration <= 0 {
+		return nil
+	}
+
+	mix, err := loadBenchMix(*mixFile, timelines)
+	if err != nil {
+		return err
+	}
+	return benchQueries(*apiURL, mix, *duration, *concurrency, random)
+}
+
+func benchText(random *rand.Rand) string {
+	words := make([]string, 1+random.IntN(benchTextLength))
+	for i := range words {
+		words[i] = benchWords[random.IntN(len(benchWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+// benchIndexing inserts the synthetic commits and measures how long the indexer takes to
+// move its cursor past them. Commits from an owner outside INDEX_DOMAINS are skipped by
+// the indexer, which still counts as processed here.
+func benchIndexing(count int, pipeline string, timeout time.Duration, timelines []string, random *rand.Rand) error {
+	db, err := openPostgres(os.Getenv("DB_DSN"))
+	if err != nil {
+		return err
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_URL"),
+	})
+	ctx := context.Background()
+
+	cursorKey := "ccsearch:readitr"
+	if pipeline != "" {
+		cursorKey += ":" + pipeline
+	}
+
+	start := time.Now()
+	documents := make([]core.MessageDocument[map[string]any], count)
+	for i := range documents {
+		documents[i] = benchMessage(benchText(random), timelines[random.IntN(len(timelines))], start.Add(time.Duration(i)*time.Millisecond))
+	}
+	last, err := insertCommits(db, documents)
+	if err != nil {
+		return err
+	}
+
+	seeded := time.Since(start)
+	fmt.Printf("seeded %d commits in %s (%.0f commits/s), last commit %d\n", count, seeded.Round(time.Millisecond), float64(count)/seeded.Seconds(), last)
+
+	indexStart := time.Now()
+	err = waitForCursor(ctx, rdb, cursorKey, last, timeout)
+	if err != nil {
+		return err
+	}
+
+	indexed := time.Since(indexStart)
+	fmt.Printf("indexed %d commits in %s (%.0f commits/s)\n", count, indexed.Round(time.Millisecond), float64(count)/indexed.Seconds())
+	return nil
+}
+
+func benchMessage(text, timeline string, signedAt time.Time) core.MessageDocument[map[string]any] {
+	return core.MessageDocument[map[string]any]{
+		DocumentBase: core.DocumentBase[map[string]any]{
+			Signer:   benchSigner,
+			Type:     "message",
+			Schema:   "https://schema.concrnt.world/m/markdown.json",
+			Body:     map[string]any{"body": text},
+			SignedAt: signedAt,
+		},
+		Timelines: []string{timeline},
+	}
+}
+
+// insertCommits appends the documents to the commit log and returns the ID of the last one.
+func insertCommits(db *gorm.DB, documents []core.MessageDocument[map[string]any]) (uint, error) {
+	var last uint
+	logs := []core.CommitLog{}
+	flush := func() error {
+		if len(logs) == 0 {
+			return nil
+		}
+		err := db.Create(&logs).Error
+		if err != nil {
+			return err
+		}
+		last = logs[len(logs)-1].ID
+		logs = logs[:0]
+		return nil
+	}
+
+	for _, document := range documents {
+		documentJson, err := json.Marshal(document)
+		if err != nil {
+			return 0, err
+		}
+		logs = append(logs, core.CommitLog{
+			Type:     document.Type,
+			Document: string(documentJson),
+			SignedAt: document.SignedAt,
+			CDate:    time.Now(),
+		})
+		if len(logs) == 500 {
+			err = flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return last, flush()
+}
+
+// waitForCursor waits until the indexer cursor stored at cursorKey reaches the commit.
+func waitForCursor(ctx context.Context, rdb *redis.Client, cursorKey string, commit uint, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		cursor, err := rdb.Get(ctx, cursorKey).Uint64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if uint(cursor) >= commit {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("indexer did not catch up within %s (cursor %d, commit %d)", timeout, cursor, commit)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// loadBenchMix reads the query mix file. Lines are a request path with an optional
+// leading weight; blank lines and # comments are ignored.
+func loadBenchMix(path string, timelines []string) ([]benchRequest, error) {
+	mix := []benchRequest{}
+
+	if path == "" {
+		for _, word := range benchWords {
+			for _, timeline := range timelines {
+				mix = append(mix, benchRequest{weight: 1, path: apiPrefix + "/timeline/" + timeline + "?q=" + url.QueryEscape(word)})
+			}
+		}
+		return mix, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		request := benchRequest{weight: 1, path: line}
+		if weight, rest, ok := strings.Cut(line, " "); ok {
+			value, err := strconv.Atoi(weight)
+			if err != nil || value <= 0 {
+				return nil, fmt.Errorf("%s:%d: invalid weight %q", path, lineNumber, weight)
+			}
+			request = benchRequest{weight: value, path: strings.TrimSpace(rest)}
+		}
+		if !strings.HasPrefix(request.path, "/") {
+			return nil, fmt.Errorf("%s:%d: path must start with /", path, lineNumber)
+		}
+		mix = append(mix, request)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("%s: no requests", path)
+	}
+	return mix, nil
+}
+
+// benchQueries sends requests from the mix with the given number of clients until the
+// duration is over, then prints the throughput and latency percentiles.
+func benchQueries(baseURL string, mix []benchRequest, duration time.Duration, concurrency int, random *rand.Rand) error {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	totalWeight := 0
+	for _, request := range mix {
+		totalWeight += request.weight
+	}
+
+	var mu sync.Mutex
+	pick := func() string {
+		mu.Lock()
+		n := random.IntN(totalWeight)
+		mu.Unlock()
+		for _, request := range mix {
+			n -= request.weight
+			if n < 0 {
+				return request.path
+			}
+		}
+		return mix[len(mix)-1].path
+	}
+
+	results := make([][]benchResult, concurrency)
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				resp, err := client.Get(baseURL + pick())
+				failed := err != nil
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					failed = resp.StatusCode != http.StatusOK
+				}
+				results[worker] = append(results[worker], benchResult{latency: time.Since(start), err: failed})
+			}
+		}()
+	}
+	wg.Wait()
+
+	latencies := []time.Duration{}
+	errors := 0
+	for _, worker := range results {
+		for _, result := range worker {
+			latencies = append(latencies, result.latency)
+			if result.err {
+				errors++
+			}
+		}
+	}
+	if len(latencies) == 0 {
+		return fmt.Errorf("no requests completed")
+	}
+	slices.Sort(latencies)
+
+	percentile := func(p float64) time.Duration {
+		return latencies[min(len(latencies)-1, int(float64(len(latencies))*p))]
+	}
+
+	fmt.Printf("%d requests in %s with %d clients: %.1f req/s, %d errors\n",
+		len(latencies), duration, concurrency, float64(len(latencies))/duration.Seconds(), errors)
+	fmt.Printf("latency p50=%s p90=%s p99=%s max=%s\n",
+		percentile(0.5).Round(time.Microsecond),
+		percentile(0.9).Round(time.Microsecond),
+		percentile(0.99).Round(time.Microsecond),
+		latencies[len(latencies)-1].Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	blocklistKey             = "ccsearch:blocklist"
+	blocklistEnforcedKey     = "ccsearch:blocklist:enforced"
+	blocklistRefreshInterval = 10 * time.Second
+)
+
+var domainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+(:[0-9]+)?$`)
+
+// blockEntry is a CCID or a domain whose documents are never indexed.
+type blockEntry struct {
+	Entry   string `json:"entry"`
+	Reason  string `json:"reason,omitempty"`
+	AddedAt int64  `json:"addedAt,omitempty"`
+	Static  bool   `json:"static,omitempty"`
+}
+
+// blocklist keeps the entries of BLOCKLIST_FILE and the ones added through the admin API,
+// which are stored in redis. Once an entry has been enforced, i.e. the documents indexed
+// before it was added are deleted, it is recorded so that the enforcement job doesn't
+// search the indexes for it again.
+type blocklist struct {
+	rdb    *redis.Client
+	db     *gorm.DB
+	static map[string]blockEntry
+
+	mu          sync.Mutex
+	entries     map[string]blockEntry
+	refreshedAt time.Time
+}
+
+var blocked *blocklist
+
+// normalizeBlockEntry checks that an entry is a CCID or a domain. Domains are lowercased.
+func normalizeBlockEntry(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if ccidPattern.MatchString(entry) {
+		return entry, nil
+	}
+	entry = strings.ToLower(entry)
+	if domainPattern.MatchString(entry) {
+		return entry, nil
+	}
+	return "", fmt.Errorf("%q is neither a CCID nor a domain", entry)
+}
+
+// newBlocklist reads BLOCKLIST_FILE, which holds one CCID or domain per line and
+// # comments.
+func newBlocklist(rdb *redis.Client, db *gorm.DB) (*blocklist, error) {
+	b := &blocklist{
+		rdb:     rdb,
+		db:      db,
+		static:  map[string]blockEntry{},
+		entries: map[string]blockEntry{},
+	}
+
+	path := os.Getenv("BLOCKLIST_FILE")
+	if path == "" {
+		return b, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, err := normalizeBlockEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		b.static[entry] = blockEntry{Entry: entry, Static: true}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	b.entries = b.static
+	return b, nil
+}
+
+func (b *blocklist) refresh(ctx context.Context) {
+	b.refreshedAt = time.Now()
+
+	values, err := b.rdb.HGetAll(ctx, blocklistKey).Result()
+	if err != nil {
+		reportError("blocklist", err)
+		return
+	}
+
+	entries := map[string]blockEntry{}
+	for name, value := range values {
+		var entry blockEntry
+		err := json.Unmarshal([]byte(value), &entry)
+		if err != nil {
+			continue
+		}
+		entry.Entry = name
+		entries[name] = entry
+	}
+	for name, entry := range b.static {
+		entries[name] = entry
+	}
+
+	b.entries = entries
+}
+
+// current returns the entries, refreshed from redis every few seconds.
+func (b *blocklist) current(ctx context.Context) map[string]blockEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.refreshedAt) > blocklistRefreshInterval {
+		b.refresh(ctx)
+	}
+	return b.entries
+}
+
+// blocked reports whether a document is blocked by its owner, or its signer when it has
+// no owner, or by the domain of that entity.
+func (b *blocklist) blocked(ctx context.Context, owner, signer string) (bool, error) {
+	entries := b.current(ctx)
+	if len(entries) == 0 {
+		return false, nil
+	}
+
+	entity := owner
+	if entity == "" {
+		entity = signer
+	}
+	if _, ok := entries[entity]; ok {
+		return true, nil
+	}
+	if _, ok := entries[signer]; ok {
+		return true, nil
+	}
+
+	domain, err := commitOwners.lookup(entity)
+	if err != nil {
+		return false, err
+	}
+	_, ok := entries[domain]
+	return domain != "" && ok, nil
+}
+
+func (b *blocklist) list(ctx context.Context) []blockEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refresh(ctx)
+
+	list := []blockEntry{}
+	for _, entry := range b.entries {
+		list = append(list, entry)
+	}
+	slices.SortFunc(list, func(a, b blockEntry) int {
+		return strings.Compare(a.Entry, b.Entry)
+	})
+	return list
+}
+
+func (b *blocklist) add(ctx context.Context, entry blockEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = b.rdb.HSet(ctx, blocklistKey, entry.Entry, value).Err()
+	if err != nil {
+		return err
+	}
+
+	b.refresh(ctx)
+	return nil
+}
+
+// remove deletes an entry added through the admin API. The documents deleted while it
+// was enforced are indexed again by a reindex only.
+func (b *blocklist) remove(ctx context.Context, entry string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pipe := b.rdb.TxPipeline()
+	pipe.HDel(ctx, blocklistKey, entry)
+	pipe.HDel(ctx, blocklistEnforcedKey, entry)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.refresh(ctx)
+	return nil
+}
+
+// signersOf expands an entry into the signers whose documents it covers: a CCID stands
+// for itself, and a domain for the entities the concurrent database knows on it.
+func (b *blocklist) signersOf(ctx context.Context, entry string) ([]string, error) {
+	if ccidPattern.MatchString(entry) {
+		return []string{entry}, nil
+	}
+	signers := []string{}
+	err := b.db.WithContext(ctx).Table("entities").Where("lower(domain) = ?", entry).Pluck("id", &signers).Error
+	return signers, err
+}
+
+// enforce deletes the already indexed documents of the entries that have not been
+// enforced yet, from the indexes holding documents of users.
+func (b *blocklist) enforce(ctx context.Context) error {
+	entries := b.current(ctx)
+	if len(entries) == 0 {
+		return nil
+	}
+	enforced, err := b.rdb.HGetAll(ctx, blocklistEnforcedKey).Result()
+	if err != nil {
+		return err
+	}
+
+	indexes := signerIndexes()
+	for _, name := range sortedKeys(entries) {
+		if _, ok := enforced[name]; ok {
+			continue
+		}
+		signers, err := b.signersOf(ctx, name)
+		if err != nil {
+			return err
+		}
+		purged := purgeSigners("blocklist", indexes, signers)
+		moderationLog.Info("blocklist entry enforced", "entry", name, "deleted", purged)
+
+		err = b.rdb.HSet(ctx, blocklistEnforcedKey, name, time.Now().UnixMilli()).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupBlocklistRoutes(admin *echo.Group) {
+
+	admin.GET("/blocklist", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": blocked.list(c.Request().Context())})
+	})
+
+	admin.POST("/blocklist", func(c echo.Context) error {
+		var request struct {
+			Entry  string `json:"entry"`
+			Reason string `json:"reason"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if request.Entry == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "entry", "entry is required")
+		}
+		entry, err := normalizeBlockEntry(request.Entry)
+		if err != nil {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "entry", err.Error())
+		}
+
+		err = blocked.add(c.Request().Context(), blockEntry{
+			Entry:   entry,
+			Reason:  request.Reason,
+			AddedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		moderationLog.Info("blocklist entry added", "entry", entry, "reason", request.Reason)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+
+	admin.DELETE("/blocklist/:entry", func(c echo.Context) error {
+		entry, err := normalizeBlockEntry(c.Param("entry"))
+		if err != nil {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "entry", err.Error())
+		}
+		if _, ok := blocked.static[entry]; ok {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "entry", "the entry is in BLOCKLIST_FILE")
+		}
+
+		err = blocked.remove(c.Request().Context(), entry)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		moderationLog.Info("blocklist entry removed", "entry", entry)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
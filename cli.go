@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/core"
+)
+
+// configuredPipelines reads the pipelines of PIPELINES for the commands that work on
+// them without running them. An empty name selects every pipeline.
+func configuredPipelines(name string) ([]*pipeline, error) {
+	all, err := parsePipelines(os.Getenv("PIPELINES"), meilisearch_idx)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return all, nil
+	}
+	for _, p := range all {
+		if p.name == name {
+			return []*pipeline{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown pipeline %q", name)
+}
+
+// runReindex implements `cc-search reindex`. It moves the cursors back to commit 0, so
+// the running service reads the whole commit log again; the documents are replaced as
+// their commits come by. With -wait it follows the progress until the service has caught
+// up with the latest commit.
+func runReindex(args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	name := flags.String("pipeline", "", "only reindex this pipeline")
+	wait := flags.Bool("wait", false, "wait until the service has caught up again")
+	timeout := flags.Duration("timeout", time.Hour, "how long to wait with -wait")
+	flags.Parse(args)
+
+	loadConnectionConfig()
+	targets, err := configuredPipelines(*name)
+	if err != nil {
+		return err
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: redis_url,
+	})
+	defer rdb.Close()
+	ctx := context.Background()
+
+	for _, p := range targets {
+		p.rdb = rdb
+		err := p.resetCursor(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: cursor reset to commit 0\n", p.name)
+	}
+
+	if !*wait {
+		return nil
+	}
+
+	db, err := openPostgres(db_dsn)
+	if err != nil {
+		return err
+	}
+	latest, err := getLatestCommitID(db)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	for _, p := range targets {
+		err := waitForCursor(ctx, rdb, p.cursorKey, latest, *timeout-time.Since(start))
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+		fmt.Printf("%s: caught up with commit %d after %s\n", p.name, latest, time.Since(start).Round(time.Second))
+	}
+	return nil
+}
+
+// runVerify implements `cc-search verify`. For every pipeline it compares the commits of
+// its document type up to the cursor with the documents of its indexes. Fewer documents
+// than commits is expected, since skipped, edited and deleted documents don't add up;
+// more documents means the index holds documents whose commits are gone, e.g. after the
+// database was restored, and calls for a purge and a reindex.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	name := flags.String("pipeline", "", "only verify this pipeline")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long the checks may take")
+	flags.Parse(args)
+
+	loadConnectionConfig()
+	targets, err := configuredPipelines(*name)
+	if err != nil {
+		return err
+	}
+	routes, err := loadIndexRoutes()
+	if err != nil {
+		return err
+	}
+	meiliConfig, err := loadMeilisearchConfig()
+	if err != nil {
+		return err
+	}
+
+	db, err := openPostgres(db_dsn)
+	if err != nil {
+		return err
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr: redis_url,
+	})
+	defer rdb.Close()
+	backend, err := newSearchBackend(newMeilisearchClient(meilisearch_url, meilisearch_key, meiliConfig))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	latest, err := getLatestCommitID(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("latest commit %d\n", latest)
+
+	mismatches := 0
+	for _, p := range targets {
+		p.rdb = rdb
+		cursor, err := p.getCursor(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+
+		documentType := transformers[p.transform].documentType
+		var commits int64
+		err = db.WithContext(ctx).Model(&core.CommitLog{}).Where("type = ? AND id <= ?", documentType, cursor).Count(&commits).Error
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+
+		// the messages of the routed schemas live in the route indexes, and the ones of
+		// the sharded index in its shards
+		uids := []string{p.indexUID}
+		if p.transform == "messages" {
+			shards, err := recordedShardUIDs(ctx, rdb, p.indexUID)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p.name, err)
+			}
+			uids = append(uids, shards...)
+			for _, route := range routes {
+				if !slices.Contains(uids, route.Index) {
+					uids = append(uids, route.Index)
+				}
+			}
+		}
+		var documents int64
+		for _, uid := range uids {
+			stats, err := backend.index(uid).GetStatsWithContext(ctx)
+			if err != nil {
+				return fmt.Errorf("%s: index %s: %w", p.name, uid, err)
+			}
+			documents += stats.NumberOfDocuments
+		}
+
+		outcome := "ok"
+		if documents > commits {
+			outcome = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%-12s cursor %d, %d %s commits, %d documents in %v: %s\n", p.name, cursor, commits, documentType, documents, uids, outcome)
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d pipelines have more documents than commits; purge and reindex them", mismatches)
+	}
+	return nil
+}
+
+// runPurge implements `cc-search purge -signer`. It deletes the documents of a signer
+// from every index, e.g. after an account was deleted on the node. The commits are left
+// alone, so a reindex brings back whatever is still in the commit log.
+func runPurge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	signer := flags.String("signer", "", "CCID of the signer whose documents to delete")
+	wait := flags.Bool("wait", true, "wait until the search engine has deleted the documents")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long to wait with -wait")
+	flags.Parse(args)
+
+	if *signer == "" {
+		return errors.New("purge: -signer is required")
+	}
+
+	loadConnectionConfig()
+	all, err := configuredPipelines("")
+	if err != nil {
+		return err
+	}
+	routes, err := loadIndexRoutes()
+	if err != nil {
+		return err
+	}
+	meiliConfig, err := loadMeilisearchConfig()
+	if err != nil {
+		return err
+	}
+	backend, err := newSearchBackend(newMeilisearchClient(meilisearch_url, meilisearch_key, meiliConfig))
+	if err != nil {
+		return err
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: redis_url,
+	})
+	defer rdb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	uids := []string{}
+	if meilisearch_idx != "" {
+		uids = append(uids, meilisearch_idx)
+	}
+	for _, p := range all {
+		if !slices.Contains(uids, p.indexUID) {
+			uids = append(uids, p.indexUID)
+		}
+	}
+	for _, route := range routes {
+		if !slices.Contains(uids, route.Index) {
+			uids = append(uids, route.Index)
+		}
+	}
+	// the shards are only known to redis
+	for _, uid := range slices.Clone(uids) {
+		shards, err := recordedShardUIDs(ctx, rdb, uid)
+		if err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			if !slices.Contains(uids, shard) {
+				uids = append(uids, shard)
+			}
+		}
+	}
+
+	filter := fmt.Sprintf("signer = %s", quoteFilter(*signer))
+	for _, uid := range uids {
+		index := backend.index(uid)
+		info, err := index.DeleteDocumentsByFilterWithContext(ctx, filter)
+		if err != nil {
+			return fmt.Errorf("index %s: %w", uid, err)
+		}
+		if !*wait {
+			fmt.Printf("%s: deletion enqueued as task %d\n", uid, info.TaskUID)
+			continue
+		}
+
+		task, err := index.WaitForTaskWithContext(ctx, info.TaskUID, 500*time.Millisecond)
+		if err != nil {
+			return fmt.Errorf("index %s: task %d: %w", uid, info.TaskUID, err)
+		}
+		if task.Status != meilisearch.TaskStatusSucceeded {
+			return fmt.Errorf("index %s: task %d %s: %s", uid, info.TaskUID, task.Status, task.Error.Message)
+		}
+		fmt.Printf("%s: documents of %s deleted\n", uid, *signer)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the structure of the -config file. Every setting stands for an
+// environment variable, which takes precedence when it is set. Settings without a
+// section go under env, by the name of their variable.
+type configFile struct {
+	Database struct {
+		DSN string `yaml:"dsn"`
+	} `yaml:"database"`
+	Redis struct {
+		URL string `yaml:"url"`
+	} `yaml:"redis"`
+	Meilisearch struct {
+		URL        string   `yaml:"url"`
+		Key        string   `yaml:"key"`
+		Index      string   `yaml:"index"`
+		Replicas   []string `yaml:"replicas"`
+		ReplicaKey string   `yaml:"replicaKey"`
+		Timeout    string   `yaml:"timeout"`
+		Retries    *int     `yaml:"retries"`
+	} `yaml:"meilisearch"`
+	Server struct {
+		Port           *int     `yaml:"port"`
+		AdminToken     string   `yaml:"adminToken"`
+		AdminKeys      []string `yaml:"adminKeys"`
+		CORSOrigins    []string `yaml:"corsOrigins"`
+		TrustedProxies []string `yaml:"trustedProxies"`
+		LogLevel       string   `yaml:"logLevel"`
+		LogFormat      string   `yaml:"logFormat"`
+		Auth           struct {
+			Audience     string `yaml:"audience"`
+			TrustGateway *bool  `yaml:"trustGateway"`
+		} `yaml:"auth"`
+		RateLimit struct {
+			Anonymous     string `yaml:"anonymous"`
+			Authenticated string `yaml:"authenticated"`
+		} `yaml:"rateLimit"`
+	} `yaml:"server"`
+	OpenSearch struct {
+		URL         string `yaml:"url"`
+		Username    string `yaml:"username"`
+		Password    string `yaml:"password"`
+		IndexPrefix string `yaml:"indexPrefix"`
+		Timeout     string `yaml:"timeout"`
+	} `yaml:"opensearch"`
+	Search struct {
+		Backend    string `yaml:"backend"`
+		MaxLimit   *int   `yaml:"maxLimit"`
+		Dictionary string `yaml:"dictionary"`
+		Typos      struct {
+			MinWordSizeOne      *int     `yaml:"minWordSizeOne"`
+			MinWordSizeTwo      *int     `yaml:"minWordSizeTwo"`
+			DisableOnAttributes []string `yaml:"disableOnAttributes"`
+			DisableOnWords      []string `yaml:"disableOnWords"`
+		} `yaml:"typos"`
+		Postgres struct {
+			DSN    string `yaml:"dsn"`
+			Config string `yaml:"config"`
+		} `yaml:"postgres"`
+	} `yaml:"search"`
+	Indexer struct {
+		Pipelines            []string `yaml:"pipelines"`
+		BackfillWorkers      *int     `yaml:"backfillWorkers"`
+		BatchSize            *int     `yaml:"batchSize"`
+		PollInterval         string   `yaml:"pollInterval"`
+		BatchDelay           string   `yaml:"batchDelay"`
+		TransformWorkers     *int     `yaml:"transformWorkers"`
+		TaskTimeout          string   `yaml:"taskTimeout"`
+		Sharding             string   `yaml:"sharding"`
+		ShardRetention       *int     `yaml:"shardRetention"`
+		RetentionDays        *int     `yaml:"retentionDays"`
+		MaxDocumentSize      *int     `yaml:"maxDocumentSize"`
+		DocumentSizeStrategy string   `yaml:"documentSizeStrategy"`
+		Events               struct {
+			Channels string `yaml:"channels"`
+			RedisURL string `yaml:"redisUrl"`
+		} `yaml:"events"`
+	} `yaml:"indexer"`
+	Tracing struct {
+		Endpoint    string `yaml:"endpoint"`
+		SampleRatio string `yaml:"sampleRatio"`
+	} `yaml:"tracing"`
+	Env map[string]string `yaml:"env"`
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// variables maps the settings of the file to their environment variables, leaving out
+// the ones the file doesn't set.
+func (f *configFile) variables() (map[string]string, error) {
+	vars := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			vars[name] = value
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			vars[name] = strconv.Itoa(*value)
+		}
+	}
+
+	for name, value := range f.Env {
+		if !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("env: %q is not an environment variable name", name)
+		}
+		vars[name] = value
+	}
+
+	set("DB_DSN", f.Database.DSN)
+	set("REDIS_URL", f.Redis.URL)
+	set("MEILISEARCH_URL", f.Meilisearch.URL)
+	set("MEILISEARCH_KEY", f.Meilisearch.Key)
+	set("MEILISEARCH_IDX", f.Meilisearch.Index)
+	set("MEILISEARCH_REPLICAS", strings.Join(f.Meilisearch.Replicas, ","))
+	set("MEILISEARCH_REPLICA_KEY", f.Meilisearch.ReplicaKey)
+	set("MEILISEARCH_TIMEOUT", f.Meilisearch.Timeout)
+	setInt("MEILISEARCH_RETRIES", f.Meilisearch.Retries)
+	setInt("PORT", f.Server.Port)
+	set("ADMIN_TOKEN", f.Server.AdminToken)
+	set("ADMIN_API_KEYS", strings.Join(f.Server.AdminKeys, ","))
+	set("CORS_ORIGINS", strings.Join(f.Server.CORSOrigins, ","))
+	set("TRUSTED_PROXIES", strings.Join(f.Server.TrustedProxies, ","))
+	set("LOG_LEVEL", f.Server.LogLevel)
+	set("LOG_FORMAT", f.Server.LogFormat)
+	set("AUTH_AUDIENCE", f.Server.Auth.Audience)
+	if f.Server.Auth.TrustGateway != nil {
+		set("AUTH_TRUST_GATEWAY", strconv.FormatBool(*f.Server.Auth.TrustGateway))
+	}
+	set("RATE_LIMIT_ANONYMOUS", f.Server.RateLimit.Anonymous)
+	set("RATE_LIMIT_AUTHENTICATED", f.Server.RateLimit.Authenticated)
+	set("OPENSEARCH_URL", f.OpenSearch.URL)
+	set("OPENSEARCH_USERNAME", f.OpenSearch.Username)
+	set("OPENSEARCH_PASSWORD", f.OpenSearch.Password)
+	set("OPENSEARCH_INDEX_PREFIX", f.OpenSearch.IndexPrefix)
+	set("OPENSEARCH_TIMEOUT", f.OpenSearch.Timeout)
+	set("SEARCH_BACKEND", f.Search.Backend)
+	setInt("SEARCH_MAX_LIMIT", f.Search.MaxLimit)
+	set("SEARCH_DICTIONARY", f.Search.Dictionary)
+	setInt("TYPO_MIN_WORD_SIZE_ONE", f.Search.Typos.MinWordSizeOne)
+	setInt("TYPO_MIN_WORD_SIZE_TWO", f.Search.Typos.MinWordSizeTwo)
+	set("TYPO_DISABLE_ON_ATTRIBUTES", strings.Join(f.Search.Typos.DisableOnAttributes, ","))
+	set("TYPO_DISABLE_ON_WORDS", strings.Join(f.Search.Typos.DisableOnWords, ","))
+	set("POSTGRES_SEARCH_DSN", f.Search.Postgres.DSN)
+	set("POSTGRES_SEARCH_CONFIG", f.Search.Postgres.Config)
+	set("PIPELINES", strings.Join(f.Indexer.Pipelines, ";"))
+	setInt("BACKFILL_WORKERS", f.Indexer.BackfillWorkers)
+	setInt("INDEX_BATCH_SIZE", f.Indexer.BatchSize)
+	set("INDEX_POLL_INTERVAL", f.Indexer.PollInterval)
+	set("INDEX_BATCH_DELAY", f.Indexer.BatchDelay)
+	setInt("INDEX_TRANSFORM_WORKERS", f.Indexer.TransformWorkers)
+	set("INDEX_TASK_TIMEOUT", f.Indexer.TaskTimeout)
+	set("INDEX_SHARDING", f.Indexer.Sharding)
+	setInt("INDEX_SHARD_RETENTION", f.Indexer.ShardRetention)
+	setInt("RETENTION_DAYS", f.Indexer.RetentionDays)
+	setInt("MAX_DOCUMENT_SIZE", f.Indexer.MaxDocumentSize)
+	set("DOCUMENT_SIZE_STRATEGY", f.Indexer.DocumentSizeStrategy)
+	set("INDEX_EVENTS_CHANNELS", f.Indexer.Events.Channels)
+	set("INDEX_EVENTS_REDIS_URL", f.Indexer.Events.RedisURL)
+	set("TRACE_ENDPOINT", f.Tracing.Endpoint)
+	set("TRACE_SAMPLE_RATIO", f.Tracing.SampleRatio)
+
+	return vars, nil
+}
+
+func (f *configFile) validate() error {
+	if f.Server.Port != nil && (*f.Server.Port <= 0 || *f.Server.Port > 65535) {
+		return fmt.Errorf("server.port: %d is not a valid port", *f.Server.Port)
+	}
+	if f.Search.Backend != "" && f.Search.Backend != "meilisearch" && f.Search.Backend != "opensearch" && f.Search.Backend != "postgres" {
+		return fmt.Errorf("search.backend: %q is not meilisearch, opensearch or postgres", f.Search.Backend)
+	}
+	if f.Search.MaxLimit != nil && *f.Search.MaxLimit <= 0 {
+		return fmt.Errorf("search.maxLimit: must be positive")
+	}
+	if f.Indexer.BackfillWorkers != nil && *f.Indexer.BackfillWorkers < 1 {
+		return fmt.Errorf("indexer.backfillWorkers: must be at least 1")
+	}
+	if f.Indexer.BatchSize != nil && (*f.Indexer.BatchSize < 1 || *f.Indexer.BatchSize > maxIndexBatchSize) {
+		return fmt.Errorf("indexer.batchSize: must be 1 to %d", maxIndexBatchSize)
+	}
+	if f.Indexer.TransformWorkers != nil && (*f.Indexer.TransformWorkers < 1 || *f.Indexer.TransformWorkers > maxIndexTransformWorkers) {
+		return fmt.Errorf("indexer.transformWorkers: must be 1 to %d", maxIndexTransformWorkers)
+	}
+	if f.Indexer.DocumentSizeStrategy != "" && f.Indexer.DocumentSizeStrategy != sizeTruncate && f.Indexer.DocumentSizeStrategy != sizeSkip {
+		return fmt.Errorf("indexer.documentSizeStrategy: %q is not truncate or skip", f.Indexer.DocumentSizeStrategy)
+	}
+	if f.Meilisearch.Retries != nil && *f.Meilisearch.Retries < 0 {
+		return fmt.Errorf("meilisearch.retries: must not be negative")
+	}
+	for _, origin := range f.Server.CORSOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("server.corsOrigins: %q is not an origin such as https://example.com", origin)
+		}
+	}
+	for _, cidr := range f.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("server.trustedProxies: %q is not a CIDR such as 10.0.0.0/8", cidr)
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads a YAML config file into the environment. Variables that are
+// already set are left alone, so the environment overrides the file. Unknown settings are
+// errors, to catch typos.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file configFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	err = file.validate()
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	vars, err := file.variables()
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	overridden := []string{}
+	for _, name := range sortedKeys(vars) {
+		if _, ok := os.LookupEnv(name); ok {
+			overridden = append(overridden, name)
+			continue
+		}
+		os.Setenv(name, vars[name])
+	}
+	if len(overridden) > 0 {
+		serverLog.Info("config overridden by the environment", "path", path, "variables", overridden)
+	}
+	return nil
+}
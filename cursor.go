@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// searchCursor marks where a page of chronological results ended: the signedAt of its
+// last hit, and the IDs of the hits of the pages so far signed at that same time, which
+// the next page leaves out. Unlike an offset it stays put when new messages arrive.
+type searchCursor struct {
+	SignedAt int64    `json:"signedAt"`
+	IDs      []string `json:"ids"`
+}
+
+// encodeCursor makes the opaque value of the cursor parameter.
+func encodeCursor(cursor searchCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (searchCursor, error) {
+	var cursor searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || len(cursor.IDs) == 0 {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// filter returns the filter of the hits after the cursor, for the sort of the page.
+func (cursor searchCursor) filter(sort string) string {
+	operator := "<"
+	if sort == "oldest" {
+		operator = ">"
+	}
+	quoted := []string{}
+	for _, id := range cursor.IDs {
+		quoted = append(quoted, quoteFilter(id))
+	}
+	return fmt.Sprintf("(signedAt %s %d OR (signedAt = %d AND id NOT IN [%s]))",
+		operator, cursor.SignedAt, cursor.SignedAt, strings.Join(quoted, ", "))
+}
+
+// nextCursor returns the cursor following a page of hits, extending the previous cursor
+// when the page ends at the same signedAt.
+func nextCursor(previous *searchCursor, hits []any) searchCursor {
+	last := hits[len(hits)-1]
+	next := searchCursor{SignedAt: int64(hitNumber(last, "signedAt"))}
+	if previous != nil && previous.SignedAt == next.SignedAt {
+		next.IDs = append(next.IDs, previous.IDs...)
+	}
+	for _, hit := range hits {
+		hitDoc, _ := hit.(map[string]any)
+		id, _ := hitDoc["id"].(string)
+		if id != "" && int64(hitNumber(hit, "signedAt")) == next.SignedAt {
+			next.IDs = append(next.IDs, id)
+		}
+	}
+	return next
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// postgresConfig holds the connection options that can be set individually instead of
+// being packed into DB_DSN.
+type postgresConfig struct {
+	host            string
+	port            string
+	user            string
+	password        string
+	name            string
+	sslMode         string
+	sslCert         string
+	sslKey          string
+	sslRootCert     string
+	searchPath      string
+	applicationName string
+}
+
+func loadPostgresConfig() postgresConfig {
+	return postgresConfig{
+		host:            os.Getenv("DB_HOST"),
+		port:            os.Getenv("DB_PORT"),
+		user:            os.Getenv("DB_USER"),
+		password:        os.Getenv("DB_PASSWORD"),
+		name:            os.Getenv("DB_NAME"),
+		sslMode:         os.Getenv("DB_SSLMODE"),
+		sslCert:         os.Getenv("DB_SSLCERT"),
+		sslKey:          os.Getenv("DB_SSLKEY"),
+		sslRootCert:     os.Getenv("DB_SSLROOTCERT"),
+		searchPath:      os.Getenv("DB_SEARCH_PATH"),
+		applicationName: os.Getenv("DB_APPLICATION_NAME"),
+	}
+}
+
+func (c postgresConfig) validate() error {
+	if c.sslMode != "" && !slices.Contains(sslModes, c.sslMode) {
+		return fmt.Errorf("invalid DB_SSLMODE %q", c.sslMode)
+	}
+	for name, path := range map[string]string{
+		"DB_SSLCERT":     c.sslCert,
+		"DB_SSLKEY":      c.sslKey,
+		"DB_SSLROOTCERT": c.sslRootCert,
+	} {
+		if path == "" {
+			continue
+		}
+		_, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if (c.sslCert == "") != (c.sslKey == "") {
+		return fmt.Errorf("DB_SSLCERT and DB_SSLKEY must be set together")
+	}
+	return nil
+}
+
+func (c postgresConfig) params() [][2]string {
+	params := [][2]string{}
+	for _, param := range [][2]string{
+		{"host", c.host},
+		{"port", c.port},
+		{"user", c.user},
+		{"password", c.password},
+		{"dbname", c.name},
+		{"sslmode", c.sslMode},
+		{"sslcert", c.sslCert},
+		{"sslkey", c.sslKey},
+		{"sslrootcert", c.sslRootCert},
+		{"search_path", c.searchPath},
+		{"application_name", c.applicationName},
+	} {
+		if param[1] != "" {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// dsn merges the individual options into base, which may be empty, a key/value DSN or
+// a postgres:// URL. Options set individually take precedence over the ones in base.
+func (c postgresConfig) dsn(base string) (string, error) {
+	params := c.params()
+
+	if strings.HasPrefix(base, "postgres://") || strings.HasPrefix(base, "postgresql://") {
+		u, err := url.Parse(base)
+		if err != nil {
+			return "", fmt.Errorf("invalid DB_DSN: %w", err)
+		}
+		query := u.Query()
+		host, port := u.Hostname(), u.Port()
+		for _, param := range params {
+			switch param[0] {
+			case "host":
+				host = param[1]
+			case "port":
+				port = param[1]
+			case "user", "password":
+				user := u.User.Username()
+				password, _ := u.User.Password()
+				if param[0] == "user" {
+					user = param[1]
+				} else {
+					password = param[1]
+				}
+				u.User = url.UserPassword(user, password)
+			case "dbname":
+				u.Path = "/" + param[1]
+			default:
+				query.Set(param[0], param[1])
+			}
+		}
+		u.Host = host
+		if port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	parts := []string{}
+	if strings.TrimSpace(base) != "" {
+		parts = append(parts, base)
+	}
+	for _, param := range params {
+		parts = append(parts, param[0]+"="+quoteDSNValue(param[1]))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// verifyPostgres checks that the session got the settings the config asked for.
+func verifyPostgres(db *gorm.DB, config postgresConfig) error {
+	var searchPath, applicationName string
+	err := db.Raw("SELECT current_setting('search_path'), current_setting('application_name')").Row().Scan(&searchPath, &applicationName)
+	if err != nil {
+		return err
+	}
+
+	var ssl bool
+	err = db.Raw("SELECT COALESCE((SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()), false)").Row().Scan(&ssl)
+	if err != nil {
+		return err
+	}
+
+	serverLog.Info("postgres connected", "ssl", ssl, "searchPath", searchPath, "applicationName", applicationName)
+
+	switch config.sslMode {
+	case "require", "verify-ca", "verify-full":
+		if !ssl {
+			return fmt.Errorf("DB_SSLMODE is %s but the connection is not encrypted", config.sslMode)
+		}
+	}
+	if config.searchPath != "" && strings.ReplaceAll(searchPath, " ", "") != strings.ReplaceAll(config.searchPath, " ", "") {
+		return fmt.Errorf("search_path is %q, expected %q", searchPath, config.searchPath)
+	}
+	if config.applicationName != "" && applicationName != config.applicationName {
+		return fmt.Errorf("application_name is %q, expected %q", applicationName, config.applicationName)
+	}
+
+	return nil
+}
+
+// openPostgres connects to the concurrent database with DB_DSN and the individual
+// connection options.
+func openPostgres(base string) (*gorm.DB, error) {
+	config := loadPostgresConfig()
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	dsn, err := config.dsn(base)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %w", err)
+	}
+	err = db.Use(tracingPlugin{})
+	if err != nil {
+		return nil, err
+	}
+	err = verifyPostgres(db, config)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the runtime image ships without zoneinfo
+
+	"github.com/labstack/echo/v4"
+)
+
+// paramError is a validation error about a single request parameter.
+type paramError struct {
+	field   string
+	message string
+}
+
+func (e *paramError) Error() string {
+	return e.message
+}
+
+var relativeUnits = map[byte]time.Duration{
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseDate reads a human-friendly date: unix milliseconds, RFC 3339, a date or a date
+// and time in loc, "now", "today", "yesterday", or a relative age such as "7d" or "12h".
+// Calendar days stand for their first instant, or for their last millisecond when endOfDay
+// is set, so that an inclusive until=yesterday covers all of yesterday.
+func parseDate(value string, loc *time.Location, now time.Time, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	now = now.In(loc)
+
+	day := func(t time.Time) time.Time {
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		if endOfDay {
+			return start.AddDate(0, 0, 1).Add(-time.Millisecond)
+		}
+		return start
+	}
+
+	switch value {
+	case "now":
+		return now, nil
+	case "today":
+		return day(now), nil
+	case "yesterday":
+		return day(now.AddDate(0, 0, -1)), nil
+	}
+
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+
+	if len(value) > 1 {
+		if unit, ok := relativeUnits[value[len(value)-1]]; ok {
+			amount, err := strconv.Atoi(value[:len(value)-1])
+			if err == nil && amount >= 0 {
+				return now.Add(-time.Duration(amount) * unit), nil
+			}
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, strings.ToUpper(value)); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02t15:04", value, loc); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, loc); err == nil {
+		return day(t), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized date %q", value)
+}
+
+// dateRange reads the since, until and tz parameters. Bounds that are not given are zero.
+func dateRange(c echo.Context) (time.Time, time.Time, error) {
+	var sinceTime, untilTime time.Time
+	since, until := c.QueryParam("since"), c.QueryParam("until")
+	if since == "" && until == "" {
+		return sinceTime, untilTime, nil
+	}
+
+	loc := time.UTC
+	if tz := c.QueryParam("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return sinceTime, untilTime, &paramError{field: "tz", message: "unknown time zone"}
+		}
+	}
+
+	now := time.Now()
+	if since != "" {
+		t, err := parseDate(since, loc, now, false)
+		if err != nil {
+			return sinceTime, untilTime, &paramError{field: "since", message: err.Error()}
+		}
+		sinceTime = t
+	}
+	if until != "" {
+		t, err := parseDate(until, loc, now, true)
+		if err != nil {
+			return sinceTime, untilTime, &paramError{field: "until", message: err.Error()}
+		}
+		if !sinceTime.IsZero() && t.Before(sinceTime) {
+			return sinceTime, untilTime, &paramError{field: "until", message: "until must not be before since"}
+		}
+		untilTime = t
+	}
+
+	return sinceTime, untilTime, nil
+}
+
+// dateFilters turns a date range into signedAt bounds. Both bounds are inclusive.
+func dateFilters(since, until time.Time) []string {
+	filters := []string{}
+	if !since.IsZero() {
+		filters = append(filters, fmt.Sprintf("signedAt >= %d", since.UnixMilli()))
+	}
+	if !until.IsZero() {
+		filters = append(filters, fmt.Sprintf("signedAt <= %d", until.UnixMilli()))
+	}
+	return filters
+}
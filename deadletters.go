@@ -0,0 +1,297 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/core"
+)
+
+const deadLetterKey = "ccsearch:dlq"
+
+const deadLetterRetryChunk = 500
+
+// deadLetter is a commit the indexer failed to process and moved past. Unlike skipped
+// commits, which the filters leave out on purpose, it belongs in the index.
+type deadLetter struct {
+	ID            string    `json:"id"`
+	Pipeline      string    `json:"pipeline"`
+	Commit        uint      `json:"commit"`
+	Type          string    `json:"type,omitempty"`
+	Schema        string    `json:"schema,omitempty"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt"`
+}
+
+type deadLetterResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Outcomes of a retried dead letter.
+const (
+	retryIndexed = "indexed"
+	retrySkipped = "skipped"
+	retryFailed  = "failed"
+	retryMissing = "missing"
+	retryUnknown = "unknown"
+)
+
+func deadLetterID(pipeline string, commit uint) string {
+	return fmt.Sprintf("%s:%d", pipeline, commit)
+}
+
+func getDeadLetter(ctx context.Context, rdb *redis.Client, id string) (*deadLetter, error) {
+	letterStr, err := rdb.HGet(ctx, deadLetterKey, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var letter deadLetter
+	err = json.Unmarshal([]byte(letterStr), &letter)
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// deadLetter records a commit that failed, or fails again, to be processed.
+func (p *pipeline) deadLetter(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cause error) {
+	id := deadLetterID(p.name, commit.ID)
+	now := time.Now()
+
+	letter, err := getDeadLetter(ctx, p.rdb, id)
+	if err != nil {
+		reportError("indexer", err)
+		return
+	}
+	if letter == nil {
+		letter = &deadLetter{
+			ID:            id,
+			Pipeline:      p.name,
+			Commit:        commit.ID,
+			Type:          cmp.Or(doc.Type, commit.Type),
+			Schema:        doc.Schema,
+			FirstFailedAt: now,
+		}
+	}
+	letter.Error = cause.Error()
+	letter.Attempts++
+	letter.LastFailedAt = now
+
+	letterJson, err := json.Marshal(letter)
+	if err != nil {
+		reportError("indexer", err)
+		return
+	}
+	err = p.rdb.HSet(ctx, deadLetterKey, id, letterJson).Err()
+	if err != nil {
+		reportError("indexer", err)
+		return
+	}
+	metrics.add("dead_letters_total", map[string]string{"pipeline": p.name}, 1)
+}
+
+func listDeadLetters(ctx context.Context, rdb *redis.Client) ([]deadLetter, error) {
+	entries, err := rdb.HGetAll(ctx, deadLetterKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []deadLetter{}
+	for _, letterStr := range entries {
+		var letter deadLetter
+		err := json.Unmarshal([]byte(letterStr), &letter)
+		if err != nil {
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	slices.SortFunc(letters, func(a, b deadLetter) int {
+		return cmp.Or(cmp.Compare(a.Pipeline, b.Pipeline), cmp.Compare(a.Commit, b.Commit))
+	})
+	return letters, nil
+}
+
+// retryDeadLetters runs the commits through the pipeline again, like a regular batch.
+// The ones that get indexed or skipped leave the queue; the others stay with their new
+// error.
+func (p *pipeline) retryDeadLetters(ctx context.Context, letters []deadLetter) []deadLetterResult {
+	ids := []uint{}
+	for _, letter := range letters {
+		ids = append(ids, letter.Commit)
+	}
+
+	var commits []core.CommitLog
+	err := p.db.Where("id IN ?", ids).Order("id").Find(&commits).Error
+	if err != nil {
+		results := []deadLetterResult{}
+		for _, letter := range letters {
+			results = append(results, deadLetterResult{ID: letter.ID, Status: retryFailed, Error: err.Error()})
+		}
+		return results
+	}
+
+	results := []deadLetterResult{}
+	resolved := []string{}
+	found := map[uint]bool{}
+	for _, commit := range commits {
+		found[commit.ID] = true
+	}
+	for _, letter := range letters {
+		if !found[letter.Commit] {
+			results = append(results, deadLetterResult{ID: letter.ID, Status: retryMissing})
+			resolved = append(resolved, letter.ID)
+		}
+	}
+
+	batch := transformers[p.transform].newBatch(p)
+	kept := []core.CommitLog{}
+	prepared := map[uint]core.DocumentBase[any]{}
+	for _, commit := range commits {
+		id := deadLetterID(p.name, commit.ID)
+		doc, skip, err := p.prepare(ctx, batch, commit)
+		switch {
+		case err != nil:
+			p.deadLetter(ctx, commit, doc, err)
+			results = append(results, deadLetterResult{ID: id, Status: retryFailed, Error: err.Error()})
+		case skip != "":
+			p.recordSkipped(commit.ID, doc.Type, doc.Schema, skip, commit.Document)
+			results = append(results, deadLetterResult{ID: id, Status: retrySkipped, Error: skip})
+			resolved = append(resolved, id)
+		default:
+			kept = append(kept, commit)
+			prepared[commit.ID] = doc
+		}
+	}
+
+	_, err = writeDocuments(ctx, batch.documents(ctx))
+	if err == nil {
+		err = applyBatch(ctx, batch)
+	}
+	if err == nil {
+		batch.finish(ctx)
+	}
+	for _, commit := range kept {
+		id := deadLetterID(p.name, commit.ID)
+		if err != nil {
+			p.deadLetter(ctx, commit, prepared[commit.ID], err)
+			results = append(results, deadLetterResult{ID: id, Status: retryFailed, Error: err.Error()})
+			continue
+		}
+		results = append(results, deadLetterResult{ID: id, Status: retryIndexed})
+		resolved = append(resolved, id)
+	}
+
+	if len(resolved) > 0 {
+		err = p.rdb.HDel(ctx, deadLetterKey, resolved...).Err()
+		if err != nil {
+			reportError("indexer", err)
+		}
+	}
+	return results
+}
+
+// retryAllDeadLetters requeues the given dead letters, or every one when ids is empty.
+func retryAllDeadLetters(ctx context.Context, rdb *redis.Client, ids []string) ([]deadLetterResult, error) {
+	letters, err := listDeadLetters(ctx, rdb)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []deadLetterResult{}
+	if len(ids) > 0 {
+		selected := []deadLetter{}
+		for _, id := range ids {
+			i := slices.IndexFunc(letters, func(letter deadLetter) bool { return letter.ID == id })
+			if i < 0 {
+				results = append(results, deadLetterResult{ID: id, Status: retryUnknown})
+				continue
+			}
+			selected = append(selected, letters[i])
+		}
+		letters = selected
+	}
+
+	byPipeline := map[string][]deadLetter{}
+	for _, letter := range letters {
+		byPipeline[letter.Pipeline] = append(byPipeline[letter.Pipeline], letter)
+	}
+
+	for name, pipelineLetters := range byPipeline {
+		p := getPipeline(name)
+		if p == nil {
+			// the pipeline is no longer configured; keep its letters for when it comes back
+			for _, letter := range pipelineLetters {
+				results = append(results, deadLetterResult{ID: letter.ID, Status: retryFailed, Error: "unknown pipeline"})
+			}
+			continue
+		}
+		for start := 0; start < len(pipelineLetters); start += deadLetterRetryChunk {
+			end := min(start+deadLetterRetryChunk, len(pipelineLetters))
+			results = append(results, p.retryDeadLetters(ctx, pipelineLetters[start:end])...)
+		}
+	}
+
+	return results, nil
+}
+
+func setupDeadLetterRoutes(admin *echo.Group, rdb *redis.Client) {
+
+	admin.GET("/dlq", func(c echo.Context) error {
+		letters, err := listDeadLetters(c.Request().Context(), rdb)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": letters})
+	})
+
+	admin.POST("/dlq/retry", func(c echo.Context) error {
+		var request struct {
+			IDs []string `json:"ids"`
+			All bool     `json:"all"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if len(request.IDs) == 0 && !request.All {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "ids", "ids is empty; set all to retry every entry")
+		}
+		if len(request.IDs) > 0 && request.All {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "all", "all cannot be combined with ids")
+		}
+
+		results, err := retryAllDeadLetters(c.Request().Context(), rdb, request.IDs)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		counts := map[string]int{}
+		for _, result := range results {
+			counts[result.Status]++
+		}
+		indexerLog.Info("dead letters retried", "count", len(results), "results", counts)
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"status": "ok",
+			"content": echo.Map{
+				"counts":  counts,
+				"results": results,
+			},
+		})
+	})
+}
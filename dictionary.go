@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// searchDictionary holds the synonyms and stop words of the message indexes. Synonyms
+// work one way, from the key to its alternatives, so words that stand for each other
+// are listed under both.
+type searchDictionary struct {
+	Synonyms  map[string][]string `json:"synonyms"`
+	StopWords []string            `json:"stopWords"`
+}
+
+// dictionary is the SEARCH_DICTIONARY in use, nil to leave the index alone.
+var dictionary *searchDictionary
+
+// setupSearchDictionary reads SEARCH_DICTIONARY, a JSON file like
+// {"synonyms": {"こんにちは": ["こんにちわ"]}, "stopWords": ["the"]}. The reconciliation
+// pushes it to the message indexes, which then match one word for the other, so the
+// file is the place to edit them rather than Meilisearch.
+func setupSearchDictionary() error {
+	path := os.Getenv("SEARCH_DICTIONARY")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var loaded searchDictionary
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return fmt.Errorf("invalid SEARCH_DICTIONARY: %w", err)
+	}
+	if loaded.Synonyms == nil {
+		loaded.Synonyms = map[string][]string{}
+	}
+	if loaded.StopWords == nil {
+		loaded.StopWords = []string{}
+	}
+	for word, synonyms := range loaded.Synonyms {
+		if strings.TrimSpace(word) == "" || len(synonyms) == 0 {
+			return fmt.Errorf("invalid SEARCH_DICTIONARY: synonyms of %q are empty", word)
+		}
+	}
+
+	dictionary = &loaded
+	return nil
+}
+
+// sameSynonyms compares synonyms the way Meilisearch keeps them, lowercased and in any
+// order, so that an unchanged dictionary doesn't trigger a reindex.
+func sameSynonyms(current, desired map[string][]string) bool {
+	normalize := func(synonyms map[string][]string) map[string][]string {
+		normalized := map[string][]string{}
+		for word, alternatives := range synonyms {
+			key := strings.ToLower(word)
+			for _, alternative := range alternatives {
+				normalized[key] = append(normalized[key], strings.ToLower(alternative))
+			}
+			slices.Sort(normalized[key])
+			normalized[key] = slices.Compact(normalized[key])
+		}
+		return normalized
+	}
+	a, b := normalize(current), normalize(desired)
+	if len(a) != len(b) {
+		return false
+	}
+	for word, alternatives := range b {
+		if !slices.Equal(a[word], alternatives) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameWords compares lists of words lowercased and in any order.
+func sameWords(current, desired []string) bool {
+	normalize := func(words []string) []string {
+		normalized := []string{}
+		for _, word := range words {
+			normalized = append(normalized, strings.ToLower(word))
+		}
+		slices.Sort(normalized)
+		return slices.Compact(normalized)
+	}
+	return slices.Equal(normalize(current), normalize(desired))
+}
+
+// dictionaryDrift lists the parts of the dictionary the index lacks.
+func dictionaryDrift(index meilisearch.IndexManager) ([]string, error) {
+	drift := []string{}
+	synonyms, err := index.GetSynonyms()
+	if err != nil {
+		return nil, err
+	}
+	if !sameSynonyms(*synonyms, dictionary.Synonyms) {
+		drift = append(drift, "synonyms")
+	}
+	stopWords, err := index.GetStopWords()
+	if err != nil {
+		return nil, err
+	}
+	if !sameWords(*stopWords, dictionary.StopWords) {
+		drift = append(drift, "stopWords")
+	}
+	return drift, nil
+}
+
+// reconcileDictionary pushes the dictionary to the index where it differs.
+func reconcileDictionary(index meilisearch.IndexManager) error {
+	drift, err := dictionaryDrift(index)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(drift, "synonyms") {
+		synonyms := dictionary.Synonyms
+		_, err := index.UpdateSynonyms(&synonyms)
+		if err != nil {
+			return err
+		}
+		settingsLog.Info("synonyms updated")
+	}
+	if slices.Contains(drift, "stopWords") {
+		stopWords := slices.Clone(dictionary.StopWords)
+		_, err := index.UpdateStopWords(&stopWords)
+		if err != nil {
+			return err
+		}
+		settingsLog.Info("stop words updated")
+	}
+	return nil
+}
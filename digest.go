@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/core"
+)
+
+const (
+	digestKey       = "ccsearch:digest"
+	digestSchema    = "https://schema.concrnt.world/m/markdown.json"
+	digestMaxHits   = 10
+	digestTextLimit = 80
+)
+
+// savedSearch is a query whose new matches are posted in the digest.
+type savedSearch struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// Filter narrows the query with a Meilisearch filter, e.g. a timeline.
+	Filter string `json:"filter,omitempty"`
+}
+
+// digestBot periodically posts the new matches of saved searches to a Concurrent
+// timeline, signing its messages with a sub-key of the bot entity.
+type digestBot struct {
+	rdb      *redis.Client
+	index    searchIndex
+	client   *http.Client
+	searches []savedSearch
+
+	privateKey string
+	ccid       string
+	domain     string
+	keyID      string
+	timeline   string
+	link       string
+	interval   time.Duration
+}
+
+// parseSubkey reads a sub-key in the "concurrent-subkey <private key> <ccid>@<domain> <name>"
+// format exported by Concurrent clients.
+func parseSubkey(subkey string) (privateKey, ccid, domain string, err error) {
+	parts := strings.Fields(subkey)
+	if len(parts) < 3 || parts[0] != "concurrent-subkey" {
+		return "", "", "", fmt.Errorf("invalid DIGEST_SUBKEY: expected concurrent-subkey <key> <ccid>@<domain> <name>")
+	}
+	ccid, domain, ok := strings.Cut(parts[2], "@")
+	if !ok || ccid == "" || domain == "" {
+		return "", "", "", fmt.Errorf("invalid DIGEST_SUBKEY: expected <ccid>@<domain>")
+	}
+	return parts[1], ccid, domain, nil
+}
+
+// setupDigest configures the digest bot from DIGEST_SUBKEY, DIGEST_KEY_ID (the ckid of
+// the sub-key), DIGEST_TIMELINE and DIGEST_QUERIES, a JSON file of saved searches.
+// DIGEST_INTERVAL and DIGEST_LINK ({signer} and {id} are replaced) are optional.
+// It returns nil when no sub-key is configured.
+func setupDigest(rdb *redis.Client, index searchIndex) (*digestBot, error) {
+	subkey := os.Getenv("DIGEST_SUBKEY")
+	if subkey == "" {
+		return nil, nil
+	}
+
+	privateKey, ccid, domain, err := parseSubkey(subkey)
+	if err != nil {
+		return nil, err
+	}
+
+	bot := &digestBot{
+		rdb:   rdb,
+		index: index,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		privateKey: privateKey,
+		ccid:       ccid,
+		domain:     domain,
+		keyID:      os.Getenv("DIGEST_KEY_ID"),
+		timeline:   os.Getenv("DIGEST_TIMELINE"),
+		link:       os.Getenv("DIGEST_LINK"),
+		interval:   time.Hour,
+	}
+	if bot.keyID == "" || bot.timeline == "" {
+		return nil, fmt.Errorf("DIGEST_KEY_ID and DIGEST_TIMELINE are required with DIGEST_SUBKEY")
+	}
+	if bot.link == "" {
+		bot.link = "https://concrnt.world/{signer}/{id}"
+	}
+
+	if value := os.Getenv("DIGEST_INTERVAL"); value != "" {
+		bot.interval, err = time.ParseDuration(value)
+		if err != nil || bot.interval < time.Minute {
+			return nil, fmt.Errorf("invalid DIGEST_INTERVAL: %s", value)
+		}
+	}
+
+	path := os.Getenv("DIGEST_QUERIES")
+	if path == "" {
+		return nil, fmt.Errorf("DIGEST_QUERIES is required with DIGEST_SUBKEY")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &bot.searches)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DIGEST_QUERIES: %w", err)
+	}
+	for _, search := range bot.searches {
+		if search.Name == "" || search.Query == "" {
+			return nil, fmt.Errorf("invalid DIGEST_QUERIES: every search needs a name and a query")
+		}
+	}
+
+	jobsLog.Info("digest bot configured", "searches", len(bot.searches), "timeline", bot.timeline, "interval", bot.interval)
+	return bot, nil
+}
+
+// run posts a digest for every saved search with matches signed since its last digest.
+// The first run of a search only records the starting point.
+func (b *digestBot) run(ctx context.Context) error {
+	now := time.Now()
+
+	for _, search := range b.searches {
+		since, err := b.rdb.HGet(ctx, digestKey, search.Name).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		if since > 0 {
+			hits, err := b.matches(search, since, now.UnixMilli())
+			if err != nil {
+				reportError("digest", fmt.Errorf("search %s: %w", search.Name, err))
+				continue
+			}
+			if len(hits) > 0 {
+				err = b.post(ctx, b.compose(search, hits))
+				if err != nil {
+					reportError("digest", fmt.Errorf("search %s: %w", search.Name, err))
+					continue
+				}
+				jobsLog.Info("digest posted", "search", search.Name, "matches", len(hits))
+			}
+		}
+
+		err = b.rdb.HSet(ctx, digestKey, search.Name, now.UnixMilli()).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *digestBot) matches(search savedSearch, since, until int64) ([]any, error) {
+	filter := []string{
+		"hidden != true",
+		"spam != true",
+		"flagged != true",
+		"restricted != true",
+		notExpiredFilter(time.Now()),
+		fmt.Sprintf("signer != %s", quoteFilter(b.ccid)),
+		fmt.Sprintf("signedAt >= %d", since),
+		fmt.Sprintf("signedAt < %d", until),
+	}
+	if search.Filter != "" {
+		filter = append(filter, search.Filter)
+	}
+
+	targets := []searchIndex{b.index}
+	if messageShards != nil && b.index == messageShards.base {
+		// the new messages are in the shards of the period
+		targets = messageShards.between(time.UnixMilli(since), time.UnixMilli(until))
+	}
+	for _, route := range indexRoutes {
+		targets = append(targets, route.index)
+	}
+
+	hits, _, _, err := searchIndexes(context.Background(), targets, search.Query, &meilisearch.SearchRequest{
+		Limit:  digestMaxHits,
+		Filter: filter,
+		Sort:   []string{"signedAt:desc"},
+	}, false)
+	return hits, err
+}
+
+// compose writes the digest as a markdown list of links to the matching messages.
+func (b *digestBot) compose(search savedSearch, hits []any) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "**%s**: new matches for `%s`\n\n", search.Name, search.Query)
+
+	for _, hit := range hits {
+		hitDoc, _ := hit.(map[string]any)
+		id, _ := hitDoc["id"].(string)
+		signer, _ := hitDoc["signer"].(string)
+
+		title := id
+		if preview := hitPreview(hitDoc); preview != nil {
+			if preview.Title != "" {
+				title = preview.Title
+			} else if preview.Text != "" {
+				title = preview.Text
+			}
+		}
+		title = strings.Join(strings.Fields(truncateRunes(title, digestTextLimit)), " ")
+
+		link := strings.NewReplacer("{signer}", signer, "{id}", strings.TrimPrefix(id, "m")).Replace(b.link)
+		fmt.Fprintf(&text, "- [%s](%s)\n", title, link)
+	}
+
+	return text.String()
+}
+
+type digestBody struct {
+	Body string `json:"body"`
+}
+
+type commitRequest struct {
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+}
+
+// post signs a markdown message with the sub-key and commits it to the bot's domain.
+func (b *digestBot) post(ctx context.Context, text string) error {
+	document := core.MessageDocument[digestBody]{
+		DocumentBase: core.DocumentBase[digestBody]{
+			Signer:   b.ccid,
+			Type:     "message",
+			Schema:   digestSchema,
+			Body:     digestBody{Body: text},
+			SignedAt: time.Now(),
+			KeyID:    b.keyID,
+		},
+		Timelines: []string{b.timeline},
+	}
+
+	documentJson, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	signature, err := core.SignBytes(documentJson, b.privateKey)
+	if err != nil {
+		return err
+	}
+
+	requestJson, err := json.Marshal(commitRequest{
+		Document:  string(documentJson),
+		Signature: hex.EncodeToString(signature),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+b.domain+"/api/v1/commit", bytes.NewReader(requestJson))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("commit returned %d", resp.StatusCode)
+	}
+	return nil
+}
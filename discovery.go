@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"github.com/totegamma/concurrent/core"
+)
+
+type discoveryParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type discoveryEndpoint struct {
+	Method      string           `json:"method"`
+	Path        string           `json:"path"`
+	Scope       string           `json:"scope,omitempty"`
+	Description string           `json:"description"`
+	Params      []discoveryParam `json:"params,omitempty"`
+}
+
+// searchParams are the parameters understood by every search endpoint.
+var searchParams = []discoveryParam{
+	{Name: "q", Description: "query text, supporting the operators listed in the document"},
+	{Name: "offset", Description: "number of results to skip"},
+	{Name: "limit", Description: "number of results to return, up to the maxLimit of this document (default 10)"},
+	{Name: "cursor", Description: "the nextCursor of the previous page, to page through newest or oldest results instead of offset"},
+	{Name: "signer", Description: "only messages signed by this CCID"},
+	{Name: "schema", Description: "only messages of this schema; repeat for several"},
+	{Name: "domain", Description: "only messages linking to this domain"},
+	{Name: "lang", Description: "only messages detected in this language, an ISO 639-1 code like ja or en; repeat for several"},
+	{Name: "lat", Description: "latitude of the center of a radius search"},
+	{Name: "lng", Description: "longitude of the center of a radius search"},
+	{Name: "radius", Description: "radius in meters around lat/lng"},
+	{Name: "bbox", Description: "bounding box as topRightLat,topRightLng,bottomLeftLat,bottomLeftLng"},
+	{Name: "since", Description: "only messages signed at or after this date, e.g. 2024-05-01, yesterday, 7d"},
+	{Name: "until", Description: "only messages signed at or before this time, or by the end of this date, e.g. 2024-05-31, 1714521600000"},
+	{Name: "tz", Description: "IANA time zone of since and until, e.g. Asia/Tokyo (default UTC)"},
+	{Name: "field.<name>", Description: "exact match on a field extracted by the schema registry"},
+	{Name: "includeFlagged", Description: "set to true to include messages matching the suppression rules"},
+	{Name: "search_cw", Description: "set to true to also match the content warning text of messages"},
+	{Name: "sort", Description: "newest (default), oldest or relevance; timelines may pin their own default"},
+	{Name: "include", Description: "set to document to return the schema, body or text, signedAt and timelines of each message"},
+	{Name: "index", Description: "restrict the search to one index: default or a route name"},
+	{Name: "facets", Description: "comma separated attributes to count the hits by: schema (default), signer, hashtags, lang"},
+}
+
+// ccInfo extends the standard service info with what this deployment supports.
+type ccInfo struct {
+	core.CCInfo
+	Capabilities []string `json:"capabilities"`
+}
+
+// capabilities lists the optional abilities of this deployment, following the feature
+// flags and the configuration.
+func capabilities(ctx context.Context) []string {
+	result := []string{"global", "timelines", "threads", "links", "geo", "previews", "related"}
+	if features.enabled(ctx, featureTrends) {
+		result = append(result, "trends")
+	}
+	if features.enabled(ctx, featureEnrichment) {
+		result = append(result, "linkPreviews")
+	}
+	if features.enabled(ctx, featureAutocomplete) {
+		result = append(result, "autocomplete")
+	}
+	if features.enabled(ctx, featureLive) {
+		result = append(result, "live")
+	}
+	if len(indexRoutes) > 0 {
+		result = append(result, "indexRoutes")
+	}
+	if policies.enabled {
+		result = append(result, "policies")
+	}
+	if auth.enabled() {
+		result = append(result, "auth")
+	}
+	if profileIndex() != nil {
+		result = append(result, "profiles")
+	}
+	if timelineIndex() != nil {
+		result = append(result, "timelines")
+	}
+	return result
+}
+
+func ccInfoHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, ccInfo{
+		CCInfo: core.CCInfo{
+			Name:    "github.com/concrnt/cc-search",
+			Version: version,
+		},
+		Capabilities: capabilities(c.Request().Context()),
+	})
+}
+
+// discoveryDocument describes what this instance supports, so clients can configure
+// themselves against it.
+func discoveryDocument(ctx context.Context) echo.Map {
+	endpoints := []discoveryEndpoint{
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/search",
+			Scope:       "global",
+			Description: "search every indexed message",
+			Params:      searchParams,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/suggest",
+			Scope:       "global",
+			Description: "suggest messages while typing, the last word matching as a prefix",
+			Params: []discoveryParam{
+				{Name: "q", Description: "query text typed so far"},
+				{Name: "limit", Description: "number of suggestions, up to 10 (default 5)"},
+			},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/timeline/:id",
+			Scope:       "timeline",
+			Description: "search the messages of a timeline",
+			Params:      searchParams,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/thread/:rootId/search",
+			Scope:       "thread",
+			Description: "search the messages of a conversation",
+			Params:      searchParams,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/hashtags/:tag",
+			Scope:       "hashtag",
+			Description: "the messages of a hashtag, newest first; q is optional",
+			Params:      searchParams,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/mentions/:ccid",
+			Scope:       "mention",
+			Description: "the public messages mentioning a CCID, newest first; q is optional",
+			Params:      searchParams,
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/related",
+			Description: "hashtags and terms that often appear with a hashtag",
+			Params: []discoveryParam{
+				{Name: "tag", Description: "the hashtag, with or without '#'"},
+			},
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/timeline/:id/settings",
+			Scope:       "timeline",
+			Description: "search defaults of a timeline; its owner can change them with PUT and DELETE",
+		},
+	}
+	if profileIndex() != nil {
+		endpoints = append(endpoints, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/profiles",
+			Description: "search profiles by username and description",
+			Params: []discoveryParam{
+				{Name: "q", Description: "query text"},
+				{Name: "offset", Description: "number of results to skip"},
+				{Name: "limit", Description: "number of results to return"},
+				{Name: "schema", Description: "only profiles of this schema"},
+			},
+		})
+	}
+	if timelineIndex() != nil {
+		endpoints = append(endpoints, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/timelines",
+			Description: "search the indexable timelines by name and description",
+			Params: []discoveryParam{
+				{Name: "q", Description: "query text"},
+				{Name: "offset", Description: "number of results to skip"},
+				{Name: "limit", Description: "number of results to return"},
+				{Name: "schema", Description: "only timelines of this schema"},
+			},
+		})
+	}
+	if features.enabled(ctx, featureTrends) {
+		endpoints = append(endpoints, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/trends/messages",
+			Description: "currently trending messages",
+			Params: []discoveryParam{
+				{Name: "limit", Description: "number of messages to return"},
+				{Name: "timeline", Description: "only messages posted to this timeline"},
+			},
+		}, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/trends/hashtags",
+			Description: "the hashtags used the most lately, with the change from the window before",
+			Params: []discoveryParam{
+				{Name: "window", Description: "whole hours to count, e.g. 24h (default), up to 168h"},
+				{Name: "limit", Description: "number of hashtags to return"},
+			},
+		})
+	}
+
+	if features.enabled(ctx, featureAutocomplete) {
+		endpoints = append(endpoints, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/autocomplete",
+			Description: "hashtags or users starting with the text being typed, the most used lately first",
+			Params: []discoveryParam{
+				{Name: "q", Description: "the text being typed, with or without '#' or '@'"},
+				{Name: "type", Description: "hashtag or user"},
+				{Name: "limit", Description: "number of completions to return, up to 20"},
+			},
+		})
+	}
+
+	if features.enabled(ctx, featureLive) {
+		endpoints = append(endpoints, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/subscribe",
+			Description: "a WebSocket receiving the messages matching its subscriptions as they are indexed",
+		}, discoveryEndpoint{
+			Method:      http.MethodGet,
+			Path:        apiPrefix + "/stream",
+			Description: "server-sent events of the IDs of the messages matching a query as they are indexed, resumed with Last-Event-ID",
+			Params: []discoveryParam{
+				{Name: "q", Description: "words the messages must all contain"},
+				{Name: "timeline", Description: "only messages posted to this timeline"},
+				{Name: "signer", Description: "only messages of this CCID"},
+				{Name: "schema", Description: "only messages of these schemas"},
+				{Name: "hashtag", Description: "only messages with this hashtag"},
+			},
+		})
+	}
+
+	indexes := []string{"default"}
+	for _, route := range indexRoutes {
+		indexes = append(indexes, route.Name)
+	}
+
+	fields := []string{}
+	for _, mapping := range schemaRegistry {
+		for name := range mapping.Filterable {
+			if !slices.Contains(fields, name) {
+				fields = append(fields, name)
+			}
+		}
+	}
+	slices.Sort(fields)
+
+	return echo.Map{
+		"name":         "github.com/concrnt/cc-search",
+		"version":      version,
+		"capabilities": capabilities(ctx),
+		"endpoints":    endpoints,
+		"scopes":       []string{"global", "timeline", "thread"},
+		"operators":    []string{"has:link"},
+		"fields":       fields,
+		"indexes":      indexes,
+		"maxLimit":     searchMaxLimit,
+		"highlight":    []string{highlightPreTag, highlightPostTag},
+		"federation":   false,
+	}
+}
+
+func discoveryHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, discoveryDocument(c.Request().Context()))
+}
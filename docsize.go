@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+const (
+	sizeTruncate = "truncate"
+	sizeSkip     = "skip"
+	// minTruncatedLength is the shortest a string is cut to. A document that still doesn't
+	// fit is mostly structure, not text, and is skipped whatever the strategy.
+	minTruncatedLength = 256
+)
+
+// maxDocumentSize bounds the encoded size of a message document, so that embedded files
+// and giant pastes don't bloat the index or go past the payload limit of the engine.
+// Zero disables the guard. documentSizeStrategy is what becomes of a larger document:
+// its strings are truncated, or it is skipped.
+var (
+	maxDocumentSize      = 64 * 1024
+	documentSizeStrategy = sizeTruncate
+)
+
+// setupDocumentSize reads MAX_DOCUMENT_SIZE, in bytes, and DOCUMENT_SIZE_STRATEGY.
+func setupDocumentSize() error {
+	if value := os.Getenv("MAX_DOCUMENT_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 || size > 0 && size < 4*minTruncatedLength {
+			return fmt.Errorf("invalid MAX_DOCUMENT_SIZE: %s (expected 0 or at least %d)", value, 4*minTruncatedLength)
+		}
+		maxDocumentSize = size
+	}
+	switch strategy := os.Getenv("DOCUMENT_SIZE_STRATEGY"); strategy {
+	case "":
+	case sizeTruncate, sizeSkip:
+		documentSizeStrategy = strategy
+	default:
+		return fmt.Errorf("invalid DOCUMENT_SIZE_STRATEGY: %s (expected truncate or skip)", strategy)
+	}
+	return nil
+}
+
+func documentSize(record messageRecord) int {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
+}
+
+// fitDocument keeps a message record under maxDocumentSize. Truncating caps every string
+// of the text, the fields and the body at the longest length that fits, so the short
+// strings, e.g. IDs and names, are left whole and the long ones lose their tail. It
+// returns the reason the record is skipped, if it is.
+func fitDocument(record *messageRecord) string {
+	if maxDocumentSize == 0 {
+		return ""
+	}
+	size := documentSize(*record)
+	if size <= maxDocumentSize {
+		return ""
+	}
+	if documentSizeStrategy == sizeSkip {
+		indexerLog.Warn("skipping oversized document", "id", record.ID, "size", size, "max", maxDocumentSize)
+		return skipTooLarge
+	}
+
+	longest := 0
+	walkStrings([]any{record.Text, record.Body, record.Fields}, func(s string) {
+		longest = max(longest, len(s))
+	})
+
+	// search the longest cap that fits
+	capped := func(limit int) messageRecord {
+		truncated := *record
+		truncated.Text = truncateString(record.Text, limit)
+		truncated.Body = truncateStrings(record.Body, limit)
+		if record.Fields != nil {
+			truncated.Fields = truncateStrings(record.Fields, limit).(map[string]any)
+		}
+		truncated.Truncated = true
+		return truncated
+	}
+	low, high := minTruncatedLength, longest
+	if documentSize(capped(low)) > maxDocumentSize {
+		indexerLog.Warn("skipping oversized document", "id", record.ID, "size", size, "max", maxDocumentSize)
+		return skipTooLarge
+	}
+	for low < high {
+		limit := (low + high + 1) / 2
+		if documentSize(capped(limit)) <= maxDocumentSize {
+			low = limit
+		} else {
+			high = limit - 1
+		}
+	}
+
+	*record = capped(low)
+	indexerLog.Info("truncated oversized document", "id", record.ID, "size", size, "max", maxDocumentSize, "stringLength", low)
+	return ""
+}
+
+// truncateString cuts s to at most limit bytes, on a rune boundary.
+func truncateString(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// truncateStrings copies a decoded JSON value with its strings cut to at most limit bytes.
+func truncateStrings(value any, limit int) any {
+	switch v := value.(type) {
+	case string:
+		return truncateString(v, limit)
+	case []any:
+		result := make([]any, len(v))
+		for i, item := range v {
+			result[i] = truncateStrings(item, limit)
+		}
+		return result
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[key] = truncateStrings(item, limit)
+		}
+		return result
+	}
+	return value
+}
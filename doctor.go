@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+)
+
+// Outcomes of a doctor check. Warnings are things the service fixes by itself on
+// startup, or can't verify.
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+// meilisearchActions are the API key actions the service uses. Dumps are only needed by
+// the dumps job.
+var meilisearchActions = []string{
+	"search", "documents.add", "documents.get", "documents.delete", "indexes.create", "indexes.get",
+	"settings.get", "settings.update", "tasks.get", "stats.get",
+}
+
+type doctorReport struct {
+	failed int
+}
+
+func (r *doctorReport) print(outcome, name, detail string, args ...any) {
+	if outcome == doctorFail {
+		r.failed++
+	}
+	fmt.Printf("%s  %-12s %s\n", outcome, name, fmt.Sprintf(detail, args...))
+}
+
+// keyAllows tells whether the key actions cover the action, directly or with a wildcard.
+func keyAllows(actions []string, action string) bool {
+	group, _, _ := strings.Cut(action, ".")
+	return slices.Contains(actions, "*") || slices.Contains(actions, action) || slices.Contains(actions, group+".*")
+}
+
+// runDoctor implements `cc-search doctor`. It checks the configuration and every
+// dependency the way the service would use them, without changing anything, and prints
+// a report.
+func runDoctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "how long each check may take")
+	flags.Parse(args)
+
+	loadConnectionConfig()
+
+	report := &doctorReport{}
+
+	required := []string{"DB_DSN", "REDIS_URL", "MEILISEARCH_IDX"}
+	switch os.Getenv("SEARCH_BACKEND") {
+	case "opensearch":
+		required = append(required, "OPENSEARCH_URL")
+	case "postgres":
+	default:
+		required = append(required, "MEILISEARCH_URL")
+	}
+	for _, name := range required {
+		if os.Getenv(name) == "" {
+			report.print(doctorFail, "config", "%s is not set", name)
+		}
+	}
+	pipelines, err := parsePipelines(os.Getenv("PIPELINES"), meilisearch_idx)
+	if err != nil {
+		report.print(doctorFail, "config", "%v", err)
+	}
+	routes, err := loadIndexRoutes()
+	if err != nil {
+		report.print(doctorFail, "config", "%v", err)
+	}
+	meiliConfig, err := loadMeilisearchConfig()
+	if err != nil {
+		report.print(doctorFail, "config", "%v", err)
+	}
+	if report.failed == 0 {
+		report.print(doctorPass, "config", "%d pipelines, %d index routes", len(pipelines), len(routes))
+	}
+
+	doctorPostgres(report)
+	doctorRedis(report, *timeout)
+
+	client := newMeilisearchClient(meilisearch_url, meilisearch_key, meiliConfig)
+	backend, err := newSearchBackend(client)
+	if err != nil {
+		report.print(doctorFail, "config", "%v", err)
+		return fmt.Errorf("%d checks failed", report.failed)
+	}
+	err = setupSearchDictionary()
+	if err != nil {
+		report.print(doctorFail, "config", "%v", err)
+	}
+	err = setupTypoTolerance()
+	if err != nil {
+		report.print(doctorFail, "config", "%v", err)
+	}
+	var reachable bool
+	if searchBackendName == "meilisearch" {
+		reachable = doctorMeilisearch(report, client, *timeout)
+	} else {
+		reachable = doctorSearchBackend(report, backend, *timeout)
+	}
+	if reachable {
+		indexes := map[string]indexSettings{meilisearch_idx: messageSettings}
+		for _, p := range pipelines {
+			indexes[p.indexUID] = transformers[p.transform].settings
+		}
+		for _, route := range routes {
+			indexes[route.Index] = route.settings()
+		}
+		for _, uid := range sortedKeys(indexes) {
+			doctorIndex(report, backend, uid, indexes[uid])
+		}
+	}
+
+	err = setupReplicas(meiliConfig)
+	if err != nil {
+		report.print(doctorFail, "replicas", "%v", err)
+	} else if searchReplicas != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		searchReplicas.check(ctx)
+		cancel()
+		for _, status := range searchReplicas.statuses() {
+			if status.Healthy {
+				report.print(doctorPass, "replicas", "%s is healthy", status.URL)
+			} else {
+				report.print(doctorFail, "replicas", "%s: %s", status.URL, status.LastError)
+			}
+		}
+	}
+
+	if report.failed > 0 {
+		return fmt.Errorf("%d checks failed", report.failed)
+	}
+	fmt.Println("all checks passed")
+	return nil
+}
+
+func doctorPostgres(report *doctorReport) {
+	db, err := openPostgres(os.Getenv("DB_DSN"))
+	if err != nil {
+		report.print(doctorFail, "postgres", "cannot connect: %v", err)
+		return
+	}
+	if !db.Migrator().HasTable("commit_logs") {
+		report.print(doctorFail, "postgres", "the commit_logs table is missing; is DB_DSN the database of the Concurrent node?")
+		return
+	}
+	latest, err := getLatestCommitID(db)
+	if err != nil {
+		report.print(doctorFail, "postgres", "cannot read commit_logs: %v", err)
+		return
+	}
+	report.print(doctorPass, "postgres", "commit_logs present, latest commit %d", latest)
+}
+
+func doctorRedis(report *doctorReport, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_URL"),
+	})
+	defer rdb.Close()
+
+	key := "ccsearch:doctor:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	start := time.Now()
+	err := rdb.Set(ctx, key, "ok", time.Minute).Err()
+	if err != nil {
+		report.print(doctorFail, "redis", "cannot write: %v", err)
+		return
+	}
+	value, err := rdb.GetDel(ctx, key).Result()
+	if err != nil || value != "ok" {
+		report.print(doctorFail, "redis", "cannot read back: %v", err)
+		return
+	}
+	report.print(doctorPass, "redis", "round-trip in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// doctorMeilisearch checks the engine and the permissions of the key. It returns whether
+// the indexes can be checked.
+func doctorMeilisearch(report *doctorReport, client meilisearch.ServiceManager, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := client.HealthWithContext(ctx)
+	if err != nil {
+		report.print(doctorFail, "meilisearch", "unreachable at %s: %v", meilisearch_url, err)
+		return false
+	}
+	version, err := client.VersionWithContext(ctx)
+	if err != nil {
+		report.print(doctorFail, "meilisearch", "cannot read the version, check MEILISEARCH_KEY: %v", err)
+		return false
+	}
+	report.print(doctorPass, "meilisearch", "version %s at %s", version.PkgVersion, meilisearch_url)
+
+	key, err := client.GetKey(meilisearch_key)
+	if err != nil {
+		report.print(doctorWarn, "key", "cannot inspect the key (the master key, or a key without keys.get): %v", err)
+		return true
+	}
+	missing := []string{}
+	for _, action := range meilisearchActions {
+		if !keyAllows(key.Actions, action) {
+			missing = append(missing, action)
+		}
+	}
+	if len(missing) > 0 {
+		report.print(doctorFail, "key", "missing actions: %s", strings.Join(missing, ", "))
+	} else if !slices.Contains(key.Indexes, "*") {
+		report.print(doctorWarn, "key", "limited to indexes %s", strings.Join(key.Indexes, ", "))
+	} else {
+		report.print(doctorPass, "key", "%q has every action needed", key.Name)
+	}
+	if !key.ExpiresAt.IsZero() && time.Until(key.ExpiresAt) < 30*24*time.Hour {
+		report.print(doctorWarn, "key", "expires at %s", key.ExpiresAt.Format(time.RFC3339))
+	}
+	return true
+}
+
+// doctorSearchBackend checks a search engine other than Meilisearch. It returns whether
+// the indexes can be checked.
+func doctorSearchBackend(report *doctorReport, backend searchBackend, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := backend.health(ctx)
+	if err != nil {
+		report.print(doctorFail, searchBackendName, "unhealthy: %v", err)
+		return false
+	}
+	report.print(doctorPass, searchBackendName, "healthy")
+	return true
+}
+
+func doctorIndex(report *doctorReport, backend searchBackend, uid string, settings indexSettings) {
+	name := "index " + uid
+	drift, err := backend.index(uid).settingsDrift(settings)
+	if err != nil {
+		var meiliErr *meilisearch.Error
+		if errors.As(err, &meiliErr) && meiliErr.StatusCode == http.StatusNotFound || isOpensearchNotFound(err) || isPostgresNotFound(err) {
+			report.print(doctorWarn, name, "does not exist yet; it is created on startup")
+			return
+		}
+		report.print(doctorFail, name, "cannot read the settings: %v", err)
+		return
+	}
+	if len(drift) > 0 {
+		report.print(doctorWarn, name, "settings drift in %s; reconciled on startup", strings.Join(drift, ", "))
+		return
+	}
+	report.print(doctorPass, name, "settings up to date")
+}
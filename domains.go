@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+const ownerCacheSize = 100000
+
+// ownerFilter restricts indexing to the commits whose owner lives on one of the given
+// domains, so that remote federated content doesn't take up index space.
+type ownerFilter struct {
+	db      *gorm.DB
+	domains []string
+
+	mu       sync.Mutex
+	domainOf map[string]string
+}
+
+var commitOwners *ownerFilter
+
+// newOwnerFilter reads INDEX_DOMAINS, a comma separated list of domains. Without it every
+// commit is indexed.
+func newOwnerFilter(db *gorm.DB) *ownerFilter {
+	domains := []string{}
+	for _, domain := range strings.Split(os.Getenv("INDEX_DOMAINS"), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	return &ownerFilter{
+		db:       db,
+		domains:  domains,
+		domainOf: map[string]string{},
+	}
+}
+
+func (f *ownerFilter) enabled() bool {
+	return len(f.domains) > 0
+}
+
+// lookup returns the domain of an entity as recorded in the entities table of the
+// concurrent database, or "" for an unknown entity.
+func (f *ownerFilter) lookup(entity string) (string, error) {
+	f.mu.Lock()
+	domain, ok := f.domainOf[entity]
+	f.mu.Unlock()
+	if ok {
+		return domain, nil
+	}
+
+	var domains []string
+	err := f.db.Table("entities").Where("id = ?", entity).Limit(1).Pluck("domain", &domains).Error
+	if err != nil {
+		return "", err
+	}
+	if len(domains) > 0 {
+		domain = strings.ToLower(domains[0])
+	}
+
+	f.mu.Lock()
+	if len(f.domainOf) >= ownerCacheSize {
+		f.domainOf = map[string]string{}
+	}
+	f.domainOf[entity] = domain
+	f.mu.Unlock()
+
+	return domain, nil
+}
+
+// allowed reports whether a document should be indexed. The owner of a document is its
+// owner field when set, and its signer otherwise.
+func (f *ownerFilter) allowed(owner, signer string) (bool, error) {
+	if !f.enabled() {
+		return true, nil
+	}
+
+	entity := owner
+	if entity == "" {
+		entity = signer
+	}
+
+	domain, err := f.lookup(entity)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(f.domains, domain), nil
+}
@@ -0,0 +1,153 @@
+//go:build e2e
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/core"
+)
+
+// The end-to-end tests run against a live cc-search and its dependencies (see
+// compose.e2e.yaml). They seed known messages into the commit log, wait for the
+// indexer, and assert the search results of the API:
+//
+//	CC_SEARCH_URL=http://localhost:8000 DB_DSN=... REDIS_URL=... go test -tags e2e -run TestE2E .
+
+// e2eTimeout is how long to wait for the seeded messages to become searchable.
+const e2eTimeout = 2 * time.Minute
+
+// e2eCheck is one end-to-end assertion against the running API.
+type e2eCheck struct {
+	name   string
+	path   string
+	status int
+	// results is the number of search results expected, or -1 to skip the count.
+	results int
+	code    string
+	header  string
+}
+
+type e2eResponse struct {
+	Status  string           `json:"status"`
+	Content []map[string]any `json:"content"`
+	Error   *apiError        `json:"error"`
+}
+
+func TestE2E(t *testing.T) {
+	apiURL := os.Getenv("CC_SEARCH_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8000"
+	}
+
+	db, err := openPostgres(os.Getenv("DB_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an empty database has no commit log yet; the indexer retries until it exists
+	err = db.AutoMigrate(&core.CommitLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_URL"),
+	})
+	defer rdb.Close()
+
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	token := "e2e" + runID
+	timelineA := fmt.Sprintf("te2ea%0*s", 27-len("te2ea"), runID)
+	timelineB := fmt.Sprintf("te2eb%0*s", 27-len("te2eb"), runID)
+
+	now := time.Now()
+	documents := []core.MessageDocument[map[string]any]{
+		benchMessage("first "+token+" message", timelineA, now),
+		benchMessage("second "+token+" message", timelineA, now.Add(time.Millisecond)),
+		benchMessage("third "+token+" message", timelineA, now.Add(2*time.Millisecond)),
+		benchMessage("unrelated message", timelineA, now.Add(3*time.Millisecond)),
+		benchMessage("other timeline "+token, timelineB, now.Add(4*time.Millisecond)),
+	}
+	last, err := insertCommits(db, documents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = waitForCursor(context.Background(), rdb, "ccsearch:readitr", last, e2eTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []e2eCheck{
+		{name: "timeline search", path: apiPrefix + "/timeline/" + timelineA + "?q=" + token, status: http.StatusOK, results: 3},
+		{name: "timeline scope", path: apiPrefix + "/timeline/" + timelineB + "?q=" + token, status: http.StatusOK, results: 1},
+		{name: "global search", path: apiPrefix + "/search?q=" + token, status: http.StatusOK, results: 4},
+		{name: "no match", path: apiPrefix + "/timeline/" + timelineA + "?q=nothing" + token, status: http.StatusOK, results: 0},
+		{name: "empty query", path: apiPrefix + "/timeline/" + timelineA + "?q=", status: http.StatusBadRequest, results: -1, code: codeMissingParameter},
+		{name: "legacy route", path: "/timeline/" + timelineA + "?q=" + token, status: http.StatusOK, results: 3, header: "Deprecation"},
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			// documents become searchable once the backend has processed the indexing task
+			deadline := time.Now().Add(e2eTimeout)
+			var err error
+			for {
+				err = check.run(client, apiURL)
+				if err == nil || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Second)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func (check e2eCheck) run(client *http.Client, baseURL string) error {
+	resp, err := client.Get(baseURL + check.path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != check.status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, check.status)
+	}
+	if check.header != "" && resp.Header.Get(check.header) == "" {
+		return fmt.Errorf("missing %s header", check.header)
+	}
+
+	var body e2eResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return err
+	}
+
+	if check.code != "" {
+		if body.Error == nil || body.Error.Code != check.code {
+			return fmt.Errorf("error code %v, expected %s", body.Error, check.code)
+		}
+	}
+	if check.results >= 0 {
+		if len(body.Content) != check.results {
+			return fmt.Errorf("%d results, expected %d", len(body.Content), check.results)
+		}
+		for _, result := range body.Content {
+			if result["owner"] != benchSigner {
+				return fmt.Errorf("unexpected owner %v", result["owner"])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Error codes returned in the `code` field of error responses. Clients branch on these
+// rather than on the message, which is meant for humans and may change.
+const (
+	codeInvalidBody      = "invalid_body"
+	codeInvalidParameter = "invalid_parameter"
+	codeMissingParameter = "missing_parameter"
+	codeNotFound         = "not_found"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeFeatureDisabled  = "feature_disabled"
+	codeMaintenance      = "maintenance"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeRateLimited      = "rate_limited"
+	codeInternal         = "internal_error"
+)
+
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// respondFieldError writes an error response about the given request field.
+func respondFieldError(c echo.Context, status int, code, field, message string) error {
+	return c.JSON(status, echo.Map{
+		"status": "error",
+		"error": apiError{
+			Code:      code,
+			Message:   message,
+			Field:     field,
+			RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+		},
+	})
+}
+
+func respondError(c echo.Context, status int, code, message string) error {
+	return respondFieldError(c, status, code, "", message)
+}
+
+// httpErrorHandler renders the errors raised by echo itself (unknown routes, panics
+// caught by the recover middleware, ...) in the same format as the handlers.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	code := codeInternal
+	message := err.Error()
+
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		status = httpError.Code
+		if msg, ok := httpError.Message.(string); ok {
+			message = msg
+		}
+		switch status {
+		case http.StatusNotFound:
+			code = codeNotFound
+		case http.StatusMethodNotAllowed:
+			code = codeMethodNotAllowed
+		case http.StatusUnauthorized:
+			code = codeUnauthorized
+		case http.StatusForbidden:
+			code = codeForbidden
+		case http.StatusBadRequest:
+			code = codeInvalidParameter
+		}
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = respondError(c, status, code, message)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// indexEventDelay gathers the events of a burst into one run of the pipelines.
+const indexEventDelay = 200 * time.Millisecond
+
+// startIndexEvents runs the pipelines as soon as the concurrent node publishes an event,
+// when INDEX_EVENTS_CHANNELS is set to the pattern of its channels, e.g. "*". The node
+// publishes to its own redis, INDEX_EVENTS_REDIS_URL, which defaults to REDIS_URL. Polling
+// goes on at the interval of every pipeline to catch up on missed events, so the interval
+// can be raised once events are on.
+func startIndexEvents(ctx context.Context, rdb *redis.Client) error {
+	pattern := os.Getenv("INDEX_EVENTS_CHANNELS")
+	if pattern == "" {
+		return nil
+	}
+
+	client := rdb
+	if url := os.Getenv("INDEX_EVENTS_REDIS_URL"); url != "" {
+		client = redis.NewClient(&redis.Options{
+			Addr: url,
+		})
+	}
+
+	pubsub := client.PSubscribe(ctx, pattern)
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return err
+	}
+	indexerLog.Info("indexing on events", "channels", pattern)
+
+	go listenIndexEvents(ctx, pubsub)
+	return nil
+}
+
+func listenIndexEvents(ctx context.Context, pubsub *redis.PubSub) {
+	defer pubsub.Close()
+
+	events := pubsub.Channel()
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			metrics.add("index_events_total", nil, 1)
+			if pending == nil {
+				pending = time.After(indexEventDelay)
+			}
+		case <-pending:
+			pending = nil
+			for _, p := range getPipelines() {
+				p.notified.Store(true)
+				jobs.runNow("index_" + p.name)
+			}
+		}
+	}
+}
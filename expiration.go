@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseExpiry reads an expiry time given as unix milliseconds or an RFC 3339 string.
+func parseExpiry(value any) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), v > 0
+	case string:
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return ms, ms > 0
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t.UnixMilli(), true
+		}
+	}
+	return 0, false
+}
+
+// expiresAt returns the expiry time of a message body declared at the Expires path of its
+// schema, or 0 when the message doesn't expire.
+func (m schemaMapping) expiresAt(body any) int64 {
+	if m.Expires == "" {
+		return 0
+	}
+	for _, value := range valuesAt(body, splitPath(m.Expires)) {
+		if ms, ok := parseExpiry(value); ok {
+			return ms
+		}
+	}
+	return 0
+}
+
+// notExpiredFilter leaves out the documents whose expiry time has passed, for the time
+// between their expiry and the next run of the expiration job.
+func notExpiredFilter(now time.Time) string {
+	return fmt.Sprintf("(expiresAt NOT EXISTS OR expiresAt > %d)", now.UnixMilli())
+}
+
+// purgeExpiredMessages deletes the messages whose expiry time has passed.
+func purgeExpiredMessages() error {
+	filter := fmt.Sprintf("expiresAt <= %d", time.Now().UnixMilli())
+
+	purged := 0
+	for _, index := range messageIndexes() {
+		ids, err := findDocuments(index, filter)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		_, err = index.DeleteDocuments(ids)
+		if err != nil {
+			return err
+		}
+		purged += len(ids)
+	}
+
+	if purged > 0 {
+		jobsLog.Info("deleted expired messages", "count", purged)
+	}
+	return nil
+}
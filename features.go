@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// featureEnrichment fetches OpenGraph previews of shared links at index time.
+	featureEnrichment = "enrichment"
+	// featureTrends computes and serves trending messages.
+	featureTrends = "trends"
+	// featureAutocomplete counts the hashtags and users seen while indexing and serves
+	// completions of them.
+	featureAutocomplete = "autocomplete"
+	// featureLive publishes the indexed messages to the live subscriptions.
+	featureLive = "live"
+)
+
+// featureDefaults lists every known feature flag with its built-in default.
+var featureDefaults = map[string]bool{
+	featureEnrichment:   false,
+	featureTrends:       true,
+	featureAutocomplete: false,
+	featureLive:         false,
+}
+
+const featureRefreshInterval = 10 * time.Second
+
+type featureState struct {
+	Name     string `json:"name"`
+	Default  bool   `json:"default"`
+	Override *bool  `json:"override,omitempty"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// featureFlags resolves flags from the configured defaults and the runtime overrides
+// stored in redis, so operators can toggle behaviors without a redeploy.
+type featureFlags struct {
+	rdb      *redis.Client
+	defaults map[string]bool
+
+	mu          sync.Mutex
+	overrides   map[string]bool
+	refreshedAt time.Time
+}
+
+var features *featureFlags
+
+// newFeatureFlags applies the FEATURES config (e.g. "enrichment,-trends") on top of the
+// built-in defaults.
+func newFeatureFlags(rdb *redis.Client, config string) *featureFlags {
+	defaults := maps.Clone(featureDefaults)
+
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		enabled := true
+		if name, found := strings.CutPrefix(entry, "-"); found {
+			entry = name
+			enabled = false
+		}
+		if _, ok := featureDefaults[entry]; !ok {
+			serverLog.Warn("unknown feature flag", "flag", entry)
+			continue
+		}
+		defaults[entry] = enabled
+	}
+
+	return &featureFlags{
+		rdb:       rdb,
+		defaults:  defaults,
+		overrides: map[string]bool{},
+	}
+}
+
+func (f *featureFlags) refresh(ctx context.Context) {
+	f.refreshedAt = time.Now()
+
+	values, err := f.rdb.HGetAll(ctx, "ccsearch:features").Result()
+	if err != nil {
+		reportError("features", err)
+		return
+	}
+
+	overrides := map[string]bool{}
+	for name, value := range values {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			continue
+		}
+		overrides[name] = enabled
+	}
+
+	f.overrides = overrides
+}
+
+func (f *featureFlags) enabled(ctx context.Context, name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.refreshedAt) > featureRefreshInterval {
+		f.refresh(ctx)
+	}
+
+	if enabled, ok := f.overrides[name]; ok {
+		return enabled
+	}
+	return f.defaults[name]
+}
+
+func (f *featureFlags) states(ctx context.Context) []featureState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refresh(ctx)
+
+	states := []featureState{}
+	for name, def := range f.defaults {
+		state := featureState{
+			Name:    name,
+			Default: def,
+			Enabled: def,
+		}
+		if enabled, ok := f.overrides[name]; ok {
+			state.Override = &enabled
+			state.Enabled = enabled
+		}
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b featureState) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return states
+}
+
+func (f *featureFlags) setOverride(ctx context.Context, name string, enabled *bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	if enabled == nil {
+		err = f.rdb.HDel(ctx, "ccsearch:features", name).Err()
+	} else {
+		err = f.rdb.HSet(ctx, "ccsearch:features", name, strconv.FormatBool(*enabled)).Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.refresh(ctx)
+	return nil
+}
+
+func setupFeatureRoutes(admin *echo.Group) {
+
+	admin.GET("/features", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": features.states(c.Request().Context())})
+	})
+
+	admin.PUT("/features/:name", func(c echo.Context) error {
+		name := c.Param("name")
+		if _, ok := featureDefaults[name]; !ok {
+			return respondFieldError(c, http.StatusNotFound, codeNotFound, "name", "unknown feature")
+		}
+
+		var request struct {
+			Enabled *bool `json:"enabled"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if request.Enabled == nil {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "enabled", "enabled is required")
+		}
+
+		err = features.setOverride(c.Request().Context(), name, request.Enabled)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		adminLog.Info("feature overridden", "feature", name, "enabled", *request.Enabled)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+
+	admin.DELETE("/features/:name", func(c echo.Context) error {
+		name := c.Param("name")
+		if _, ok := featureDefaults[name]; !ok {
+			return respondFieldError(c, http.StatusNotFound, codeNotFound, "name", "unknown feature")
+		}
+
+		err := features.setOverride(c.Request().Context(), name, nil)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		adminLog.Info("feature override cleared", "feature", name)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filterToken is a token of a Meilisearch filter expression. Quoted strings are marked,
+// so that "true" stays a string.
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("()[],", c) >= 0:
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '!' || c == '<' || c == '>' || c == '=':
+			if i+1 < len(filter) && filter[i+1] == '=' {
+				tokens = append(tokens, filterToken{text: filter[i : i+2]})
+				i += 2
+			} else {
+				tokens = append(tokens, filterToken{text: string(c)})
+				i++
+			}
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(filter) && filter[end] != c {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter %q", filter)
+			}
+			value := filter[i+1 : end]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(filter[i : end+1])
+				if err == nil {
+					value = unquoted
+				}
+			}
+			tokens = append(tokens, filterToken{text: value, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !unicode.IsSpace(rune(filter[end])) && strings.IndexByte("()[],!<>=\"'", filter[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: filter[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// filterNode is a parsed filter expression, which the backends translate into their own
+// queries. The leaves compare an attribute: equal to value, within the bounds of a
+// range (gt, gte, lt, lte), or present at all. An or without children matches nothing,
+// an and without children everything.
+type filterNode struct {
+	kind      string
+	children  []*filterNode
+	attribute string
+	value     any
+	bounds    map[string]any
+	// args are latitude, longitude and radius in meters of geoRadius, and the top right
+	// and bottom left corners of geoBoundingBox.
+	args []float64
+}
+
+const (
+	filterAnd            = "and"
+	filterOr             = "or"
+	filterNot            = "not"
+	filterEqual          = "equal"
+	filterRange          = "range"
+	filterExists         = "exists"
+	filterGeoRadius      = "geoRadius"
+	filterGeoBoundingBox = "geoBoundingBox"
+)
+
+// filterParser parses a Meilisearch filter expression.
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseFilter parses the filter of a search or a documents query: a string, or an array
+// whose elements are ANDed, with nested arrays ORed. An empty filter is nil.
+func parseFilter(filter any) (*filterNode, error) {
+	switch filter := filter.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if strings.TrimSpace(filter) == "" {
+			return nil, nil
+		}
+		tokens, err := tokenizeFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		parser := &filterParser{tokens: tokens}
+		node, err := parser.or()
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+		}
+		if parser.pos < len(tokens) {
+			return nil, fmt.Errorf("invalid filter %q: unexpected %q", filter, tokens[parser.pos].text)
+		}
+		return node, nil
+	case []string:
+		elements := []any{}
+		for _, element := range filter {
+			elements = append(elements, element)
+		}
+		return parseFilter(elements)
+	case [][]string:
+		elements := []any{}
+		for _, group := range filter {
+			alternatives := []any{}
+			for _, element := range group {
+				alternatives = append(alternatives, element)
+			}
+			elements = append(elements, alternatives)
+		}
+		return parseFilter(elements)
+	case []any:
+		clauses := []*filterNode{}
+		for _, element := range filter {
+			var node *filterNode
+			var err error
+			if group, ok := element.([]any); ok {
+				alternatives := []*filterNode{}
+				for _, alternative := range group {
+					node, err = parseFilter(alternative)
+					if err != nil {
+						return nil, err
+					}
+					if node != nil {
+						alternatives = append(alternatives, node)
+					}
+				}
+				node = combineFilters(filterOr, alternatives)
+			} else {
+				node, err = parseFilter(element)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if node != nil {
+				clauses = append(clauses, node)
+			}
+		}
+		if len(clauses) == 0 {
+			return nil, nil
+		}
+		return combineFilters(filterAnd, clauses), nil
+	}
+	return nil, fmt.Errorf("unsupported filter of type %T", filter)
+}
+
+// combineFilters joins the clauses with and or or, leaving a single clause as it is.
+func combineFilters(kind string, clauses []*filterNode) *filterNode {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return &filterNode{kind: kind, children: clauses}
+}
+
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, fmt.Errorf("unexpected end")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	return token, nil
+}
+
+func (p *filterParser) expect(text string) error {
+	token, err := p.next()
+	if err != nil {
+		return err
+	}
+	if token.quoted || token.text != text {
+		return fmt.Errorf("expected %q, got %q", text, token.text)
+	}
+	return nil
+}
+
+func (p *filterParser) or() (*filterNode, error) {
+	clauses := []*filterNode{}
+	for {
+		clause, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+		if p.peek() != "OR" {
+			return combineFilters(filterOr, clauses), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *filterParser) and() (*filterNode, error) {
+	clauses := []*filterNode{}
+	for {
+		clause, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+		if p.peek() != "AND" {
+			return combineFilters(filterAnd, clauses), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *filterParser) not() (*filterNode, error) {
+	if p.peek() == "NOT" {
+		p.pos++
+		clause, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNode{kind: filterNot, children: []*filterNode{clause}}, nil
+	}
+	if p.peek() == "(" {
+		p.pos++
+		clause, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return clause, p.expect(")")
+	}
+	return p.condition()
+}
+
+func (p *filterParser) numbers(count int) ([]float64, error) {
+	numbers := []float64{}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			err := p.expect(",")
+			if err != nil {
+				return nil, err
+			}
+		}
+		token, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number, got %q", token.text)
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
+
+func (p *filterParser) point() ([]float64, error) {
+	err := p.expect("[")
+	if err != nil {
+		return nil, err
+	}
+	coords, err := p.numbers(2)
+	if err != nil {
+		return nil, err
+	}
+	return coords, p.expect("]")
+}
+
+func (p *filterParser) condition() (*filterNode, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	attribute := token.text
+
+	switch attribute {
+	case "_geoRadius":
+		err := p.expect("(")
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.numbers(3)
+		if err != nil {
+			return nil, err
+		}
+		return &filterNode{kind: filterGeoRadius, args: args}, p.expect(")")
+	case "_geoBoundingBox":
+		err := p.expect("(")
+		if err != nil {
+			return nil, err
+		}
+		topRight, err := p.point()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+		bottomLeft, err := p.point()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNode{kind: filterGeoBoundingBox, args: append(topRight, bottomLeft...)}, p.expect(")")
+	}
+
+	operator, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	negate := false
+	if !operator.quoted && operator.text == "NOT" {
+		negate = true
+		operator, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var node *filterNode
+	switch operator.text {
+	case "EXISTS":
+		node = &filterNode{kind: filterExists, attribute: attribute}
+	case "IN":
+		err := p.expect("[")
+		if err != nil {
+			return nil, err
+		}
+		clauses := []*filterNode{}
+		for p.peek() != "]" {
+			if len(clauses) > 0 {
+				err := p.expect(",")
+				if err != nil {
+					return nil, err
+				}
+			}
+			value, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, &filterNode{kind: filterEqual, attribute: attribute, value: filterValue(value)})
+		}
+		p.pos++
+		node = combineFilters(filterOr, clauses)
+		if len(clauses) == 0 {
+			node = &filterNode{kind: filterOr}
+		}
+	case "=", "!=":
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		node = &filterNode{kind: filterEqual, attribute: attribute, value: filterValue(value)}
+		if operator.text == "!=" {
+			negate = !negate
+		}
+	case ">", ">=", "<", "<=":
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		bound := map[string]string{">": "gt", ">=": "gte", "<": "lt", "<=": "lte"}[operator.text]
+		node = &filterNode{kind: filterRange, attribute: attribute, bounds: map[string]any{bound: filterValue(value)}}
+	default:
+		// attribute low TO high
+		if operator.quoted {
+			return nil, fmt.Errorf("expected an operator after %s, got %q", attribute, operator.text)
+		}
+		low := operator
+		err := p.expect("TO")
+		if err != nil {
+			return nil, fmt.Errorf("unsupported operator %q", operator.text)
+		}
+		high, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		node = &filterNode{kind: filterRange, attribute: attribute, bounds: map[string]any{"gte": filterValue(low), "lte": filterValue(high)}}
+	}
+
+	if negate {
+		return &filterNode{kind: filterNot, children: []*filterNode{node}}, nil
+	}
+	return node, nil
+}
+
+// filterValue reads an unquoted number or boolean, and leaves anything else a string.
+func filterValue(token filterToken) any {
+	if token.quoted {
+		return token.text
+	}
+	if number, err := strconv.ParseFloat(token.text, 64); err == nil {
+		return number
+	}
+	switch token.text {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return token.text
+}
+
+// parseSort parses a sort rule, attribute:asc or _geoPoint(lat, lng):asc, returning the
+// point of a _geoPoint rule.
+func parseSort(rule string) (string, []float64, string, error) {
+	colon := strings.LastIndex(rule, ":")
+	if colon < 0 {
+		return "", nil, "", fmt.Errorf("invalid sort %q", rule)
+	}
+	attribute, order := strings.TrimSpace(rule[:colon]), rule[colon+1:]
+	if order != "asc" && order != "desc" {
+		return "", nil, "", fmt.Errorf("invalid sort %q", rule)
+	}
+
+	if point, ok := strings.CutPrefix(attribute, "_geoPoint("); ok {
+		coords := strings.Split(strings.TrimSuffix(point, ")"), ",")
+		if len(coords) != 2 {
+			return "", nil, "", fmt.Errorf("invalid sort %q", rule)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("invalid sort %q", rule)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("invalid sort %q", rule)
+		}
+		return attribute, []float64{lat, lng}, order, nil
+	}
+	return attribute, nil, order, nil
+}
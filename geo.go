@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// geoContainers are the body keys that check-in style schemas use to nest coordinates.
+var geoContainers = []string{"location", "geo", "coordinates", "position"}
+
+// extractGeo looks for coordinates either at the top level of a message body
+// or inside one of the well-known containers.
+func extractGeo(body any) *geoPoint {
+	fields, ok := body.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	if point := geoFromMap(fields); point != nil {
+		return point
+	}
+
+	for _, key := range geoContainers {
+		nested, ok := fields[key].(map[string]any)
+		if !ok {
+			continue
+		}
+		if point := geoFromMap(nested); point != nil {
+			return point
+		}
+	}
+
+	return nil
+}
+
+func geoFromMap(fields map[string]any) *geoPoint {
+	lat, ok := geoNumber(fields, "lat", "latitude")
+	if !ok {
+		return nil
+	}
+	lng, ok := geoNumber(fields, "lng", "lon", "long", "longitude")
+	if !ok {
+		return nil
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil
+	}
+	return &geoPoint{Lat: lat, Lng: lng}
+}
+
+func geoNumber(fields map[string]any, keys ...string) (float64, bool) {
+	for _, key := range keys {
+		switch v := fields[key].(type) {
+		case float64:
+			return v, true
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				return f, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// geoFilters builds the Meilisearch geo filters from the `lat`, `lng`, `radius`
+// and `bbox` (topRightLat,topRightLng,bottomLeftLat,bottomLeftLng) query parameters.
+func geoFilters(c echo.Context) ([]string, error) {
+	filters := []string{}
+
+	latStr, lngStr, radiusStr := c.QueryParam("lat"), c.QueryParam("lng"), c.QueryParam("radius")
+	if latStr != "" || lngStr != "" || radiusStr != "" {
+		if latStr == "" || lngStr == "" || radiusStr == "" {
+			return nil, errors.New("lat, lng and radius must be given together")
+		}
+		lat, err := strconv.ParseFloat(latStr, 64)
+		if err != nil || lat < -90 || lat > 90 {
+			return nil, errors.New("invalid lat")
+		}
+		lng, err := strconv.ParseFloat(lngStr, 64)
+		if err != nil || lng < -180 || lng > 180 {
+			return nil, errors.New("invalid lng")
+		}
+		radius, err := strconv.ParseFloat(radiusStr, 64)
+		if err != nil || radius <= 0 {
+			return nil, errors.New("invalid radius")
+		}
+		filters = append(filters, fmt.Sprintf("_geoRadius(%f, %f, %f)", lat, lng, radius))
+	}
+
+	bboxStr := c.QueryParam("bbox")
+	if bboxStr != "" {
+		parts := strings.Split(bboxStr, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("bbox must be topRightLat,topRightLng,bottomLeftLat,bottomLeftLng")
+		}
+		coords := make([]float64, 4)
+		for i, part := range parts {
+			coord, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, errors.New("invalid bbox")
+			}
+			coords[i] = coord
+		}
+		filters = append(filters, fmt.Sprintf("_geoBoundingBox([%f, %f], [%f, %f])", coords[0], coords[1], coords[2], coords[3]))
+	}
+
+	return filters, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultHashtagWindow = 24 * time.Hour
+	maxHashtagWindow     = 7 * 24 * time.Hour
+	// hashtagCountsTTL keeps the hourly counts of two of the longest windows, the current
+	// one and the one it is compared with.
+	hashtagCountsTTL   = 2*maxHashtagWindow + time.Hour
+	hashtagTrendsLimit = 100
+	hashtagHourLayout  = "2006010215"
+)
+
+type trendingHashtag struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+	// Delta is the change from the window before, e.g. the 24 hours before the last 24.
+	Delta int64 `json:"delta"`
+}
+
+func hashtagCountsKey(hour time.Time) string {
+	return "ccsearch:hashtags:" + hour.UTC().Format(hashtagHourLayout)
+}
+
+// recordHashtags counts the hashtags of the indexed messages in the hour they were signed.
+// Messages older than the counts kept, e.g. while backfilling, are not counted.
+func recordHashtags(ctx context.Context, rdb *redis.Client, records []messageRecord) {
+	now := time.Now()
+	oldest := now.Add(-hashtagCountsTTL)
+	pipe := rdb.Pipeline()
+	keys := map[string]bool{}
+	for _, record := range records {
+		if len(record.Hashtags) == 0 || record.Hidden || record.Spam || record.Flagged || record.Restricted {
+			continue
+		}
+		signedAt := time.UnixMilli(record.SignedAt)
+		if signedAt.Before(oldest) {
+			continue
+		}
+		if signedAt.After(now) {
+			signedAt = now
+		}
+		key := hashtagCountsKey(signedAt)
+		for _, tag := range record.Hashtags {
+			pipe.ZIncrBy(ctx, key, 1, tag)
+		}
+		keys[key] = true
+	}
+	if len(keys) == 0 {
+		return
+	}
+	for key := range keys {
+		pipe.Expire(ctx, key, hashtagCountsTTL)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		reportError("trends", err)
+	}
+}
+
+// countHashtags sums the hourly counts of the window ending at end.
+func countHashtags(ctx context.Context, rdb *redis.Client, end time.Time, window time.Duration) (map[string]int64, error) {
+	keys := []string{}
+	for hour := end.Truncate(time.Hour); hour.After(end.Add(-window)); hour = hour.Add(-time.Hour) {
+		keys = append(keys, hashtagCountsKey(hour))
+	}
+	counts, err := rdb.ZUnionWithScores(ctx, redis.ZStore{Keys: keys}).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]int64{}
+	for _, count := range counts {
+		result[count.Member.(string)] = int64(count.Score)
+	}
+	return result, nil
+}
+
+// getHashtagTrends returns the hashtags used the most in the window up to now, with the
+// change from the window before.
+func getHashtagTrends(ctx context.Context, rdb *redis.Client, window time.Duration) ([]trendingHashtag, error) {
+	now := time.Now()
+	current, err := countHashtags(ctx, rdb, now, window)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := countHashtags(ctx, rdb, now.Add(-window), window)
+	if err != nil {
+		return nil, err
+	}
+
+	trends := []trendingHashtag{}
+	for tag, count := range current {
+		trends = append(trends, trendingHashtag{Tag: tag, Count: count, Delta: count - previous[tag]})
+	}
+	slices.SortFunc(trends, func(a, b trendingHashtag) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(b.Delta, a.Delta), cmp.Compare(a.Tag, b.Tag))
+	})
+	if len(trends) > hashtagTrendsLimit {
+		trends = trends[:hashtagTrendsLimit]
+	}
+	return trends, nil
+}
+
+// hashtagTrendsHandler serves GET /v1/trends/hashtags?window=24h. The window is a whole
+// number of hours, up to a week.
+func hashtagTrendsHandler(rdb *redis.Client) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !features.enabled(c.Request().Context(), featureTrends) {
+			return respondError(c, http.StatusNotFound, codeFeatureDisabled, "trends are disabled")
+		}
+
+		window := defaultHashtagWindow
+		if value := c.QueryParam("window"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < time.Hour || parsed > maxHashtagWindow || parsed%time.Hour != 0 {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "window", "window must be a whole number of hours up to 168h")
+			}
+			window = parsed
+		}
+
+		limit := 20
+		if value := c.QueryParam("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "limit", "limit must be a positive integer")
+			}
+			limit = min(parsed, hashtagTrendsLimit)
+		}
+
+		trends, err := getHashtagTrends(c.Request().Context(), rdb, window)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		if len(trends) > limit {
+			trends = trends[:limit]
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": trends, "window": strconv.Itoa(int(window.Hours())) + "h"})
+	}
+}
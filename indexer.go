@@ -0,0 +1,1394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/cdid"
+	"github.com/totegamma/concurrent/core"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// batchTransformer turns the commits of one batch into documents for a pipeline's index.
+type batchTransformer interface {
+	// add is called for every commit of the batch, in commit order. It returns the
+	// reason the commit was left out of the index, if it was.
+	add(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cdidBase string) (string, error)
+	documents(ctx context.Context) []documentSet
+	// commitOf returns the ID of the commit a document of the batch was built from.
+	commitOf(id string) (uint, bool)
+	// finish is called once the documents of the batch have been written to the index.
+	finish(ctx context.Context)
+}
+
+// commitDecoder is implemented by the transformers with work that doesn't depend on the
+// other commits of the batch. decode runs on the transform workers, concurrently and in
+// any order, before add is called in commit order.
+type commitDecoder interface {
+	decode(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cdidBase string)
+}
+
+// threadRebaser is implemented by the transformers whose documents point to the root of
+// their thread. The backfill transforms its ranges alongside each other, so a reply to a
+// message of an earlier range finds neither the batch nor the index holding it, and is
+// resolved again against the earlier ranges before it is written.
+type threadRebaser interface {
+	// roots returns the thread root of every message of the batch, by ID.
+	roots() map[string]string
+	// rebaseThreads replaces the roots that are messages of the earlier ranges with their
+	// own roots, which are final.
+	rebaseThreads(earlier map[string]string)
+}
+
+// batchApplier is implemented by the transformers that update documents already in the
+// index, once the documents of the batch are written. An error fails the batch before
+// the cursor moves, so that the updates are applied again with its retry.
+type batchApplier interface {
+	apply(ctx context.Context) error
+}
+
+// applyBatch runs the updates of a batch that has any.
+func applyBatch(ctx context.Context, batch batchTransformer) error {
+	if applier, ok := batch.(batchApplier); ok {
+		return applier.apply(ctx)
+	}
+	return nil
+}
+
+// documentSet is a group of documents bound for the same index, and the IDs of the
+// documents to remove from it.
+type documentSet struct {
+	index     searchIndex
+	documents []any
+	deletions []string
+}
+
+// transformerSpec describes one kind of transformation a pipeline can apply,
+// along with the index settings its documents need and the type of the documents it
+// indexes.
+type transformerSpec struct {
+	newBatch     func(p *pipeline) batchTransformer
+	settings     indexSettings
+	documentType string
+}
+
+var transformers = map[string]transformerSpec{
+	"messages": {
+		newBatch:     newMessageBatch,
+		settings:     messageSettings,
+		documentType: "message",
+	},
+	"profiles": {
+		newBatch:     newProfileBatch,
+		settings:     profileSettings,
+		documentType: "profile",
+	},
+	"timelines": {
+		newBatch:     newTimelineBatch,
+		settings:     timelineIndexSettings,
+		documentType: "timeline",
+	},
+}
+
+// pipeline reads the commit log from its own checkpoint and feeds one index.
+type pipeline struct {
+	name      string
+	transform string
+	indexUID  string
+	interval  time.Duration
+	cursorKey string
+
+	db    *gorm.DB
+	rdb   *redis.Client
+	index searchIndex
+
+	running   int32
+	lastBatch atomic.Pointer[batchStatus]
+	// indexed counts the documents written in the last hour.
+	indexed hourlyCounter
+	// notified is set when an event announces new commits; see startIndexEvents.
+	notified atomic.Bool
+
+	skippedMu sync.Mutex
+	skipped   map[skipKey]int64
+}
+
+var (
+	pipelinesMu sync.Mutex
+	pipelines   []*pipeline
+)
+
+// The pace of the indexer: commits read per batch, the interval at which a pipeline checks
+// for new commits, the pause between the batches of a pipeline catching up, and the
+// commits of a batch transformed at once.
+var (
+	indexBatchSize        = 512
+	indexPollInterval     = 10 * time.Second
+	indexBatchDelay       = time.Second
+	indexTransformWorkers = runtime.GOMAXPROCS(0)
+	// indexTaskTimeout bounds the wait for the engine to apply the writes of a batch.
+	indexTaskTimeout = time.Minute
+)
+
+const (
+	maxIndexBatchSize        = 10000
+	maxIndexTransformWorkers = 64
+)
+
+// loadIndexerPace reads INDEX_BATCH_SIZE, INDEX_POLL_INTERVAL, INDEX_BATCH_DELAY,
+// INDEX_TRANSFORM_WORKERS and INDEX_TASK_TIMEOUT.
+func loadIndexerPace() error {
+	if value := os.Getenv("INDEX_BATCH_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > maxIndexBatchSize {
+			return fmt.Errorf("invalid INDEX_BATCH_SIZE: %s (expected 1 to %d)", value, maxIndexBatchSize)
+		}
+		indexBatchSize = size
+	}
+	if value := os.Getenv("INDEX_POLL_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < time.Second {
+			return fmt.Errorf("invalid INDEX_POLL_INTERVAL: %s (expected at least 1s)", value)
+		}
+		indexPollInterval = interval
+	}
+	if value := os.Getenv("INDEX_BATCH_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("invalid INDEX_BATCH_DELAY: %s", value)
+		}
+		indexBatchDelay = delay
+	}
+	if value := os.Getenv("INDEX_TRANSFORM_WORKERS"); value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 1 || workers > maxIndexTransformWorkers {
+			return fmt.Errorf("invalid INDEX_TRANSFORM_WORKERS: %s (expected 1 to %d)", value, maxIndexTransformWorkers)
+		}
+		indexTransformWorkers = workers
+	}
+	if value := os.Getenv("INDEX_TASK_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid INDEX_TASK_TIMEOUT: %s", value)
+		}
+		indexTaskTimeout = timeout
+	}
+	return nil
+}
+
+// parsePipelines reads the PIPELINES config: entries separated by ';', each
+// `name:transform:index[:interval]`. Without config a single "messages" pipeline feeds
+// MEILISEARCH_IDX, keeping the original checkpoint key.
+func parsePipelines(config string, defaultIndex string) ([]*pipeline, error) {
+	if strings.TrimSpace(config) == "" {
+		return []*pipeline{{
+			name:      "messages",
+			transform: "messages",
+			indexUID:  defaultIndex,
+			interval:  indexPollInterval,
+			cursorKey: "ccsearch:readitr",
+		}}, nil
+	}
+
+	result := []*pipeline{}
+	for _, entry := range strings.Split(config, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid pipeline %q: expected name:transform:index[:interval]", entry)
+		}
+
+		p := &pipeline{
+			name:      parts[0],
+			transform: parts[1],
+			indexUID:  parts[2],
+			interval:  indexPollInterval,
+			cursorKey: "ccsearch:readitr:" + parts[0],
+		}
+		if p.name == "messages" {
+			p.cursorKey = "ccsearch:readitr"
+		}
+		if _, ok := transformers[p.transform]; !ok {
+			return nil, fmt.Errorf("invalid pipeline %q: unknown transform %q", entry, p.transform)
+		}
+		if len(parts) == 4 {
+			interval, err := time.ParseDuration(parts[3])
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid pipeline %q: bad interval", entry)
+			}
+			p.interval = interval
+		}
+		for _, other := range result {
+			if other.name == p.name {
+				return nil, fmt.Errorf("duplicate pipeline name %q", p.name)
+			}
+		}
+
+		result = append(result, p)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no pipelines configured")
+	}
+
+	return result, nil
+}
+
+func getPipelines() []*pipeline {
+	pipelinesMu.Lock()
+	defer pipelinesMu.Unlock()
+
+	return pipelines
+}
+
+// transformIndex returns the index of the first pipeline with the transform, if there
+// is one.
+func transformIndex(transform string) searchIndex {
+	for _, p := range getPipelines() {
+		if p.transform == transform {
+			return p.index
+		}
+	}
+	return nil
+}
+
+func getPipeline(name string) *pipeline {
+	for _, p := range getPipelines() {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func isIndexerRunning() bool {
+	for _, p := range getPipelines() {
+		if p.isRunning() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pipeline) isRunning() bool {
+	return atomic.LoadInt32(&p.running) == 1
+}
+
+type pipelineStatus struct {
+	Name       string       `json:"name"`
+	Transform  string       `json:"transform"`
+	Index      string       `json:"index"`
+	Running    bool         `json:"running"`
+	Checkpoint uint         `json:"checkpoint"`
+	Lag        uint         `json:"lag"`
+	LastBatch  *batchStatus `json:"lastBatch,omitempty"`
+	// IndexedLastHour counts the documents this instance wrote in the last hour.
+	IndexedLastHour int64  `json:"indexedLastHour"`
+	Error           string `json:"error,omitempty"`
+	// Skipped counts the commits left out of the index since startup.
+	Skipped []skipCount `json:"skipped"`
+}
+
+// pipelineStatuses reports the progress of every pipeline against the latest commit ID.
+func pipelineStatuses(ctx context.Context, latest uint) []pipelineStatus {
+	statuses := []pipelineStatus{}
+	for _, p := range getPipelines() {
+		status := pipelineStatus{
+			Name:      p.name,
+			Transform: p.transform,
+			Index:     p.indexUID,
+			Running:   p.isRunning(),
+			LastBatch: p.lastBatch.Load(),
+			Skipped:   p.skipCounts(),
+		}
+		status.IndexedLastHour = p.indexed.total(time.Now())
+		cursor, err := p.getCursor(ctx)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		status.Checkpoint = cursor
+		if latest > cursor {
+			status.Lag = latest - cursor
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (p *pipeline) recordBatch(duration time.Duration, commits, documents int, cursor uint) {
+	labels := map[string]string{"pipeline": p.name}
+	metrics.add("indexed_commits_total", labels, float64(commits))
+	metrics.add("indexed_documents_total", labels, float64(documents))
+	metrics.observe("indexer_batch_duration_seconds", labels, duration.Seconds())
+	p.indexed.add(time.Now(), int64(documents))
+
+	p.lastBatch.Store(&batchStatus{
+		FinishedAt: time.Now(),
+		DurationMs: duration.Milliseconds(),
+		Commits:    commits,
+		Documents:  documents,
+		Cursor:     cursor,
+	})
+}
+
+func (p *pipeline) getCursor(ctx context.Context) (uint, error) {
+	cursorStr, err := p.rdb.Get(ctx, p.cursorKey).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := strconv.ParseUint(cursorStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(cursor), nil
+}
+
+// resetCursor starts the pipeline over from the first commit. The reindex marker lets
+// whichever replica runs the pipeline announce when it has caught up again.
+func (p *pipeline) resetCursor(ctx context.Context) error {
+	_, err := p.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, p.cursorKey, 0, 0)
+		pipe.Set(ctx, p.reindexKey(), time.Now().Unix(), 0)
+		return nil
+	})
+	return err
+}
+
+func (p *pipeline) reindexKey() string {
+	return "ccsearch:reindexing:" + p.name
+}
+
+// reindexStatus is the progress of a pipeline through the commit log. Commits are counted
+// by ID, which is close enough for an estimate.
+type reindexStatus struct {
+	Pipeline         string  `json:"pipeline"`
+	Index            string  `json:"index"`
+	Reindexing       bool    `json:"reindexing"`
+	StartedAt        int64   `json:"startedAt,omitempty"`
+	Cursor           uint    `json:"cursor"`
+	Latest           uint    `json:"latest"`
+	Processed        uint    `json:"processed"`
+	Remaining        uint    `json:"remaining"`
+	Progress         float64 `json:"progress"`
+	CommitsPerSecond float64 `json:"commitsPerSecond,omitempty"`
+	ETASeconds       *int64  `json:"etaSeconds,omitempty"`
+}
+
+// reindexStatus reports how far the pipeline is from the latest commit. During a reindex
+// the rate since the reset gives an ETA.
+func (p *pipeline) reindexStatus(ctx context.Context, latest uint) (reindexStatus, error) {
+	status := reindexStatus{
+		Pipeline: p.name,
+		Index:    p.indexUID,
+		Latest:   latest,
+		Progress: 1,
+	}
+
+	cursor, err := p.getCursor(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.Cursor = cursor
+	status.Processed = cursor
+	if latest > cursor {
+		status.Remaining = latest - cursor
+	}
+	if latest > 0 {
+		status.Progress = min(float64(cursor)/float64(latest), 1)
+	}
+
+	startedAt, err := p.rdb.Get(ctx, p.reindexKey()).Int64()
+	if err == redis.Nil {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	status.Reindexing = true
+	status.StartedAt = startedAt
+
+	elapsed := time.Since(time.Unix(startedAt, 0)).Seconds()
+	if elapsed > 0 && cursor > 0 {
+		status.CommitsPerSecond = float64(cursor) / elapsed
+		eta := int64(float64(status.Remaining) / status.CommitsPerSecond)
+		status.ETASeconds = &eta
+	}
+	return status, nil
+}
+
+// finishReindex announces the end of a reindex, if one was in progress.
+func (p *pipeline) finishReindex(ctx context.Context, cursor uint) {
+	startedAt, err := p.rdb.GetDel(ctx, p.reindexKey()).Int64()
+	if err == redis.Nil {
+		return
+	}
+	if err != nil {
+		reportError("indexer", err)
+		return
+	}
+
+	indexerLog.Info("reindex completed", "pipeline", p.name)
+	webhooks.notify(ctx, eventReindexCompleted, map[string]any{
+		"pipeline":        p.name,
+		"index":           p.indexUID,
+		"cursor":          cursor,
+		"durationSeconds": time.Now().Unix() - startedAt,
+	})
+}
+
+// run indexes every commit after the pipeline checkpoint, one page at a time. When the
+// context is done, the batch in progress is still written and checkpointed before run
+// returns.
+func (p *pipeline) run(stop context.Context) {
+	ctx := context.WithoutCancel(stop)
+
+	if atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		defer atomic.StoreInt32(&p.running, 0)
+	} else {
+		return
+	}
+
+	lastKeyStr, err := p.rdb.Get(ctx, p.cursorKey).Result()
+	if err != nil {
+		indexerLog.Info("cursor not found, starting from the first commit", "pipeline", p.name)
+		lastKeyStr = "0"
+	}
+
+	lastKey64, err := strconv.ParseUint(lastKeyStr, 10, 64)
+	if err != nil {
+		indexerLog.Warn("cursor is not an integer, starting from the first commit", "pipeline", p.name, "cursor", lastKeyStr)
+		lastKey64 = 0
+	}
+
+	lastKey := uint(lastKey64)
+
+	pageSize := indexBatchSize
+
+	for {
+		if stop.Err() != nil {
+			indexerLog.Info("stopped", "pipeline", p.name, "cursor", lastKey)
+			break
+		}
+		if maintenance.get(ctx).IndexerPaused {
+			indexerLog.Info("indexer is paused")
+			break
+		}
+		if !leading() {
+			indexerLog.Warn("lost leadership, stopping", "pipeline", p.name, "cursor", lastKey)
+			break
+		}
+
+		if backfillWorkers > 1 {
+			latest, err := getLatestCommitID(p.db)
+			if err != nil {
+				reportError("indexer", err)
+				break
+			}
+			if latest > lastKey && latest-lastKey > uint(backfillWorkers*pageSize) {
+				lastKey, err = p.backfill(ctx, lastKey, latest, pageSize)
+				if errors.Is(err, errLostLeadership) {
+					indexerLog.Warn("lost leadership, stopping", "pipeline", p.name, "cursor", lastKey)
+					break
+				}
+				if err != nil {
+					reportError("indexer", err)
+					break
+				}
+				continue
+			}
+		}
+
+		p.notified.Store(false)
+
+		commits, next, err := p.indexBatch(ctx, lastKey, pageSize)
+		if err != nil {
+			reportError("indexer", err)
+			break
+		}
+
+		if commits == 0 {
+			p.finishReindex(ctx, lastKey)
+			if p.notified.Load() {
+				continue
+			}
+			break
+		}
+		lastKey = next
+
+		if commits < pageSize { // no more commits
+			p.finishReindex(ctx, lastKey)
+			// an event that came in during the batch may be about a commit it missed
+			if p.notified.Load() {
+				continue
+			}
+			break
+		}
+
+		select {
+		case <-stop.Done():
+		case <-time.After(indexBatchDelay):
+		}
+	}
+}
+
+// indexBatch indexes the page of commits after lastKey and moves the cursor past them. It
+// returns the number of commits and the ID of the last one.
+func (p *pipeline) indexBatch(ctx context.Context, lastKey uint, pageSize int) (int, uint, error) {
+	ctx, span := tracer.Start(ctx, "indexer batch", trace.WithAttributes(
+		attribute.String("pipeline", p.name),
+		attribute.Int64("after", int64(lastKey)),
+	))
+	defer span.End()
+	batchStart := time.Now()
+
+	var commits []core.CommitLog
+	p.db.WithContext(ctx).Where("id > ?", lastKey).Limit(pageSize).Find(&commits)
+	indexerLog.Debug("fetched commits", "pipeline", p.name, "after", lastKey, "count", len(commits))
+	span.SetAttributes(attribute.Int("commits", len(commits)))
+	if len(commits) == 0 {
+		return 0, lastKey, nil
+	}
+
+	batch := transformers[p.transform].newBatch(p)
+	lastKey = p.transformCommits(ctx, batch, commits)
+
+	documents, err := p.writeBatch(ctx, batch, batch.documents(ctx), commits)
+	if err == nil {
+		err = applyBatch(ctx, batch)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, lastKey, err
+	}
+	span.SetAttributes(attribute.Int("documents", documents))
+
+	batch.finish(ctx)
+
+	p.rdb.Set(ctx, p.cursorKey, lastKey, 0)
+	indexerLog.Info("indexed", "pipeline", p.name, "cursor", lastKey, "commits", len(commits), "documents", documents)
+	p.recordBatch(time.Since(batchStart), len(commits), documents, lastKey)
+	return len(commits), lastKey, nil
+}
+
+// transformCommits adds the commits to the batch, dead-lettering the ones that fail and
+// recording the skipped ones. It returns the ID of the last commit.
+//
+// The filters, and the decode step of the transformers that have one, run on
+// indexTransformWorkers goroutines, as they mostly wait on redis, the database and link
+// previews. The commits are then added one by one in commit order, so a batch comes out
+// the same as when transformed serially.
+func (p *pipeline) transformCommits(ctx context.Context, batch batchTransformer, commits []core.CommitLog) uint {
+	checked := make([]checkedCommit, len(commits))
+	decoder, _ := batch.(commitDecoder)
+
+	positions := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(indexTransformWorkers, len(commits)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for position := range positions {
+				commit := commits[position]
+				result := p.check(ctx, commit)
+				if decoder != nil && result.skip == "" && result.err == nil {
+					decoder.decode(ctx, commit, result.doc, result.cdidBase)
+				}
+				checked[position] = result
+			}
+		}()
+	}
+	for position := range commits {
+		positions <- position
+	}
+	close(positions)
+	wg.Wait()
+
+	for i, commit := range commits {
+		doc, skip, err := p.addChecked(ctx, batch, commit, checked[i])
+		if err != nil {
+			reportError("indexer", err)
+			p.deadLetter(ctx, commit, doc, err)
+			continue
+		}
+		if skip != "" {
+			p.recordSkipped(commit.ID, doc.Type, doc.Schema, skip, commit.Document)
+		}
+	}
+	return commits[len(commits)-1].ID
+}
+
+// commitCDID derives the ID of the document of a commit, as the concurrent node does.
+func commitCDID(document string, signedAt time.Time) string {
+	hash := core.GetHash([]byte(document))
+	hash10 := [10]byte{}
+	copy(hash10[:], hash[:10])
+	return cdid.New(hash10, signedAt).String()
+}
+
+// checkedCommit is a commit decoded and checked against the indexing filters.
+type checkedCommit struct {
+	doc      core.DocumentBase[any]
+	cdidBase string
+	skip     string
+	err      error
+}
+
+// prepare checks a commit against the indexing filters and adds it to the batch. It
+// returns the decoded document and the reason the commit was skipped, if it was.
+func (p *pipeline) prepare(ctx context.Context, batch batchTransformer, commit core.CommitLog) (core.DocumentBase[any], string, error) {
+	return p.addChecked(ctx, batch, commit, p.check(ctx, commit))
+}
+
+// addChecked adds a checked commit to the batch, unless it was skipped.
+func (p *pipeline) addChecked(ctx context.Context, batch batchTransformer, commit core.CommitLog, checked checkedCommit) (core.DocumentBase[any], string, error) {
+	if checked.err != nil || checked.skip != "" {
+		return checked.doc, checked.skip, checked.err
+	}
+
+	skip, err := batch.add(ctx, commit, checked.doc, checked.cdidBase)
+	if err != nil {
+		return checked.doc, "", err
+	}
+
+	indexerLog.Debug("processed commit", "pipeline", p.name, "commit", commit.ID, "type", checked.doc.Type, "schema", checked.doc.Schema)
+	return checked.doc, skip, nil
+}
+
+// check decodes a commit and checks it against the indexing filters. It only reads
+// shared state, so commits are checked concurrently.
+func (p *pipeline) check(ctx context.Context, commit core.CommitLog) checkedCommit {
+	document := commit.Document
+
+	var doc core.DocumentBase[any]
+	err := json.Unmarshal([]byte(document), &doc)
+	if err != nil {
+		// dead-lettered rather than skipped, so that it shows up for an operator
+		return checkedCommit{doc: core.DocumentBase[any]{Type: commit.Type}, err: fmt.Errorf("malformed commit %d: %w", commit.ID, err)}
+	}
+
+	checked := checkedCommit{doc: doc, cdidBase: commitCDID(document, doc.SignedAt)}
+
+	owned, err := commitOwners.allowed(doc.Owner, doc.Signer)
+	if err != nil {
+		checked.err = err
+		return checked
+	}
+	if !owned {
+		indexerLog.Debug("skipping remote commit", "pipeline", p.name, "commit", commit.ID, "signer", doc.Signer)
+		checked.skip = skipOwner
+		return checked
+	}
+
+	isBlocked, err := blocked.blocked(ctx, doc.Owner, doc.Signer)
+	if err != nil {
+		checked.err = err
+		return checked
+	}
+	if isBlocked {
+		indexerLog.Debug("skipping blocked commit", "pipeline", p.name, "commit", commit.ID, "signer", doc.Signer)
+		checked.skip = skipBlocked
+		return checked
+	}
+
+	optedOut, err := optOuts.optedOut(ctx, doc.Signer)
+	if err != nil {
+		checked.err = err
+		return checked
+	}
+	if optedOut {
+		indexerLog.Debug("skipping opted out commit", "pipeline", p.name, "commit", commit.ID, "signer", doc.Signer)
+		checked.skip = skipOptOut
+		return checked
+	}
+
+	if doc.Type == "message" && !messageSchemas.allowed(doc.Schema) {
+		indexerLog.Debug("skipping message schema", "pipeline", p.name, "commit", commit.ID, "schema", doc.Schema)
+		checked.skip = skipSchema
+	}
+	return checked
+}
+
+// writeDocuments adds every set to its index, then applies its deletions, and returns
+// the number of documents written. Meilisearch runs the tasks of an index in order, so a
+// document deleted in the same batch it was added in stays deleted. It returns once the
+// tasks succeeded, as Meilisearch only validates the documents when it runs them, and a
+// batch whose task failed must not move the cursor.
+func writeDocuments(ctx context.Context, sets []documentSet) (int, error) {
+	written := 0
+	tasks := []indexTask{}
+	for _, set := range sets {
+		if len(set.documents) > 0 {
+			info, err := set.index.AddDocumentsWithContext(ctx, set.documents)
+			if err != nil {
+				return written, err
+			}
+			tasks = append(tasks, indexTask{set.index, info})
+			written += len(set.documents)
+		}
+		if len(set.deletions) > 0 {
+			info, err := set.index.DeleteDocumentsWithContext(ctx, set.deletions)
+			if err != nil {
+				return written, err
+			}
+			tasks = append(tasks, indexTask{set.index, info})
+		}
+	}
+	for _, task := range tasks {
+		err := task.wait(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return written, nil
+}
+
+// indexTask is a write enqueued to an index.
+type indexTask struct {
+	index searchIndex
+	info  *meilisearch.TaskInfo
+}
+
+const indexTaskPollInterval = 200 * time.Millisecond
+
+// wait polls the task until it is done, for up to INDEX_TASK_TIMEOUT, and fails unless it
+// succeeded. The backends other than Meilisearch write synchronously and return tasks that
+// already succeeded.
+func (t indexTask) wait(ctx context.Context) error {
+	if t.info.Status == meilisearch.TaskStatusSucceeded {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, indexTaskTimeout)
+	defer cancel()
+
+	task, err := t.index.WaitForTaskWithContext(ctx, t.info.TaskUID, indexTaskPollInterval)
+	if err != nil {
+		return fmt.Errorf("task %d: %w", t.info.TaskUID, err)
+	}
+	if task.Status != meilisearch.TaskStatusSucceeded {
+		return fmt.Errorf("task %d %s: %s", t.info.TaskUID, task.Status, task.Error.Message)
+	}
+	return nil
+}
+
+const (
+	// indexWriteRetries is the number of times a failed batch write is retried, after
+	// indexRetryBackoff doubling each time.
+	indexWriteRetries = 3
+	indexRetryBackoff = time.Second
+)
+
+// writeBatch writes the documents of a batch, retrying with a backoff when it fails. When
+// the batch keeps failing, its documents are written one by one: those that fail on
+// their own, e.g. too large for the engine, are dead-lettered with the commit they come
+// from so that the cursor can move on, while an error on every document means the index
+// is unavailable and the batch is left for the next run.
+func (p *pipeline) writeBatch(ctx context.Context, batch batchTransformer, sets []documentSet, commits []core.CommitLog) (int, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var written int
+		written, err = writeDocuments(ctx, sets)
+		if err == nil {
+			return written, nil
+		}
+		if attempt == indexWriteRetries {
+			break
+		}
+		backoff := indexRetryBackoff << attempt
+		indexerLog.Warn("batch write failed, retrying", "pipeline", p.name, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	written, failures, err := writeEachDocument(ctx, sets)
+	if err != nil {
+		return 0, err
+	}
+
+	sources := map[uint]core.CommitLog{}
+	for _, commit := range commits {
+		sources[commit.ID] = commit
+	}
+	for id, cause := range failures {
+		// the documents are keyed by the ID of their record, e.g. "m" and the cdid, or the
+		// ID of the message an edit replaces, so the batch maps them back to their commit
+		source, ok := batch.commitOf(id)
+		commit, found := sources[source]
+		if !ok || !found {
+			reportError("indexer", fmt.Errorf("document %s not written: %w", id, cause))
+			continue
+		}
+		p.deadLetter(ctx, commit, core.DocumentBase[any]{Type: commit.Type}, cause)
+	}
+	if len(failures) > 0 {
+		indexerLog.Warn("documents dead-lettered", "pipeline", p.name, "count", len(failures), "written", written)
+	}
+	return written, nil
+}
+
+// writeEachDocument writes the documents of the sets one at a time and returns the errors
+// of the ones that failed by document ID. It fails when no document could be written.
+func writeEachDocument(ctx context.Context, sets []documentSet) (int, map[string]error, error) {
+	written := 0
+	failures := map[string]error{}
+	var last error
+	for _, set := range sets {
+		// the tasks are enqueued before any is waited for, as they run one after the other
+		tasks := map[string]indexTask{}
+		for _, document := range set.documents {
+			info, err := set.index.AddDocumentsWithContext(ctx, []any{document})
+			if err != nil {
+				failures[documentID(document)] = err
+				last = err
+				continue
+			}
+			tasks[documentID(document)] = indexTask{set.index, info}
+		}
+		for id, task := range tasks {
+			err := task.wait(ctx)
+			if err != nil {
+				failures[id] = err
+				last = err
+				continue
+			}
+			written++
+		}
+		if len(set.deletions) > 0 {
+			info, err := set.index.DeleteDocumentsWithContext(ctx, set.deletions)
+			if err == nil {
+				err = indexTask{set.index, info}.wait(ctx)
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+	if written == 0 && last != nil {
+		return 0, nil, last
+	}
+	return written, failures, nil
+}
+
+// documentID reads the ID of a document of any transform.
+func documentID(document any) string {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return ""
+	}
+	var identified struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(data, &identified)
+	return identified.ID
+}
+
+// setupPipelines connects every configured pipeline to its index and registers it with the scheduler.
+func setupPipelines(db *gorm.DB, rdb *redis.Client, backend searchBackend) error {
+	err := loadIndexerPace()
+	if err != nil {
+		return err
+	}
+	configured, err := parsePipelines(os.Getenv("PIPELINES"), meilisearch_idx)
+	if err != nil {
+		return err
+	}
+	backfillWorkers, err = loadBackfillWorkers()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range configured {
+		p.index, err = backend.openIndex(p.indexUID)
+		if err != nil {
+			return err
+		}
+		p.db = db
+		p.rdb = rdb
+
+		err = p.index.ensureSettings(transformers[p.transform].settings)
+		if err != nil {
+			return err
+		}
+
+		jobs.register("index_"+p.name, p.interval, 0, true, func(ctx context.Context) error {
+			p.run(ctx)
+			return nil
+		})
+	}
+
+	pipelinesMu.Lock()
+	pipelines = configured
+	pipelinesMu.Unlock()
+
+	return nil
+}
+
+// messageBatch indexes message documents and collects engagement and reports from associations.
+type messageBatch struct {
+	p           *pipeline
+	records     []messageRecord
+	engagements map[string]int64
+	engagedAt   map[string]int64
+	reports     map[string]int64
+	threadRoots map[string]string
+	// routes holds the route of the records that don't belong in the pipeline index.
+	routes map[string]*indexRoute
+	// deletions holds the IDs of the deleted messages, removed from every message index
+	// as the route of a message is not known once it is gone.
+	deletions []string
+	// retractions holds the timelines the indexed messages were taken out of, by ID.
+	retractions map[string][]string
+	// commits holds the commit of each record, for dead letters and the live
+	// subscriptions, and written the records as written, with their moderation state.
+	commits map[string]uint
+	written []messageRecord
+	// signers holds the signer of every message of the batch, skipped ones included, so
+	// that their edits are checked against it.
+	signers map[string]string
+	// decoded holds the messages decoded by the transform workers, by commit ID.
+	decodedMu sync.Mutex
+	decoded   map[uint]decodedMessage
+}
+
+func newMessageBatch(p *pipeline) batchTransformer {
+	return &messageBatch{
+		p:           p,
+		records:     []messageRecord{},
+		engagements: map[string]int64{},
+		engagedAt:   map[string]int64{},
+		reports:     map[string]int64{},
+		threadRoots: map[string]string{},
+		routes:      map[string]*indexRoute{},
+		decoded:     map[uint]decodedMessage{},
+		commits:     map[string]uint{},
+		signers:     map[string]string{},
+	}
+}
+
+func (b *messageBatch) roots() map[string]string {
+	return b.threadRoots
+}
+
+func (b *messageBatch) rebaseThreads(earlier map[string]string) {
+	for id, root := range b.threadRoots {
+		if actual, ok := earlier[root]; ok {
+			b.threadRoots[id] = actual
+		}
+	}
+	for i, record := range b.records {
+		if actual, ok := earlier[record.ThreadRoot]; ok {
+			b.records[i].ThreadRoot = actual
+		}
+	}
+}
+
+// decodedMessage is a message record built ahead of its batch, or the reason it is not
+// indexed. Its thread root is left to add, as it depends on the messages before it.
+type decodedMessage struct {
+	id     string
+	update bool
+	// signer, schema and signedAt are those of the commit, to check an edit against the
+	// message it replaces and to index it on its own when there is none.
+	signer   string
+	schema   string
+	signedAt int64
+	record   messageRecord
+	body     any
+	skip     string
+	err      error
+}
+
+// decode builds the record of a message commit, looking up its link previews, policies
+// and spam score. It only reads the batch, so the transform workers run it concurrently;
+// add then takes the result.
+func (b *messageBatch) decode(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cdidBase string) {
+	if doc.Type != "message" {
+		return
+	}
+	decoded := b.decodeMessage(ctx, commit, cdidBase)
+	b.decodedMu.Lock()
+	b.decoded[commit.ID] = decoded
+	b.decodedMu.Unlock()
+}
+
+func (b *messageBatch) decodeMessage(ctx context.Context, commit core.CommitLog, cdidBase string) decodedMessage {
+	var message core.MessageDocument[any]
+	err := json.Unmarshal([]byte(commit.Document), &message)
+	if err != nil {
+		return decodedMessage{err: err}
+	}
+	id, signedAt, update := messageIdentity(message, cdidBase)
+	links, linkDomains := extractLinks(message.Body)
+	var linkPreviews []linkPreview
+	if len(links) > 0 && features.enabled(ctx, featureEnrichment) {
+		linkPreviews = linkPreviewer.previews(ctx, links)
+	}
+	decoded := decodedMessage{
+		id:       id,
+		update:   update,
+		signer:   message.Signer,
+		schema:   message.Schema,
+		signedAt: message.SignedAt.UnixMilli(),
+		body:     message.Body,
+	}
+	if pastRetention(signedAt) || messageShards.covers(b.p.indexUID) && messageShards.retired(signedAt) {
+		decoded.skip = skipRetention
+		return decoded
+	}
+	record := messageRecord{
+		ID:           id,
+		Type:         "message",
+		Body:         message.Body,
+		Schema:       message.Schema,
+		SignedAt:     signedAt.UnixMilli(),
+		Signer:       message.Signer,
+		Timelines:    message.Timelines,
+		Links:        links,
+		LinkDomains:  linkDomains,
+		Hashtags:     extractHashtags(message.Body),
+		Mentions:     extractMentions(message.Body),
+		LinkPreviews: linkPreviews,
+		Geo:          extractGeo(message.Body),
+		Flagged:      isSuppressed(message.Body),
+	}
+	if update {
+		record.UpdatedAt = message.SignedAt.UnixMilli()
+	}
+	record.Restricted, err = policies.restricted(ctx, message.Timelines)
+	if err != nil {
+		// fail closed: the message stays out of public results until reindexed
+		reportError("indexer", err)
+		record.Restricted = true
+	} else if record.Restricted && policies.skipRestricted {
+		// private communities stay out of the index altogether
+		decoded.skip = skipPrivate
+		return decoded
+	}
+	if mapping, ok := lookupSchema(message.Schema); ok {
+		record.Text, record.Fields = mapping.extract(message.Body)
+		record.Preview = mapping.preview(message.Body, record.Text)
+		record.ExpiresAt = mapping.expiresAt(message.Body)
+		record.ContentWarning = mapping.contentWarning(message.Body)
+		record.Media = mapping.media(message.Body)
+		record.Body = nil
+	} else {
+		record.Preview = fallbackPreview(message.Body)
+	}
+	record.Lang = detectLanguage(record.Preview.Text)
+	if record.ExpiresAt > 0 && record.ExpiresAt <= time.Now().UnixMilli() {
+		decoded.skip = skipExpired
+		return decoded
+	}
+	record.SpamScore = scoreSpam(ctx, &record)
+	if record.SpamScore >= spamThreshold {
+		if spamExclude {
+			indexerLog.Debug("excluding spam", "pipeline", b.p.name, "id", id, "score", record.SpamScore)
+			decoded.skip = skipSpam
+			return decoded
+		}
+		record.Spam = true
+	}
+	if skip := fitDocument(&record); skip != "" {
+		decoded.skip = skip
+		return decoded
+	}
+	decoded.record = record
+	return decoded
+}
+
+// messageIdentity returns the ID and the signing time of the message a commit writes. An
+// edit carries the ID of the message it replaces, and keeps its time, taken from the ID,
+// so that it stays in place in the results sorted by date and in its shard.
+func messageIdentity(message core.MessageDocument[any], cdidBase string) (string, time.Time, bool) {
+	if message.ID == "" {
+		return "m" + cdidBase, message.SignedAt, false
+	}
+	signedAt := message.SignedAt
+	if len(message.ID) > 1 {
+		if parsed, err := cdid.Parse(message.ID[1:]); err == nil {
+			signedAt = parsed.Time()
+		}
+	}
+	return message.ID, signedAt, true
+}
+
+// standalone makes an edit a message of its own, with the ID of its commit.
+func (d decodedMessage) standalone(cdidBase string) decodedMessage {
+	d.id = "m" + cdidBase
+	d.update = false
+	if d.record.ID != "" {
+		d.record.ID = d.id
+		d.record.SignedAt = d.signedAt
+		d.record.UpdatedAt = 0
+	}
+	return d
+}
+
+// editSigner returns the signer of the message an edit replaces, added earlier in the
+// batch or indexed, and whether there is one.
+func (b *messageBatch) editSigner(ctx context.Context, id, schema string) (string, bool, error) {
+	if signer, ok := b.signers[id]; ok {
+		return signer, true, nil
+	}
+	indexes := []searchIndex{b.indexOf(id)}
+	if route := routeFor(schema); route != nil {
+		indexes = append(indexes, route.index)
+	}
+	for _, index := range indexes {
+		var result meilisearch.DocumentsResult
+		err := index.GetDocumentsWithContext(ctx, &meilisearch.DocumentsQuery{
+			Fields: []string{"id", "signer"},
+			Filter: "id = " + quoteFilter(id),
+			Limit:  1,
+		}, &result)
+		if err != nil {
+			return "", false, err
+		}
+		if len(result.Results) > 0 {
+			signer, _ := result.Results[0]["signer"].(string)
+			return signer, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (b *messageBatch) add(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cdidBase string) (string, error) {
+	document := commit.Document
+
+	switch doc.Type {
+	case "message":
+		{
+			b.decodedMu.Lock()
+			decoded, ok := b.decoded[commit.ID]
+			delete(b.decoded, commit.ID)
+			b.decodedMu.Unlock()
+			if !ok {
+				decoded = b.decodeMessage(ctx, commit, cdidBase)
+			}
+			if decoded.err != nil {
+				return "", decoded.err
+			}
+			if decoded.update {
+				// only the signer of a message may replace it; an edit of a message that
+				// isn't known stands on its own
+				signer, found, err := b.editSigner(ctx, decoded.id, decoded.schema)
+				if err != nil {
+					return "", err
+				}
+				if found && signer != decoded.signer {
+					return skipForeignEdit, nil
+				}
+				if !found {
+					decoded = decoded.standalone(cdidBase)
+				}
+			}
+			id := decoded.id
+			b.signers[id] = decoded.signer
+			if decoded.update {
+				// the edit replaces the version added earlier in the batch, and a skipped
+				// edit takes the indexed version out, so that stale content isn't found
+				b.records = slices.DeleteFunc(b.records, func(other messageRecord) bool {
+					return other.ID == id
+				})
+				delete(b.routes, id)
+				if decoded.skip != "" {
+					b.deletions = append(b.deletions, id)
+				}
+			}
+			if decoded.skip == skipRetention {
+				return skipRetention, nil
+			}
+			// the root is kept even for a skipped message, so that its replies still
+			// resolve to it
+			threadRoot := resolveThreadRoot(b.indexOf, b.threadRoots, id, decoded.body)
+			b.threadRoots[id] = threadRoot
+			if decoded.skip != "" {
+				return decoded.skip, nil
+			}
+			record := decoded.record
+			record.ThreadRoot = threadRoot
+			if route := routeFor(record.Schema); route != nil {
+				b.routes[id] = route
+			}
+			b.commits[id] = commit.ID
+			b.records = append(b.records, record)
+		}
+	case "delete":
+		{
+			var deletion core.DeleteDocument
+			err := json.Unmarshal([]byte(document), &deletion)
+			if err != nil {
+				return "", err
+			}
+			// deletes of associations, profiles and timelines have nothing to remove here
+			if !strings.HasPrefix(deletion.Target, "m") {
+				return skipType, nil
+			}
+			b.records = slices.DeleteFunc(b.records, func(record messageRecord) bool {
+				return record.ID == deletion.Target
+			})
+			delete(b.routes, deletion.Target)
+			b.deletions = append(b.deletions, deletion.Target)
+		}
+	case "retract":
+		return b.addRetraction(ctx, document)
+	case "association":
+		{
+			var association core.AssociationDocument[any]
+			err := json.Unmarshal([]byte(document), &association)
+			if err != nil {
+				return "", err
+			}
+			if isReportSchema(association.Schema) {
+				b.reports[association.Target]++
+				break
+			}
+			b.engagements[association.Target]++
+			b.engagedAt[association.Target] = association.SignedAt.Unix()
+		}
+	default:
+		return skipType, nil
+	}
+
+	return "", nil
+}
+
+// indexOf returns the index holding a message of the pipeline: its shard when the index
+// is sharded, and the pipeline index otherwise.
+func (b *messageBatch) indexOf(id string) searchIndex {
+	if messageShards.covers(b.p.indexUID) {
+		if shard := messageShards.shardOf(id); shard != nil {
+			return shard
+		}
+	}
+	return b.p.index
+}
+
+func (b *messageBatch) commitOf(id string) (uint, bool) {
+	commit, ok := b.commits[id]
+	return commit, ok
+}
+
+func (b *messageBatch) documents(ctx context.Context) []documentSet {
+	ids := []string{}
+	for _, record := range b.records {
+		ids = append(ids, record.ID)
+	}
+	reports, err := getReportCounts(ctx, b.p.rdb, ids)
+	if err != nil {
+		reportError("reports", err)
+	}
+
+	sets := []documentSet{{index: b.p.index, documents: []any{}}}
+	indexed := map[searchIndex]int{b.p.index: 0}
+	setOf := func(index searchIndex) int {
+		set, ok := indexed[index]
+		if !ok {
+			set = len(sets)
+			indexed[index] = set
+			sets = append(sets, documentSet{index: index})
+		}
+		return set
+	}
+	sharded := messageShards.covers(b.p.indexUID)
+
+	b.written = b.written[:0]
+	for _, record := range moderation.apply(ctx, b.records) {
+		record.Penalty = penaltyFor(reports[record.ID] + b.reports[record.ID])
+		b.written = append(b.written, record)
+
+		set := 0
+		if route, ok := b.routes[record.ID]; ok {
+			set = setOf(route.index)
+		} else if sharded {
+			shard, err := messageShards.forTime(ctx, time.UnixMilli(record.SignedAt))
+			if err != nil {
+				// the unsharded index keeps it searchable until the shard can be created
+				reportError("sharding", err)
+			} else {
+				set = setOf(shard)
+			}
+		}
+		sets[set].documents = append(sets[set].documents, record)
+	}
+
+	if len(b.deletions) > 0 {
+		sets[0].deletions = b.deletions
+		for _, route := range indexRoutes {
+			if route.Index == b.p.indexUID {
+				continue
+			}
+			set := setOf(route.index)
+			sets[set].deletions = b.deletions
+		}
+		if sharded {
+			for _, id := range b.deletions {
+				if shard := messageShards.shardOf(id); shard != nil {
+					set := setOf(shard)
+					sets[set].deletions = append(sets[set].deletions, id)
+				}
+			}
+		}
+	}
+	return sets
+}
+
+func (b *messageBatch) finish(ctx context.Context) {
+	if len(b.engagements) > 0 {
+		recordEngagements(ctx, b.p.rdb, b.engagements, b.engagedAt)
+	}
+	recordHashtags(ctx, b.p.rdb, b.records)
+	if live != nil && features.enabled(ctx, featureLive) {
+		publishLive(ctx, b.p.rdb, b.written, b.commits)
+	}
+	if completions != nil {
+		completions.recordMessages(ctx, b.records)
+	}
+}
+
+// apply takes the indexed messages out of the timelines they were retracted from and
+// records their reports.
+func (b *messageBatch) apply(ctx context.Context) error {
+	if len(b.retractions) > 0 {
+		err := applyRetractions(ctx, messageIndexes(), b.retractions)
+		if err != nil {
+			return fmt.Errorf("retractions: %w", err)
+		}
+	}
+	if len(b.reports) > 0 {
+		pending := map[string]bool{}
+		for _, record := range b.records {
+			pending[record.ID] = true
+		}
+		err := recordReports(ctx, b.p.rdb, messageIndexes(), b.reports, pending)
+		if err != nil {
+			return fmt.Errorf("reports: %w", err)
+		}
+	}
+	return nil
+}
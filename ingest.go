@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/totegamma/concurrent/core"
+)
+
+const (
+	maxIngestCommits = 100
+	maxBulkDocuments = 10000
+	bulkChunkSize    = 500
+	maxBulkLineSize  = 1 << 20
+)
+
+// Outcomes of an ingested document.
+const (
+	ingestIndexed = "indexed"
+	ingestSkipped = "skipped"
+	ingestInvalid = "invalid"
+	ingestFailed  = "failed"
+)
+
+type ingestCommit struct {
+	// ID is the commit log ID, when the caller knows it. It only shows up in the logs.
+	ID       uint            `json:"id,omitempty"`
+	Document json.RawMessage `json:"document"`
+}
+
+type ingestRequest struct {
+	Commits []ingestCommit `json:"commits"`
+}
+
+type ingestResult struct {
+	Line   int    `json:"line,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ingestDocument reads a commit document, sent either as the JSON document itself or as
+// the string stored in the commit log.
+func ingestDocument(raw json.RawMessage) (string, bool) {
+	var document string
+	if json.Unmarshal(raw, &document) == nil {
+		return document, true
+	}
+	if json.Valid(raw) && strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		return string(raw), true
+	}
+	return "", false
+}
+
+// ingestCommitLog validates a pushed document and wraps it like a commit log entry.
+func ingestCommitLog(id uint, raw json.RawMessage) (core.CommitLog, error) {
+	document, ok := ingestDocument(raw)
+	if !ok {
+		return core.CommitLog{}, errors.New("document must be a JSON object or string")
+	}
+
+	var doc core.DocumentBase[any]
+	err := json.Unmarshal([]byte(document), &doc)
+	if err != nil || doc.Type == "" || doc.Signer == "" || doc.SignedAt.IsZero() {
+		return core.CommitLog{}, errors.New("document needs a type, a signer and signedAt")
+	}
+
+	return core.CommitLog{
+		ID:       id,
+		Type:     doc.Type,
+		Document: document,
+		SignedAt: doc.SignedAt,
+		CDate:    time.Now(),
+	}, nil
+}
+
+// indexCommits runs the commits through every pipeline and writes the documents right
+// away. A commit counts as indexed when at least one pipeline kept it.
+func indexCommits(ctx context.Context, commits []core.CommitLog) ([]ingestResult, int) {
+	results := make([]ingestResult, len(commits))
+	for i, commit := range commits {
+		results[i] = ingestResult{Status: ingestSkipped}
+		if commit.Type == "message" {
+			results[i].ID = "m" + commitCDID(commit.Document, commit.SignedAt)
+		}
+	}
+
+	indexed := 0
+	for _, p := range getPipelines() {
+		batch := transformers[p.transform].newBatch(p)
+		kept := []int{}
+		for i, commit := range commits {
+			_, skip, err := p.prepare(ctx, batch, commit)
+			if err != nil {
+				results[i] = ingestResult{ID: results[i].ID, Status: ingestFailed, Reason: err.Error()}
+				continue
+			}
+			if skip != "" {
+				if results[i].Status == ingestSkipped {
+					results[i].Reason = skip
+				}
+				continue
+			}
+			kept = append(kept, i)
+		}
+
+		documents, err := writeDocuments(ctx, batch.documents(ctx))
+		if err == nil {
+			err = applyBatch(ctx, batch)
+		}
+		for _, i := range kept {
+			if err != nil {
+				results[i] = ingestResult{ID: results[i].ID, Status: ingestFailed, Reason: err.Error()}
+			} else if results[i].Status != ingestFailed {
+				results[i] = ingestResult{ID: results[i].ID, Status: ingestIndexed}
+			}
+		}
+		indexed += documents
+	}
+
+	metrics.add("ingested_commits_total", nil, float64(len(commits)))
+	return results, indexed
+}
+
+func ingestAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			bearer, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				return respondError(c, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+			}
+			if maintenance.get(c.Request().Context()).IndexerPaused {
+				return respondError(c, http.StatusServiceUnavailable, codeMaintenance, "indexer is paused")
+			}
+			return next(c)
+		}
+	}
+}
+
+// setupIngest registers the ingestion endpoints when INGEST_TOKEN is set.
+//
+// POST /ingest lets the local Concurrent node (or a commit hook) push new commits to
+// have them indexed right away. POST /ingest/bulk takes an NDJSON stream of documents
+// from migration scripts and archive importers, and reports the outcome of each line.
+//
+// The pollers still read the commit log and index every commit again from there, so they
+// remain the source of truth; engagements and reports are only counted by them.
+func setupIngest(e *echo.Echo) {
+	token := os.Getenv("INGEST_TOKEN")
+	if token == "" {
+		return
+	}
+
+	ingest := e.Group("/ingest", ingestAuth(token))
+
+	ingest.POST("", func(c echo.Context) error {
+		var request ingestRequest
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if len(request.Commits) == 0 {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "commits", "commits is empty")
+		}
+		if len(request.Commits) > maxIngestCommits {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "commits", "too many commits")
+		}
+
+		commits := []core.CommitLog{}
+		for _, commit := range request.Commits {
+			commitLog, err := ingestCommitLog(commit.ID, commit.Document)
+			if err != nil {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "commits", err.Error())
+			}
+			commits = append(commits, commitLog)
+		}
+
+		results, indexed := indexCommits(c.Request().Context(), commits)
+		skipped := map[string]int{}
+		for _, result := range results {
+			if result.Status == ingestFailed {
+				return respondError(c, http.StatusInternalServerError, codeInternal, result.Reason)
+			}
+			if result.Status == ingestSkipped {
+				skipped[result.Reason]++
+			}
+		}
+		indexerLog.Info("ingested", "commits", len(commits), "documents", indexed)
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"status": "ok",
+			"content": echo.Map{
+				"commits":   len(commits),
+				"documents": indexed,
+				"skipped":   skipped,
+			},
+		})
+	})
+
+	ingest.POST("/bulk", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		scanner := bufio.NewScanner(c.Request().Body)
+		scanner.Buffer(make([]byte, 64*1024), maxBulkLineSize)
+
+		results := []ingestResult{}
+		commits := []core.CommitLog{}
+		lines := []int{}
+		counts := map[string]int{}
+
+		flush := func() {
+			chunk, _ := indexCommits(ctx, commits)
+			for i, result := range chunk {
+				result.Line = lines[i]
+				results = append(results, result)
+			}
+			commits = commits[:0]
+			lines = lines[:0]
+		}
+
+		lineNumber := 0
+		documents := 0
+		truncated := false
+		for scanner.Scan() {
+			lineNumber++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			documents++
+			if documents > maxBulkDocuments {
+				// the lines read so far are indexed; the caller resends the rest
+				truncated = true
+				break
+			}
+
+			commit, err := ingestCommitLog(0, json.RawMessage(line))
+			if err != nil {
+				results = append(results, ingestResult{Line: lineNumber, Status: ingestInvalid, Reason: err.Error()})
+				continue
+			}
+			commits = append(commits, commit)
+			lines = append(lines, lineNumber)
+			if len(commits) == bulkChunkSize {
+				flush()
+			}
+		}
+		if len(commits) > 0 {
+			flush()
+		}
+		// the earlier chunks are indexed already, so a line that can't be read ends the
+		// request with the results so far rather than an error
+		if err := scanner.Err(); err != nil {
+			reason := err.Error()
+			if errors.Is(err, bufio.ErrTooLong) {
+				reason = fmt.Sprintf("line exceeds %d bytes", maxBulkLineSize)
+			}
+			results = append(results, ingestResult{Line: lineNumber + 1, Status: ingestInvalid, Reason: reason})
+			truncated = true
+		}
+
+		for _, result := range results {
+			counts[result.Status]++
+		}
+		indexerLog.Info("bulk ingested", "documents", len(results), "results", counts)
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"status": "ok",
+			"content": echo.Map{
+				"counts":       counts,
+				"results":      results,
+				"truncated":    truncated,
+				"maxDocuments": maxBulkDocuments,
+			},
+		})
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageStopwords are frequent words that tell the languages written in Latin script
+// apart.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "was", "you", "of", "to", "in", "it", "that", "this", "for", "with", "have", "not", "but", "what", "my"},
+	"es": {"el", "la", "los", "las", "de", "que", "y", "en", "un", "una", "es", "por", "con", "para", "no", "pero", "muy", "yo"},
+	"fr": {"le", "la", "les", "de", "des", "et", "est", "un", "une", "je", "tu", "il", "que", "pas", "pour", "dans", "avec", "sur"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "du", "ein", "eine", "zu", "mit", "auf", "für", "den", "von", "auch"},
+	"pt": {"o", "a", "os", "as", "de", "que", "e", "é", "um", "uma", "não", "para", "com", "em", "do", "da", "eu", "mas"},
+}
+
+// detectLanguage guesses the ISO 639-1 code of the language of a text from its script,
+// and for Latin script from its stopwords. Kana make a text Japanese even among kanji,
+// and han alone Chinese. It returns "" when the text is too short or unclear.
+func detectLanguage(text string) string {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			counts["ja"]++
+		case unicode.Is(unicode.Han, r):
+			counts["han"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["he"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["el"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["latin"]++
+		}
+	}
+	if letters < 3 {
+		return ""
+	}
+
+	if counts["ja"] > 0 && counts["ja"]+counts["han"] >= letters/4 {
+		return "ja"
+	}
+	script, best := "", 0
+	for name, count := range counts {
+		if count > best || count == best && name < script {
+			script, best = name, count
+		}
+	}
+	switch script {
+	case "han":
+		return "zh"
+	case "latin":
+		return detectLatinLanguage(text)
+	case "ja":
+		return "ja"
+	}
+	if best*2 < letters {
+		return ""
+	}
+	return script
+}
+
+func detectLatinLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	if len(words) < 2 {
+		return ""
+	}
+
+	seen := map[string]bool{}
+	for _, word := range words {
+		seen[word] = true
+	}
+	language, best, second := "", 0, 0
+	for _, code := range sortedKeys(languageStopwords) {
+		score := 0
+		for _, stopword := range languageStopwords[code] {
+			if seen[stopword] {
+				score++
+			}
+		}
+		switch {
+		case score > best:
+			language, best, second = code, score, best
+		case score > second:
+			second = score
+		}
+	}
+	if best == 0 || best == second {
+		return ""
+	}
+	return language
+}
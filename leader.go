@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	leaderKey = "ccsearch:leader"
+	leaderTTL = 15 * time.Second
+)
+
+// errLostLeadership stops a leader-only run whose lease was lost.
+var errLostLeadership = errors.New("lost leadership")
+
+// renewLeadership extends the lease only if it is still held by this instance.
+var renewLeadership = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLeadership drops the lease only if it is still held by this instance.
+var releaseLeadership = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// leaderElection makes sure background jobs run on a single replica. The leader holds
+// a lease in redis that it keeps renewing; when it dies the lease expires and another
+// replica takes over.
+type leaderElection struct {
+	rdb      *redis.Client
+	id       string
+	isLeader atomic.Bool
+	// leaseEnd is when the lease last acquired or renewed expires, in unix milliseconds,
+	// so that a leader that can't renew it in time stops on its own.
+	leaseEnd atomic.Int64
+}
+
+var elector *leaderElection
+
+func newLeaderElection(rdb *redis.Client) *leaderElection {
+	hostname, _ := os.Hostname()
+	return &leaderElection{
+		rdb: rdb,
+		id:  fmt.Sprintf("%s-%d-%08x", hostname, os.Getpid(), rand.Uint32()),
+	}
+}
+
+func (l *leaderElection) leader() bool {
+	return l.isLeader.Load() && time.Now().UnixMilli() < l.leaseEnd.Load()
+}
+
+// leading reports whether this instance may go on with the leader-only work it started.
+// The long runs, catching up or backfilling, check it between batches, as the lease may
+// expire and another instance take over meanwhile. Without an election, e.g. in the
+// commands, it always does.
+func leading() bool {
+	return elector == nil || elector.leader()
+}
+
+func (l *leaderElection) currentLeader(ctx context.Context) (string, error) {
+	leader, err := l.rdb.Get(ctx, leaderKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return leader, err
+}
+
+func (l *leaderElection) run(ctx context.Context) {
+	l.campaign(ctx)
+
+	ticker := time.NewTicker(leaderTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.campaign(ctx)
+		}
+	}
+}
+
+func (l *leaderElection) campaign(ctx context.Context) {
+	// the lease is counted from before the request, which redis may apply late
+	leaseEnd := time.Now().Add(leaderTTL).UnixMilli()
+	if l.isLeader.Load() {
+		renewed, err := renewLeadership.Run(ctx, l.rdb, []string{leaderKey}, l.id, leaderTTL.Milliseconds()).Int()
+		if err != nil || renewed == 0 {
+			l.isLeader.Store(false)
+			jobsLog.Warn("lost leadership", "id", l.id)
+			return
+		}
+		l.leaseEnd.Store(leaseEnd)
+		return
+	}
+
+	acquired, err := l.rdb.SetNX(ctx, leaderKey, l.id, leaderTTL).Result()
+	if err != nil {
+		reportError("leader", err)
+		return
+	}
+	if acquired {
+		l.leaseEnd.Store(leaseEnd)
+		l.isLeader.Store(true)
+		jobsLog.Info("acquired leadership", "id", l.id)
+	}
+}
+
+// resign gives up the leadership on shutdown, so that another replica takes over without
+// waiting for the lease to expire.
+func (l *leaderElection) resign(ctx context.Context) {
+	if !l.isLeader.Swap(false) {
+		return
+	}
+	err := releaseLeadership.Run(ctx, l.rdb, []string{leaderKey}, l.id).Err()
+	if err != nil {
+		reportError("leader", err)
+		return
+	}
+	jobsLog.Info("resigned leadership", "id", l.id)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"'\x60\[\]{}|\\^]+`)
+
+// extractLinks collects every http(s) URL found in the string values of a message body,
+// along with the set of domains they point to.
+func extractLinks(body any) ([]string, []string) {
+	links := []string{}
+	domains := []string{}
+
+	walkStrings(body, func(text string) {
+		for _, match := range linkPattern.FindAllString(text, -1) {
+			link := strings.TrimRight(match, ".,;:!?)'\"")
+			parsed, err := url.Parse(link)
+			if err != nil || parsed.Hostname() == "" {
+				continue
+			}
+			if !slices.Contains(links, link) {
+				links = append(links, link)
+			}
+			domain := normalizeDomain(parsed.Hostname())
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+	})
+
+	if len(links) == 0 {
+		return nil, nil
+	}
+
+	return links, domains
+}
+
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	return strings.TrimPrefix(domain, "www.")
+}
+
+// walkStrings calls fn for every string contained in a decoded JSON value.
+func walkStrings(value any, fn func(string)) {
+	switch v := value.(type) {
+	case string:
+		fn(v)
+	case []any:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	case map[string]any:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	}
+}
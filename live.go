@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// liveChannel carries the freshly indexed messages from the indexer, which runs on
+	// the leader, to the subscribers of every instance.
+	liveChannel = "ccsearch:live"
+	// liveMaxAge leaves out of the live results the messages that are old news, e.g. the
+	// ones indexed while a pipeline catches up after a reindex.
+	liveMaxAge = time.Hour
+	// liveBuffer is the number of matches a subscriber may fall behind by. The matches of
+	// a subscriber that falls further behind are dropped.
+	liveBuffer = 64
+	// maxLiveFilters bounds the subscriptions of one connection.
+	maxLiveFilters = 10
+	// liveBacklogSize is the number of recent messages kept to catch up the streams that
+	// reconnect.
+	liveBacklogSize = 1000
+)
+
+// liveMessage is a message as indexed, with the commit it came from.
+type liveMessage struct {
+	Commit uint          `json:"commit"`
+	Record messageRecord `json:"record"`
+}
+
+// liveMatch is a message delivered to a subscriber, for one of its filters.
+type liveMatch struct {
+	Subscription string
+	Commit       uint
+	Result       searchResult
+}
+
+// liveFilter is what a subscription matches. The query is matched word by word against
+// the text of a message, ignoring case, rather than by the engine, so it has neither its
+// typo tolerance nor its ranking.
+type liveFilter struct {
+	terms    []string
+	timeline string
+	signer   string
+	schemas  []string
+	hashtag  string
+}
+
+func newLiveFilter(query, timeline, signer string, schemas []string, hashtag string) liveFilter {
+	return liveFilter{
+		terms:    strings.Fields(strings.ToLower(query)),
+		timeline: timeline,
+		signer:   signer,
+		schemas:  schemas,
+		hashtag:  strings.ToLower(strings.TrimPrefix(hashtag, "#")),
+	}
+}
+
+// matches reports whether a record is served by the filter, applying the same rules as
+// a search: hidden, spam, flagged and expired messages never are, and restricted ones
+// only to the subscribers of a timeline, which were checked for it.
+func (f liveFilter) matches(record messageRecord, now time.Time) bool {
+	if record.Hidden || record.Spam || record.Flagged {
+		return false
+	}
+	if record.ExpiresAt > 0 && record.ExpiresAt <= now.UnixMilli() {
+		return false
+	}
+	if f.timeline != "" {
+		if !slices.Contains(record.Timelines, f.timeline) {
+			return false
+		}
+	} else if policies.enabled && record.Restricted {
+		return false
+	}
+	if f.signer != "" && record.Signer != f.signer {
+		return false
+	}
+	if len(f.schemas) > 0 && !slices.Contains(f.schemas, record.Schema) {
+		return false
+	}
+	if f.hashtag != "" && !slices.Contains(record.Hashtags, f.hashtag) {
+		return false
+	}
+	if len(f.terms) == 0 {
+		return true
+	}
+
+	texts := []string{record.Text, record.ContentWarning}
+	walkStrings(record.Body, func(text string) {
+		texts = append(texts, text)
+	})
+	for _, attachment := range record.Media {
+		texts = append(texts, attachment.Name, attachment.Alt)
+	}
+	text := strings.ToLower(strings.Join(texts, "\n"))
+	for _, term := range f.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// liveSubscriber is a connection receiving live results, for one or more filters keyed
+// by the ID the client gave them.
+type liveSubscriber struct {
+	out chan liveMatch
+
+	mu      sync.Mutex
+	filters map[string]liveFilter
+	dropped int64
+}
+
+func (s *liveSubscriber) setFilter(id string, filter liveFilter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.filters[id]; !ok && len(s.filters) >= maxLiveFilters {
+		return false
+	}
+	s.filters[id] = filter
+	return true
+}
+
+func (s *liveSubscriber) removeFilter(id string) {
+	s.mu.Lock()
+	delete(s.filters, id)
+	s.mu.Unlock()
+}
+
+// takeDropped returns the number of matches dropped since the last call.
+func (s *liveSubscriber) takeDropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
+
+func (s *liveSubscriber) deliver(messages []liveMessage, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, message := range messages {
+		for id, filter := range s.filters {
+			if !filter.matches(message.Record, now) {
+				continue
+			}
+			match := liveMatch{Subscription: id, Commit: message.Commit, Result: liveResult(message.Record)}
+			select {
+			case s.out <- match:
+			default:
+				s.dropped++
+				metrics.add("live_dropped_total", nil, 1)
+			}
+		}
+	}
+}
+
+// liveResult is the search result of a live match, with its document.
+func liveResult(record messageRecord) searchResult {
+	return searchResult{
+		ID:      record.ID,
+		Owner:   record.Signer,
+		Preview: record.Preview,
+		Document: &searchDocument{
+			Schema:         record.Schema,
+			SignedAt:       record.SignedAt,
+			UpdatedAt:      record.UpdatedAt,
+			Timelines:      record.Timelines,
+			Body:           record.Body,
+			Text:           record.Text,
+			ContentWarning: record.ContentWarning,
+		},
+	}
+}
+
+// liveHub holds the subscribers of this instance. done is closed at shutdown, so that
+// the connections end instead of holding it up.
+type liveHub struct {
+	done <-chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[*liveSubscriber]bool
+	backlog     []liveMessage
+}
+
+var live *liveHub
+
+// setupLive listens to the messages published by the indexer until ctx ends.
+func setupLive(ctx context.Context, rdb *redis.Client) error {
+	pubsub := rdb.Subscribe(ctx, liveChannel)
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	live = &liveHub{
+		done:        ctx.Done(),
+		subscribers: map[*liveSubscriber]bool{},
+	}
+	go live.listen(ctx, pubsub)
+	return nil
+}
+
+func (h *liveHub) listen(ctx context.Context, pubsub *redis.PubSub) {
+	defer pubsub.Close()
+
+	events := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			var messages []liveMessage
+			err := json.Unmarshal([]byte(event.Payload), &messages)
+			if err != nil {
+				reportError("live", err)
+				continue
+			}
+			h.dispatch(messages)
+		}
+	}
+}
+
+func (h *liveHub) subscribe() *liveSubscriber {
+	s := &liveSubscriber{
+		out:     make(chan liveMatch, liveBuffer),
+		filters: map[string]liveFilter{},
+	}
+	h.mu.Lock()
+	h.subscribers[s] = true
+	h.mu.Unlock()
+	return s
+}
+
+func (h *liveHub) unsubscribe(s *liveSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, s)
+	h.mu.Unlock()
+}
+
+func (h *liveHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// since returns the messages of the backlog after a commit, and whether the backlog
+// reaches back to it, i.e. whether none may have been missed.
+func (h *liveHub) since(commit uint) ([]liveMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	messages := []liveMessage{}
+	for _, message := range h.backlog {
+		if message.Commit > commit {
+			messages = append(messages, message)
+		}
+	}
+	complete := len(h.backlog) > 0 && h.backlog[0].Commit <= commit
+	return messages, complete
+}
+
+func (h *liveHub) dispatch(messages []liveMessage) {
+	h.mu.Lock()
+	h.backlog = append(h.backlog, messages...)
+	if len(h.backlog) > liveBacklogSize {
+		h.backlog = slices.Clone(h.backlog[len(h.backlog)-liveBacklogSize:])
+	}
+	subscribers := make([]*liveSubscriber, 0, len(h.subscribers))
+	for s := range h.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	h.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range subscribers {
+		s.deliver(messages, now)
+	}
+}
+
+// publishLive sends the messages of an indexed batch to the subscribers of every
+// instance. Messages signed, or edited, before liveMaxAge are left out.
+func publishLive(ctx context.Context, rdb *redis.Client, records []messageRecord, commits map[string]uint) {
+	oldest := time.Now().Add(-liveMaxAge).UnixMilli()
+	messages := []liveMessage{}
+	for _, record := range records {
+		if max(record.SignedAt, record.UpdatedAt) < oldest {
+			continue
+		}
+		messages = append(messages, liveMessage{Commit: commits[record.ID], Record: record})
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(messages)
+	if err != nil {
+		reportError("live", err)
+		return
+	}
+	err = rdb.Publish(ctx, liveChannel, payload).Err()
+	if err != nil {
+		reportError("live", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// logLevel is shared by the process-wide logger so it can be changed at runtime.
+var logLevel = new(slog.LevelVar)
+
+// The loggers of the components tag their records with the component, so that the logs
+// of one can be told apart and filtered. They are set up along with the default logger.
+var (
+	serverLog     = slog.Default()
+	apiLog        = slog.Default()
+	adminLog      = slog.Default()
+	indexerLog    = slog.Default()
+	settingsLog   = slog.Default()
+	backendLog    = slog.Default()
+	jobsLog       = slog.Default()
+	moderationLog = slog.Default()
+)
+
+// setupLogger installs the leveled logger as the default one, writing text or, with the
+// json format, one JSON object per record. The standard `log` package is routed through
+// it as well, at the info level.
+func setupLogger(level, format string) {
+	var invalid []any
+	if level != "" {
+		err := logLevel.UnmarshalText([]byte(level))
+		if err != nil {
+			invalid = append(invalid, "LOG_LEVEL", level)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, options)
+		invalid = append(invalid, "LOG_FORMAT", format)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	serverLog = slog.With("component", "server")
+	apiLog = slog.With("component", "api")
+	adminLog = slog.With("component", "admin")
+	indexerLog = slog.With("component", "indexer")
+	settingsLog = slog.With("component", "settings")
+	backendLog = slog.With("component", "backend")
+	jobsLog = slog.With("component", "jobs")
+	moderationLog = slog.With("component", "moderation")
+
+	if len(invalid) > 0 {
+		serverLog.Warn("invalid logging settings ignored", invalid...)
+	}
+}
+
+// logRequests logs every request with the api logger, in place of the access log of echo.
+var logRequests = middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+	LogMethod:    true,
+	LogURI:       true,
+	LogStatus:    true,
+	LogLatency:   true,
+	LogRemoteIP:  true,
+	LogRequestID: true,
+	LogError:     true,
+	HandleError:  true,
+	LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+		attrs := []any{
+			"method", v.Method,
+			"uri", v.URI,
+			"status", v.Status,
+			"latency", v.Latency,
+			"remoteIP", v.RemoteIP,
+			"requestID", v.RequestID,
+		}
+		if v.Error != nil {
+			attrs = append(attrs, "error", v.Error)
+		}
+		level := slog.LevelInfo
+		if v.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		apiLog.Log(c.Request().Context(), level, "request", attrs...)
+		return nil
+	},
+})
+
+func setupLogLevelRoutes(admin *echo.Group) {
+
+	admin.GET("/loglevel", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{
+			"level": strings.ToLower(logLevel.Level().String()),
+		}})
+	})
+
+	admin.PUT("/loglevel", func(c echo.Context) error {
+		var request struct {
+			Level string `json:"level"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+
+		var level slog.Level
+		err = level.UnmarshalText([]byte(request.Level))
+		if err != nil {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "level", "level must be one of debug, info, warn, error")
+		}
+
+		logLevel.Set(level)
+		adminLog.Warn("log level changed", "level", level.String())
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{
+			"level": strings.ToLower(level.String()),
+		}})
+	})
+}
@@ -2,24 +2,21 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"slices"
+	"os/signal"
 	"strconv"
-	"sync/atomic"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/meilisearch/meilisearch-go"
 	"github.com/redis/go-redis/v9"
-	"github.com/totegamma/concurrent/cdid"
-	"github.com/totegamma/concurrent/core"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 )
 
 var (
@@ -29,6 +26,7 @@ var (
 	meilisearch_idx = ""
 	redis_url       = ""
 	port            = 8000
+	admin_token     = ""
 )
 
 var (
@@ -38,132 +36,144 @@ var (
 	goVersion    = "unknown"
 )
 
-var indexing int32 = 0
+var linkPreviewer *ogpFetcher
 
 type searchResult struct {
-	ID    string `json:"id"`
-	Owner string `json:"owner"`
+	ID       string          `json:"id"`
+	Owner    string          `json:"owner"`
+	Preview  *messagePreview `json:"preview,omitempty"`
+	Snippet  string          `json:"snippet,omitempty"`
+	Document *searchDocument `json:"document,omitempty"`
 }
 
-type messageRecord struct {
-	ID        string   `json:"id"`
-	Type      string   `json:"type"`
-	Body      any      `json:"body"`
-	Schema    string   `json:"schema"`
-	SignedAt  int64    `json:"signedAt"`
-	Signer    string   `json:"signer"`
-	Timelines []string `json:"timelines"`
+// searchDocument is the indexed message returned with include=document. Messages of
+// schemas known to the registry have their text instead of their body.
+type searchDocument struct {
+	Schema         string   `json:"schema"`
+	SignedAt       int64    `json:"signedAt"`
+	UpdatedAt      int64    `json:"updatedAt,omitempty"`
+	Timelines      []string `json:"timelines"`
+	Body           any      `json:"body,omitempty"`
+	Text           string   `json:"text,omitempty"`
+	ContentWarning string   `json:"contentWarning,omitempty"`
 }
 
-func indexLogs(ctx context.Context, db *gorm.DB, rdb *redis.Client, index meilisearch.IndexManager) {
-
-	if atomic.CompareAndSwapInt32(&indexing, 0, 1) {
-		defer atomic.StoreInt32(&indexing, 0)
-	} else {
-		return
-	}
-
-	lastKeyStr, err := rdb.Get(ctx, "ccsearch:readitr").Result()
-	if err != nil {
-		log.Println("lastKey not found")
-		lastKeyStr = "0"
-	}
-
-	lastKey64, err := strconv.ParseUint(lastKeyStr, 10, 64)
-	if err != nil {
-		log.Println("lastKey is not integer")
-		lastKey64 = 0
-	}
-
-	lastKey := uint(lastKey64)
-
-	pageSize := 512
-
-	for {
-		var commits []core.CommitLog
-		db.Where("id > ?", lastKey).Limit(pageSize).Find(&commits)
-
-		documents := []messageRecord{}
-
-		for _, commit := range commits {
-
-			document := commit.Document
-
-			var doc core.DocumentBase[any]
-			err := json.Unmarshal([]byte(document), &doc)
-			if err != nil {
-				continue
-			}
-
-			hash := core.GetHash([]byte(document))
-			hash10 := [10]byte{}
-			copy(hash10[:], hash[:10])
-			signedAt := doc.SignedAt
-			cdidBase := cdid.New(hash10, signedAt).String()
-
-			switch doc.Type {
-			case "message":
-				{
-					id := "m" + cdidBase
-					var message core.MessageDocument[any]
-					err := json.Unmarshal([]byte(document), &message)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-					documents = append(documents, messageRecord{
-						ID:        id,
-						Type:      "message",
-						Body:      message.Body,
-						Schema:    message.Schema,
-						SignedAt:  message.SignedAt.UnixMilli(),
-						Signer:    message.Signer,
-						Timelines: message.Timelines,
-					})
-				}
-			}
+type messageRecord struct {
+	ID             string            `json:"id"`
+	Type           string            `json:"type"`
+	Body           any               `json:"body,omitempty"`
+	Text           string            `json:"text,omitempty"`
+	ContentWarning string            `json:"contentWarning,omitempty"`
+	Fields         map[string]any    `json:"fields,omitempty"`
+	Preview        *messagePreview   `json:"preview,omitempty"`
+	Schema         string            `json:"schema"`
+	SignedAt       int64             `json:"signedAt"`
+	UpdatedAt      int64             `json:"updatedAt,omitempty"`
+	Signer         string            `json:"signer"`
+	Timelines      []string          `json:"timelines"`
+	Links          []string          `json:"links,omitempty"`
+	LinkDomains    []string          `json:"linkDomains,omitempty"`
+	Hashtags       []string          `json:"hashtags,omitempty"`
+	Mentions       []string          `json:"mentions,omitempty"`
+	Lang           string            `json:"lang,omitempty"`
+	LinkPreviews   []linkPreview     `json:"linkPreviews,omitempty"`
+	Media          []mediaAttachment `json:"media,omitempty"`
+	Geo            *geoPoint         `json:"_geo,omitempty"`
+	ThreadRoot     string            `json:"threadRoot,omitempty"`
+	Hidden         bool              `json:"hidden,omitempty"`
+	HiddenAt       int64             `json:"hiddenAt,omitempty"`
+	Penalty        int               `json:"penalty"`
+	Spam           bool              `json:"spam,omitempty"`
+	SpamScore      float64           `json:"spamScore,omitempty"`
+	Flagged        bool              `json:"flagged,omitempty"`
+	Restricted     bool              `json:"restricted,omitempty"`
+	ExpiresAt      int64             `json:"expiresAt,omitempty"`
+	// Truncated marks a record whose strings were cut to fit MAX_DOCUMENT_SIZE.
+	Truncated bool `json:"truncated,omitempty"`
+}
 
-			lastKey = commit.ID
-		}
+func main() {
 
-		if len(documents) == 0 {
-			break
-		}
+	flags := flag.NewFlagSet("cc-search", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML config file; environment variables override its settings")
+	flags.Parse(os.Args[1:])
 
-		_, err := index.AddDocuments(documents)
+	if *configPath != "" {
+		err := loadConfigFile(*configPath)
 		if err != nil {
-			log.Println(err)
-			break
+			slog.Error("invalid config file", "path", *configPath, "error", err)
+			os.Exit(1)
 		}
+	}
 
-		rdb.Set(ctx, "ccsearch:readitr", lastKey, 0)
-		log.Println("indexed until -> ", lastKey)
+	setupLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
 
-		if len(commits) < pageSize { // no more commits
-			break
-		}
+	commands := map[string]func([]string) error{
+		"serve":   runServe,
+		"reindex": runReindex,
+		"verify":  runVerify,
+		"purge":   runPurge,
+		"bench":   runBench,
+		"doctor":  runDoctor,
+	}
 
-		time.Sleep(1 * time.Second)
+	// without a command the service is started, as before the commands existed
+	args := flags.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		serverLog.Error("unknown command", "command", args[0], "expected", strings.Join(sortedKeys(commands), ", "))
+		os.Exit(1)
+	}
+	err := command(args[1:])
+	if err != nil {
+		serverLog.Error("command failed", "command", args[0], "error", err)
+		os.Exit(1)
 	}
 }
 
-func main() {
-
+// loadConnectionConfig reads the settings of the backends from the environment.
+func loadConnectionConfig() {
 	db_dsn = os.Getenv("DB_DSN")
 	redis_url = os.Getenv("REDIS_URL")
 	meilisearch_url = os.Getenv("MEILISEARCH_URL")
 	meilisearch_key = os.Getenv("MEILISEARCH_KEY")
 	meilisearch_idx = os.Getenv("MEILISEARCH_IDX")
+}
+
+// runServe implements `cc-search serve`, the search service and its indexer.
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
+
+	loadConnectionConfig()
 	port_env := os.Getenv("PORT")
 	if port_env != "" {
 		port, _ = strconv.Atoi(port_env)
 	}
+	admin_token = os.Getenv("ADMIN_TOKEN")
+	err := setupAdminKeys()
+	if err != nil {
+		panic(err)
+	}
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	e := echo.New()
+	err = setupTrustedProxies()
+	if err != nil {
+		panic(err)
+	}
+	e.IPExtractor = ipExtractor()
 
-	db, err := gorm.Open(postgres.Open(db_dsn), &gorm.Config{})
+	db, err := openPostgres(db_dsn)
 	if err != nil {
-		panic("failed to connect database")
+		panic(err)
 	}
 
 	rdb := redis.NewClient(&redis.Options{
@@ -171,149 +181,300 @@ func main() {
 		Password: "",
 		DB:       0,
 	})
+	err = traceRedis(rdb)
+	if err != nil {
+		panic(err)
+	}
 
-	client := meilisearch.New(meilisearch_url, meilisearch.WithAPIKey(meilisearch_key))
-	_, err = client.GetIndex(meilisearch_idx)
+	features = newFeatureFlags(rdb, os.Getenv("FEATURES"))
+	maintenance = newMaintenanceMode(rdb)
+	linkPreviewer = newOgpFetcher(rdb)
+	commitOwners = newOwnerFilter(db)
+	blocked, err = newBlocklist(rdb, db)
 	if err != nil {
-		_, err = client.CreateIndex(&meilisearch.IndexConfig{
-			Uid: meilisearch_idx,
-		})
-		if err != nil {
-			panic(err)
-		}
+		panic(err)
+	}
+	setupSchemaFilter()
+	err = setupPolicies(db)
+	if err != nil {
+		panic(err)
+	}
+	err = setupAuth(db)
+	if err != nil {
+		panic(err)
+	}
+	err = setupOptOut(db)
+	if err != nil {
+		panic(err)
+	}
+	err = setupRateLimits(rdb)
+	if err != nil {
+		panic(err)
+	}
+	err = setupRetention()
+	if err != nil {
+		panic(err)
+	}
+	err = setupDocumentSize()
+	if err != nil {
+		panic(err)
+	}
+	err = setupTimelineSettings(db)
+	if err != nil {
+		panic(err)
+	}
+	setupSkipSampling()
+	err = setupSchemaRegistry()
+	if err != nil {
+		panic(err)
+	}
+	err = setupSuppression()
+	if err != nil {
+		panic(err)
+	}
+	webhooks, err = newWebhookNotifier(rdb)
+	if err != nil {
+		panic(err)
+	}
+	err = setupSpamScoring()
+	if err != nil {
+		panic(err)
+	}
+	err = setupReports()
+	if err != nil {
+		panic(err)
+	}
+	moderation, err = newModerator(rdb, os.Getenv("MODERATION_MODE"), os.Getenv("MODERATION_RETENTION"))
+	if err != nil {
+		panic(err)
+	}
+
+	meiliConfig, err := loadMeilisearchConfig()
+	if err != nil {
+		panic(err)
+	}
+	client := newMeilisearchClient(meilisearch_url, meilisearch_key, meiliConfig)
+	backend, err := newSearchBackend(client)
+	if err != nil {
+		panic(err)
+	}
+	err = setupSearchDictionary()
+	if err != nil {
+		panic(err)
+	}
+	err = setupTypoTolerance()
+	if err != nil {
+		panic(err)
+	}
+	err = setupReplicas(meiliConfig)
+	if err != nil {
+		panic(err)
+	}
+	primary, err := backend.openIndex(meilisearch_idx)
+	if err != nil {
+		panic(err)
 	}
 
-	index := client.Index(meilisearch_idx)
-	filterables, err := index.GetFilterableAttributes()
+	index := replicated(primary, meilisearch_idx)
+	err = index.ensureSettings(messageSettings)
 	if err != nil {
 		panic(err)
 	}
-	filters := []string{"signer", "timelines"}
 
-	ok := false
-	if len(*filterables) == len(filters) {
-		for _, filter := range filters {
-			if !slices.Contains(*filterables, filter) {
-				ok = false
-				break
-			}
-		}
-		ok = true
+	err = setupSharding(context.Background(), backend, rdb, index)
+	if err != nil {
+		panic(err)
 	}
-	if !ok {
-		_, err := index.UpdateFilterableAttributes(&filters)
-		if err != nil {
-			panic(err)
-		}
-		log.Println("filterables updated")
+
+	err = setupIndexRoutes(backend)
+	if err != nil {
+		panic(err)
+	}
+
+	err = setupCompletions(backend, rdb)
+	if err != nil {
+		panic(err)
 	}
 
-	sorts := []string{"signedAt"}
-	sortables, err := index.GetSortableAttributes()
+	err = setupPipelines(db, rdb, backend)
 	if err != nil {
 		panic(err)
 	}
 
-	ok = false
-	if len(*sortables) == len(sorts) {
-		for _, sort := range sorts {
-			if !slices.Contains(*sortables, sort) {
-				ok = false
-				break
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	jobs.register("trends", 5*time.Minute, 30*time.Second, true, func(ctx context.Context) error {
+		if !features.enabled(ctx, featureTrends) {
+			return nil
+		}
+		computeTrends(ctx, rdb, messageIndexes())
+		return nil
+	})
+	jobs.register("reconciliation", 10*time.Minute, time.Minute, true, func(ctx context.Context) error {
+		err := index.ensureSettings(messageSettings)
+		if err != nil {
+			return err
+		}
+		for _, p := range getPipelines() {
+			err := p.index.ensureSettings(transformers[p.transform].settings)
+			if err != nil {
+				return err
 			}
 		}
-		ok = true
+		for _, route := range indexRoutes {
+			err := route.index.ensureSettings(route.settings())
+			if err != nil {
+				return err
+			}
+		}
+		if messageShards != nil {
+			for _, shard := range messageShards.all()[1:] {
+				err := shard.ensureSettings(messageSettings)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, messageIndex := range messageIndexes() {
+			err := backfillPenalties(messageIndex)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if messageShards != nil {
+		jobs.register("shard_rollover", time.Hour, 5*time.Minute, true, messageShards.rollover)
 	}
-	if !ok {
-		_, err := index.UpdateSortableAttributes(&sorts)
+	jobs.register("moderation_purge", time.Hour, 5*time.Minute, true, func(ctx context.Context) error {
+		return moderation.purgeExpired(ctx)
+	})
+	jobs.register("blocklist", 5*time.Minute, time.Minute, true, func(ctx context.Context) error {
+		return blocked.enforce(ctx)
+	})
+	jobs.register("optout_sweep", time.Hour, 10*time.Minute, true, func(ctx context.Context) error {
+		return optOuts.sweep(ctx)
+	})
+	jobs.register("related", 30*time.Minute, time.Minute, true, func(ctx context.Context) error {
+		return computeRelated(ctx, rdb, messageIndexes())
+	})
+	jobs.register("expiration", 5*time.Minute, 30*time.Second, true, func(ctx context.Context) error {
+		return purgeExpiredMessages()
+	})
+	jobs.register("retention", time.Hour, 5*time.Minute, true, func(ctx context.Context) error {
+		return pruneOldMessages()
+	})
+	jobs.register("lag_check", time.Minute, 0, true, func(ctx context.Context) error {
+		latest, err := getLatestCommitID(db)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		log.Println("sortables updated")
+		webhooks.checkLag(ctx, latest)
+		return webhooks.checkDeadLetters(ctx)
+	})
+	digest, err := setupDigest(rdb, index)
+	if err != nil {
+		panic(err)
+	}
+	if digest != nil {
+		jobs.register("digest", digest.interval, 0, true, digest.run)
+	}
+	if searchBackendName == "meilisearch" {
+		jobs.register("dumps", 24*time.Hour, 0, false, func(ctx context.Context) error {
+			_, err := client.CreateDump()
+			return err
+		})
 	}
 
-	ctx := context.Background()
+	if searchReplicas != nil {
+		go searchReplicas.run(ctx)
+	}
 
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				go indexLogs(ctx, db, rdb, index)
-			}
-		}
-	}()
+	elector = newLeaderElection(rdb)
+	go elector.run(ctx)
+	jobs.start(ctx, elector.leader)
 
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
+	err = startMetricsExport(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+	err = startIndexEvents(ctx, rdb)
+	if err != nil {
+		panic(err)
+	}
+	err = setupLive(ctx, rdb)
+	if err != nil {
+		panic(err)
+	}
 
-	e.GET("/cc-info", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, core.CCInfo{
-			Name:    "github.com/concrnt/cc-search",
-			Version: version,
-		})
-	})
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(middleware.RequestID())
+	e.Use(logRequests)
+	e.Use(middleware.Recover())
+	e.Use(traceRequests)
+	if origins := os.Getenv("CORS_ORIGINS"); origins != "" {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins: strings.Split(origins, ","),
+		}))
+	} else {
+		e.Use(middleware.CORS())
+	}
 
-	e.GET("/timeline/:id", func(c echo.Context) error {
-		query := c.QueryParam("q")
-		if query == "" {
-			return c.JSON(http.StatusBadRequest, echo.Map{
-				"error": "query is empty",
-			})
-		}
+	e.GET("/cc-info", ccInfoHandler)
 
-		offsetStr := c.QueryParam("offset")
-		offset := 0
-		if offsetStr != "" {
-			offset, _ = strconv.Atoi(offsetStr)
-		}
+	e.GET("/.well-known/cc-search", discoveryHandler)
+	e.GET("/metrics", prometheusHandler(db))
+	e.GET("/healthz", probeHandler(db, rdb, backend, false))
+	e.GET("/readyz", probeHandler(db, rdb, backend, true))
 
-		timeline := c.Param("id")
-		if timeline == "" {
-			return c.JSON(http.StatusBadRequest, echo.Map{
-				"error": "timeline is empty",
-			})
-		}
+	err = setupAPI(e, rdb, index)
+	if err != nil {
+		panic(err)
+	}
 
-		search, err := index.Search(query,
-			&meilisearch.SearchRequest{
-				Limit:  10,
-				Offset: int64(offset),
-				Filter: fmt.Sprintf("timelines = \"%s\"", timeline),
-				Sort:   []string{"signedAt:desc"},
-			},
-		)
+	setupIngest(e)
+	setupAdmin(e, db, rdb, backend, index)
 
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{
-				"error": err.Error(),
-			})
+	go func() {
+		err := e.Start(fmt.Sprintf(":%d", port))
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverLog.Error("http server failed", "error", err)
+			os.Exit(1)
 		}
+	}()
 
-		hits := search.Hits
-		if hits == nil {
-			return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": []searchResult{}})
-		}
+	<-ctx.Done()
+	shutdown(e)
+	return nil
+}
 
-		var results []searchResult
-		for _, hit := range hits {
-			hitDoc := hit.(map[string]any)
-			results = append(results, searchResult{
-				ID:    hitDoc["id"].(string),
-				Owner: hitDoc["signer"].(string),
-			})
+// shutdown stops the service once a signal is received: it drains the HTTP connections,
+// waits for the running jobs (the indexer writes and checkpoints its current batch) and
+// hands the leadership over, all within SHUTDOWN_TIMEOUT (default 30s).
+func shutdown(e *echo.Echo) {
+	timeout := 30 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			serverLog.Warn("invalid SHUTDOWN_TIMEOUT", "value", value)
+		} else {
+			timeout = parsed
 		}
+	}
+	serverLog.Info("shutting down", "timeout", timeout)
 
-		return c.JSON(http.StatusOK,
-			echo.Map{
-				"status":  "ok",
-				"content": results,
-				"limit":   search.Limit,
-				"offset":  search.Offset,
-			},
-		)
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	log.Fatal(e.Start(fmt.Sprintf(":%d", port)))
+	err := e.Shutdown(ctx)
+	if err != nil {
+		serverLog.Error("http shutdown failed", "error", err)
+	}
+	err = jobs.wait(ctx)
+	if err != nil {
+		serverLog.Warn("jobs still running at shutdown", "error", err)
+	}
+	elector.resign(ctx)
+	serverLog.Info("shutdown complete")
 }
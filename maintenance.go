@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+type maintenanceState struct {
+	IndexerPaused     bool `json:"indexerPaused"`
+	SearchMaintenance bool `json:"searchMaintenance"`
+}
+
+// maintenanceMode holds the operator toggles shared by every replica through redis.
+type maintenanceMode struct {
+	rdb *redis.Client
+
+	mu          sync.Mutex
+	state       maintenanceState
+	refreshedAt time.Time
+}
+
+var maintenance *maintenanceMode
+
+func newMaintenanceMode(rdb *redis.Client) *maintenanceMode {
+	return &maintenanceMode{
+		rdb: rdb,
+	}
+}
+
+func (m *maintenanceMode) refresh(ctx context.Context) {
+	m.refreshedAt = time.Now()
+
+	values, err := m.rdb.HGetAll(ctx, "ccsearch:maintenance").Result()
+	if err != nil {
+		reportError("maintenance", err)
+		return
+	}
+
+	indexerPaused, _ := strconv.ParseBool(values["indexerPaused"])
+	searchMaintenance, _ := strconv.ParseBool(values["searchMaintenance"])
+	m.state = maintenanceState{
+		IndexerPaused:     indexerPaused,
+		SearchMaintenance: searchMaintenance,
+	}
+}
+
+func (m *maintenanceMode) get(ctx context.Context) maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.refreshedAt) > featureRefreshInterval {
+		m.refresh(ctx)
+	}
+	return m.state
+}
+
+func (m *maintenanceMode) update(ctx context.Context, indexerPaused, searchMaintenance *bool) (maintenanceState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := map[string]any{}
+	if indexerPaused != nil {
+		values["indexerPaused"] = strconv.FormatBool(*indexerPaused)
+	}
+	if searchMaintenance != nil {
+		values["searchMaintenance"] = strconv.FormatBool(*searchMaintenance)
+	}
+
+	if len(values) > 0 {
+		err := m.rdb.HSet(ctx, "ccsearch:maintenance", values).Err()
+		if err != nil {
+			return m.state, err
+		}
+	}
+
+	m.refresh(ctx)
+	return m.state, nil
+}
+
+// searchGuard rejects search requests while the search backend is under maintenance.
+func searchGuard(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if maintenance.get(c.Request().Context()).SearchMaintenance {
+			c.Response().Header().Set("Retry-After", "60")
+			return respondError(c, http.StatusServiceUnavailable, codeMaintenance, "search is under maintenance")
+		}
+		return next(c)
+	}
+}
+
+func setupMaintenanceRoutes(admin *echo.Group) {
+
+	admin.GET("/maintenance", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": maintenance.get(c.Request().Context())})
+	})
+
+	admin.PUT("/maintenance", func(c echo.Context) error {
+		var request struct {
+			IndexerPaused     *bool `json:"indexerPaused"`
+			SearchMaintenance *bool `json:"searchMaintenance"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+
+		state, err := maintenance.update(c.Request().Context(), request.IndexerPaused, request.SearchMaintenance)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		adminLog.Info("maintenance updated", "indexerPaused", state.IndexerPaused, "searchMaintenance", state.SearchMaintenance)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": state})
+	})
+}
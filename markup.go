@@ -0,0 +1,78 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownFence      = regexp.MustCompile("(?m)^\\s*(```|~~~).*$")
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownReference  = regexp.MustCompile(`\[([^\]]*)\]\[[^\]]*\]`)
+	markdownHeading    = regexp.MustCompile(`(?m)^\s{0,3}#{1,6}\s+`)
+	markdownQuote      = regexp.MustCompile(`(?m)^\s{0,3}(>\s?)+`)
+	markdownList       = regexp.MustCompile(`(?m)^\s*([-*+]|\d+[.)])\s+(\[[ xX]\]\s+)?`)
+	markdownRule       = regexp.MustCompile(`(?m)^\s{0,3}([-*_]\s*){3,}$`)
+	markdownEmphasis   = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__|~~(\S(?:.*?\S)?)~~`)
+	markdownItalic     = regexp.MustCompile(`(^|[^\p{L}\p{N}*_])[*_](\S(?:[^*_]*?\S)?)[*_]([^\p{L}\p{N}*_]|$)`)
+	markdownCode       = regexp.MustCompile("`+([^`]*)`+")
+	htmlComment        = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTag            = regexp.MustCompile(`</?[a-zA-Z][^<>]*>`)
+	bareURL            = regexp.MustCompile(`<?https?://[^\s<>()]+>?`)
+	horizontalSpace    = regexp.MustCompile(`[ \t\p{Zs}]+`)
+	repeatedBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// plainText turns the text of a message body into the words a reader sees, for the
+// searchable text and the previews: markdown syntax, HTML tags and URLs are removed,
+// while the text of links, images and code stays. The links themselves are indexed on
+// their own by extractLinks.
+func plainText(markup, text string) string {
+	switch markup {
+	case "markdown":
+		text = stripMarkdown(text)
+	case "html":
+		text = stripHTML(text)
+	default:
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(horizontalSpace.ReplaceAllString(line, " "))
+	}
+	text = strings.Join(lines, "\n")
+	return strings.TrimSpace(repeatedBlankLines.ReplaceAllString(text, "\n\n"))
+}
+
+func stripMarkdown(text string) string {
+	text = markdownFence.ReplaceAllString(text, "")
+	text = markdownRule.ReplaceAllString(text, "")
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1")
+	text = markdownReference.ReplaceAllString(text, "$1")
+	// concrnt markdown allows HTML
+	text = stripHTML(text)
+	text = markdownHeading.ReplaceAllString(text, "")
+	text = markdownQuote.ReplaceAllString(text, "")
+	text = markdownList.ReplaceAllString(text, "")
+	text = markdownCode.ReplaceAllString(text, "$1")
+	for {
+		stripped := markdownEmphasis.ReplaceAllString(text, "$1$2$3")
+		stripped = markdownItalic.ReplaceAllString(stripped, "$1$2$3")
+		if stripped == text {
+			return text
+		}
+		text = stripped
+	}
+}
+
+// stripHTML removes the tags and the URLs, which are not worth indexing as words.
+func stripHTML(text string) string {
+	text = htmlComment.ReplaceAllString(text, "")
+	text = htmlTag.ReplaceAllString(text, " ")
+	text = bareURL.ReplaceAllString(text, "")
+	return html.UnescapeString(text)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// mediaAttachment is the searchable metadata of a file attached to a message, so that a
+// search for "cat.png" or the words of its alt text finds the message.
+type mediaAttachment struct {
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+	Alt  string `json:"alt,omitempty"`
+}
+
+// mediaName returns the file name of a media URL, the last segment of its path.
+func mediaName(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(parsed.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// stringAt returns the first string at a path of value.
+func stringAt(value any, p string) string {
+	if p == "" {
+		return ""
+	}
+	for _, found := range valuesAt(value, splitPath(p)) {
+		if s, ok := found.(string); ok && strings.TrimSpace(s) != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// media returns the metadata of the items at the Media path of a message body. The paths
+// of the metadata are relative to an item, and the name falls back to the file name of
+// its URL.
+func (m schemaMapping) media(body any) []mediaAttachment {
+	if m.Media == "" {
+		return nil
+	}
+	var attachments []mediaAttachment
+	for _, item := range valuesAt(body, splitPath(m.Media)) {
+		attachment := mediaAttachment{
+			Name: stringAt(item, m.MediaName),
+			Type: stringAt(item, m.MediaType),
+			Alt:  stringAt(item, m.MediaAlt),
+		}
+		if attachment.Name == "" {
+			attachment.Name = mediaName(stringAt(item, m.MediaURL))
+		}
+		if attachment == (mediaAttachment{}) {
+			continue
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// meilisearchConfig controls how long a request to the search engine may take and how
+// failed requests are retried.
+type meilisearchConfig struct {
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func loadMeilisearchConfig() (meilisearchConfig, error) {
+	config := meilisearchConfig{
+		timeout:    10 * time.Second,
+		retries:    3,
+		backoff:    200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+
+	for name, target := range map[string]*time.Duration{
+		"MEILISEARCH_TIMEOUT":     &config.timeout,
+		"MEILISEARCH_BACKOFF":     &config.backoff,
+		"MEILISEARCH_MAX_BACKOFF": &config.maxBackoff,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return config, fmt.Errorf("invalid %s: %s", name, value)
+		}
+		*target = parsed
+	}
+
+	if value := os.Getenv("MEILISEARCH_RETRIES"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return config, fmt.Errorf("invalid MEILISEARCH_RETRIES: %s", value)
+		}
+		config.retries = parsed
+	}
+
+	return config, nil
+}
+
+func newMeilisearchClient(url, key string, config meilisearchConfig) meilisearch.ServiceManager {
+	httpClient := &http.Client{
+		Transport: tracedTransport(&retryTransport{
+			base:   http.DefaultTransport,
+			config: config,
+		}, "meilisearch"),
+	}
+
+	return meilisearch.New(url,
+		meilisearch.WithAPIKey(key),
+		meilisearch.WithCustomClient(httpClient),
+		meilisearch.DisableRetries(),
+	)
+}
+
+// retryTransport bounds every attempt with the configured timeout and retries
+// transient failures with an exponential backoff.
+type retryTransport struct {
+	base   http.RoundTripper
+	config meilisearchConfig
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.config.backoff
+	retries := t.config.retries
+	if req.Body != nil && req.GetBody == nil {
+		// the body cannot be replayed
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(req.Context(), t.config.timeout)
+		attemptReq := req.WithContext(ctx)
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			if resp.StatusCode >= 500 {
+				metrics.add("meilisearch_errors_total", map[string]string{"status": strconv.Itoa(resp.StatusCode)}, 1)
+			}
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if attempt >= retries || req.Context().Err() != nil {
+			if err != nil {
+				cancel()
+				metrics.add("meilisearch_errors_total", map[string]string{"status": "network"}, 1)
+				return nil, err
+			}
+			metrics.add("meilisearch_errors_total", map[string]string{"status": strconv.Itoa(resp.StatusCode)}, 1)
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if err != nil {
+			backendLog.Warn("meilisearch request failed, retrying", "backoff", backoff, "error", err)
+		} else {
+			backendLog.Warn("meilisearch request failed, retrying", "backoff", backoff, "status", resp.StatusCode)
+			resp.Body.Close()
+		}
+		cancel()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, t.config.maxBackoff)
+	}
+}
+
+// cancelOnClose releases the per-attempt timeout once the response body has been consumed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+)
+
+// mentionPattern matches a mention in text, an '@' followed by a CCID.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@(con1[0-9a-z]+)`)
+
+// ccidPattern matches a CCID given as a parameter.
+var ccidPattern = regexp.MustCompile(`^con1[0-9a-z]+$`)
+
+// extractMentions collects the CCIDs a message body mentions: the ones of its mentions
+// list, which the concrnt clients fill in, and the @-mentions of its text. Handles are
+// not stable identities, so only mentions by CCID are indexed.
+func extractMentions(body any) []string {
+	mentions := []string{}
+	if fields, ok := body.(map[string]any); ok {
+		if list, ok := fields["mentions"].([]any); ok {
+			for _, value := range list {
+				if ccid, ok := value.(string); ok && ccidPattern.MatchString(ccid) && !slices.Contains(mentions, ccid) {
+					mentions = append(mentions, ccid)
+				}
+			}
+		}
+	}
+	walkStrings(body, func(text string) {
+		for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+			if !slices.Contains(mentions, match[1]) {
+				mentions = append(mentions, match[1])
+			}
+		}
+	})
+	if len(mentions) == 0 {
+		return nil
+	}
+	return mentions
+}
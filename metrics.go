@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// metricPoint is one value of a metric. Counters are cumulative since the process start.
+type metricPoint struct {
+	Name    string
+	Labels  map[string]string
+	Value   float64
+	Counter bool
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// labelKey identifies the series of a metric, e.g. "pipeline=messages".
+func labelKey(labels map[string]string) string {
+	keys := sortedKeys(labels)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + labels[key]
+	}
+	return strings.Join(parts, ",")
+}
+
+// durationBuckets are the upper bounds, in seconds, of the duration histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram counts observations per bucket. counts[i] holds the observations up to
+// buckets[i], not cumulated; the last entry counts the ones above every bucket.
+type histogram struct {
+	Name    string
+	Labels  map[string]string
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// metricsRegistry holds the counters and histograms of the process. Gauges are read when
+// the metrics are collected.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]*metricPoint
+	histograms map[string]*histogram
+}
+
+var metrics = &metricsRegistry{counters: map[string]*metricPoint{}, histograms: map[string]*histogram{}}
+
+// observe records a duration, in seconds, in a histogram.
+func (r *metricsRegistry) observe(name string, labels map[string]string, value float64) {
+	key := name + "{" + labelKey(labels) + "}"
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.histograms[key]
+	if !ok {
+		h = &histogram{Name: name, Labels: labels, Buckets: durationBuckets, Counts: make([]uint64, len(durationBuckets)+1)}
+		r.histograms[key] = h
+	}
+	i, _ := slices.BinarySearch(h.Buckets, value)
+	h.Counts[i]++
+	h.Sum += value
+	h.Count++
+}
+
+func (r *metricsRegistry) histogramSnapshot() []histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := make([]histogram, 0, len(r.histograms))
+	for _, h := range r.histograms {
+		copied := *h
+		copied.Counts = slices.Clone(h.Counts)
+		snapshot = append(snapshot, copied)
+	}
+	return snapshot
+}
+
+// histogramTotals reports the histograms as _sum and _count counters, for the push
+// exporters.
+func (r *metricsRegistry) histogramTotals() []metricPoint {
+	points := []metricPoint{}
+	for _, h := range r.histogramSnapshot() {
+		points = append(points,
+			metricPoint{Name: h.Name + "_sum", Labels: h.Labels, Value: h.Sum, Counter: true},
+			metricPoint{Name: h.Name + "_count", Labels: h.Labels, Value: float64(h.Count), Counter: true},
+		)
+	}
+	return points
+}
+
+func (r *metricsRegistry) add(name string, labels map[string]string, value float64) {
+	key := name + "{" + labelKey(labels) + "}"
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	point, ok := r.counters[key]
+	if !ok {
+		point = &metricPoint{Name: name, Labels: labels, Counter: true}
+		r.counters[key] = point
+	}
+	point.Value += value
+}
+
+// collect returns the counters and the current gauges.
+func (r *metricsRegistry) collect(ctx context.Context, db *gorm.DB) []metricPoint {
+	r.mu.Lock()
+	points := make([]metricPoint, 0, len(r.counters))
+	for _, point := range r.counters {
+		points = append(points, *point)
+	}
+	r.mu.Unlock()
+
+	points = append(points, metricPoint{
+		Name:  "uptime_seconds",
+		Value: time.Since(startTime).Seconds(),
+	})
+	if live != nil {
+		points = append(points, metricPoint{Name: "live_subscribers", Value: float64(live.count())})
+	}
+
+	latest, err := getLatestCommitID(db)
+	if err != nil {
+		return points
+	}
+	for _, status := range pipelineStatuses(ctx, latest) {
+		labels := map[string]string{"pipeline": status.Name}
+		points = append(points,
+			metricPoint{Name: "indexer_lag", Labels: labels, Value: float64(status.Lag)},
+			metricPoint{Name: "indexer_cursor", Labels: labels, Value: float64(status.Checkpoint)},
+		)
+	}
+	return points
+}
+
+type metricsExporter interface {
+	export(ctx context.Context, points []metricPoint) error
+}
+
+// statsdExporter sends the metrics over UDP with DogStatsD-style tags. Counters are
+// sent as the increase since the previous push.
+type statsdExporter struct {
+	conn   net.Conn
+	prefix string
+	sent   map[string]float64
+}
+
+func (s *statsdExporter) export(ctx context.Context, points []metricPoint) error {
+	var buf bytes.Buffer
+	for _, point := range points {
+		line := s.prefix + point.Name + ":"
+		if point.Counter {
+			key := point.Name + "{" + labelKey(point.Labels) + "}"
+			delta := point.Value - s.sent[key]
+			s.sent[key] = point.Value
+			if delta == 0 {
+				continue
+			}
+			line += strconv.FormatFloat(delta, 'f', -1, 64) + "|c"
+		} else {
+			line += strconv.FormatFloat(point.Value, 'f', -1, 64) + "|g"
+		}
+		if len(point.Labels) > 0 {
+			line += "|#" + strings.ReplaceAll(strings.ReplaceAll(labelKey(point.Labels), "=", ":"), " ", "_")
+		}
+
+		// keep datagrams below a typical MTU
+		if buf.Len() > 0 && buf.Len()+len(line) > 1400 {
+			_, err := s.conn.Write(buf.Bytes())
+			if err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// otlpExporter posts the metrics to an OTLP/HTTP collector using the JSON encoding.
+type otlpExporter struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	attributes := []otlpAttribute{}
+	for _, key := range sortedKeys(labels) {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: map[string]any{"stringValue": labels[key]}})
+	}
+	return attributes
+}
+
+func (o *otlpExporter) export(ctx context.Context, points []metricPoint) error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(startTime.UnixNano(), 10)
+
+	byName := map[string][]metricPoint{}
+	for _, point := range points {
+		byName[point.Name] = append(byName[point.Name], point)
+	}
+
+	otlpMetrics := []map[string]any{}
+	for _, name := range sortedKeys(byName) {
+		dataPoints := []otlpDataPoint{}
+		counter := false
+		for _, point := range byName[name] {
+			dataPoint := otlpDataPoint{
+				Attributes:   otlpAttributes(point.Labels),
+				TimeUnixNano: now,
+				AsDouble:     point.Value,
+			}
+			if point.Counter {
+				counter = true
+				dataPoint.StartTimeUnixNano = start
+			}
+			dataPoints = append(dataPoints, dataPoint)
+		}
+
+		metric := map[string]any{"name": o.prefix + name}
+		if counter {
+			metric["sum"] = map[string]any{
+				"dataPoints":             dataPoints,
+				"aggregationTemporality": 2, // cumulative
+				"isMonotonic":            true,
+			}
+		} else {
+			metric["gauge"] = map[string]any{"dataPoints": dataPoints}
+		}
+		otlpMetrics = append(otlpMetrics, metric)
+	}
+
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(map[string]any{
+		"resourceMetrics": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": otlpAttributes(map[string]string{
+						"service.name":        "cc-search",
+						"service.instance.id": hostname,
+					}),
+				},
+				"scopeMetrics": []any{
+					map[string]any{
+						"scope":   map[string]any{"name": "cc-search"},
+						"metrics": otlpMetrics,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// startMetricsExport pushes the metrics every METRICS_INTERVAL (default 15s) when
+// METRICS_EXPORT is "statsd" (METRICS_ENDPOINT is host:port) or "otlp" (METRICS_ENDPOINT
+// is the collector URL, e.g. http://collector:4318/v1/metrics). Every replica pushes
+// its own counters.
+func startMetricsExport(ctx context.Context, db *gorm.DB) error {
+	mode := os.Getenv("METRICS_EXPORT")
+	if mode == "" {
+		return nil
+	}
+
+	endpoint := os.Getenv("METRICS_ENDPOINT")
+	if endpoint == "" {
+		return fmt.Errorf("METRICS_ENDPOINT is required with METRICS_EXPORT")
+	}
+
+	interval := 15 * time.Second
+	if value := os.Getenv("METRICS_INTERVAL"); value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval < time.Second {
+			return fmt.Errorf("invalid METRICS_INTERVAL: %s", value)
+		}
+	}
+
+	prefix := "ccsearch."
+	if value, ok := os.LookupEnv("METRICS_PREFIX"); ok {
+		prefix = value
+	}
+
+	var exporter metricsExporter
+	switch mode {
+	case "statsd":
+		conn, err := net.Dial("udp", endpoint)
+		if err != nil {
+			return err
+		}
+		exporter = &statsdExporter{conn: conn, prefix: prefix, sent: map[string]float64{}}
+	case "otlp":
+		exporter = &otlpExporter{
+			endpoint: endpoint,
+			prefix:   prefix,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return fmt.Errorf("invalid METRICS_EXPORT: %s", mode)
+	}
+
+	serverLog.Info("pushing metrics", "endpoint", endpoint, "mode", mode, "interval", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := exporter.export(ctx, append(metrics.collect(ctx, db), metrics.histogramTotals()...))
+				if err != nil {
+					reportError("metrics", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const moderationKey = "ccsearch:hidden"
+
+// purgeChunkSize is the number of signers deleted with one filter.
+const purgeChunkSize = 100
+
+// moderationDecision is kept in redis so that a hide survives reindexing.
+// Purged is set once the document has been removed from the index for good.
+type moderationDecision struct {
+	HiddenAt int64  `json:"hiddenAt"`
+	Reason   string `json:"reason,omitempty"`
+	Purged   bool   `json:"purged,omitempty"`
+}
+
+// moderator applies moderation decisions to every message index. In "soft" mode hidden
+// documents stay in the index with `hidden: true` until the retention period has passed;
+// in "hard" mode they are removed right away.
+type moderator struct {
+	rdb       *redis.Client
+	soft      bool
+	retention time.Duration
+}
+
+var moderation *moderator
+
+func newModerator(rdb *redis.Client, mode string, retention string) (*moderator, error) {
+	m := &moderator{
+		rdb:       rdb,
+		retention: 30 * 24 * time.Hour,
+	}
+
+	switch mode {
+	case "", "hard":
+	case "soft":
+		m.soft = true
+	default:
+		return nil, fmt.Errorf("invalid MODERATION_MODE: %s", mode)
+	}
+
+	if retention != "" {
+		parsed, err := time.ParseDuration(retention)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MODERATION_RETENTION: %s", retention)
+		}
+		m.retention = parsed
+	}
+
+	return m, nil
+}
+
+// messageIndexes lists the distinct indexes holding messages: the ones fed by a messages
+// pipeline and the ones of the schema routes.
+func messageIndexes() []searchIndex {
+	seen := map[string]bool{}
+	indexes := []searchIndex{}
+	for _, p := range getPipelines() {
+		if p.transform != "messages" || seen[p.indexUID] {
+			continue
+		}
+		seen[p.indexUID] = true
+		indexes = append(indexes, p.index)
+		if messageShards.covers(p.indexUID) {
+			// the unsharded index comes first, as the pipeline index
+			indexes = append(indexes, messageShards.all()[1:]...)
+		}
+	}
+	for _, route := range indexRoutes {
+		if seen[route.Index] {
+			continue
+		}
+		seen[route.Index] = true
+		indexes = append(indexes, route.index)
+	}
+	return indexes
+}
+
+// signerIndexes lists the indexes holding documents of users: the message indexes, and
+// the profile and timeline indexes when they are set up.
+func signerIndexes() []searchIndex {
+	indexes := messageIndexes()
+	for _, transform := range []string{"profiles", "timelines"} {
+		if index := transformIndex(transform); index != nil {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// existingDocuments keeps the IDs that are present in the index, so that partial updates
+// don't create stub documents.
+func existingDocuments(index searchIndex, ids []string) []string {
+	existing := []string{}
+	for _, id := range ids {
+		var doc map[string]any
+		err := index.GetDocument(id, &meilisearch.DocumentQuery{Fields: []string{"id"}}, &doc)
+		if err == nil {
+			existing = append(existing, id)
+		}
+	}
+	return existing
+}
+
+// findDocuments returns the IDs of the documents of the index matching filter.
+func findDocuments(index searchIndex, filter string) ([]string, error) {
+	ids := []string{}
+	var offset int64
+	for {
+		var result meilisearch.DocumentsResult
+		err := index.GetDocuments(&meilisearch.DocumentsQuery{
+			Fields: []string{"id"},
+			Filter: filter,
+			Limit:  1000,
+			Offset: offset,
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range result.Results {
+			if id, ok := doc["id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		offset += int64(len(result.Results))
+		if len(result.Results) == 0 || offset >= result.Total {
+			return ids, nil
+		}
+	}
+}
+
+// purgeSigners deletes the documents of the given signers from the indexes and returns
+// how many there were. Errors are reported under component, and the purge goes on with
+// the other indexes.
+func purgeSigners(component string, indexes []searchIndex, signers []string) int {
+	purged := 0
+	for start := 0; start < len(signers); start += purgeChunkSize {
+		chunk := signers[start:min(start+purgeChunkSize, len(signers))]
+		quoted := make([]string, len(chunk))
+		for i, signer := range chunk {
+			quoted[i] = quoteFilter(signer)
+		}
+		filter := fmt.Sprintf("signer IN [%s]", strings.Join(quoted, ", "))
+
+		for _, index := range indexes {
+			ids, err := findDocuments(index, filter)
+			if err != nil {
+				reportError(component, err)
+				continue
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			_, err = index.DeleteDocuments(ids)
+			if err != nil {
+				reportError(component, err)
+				continue
+			}
+			purged += len(ids)
+		}
+	}
+	return purged
+}
+
+// decisions looks up the moderation decisions of the given document IDs.
+func (m *moderator) decisions(ctx context.Context, ids []string) (map[string]moderationDecision, error) {
+	decisions := map[string]moderationDecision{}
+	if len(ids) == 0 {
+		return decisions, nil
+	}
+
+	values, err := m.rdb.HMGet(ctx, moderationKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var decision moderationDecision
+		err := json.Unmarshal([]byte(str), &decision)
+		if err != nil {
+			continue
+		}
+		decisions[ids[i]] = decision
+	}
+	return decisions, nil
+}
+
+func (m *moderator) store(ctx context.Context, ids []string, decision moderationDecision) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	decisionJson, err := json.Marshal(decision)
+	if err != nil {
+		return err
+	}
+	values := map[string]any{}
+	for _, id := range ids {
+		values[id] = decisionJson
+	}
+	return m.rdb.HSet(ctx, moderationKey, values).Err()
+}
+
+func (m *moderator) hide(ctx context.Context, ids []string, reason string) error {
+	decision := moderationDecision{
+		HiddenAt: time.Now().UnixMilli(),
+		Reason:   reason,
+		Purged:   !m.soft,
+	}
+	err := m.store(ctx, ids, decision)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range messageIndexes() {
+		if !m.soft {
+			_, err := index.DeleteDocuments(ids)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		updates := []map[string]any{}
+		for _, id := range existingDocuments(index, ids) {
+			updates = append(updates, map[string]any{
+				"id":       id,
+				"hidden":   true,
+				"hiddenAt": decision.HiddenAt,
+			})
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		_, err := index.UpdateDocuments(updates)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unhide reverts a hide. Documents that have already been purged come back on the next reindex.
+func (m *moderator) unhide(ctx context.Context, ids []string) error {
+	err := m.rdb.HDel(ctx, moderationKey, ids...).Err()
+	if err != nil {
+		return err
+	}
+
+	for _, index := range messageIndexes() {
+		updates := []map[string]any{}
+		for _, id := range existingDocuments(index, ids) {
+			updates = append(updates, map[string]any{
+				"id":       id,
+				"hidden":   false,
+				"hiddenAt": nil,
+			})
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		_, err := index.UpdateDocuments(updates)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeExpired removes the documents that have been hidden for longer than the retention period.
+func (m *moderator) purgeExpired(ctx context.Context) error {
+	cutoff := time.Now().Add(-m.retention).UnixMilli()
+	filter := fmt.Sprintf("hidden = true AND hiddenAt < %d", cutoff)
+
+	purged := 0
+	for _, index := range messageIndexes() {
+		ids, err := findDocuments(index, filter)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		decisions, err := m.decisions(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			decision := decisions[id]
+			decision.Purged = true
+			err := m.store(ctx, []string{id}, decision)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = index.DeleteDocuments(ids)
+		if err != nil {
+			return err
+		}
+		purged += len(ids)
+	}
+
+	if purged > 0 {
+		moderationLog.Info("purged hidden documents", "count", purged)
+	}
+	return nil
+}
+
+// apply marks freshly built records with their moderation state and drops the purged ones.
+func (m *moderator) apply(ctx context.Context, records []messageRecord) []messageRecord {
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+
+	decisions, err := m.decisions(ctx, ids)
+	if err != nil {
+		reportError("moderation", err)
+		return records
+	}
+	if len(decisions) == 0 {
+		return records
+	}
+
+	result := []messageRecord{}
+	for _, record := range records {
+		decision, ok := decisions[record.ID]
+		if ok && decision.Purged {
+			continue
+		}
+		if ok {
+			record.Hidden = true
+			record.HiddenAt = decision.HiddenAt
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func setupModerationRoutes(admin *echo.Group) {
+
+	// resolveTargets expands the request into the IDs of the documents it affects.
+	resolveTargets := func(ids []string, signer string) ([]string, error) {
+		targets := append([]string{}, ids...)
+		if signer == "" {
+			return targets, nil
+		}
+		for _, index := range messageIndexes() {
+			found, err := findDocuments(index, fmt.Sprintf("signer = %s", quoteFilter(signer)))
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, found...)
+		}
+		return targets, nil
+	}
+
+	admin.GET("/moderation", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{
+			"soft":      moderation.soft,
+			"retention": moderation.retention.String(),
+		}})
+	})
+
+	admin.GET("/moderation/hidden", func(c echo.Context) error {
+		limit, _ := strconv.Atoi(c.QueryParam("limit"))
+		if limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+		cursor, _ := strconv.ParseUint(c.QueryParam("cursor"), 10, 64)
+
+		values, next, err := moderation.rdb.HScan(c.Request().Context(), moderationKey, cursor, "", int64(limit)).Result()
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		type hiddenDocument struct {
+			ID string `json:"id"`
+			moderationDecision
+		}
+		hidden := []hiddenDocument{}
+		for i := 0; i+1 < len(values); i += 2 {
+			var decision moderationDecision
+			err := json.Unmarshal([]byte(values[i+1]), &decision)
+			if err != nil {
+				continue
+			}
+			hidden = append(hidden, hiddenDocument{ID: values[i], moderationDecision: decision})
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": hidden, "next": next})
+	})
+
+	admin.POST("/moderation/hide", func(c echo.Context) error {
+		var request struct {
+			IDs    []string `json:"ids"`
+			Signer string   `json:"signer"`
+			Reason string   `json:"reason"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if len(request.IDs) == 0 && request.Signer == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "ids", "ids or signer is required")
+		}
+
+		targets, err := resolveTargets(request.IDs, request.Signer)
+		if err == nil && len(targets) > 0 {
+			err = moderation.hide(c.Request().Context(), targets, request.Reason)
+		}
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		moderationLog.Info("documents hidden", "count", len(targets), "signer", request.Signer, "reason", request.Reason)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{"hidden": len(targets)}})
+	})
+
+	admin.POST("/moderation/unhide", func(c echo.Context) error {
+		var request struct {
+			IDs []string `json:"ids"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if len(request.IDs) == 0 {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "ids", "ids is required")
+		}
+
+		err = moderation.unhide(c.Request().Context(), request.IDs)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		moderationLog.Info("documents unhidden", "count", len(request.IDs))
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/html"
+	"golang.org/x/time/rate"
+)
+
+const (
+	ogpUserAgent      = "cc-search (+https://github.com/concrnt/cc-search)"
+	ogpMaxBodySize    = 512 * 1024
+	ogpMaxLinks       = 3
+	ogpCacheTTL       = 7 * 24 * time.Hour
+	ogpRobotsCacheTTL = 24 * time.Hour
+	ogpMaxRedirects   = 3
+	// ogpRobotsMemorySize bounds the robots.txt rules kept in memory, by host; the rest
+	// are read from redis again.
+	ogpRobotsMemorySize = 10000
+)
+
+type linkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type robotsRules struct {
+	Allow    []string `json:"allow"`
+	Disallow []string `json:"disallow"`
+}
+
+// ogpFetcher fetches OpenGraph metadata for shared links, caching results in redis
+// and honoring robots.txt of the linked site.
+type ogpFetcher struct {
+	rdb     *redis.Client
+	client  *http.Client
+	limiter *rate.Limiter
+
+	robotsMu sync.Mutex
+	robots   map[string]cachedRobots
+}
+
+type cachedRobots struct {
+	rules     robotsRules
+	expiresAt time.Time
+}
+
+var errOgpAddress = errors.New("link preview: the address is not public")
+
+// sharedAddressSpace is the carrier-grade NAT range, private in all but name.
+var _, sharedAddressSpace, _ = net.ParseCIDR("100.64.0.0/10")
+
+// publicIP reports whether a link may be fetched from ip. The links are posted by
+// users, so the loopback, private, link-local and shared addresses, which include the
+// metadata endpoints of the clouds, are off limits.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	return !sharedAddressSpace.Contains(ip)
+}
+
+// ogpControl rejects the connections to addresses that aren't public, after the name
+// was resolved, so that no DNS answer or redirect reaches them.
+func ogpControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: %s", errOgpAddress, host)
+	}
+	return nil
+}
+
+// ogpCheckURL accepts the http and https URLs, the first one and each redirect.
+func ogpCheckURL(target *url.URL) error {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("link preview: unsupported scheme %q", target.Scheme)
+	}
+	return nil
+}
+
+func newOgpFetcher(rdb *redis.Client) *ogpFetcher {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: ogpControl,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would make the connections, out of reach of the dialer
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &ogpFetcher{
+		rdb: rdb,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > ogpMaxRedirects {
+					return fmt.Errorf("link preview: more than %d redirects", ogpMaxRedirects)
+				}
+				return ogpCheckURL(req.URL)
+			},
+		},
+		limiter: rate.NewLimiter(rate.Limit(2), 5),
+		robots:  map[string]cachedRobots{},
+	}
+}
+
+// previews returns the cached or freshly fetched previews for the given links.
+// Links without any usable metadata are omitted.
+func (f *ogpFetcher) previews(ctx context.Context, links []string) []linkPreview {
+	previews := []linkPreview{}
+	for i, link := range links {
+		if i >= ogpMaxLinks {
+			break
+		}
+		preview, ok := f.preview(ctx, link)
+		if !ok {
+			continue
+		}
+		previews = append(previews, preview)
+	}
+	if len(previews) == 0 {
+		return nil
+	}
+	return previews
+}
+
+func (f *ogpFetcher) preview(ctx context.Context, link string) (linkPreview, bool) {
+	cacheKey := "ccsearch:ogp:" + link
+
+	cached, err := f.rdb.Get(ctx, cacheKey).Result()
+	if err == nil {
+		var preview linkPreview
+		err = json.Unmarshal([]byte(cached), &preview)
+		if err == nil {
+			return preview, preview.Title != "" || preview.Description != ""
+		}
+	}
+
+	preview, err := f.fetch(ctx, link)
+	if err != nil {
+		reportError("ogp", err)
+	}
+
+	// cache misses as well, so that broken links are not fetched on every reindex
+	previewJson, _ := json.Marshal(preview)
+	f.rdb.Set(ctx, cacheKey, previewJson, ogpCacheTTL)
+
+	return preview, preview.Title != "" || preview.Description != ""
+}
+
+func (f *ogpFetcher) fetch(ctx context.Context, link string) (linkPreview, error) {
+	preview := linkPreview{URL: link}
+
+	target, err := url.Parse(link)
+	if err != nil {
+		return preview, err
+	}
+	err = ogpCheckURL(target)
+	if err != nil {
+		return preview, err
+	}
+
+	if !f.allowed(ctx, target) {
+		return preview, nil
+	}
+
+	err = f.limiter.Wait(ctx)
+	if err != nil {
+		return preview, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", ogpUserAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, nil
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return preview, nil
+	}
+
+	title, description := parseOgp(io.LimitReader(resp.Body, ogpMaxBodySize))
+	preview.Title = title
+	preview.Description = description
+
+	return preview, nil
+}
+
+// allowed reports whether robots.txt of the target host permits fetching the url.
+func (f *ogpFetcher) allowed(ctx context.Context, target *url.URL) bool {
+	rules := f.robotsRules(ctx, target)
+
+	path := target.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	allowLen, disallowLen := -1, -1
+	for _, prefix := range rules.Allow {
+		if strings.HasPrefix(path, prefix) && len(prefix) > allowLen {
+			allowLen = len(prefix)
+		}
+	}
+	for _, prefix := range rules.Disallow {
+		if strings.HasPrefix(path, prefix) && len(prefix) > disallowLen {
+			disallowLen = len(prefix)
+		}
+	}
+
+	return allowLen >= disallowLen
+}
+
+func (f *ogpFetcher) robotsRules(ctx context.Context, target *url.URL) robotsRules {
+	host := target.Scheme + "://" + target.Host
+
+	f.robotsMu.Lock()
+	cached, ok := f.robots[host]
+	f.robotsMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.rules
+	}
+
+	var rules robotsRules
+	cacheKey := "ccsearch:robots:" + host
+	value, err := f.rdb.Get(ctx, cacheKey).Result()
+	if err == nil && json.Unmarshal([]byte(value), &rules) == nil {
+		f.rememberRobots(host, rules)
+		return rules
+	}
+
+	rules = f.fetchRobots(ctx, host)
+
+	rulesJson, _ := json.Marshal(rules)
+	f.rdb.Set(ctx, cacheKey, rulesJson, ogpRobotsCacheTTL)
+
+	f.rememberRobots(host, rules)
+	return rules
+}
+
+// rememberRobots keeps the rules of a host in memory for the TTL of the redis cache. The
+// expired entries are dropped once the map is full, and the map is started over when
+// none are.
+func (f *ogpFetcher) rememberRobots(host string, rules robotsRules) {
+	f.robotsMu.Lock()
+	defer f.robotsMu.Unlock()
+
+	now := time.Now()
+	if len(f.robots) >= ogpRobotsMemorySize {
+		for other, cached := range f.robots {
+			if !now.Before(cached.expiresAt) {
+				delete(f.robots, other)
+			}
+		}
+		if len(f.robots) >= ogpRobotsMemorySize {
+			clear(f.robots)
+		}
+	}
+	f.robots[host] = cachedRobots{rules: rules, expiresAt: now.Add(ogpRobotsCacheTTL)}
+}
+
+func (f *ogpFetcher) fetchRobots(ctx context.Context, host string) robotsRules {
+	rules := robotsRules{}
+
+	err := f.limiter.Wait(ctx)
+	if err != nil {
+		return rules
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, host+"/robots.txt", nil)
+	if err != nil {
+		return rules
+	}
+	req.Header.Set("User-Agent", ogpUserAgent)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return rules
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return rules
+	}
+
+	return parseRobots(io.LimitReader(resp.Body, ogpMaxBodySize))
+}
+
+// parseRobots extracts the rules that apply to cc-search, falling back to the wildcard agent.
+func parseRobots(r io.Reader) robotsRules {
+	groups := map[string]*robotsRules{}
+	agents := []string{}
+	inRules := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if inRules {
+				agents = []string{}
+				inRules = false
+			}
+			agent := strings.ToLower(value)
+			agents = append(agents, agent)
+			if _, ok := groups[agent]; !ok {
+				groups[agent] = &robotsRules{}
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			for _, agent := range agents {
+				if key == "allow" {
+					groups[agent].Allow = append(groups[agent].Allow, value)
+				} else {
+					groups[agent].Disallow = append(groups[agent].Disallow, value)
+				}
+			}
+		}
+	}
+
+	if rules, ok := groups["cc-search"]; ok {
+		return *rules
+	}
+	if rules, ok := groups["*"]; ok {
+		return *rules
+	}
+	return robotsRules{}
+}
+
+// parseOgp reads og:title / og:description from the document head,
+// falling back to <title> and the description meta tag.
+func parseOgp(r io.Reader) (string, string) {
+	var title, description, fallbackTitle, fallbackDescription string
+
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return cmp.Or(title, fallbackTitle), cmp.Or(description, fallbackDescription)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = true
+			case "body":
+				return cmp.Or(title, fallbackTitle), cmp.Or(description, fallbackDescription)
+			case "meta":
+				var property, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						property = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				switch property {
+				case "og:title":
+					title = content
+				case "og:description":
+					description = content
+				case "description":
+					fallbackDescription = content
+				}
+			}
+		case html.TextToken:
+			if inTitle && fallbackTitle == "" {
+				fallbackTitle = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+}
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// opensearchGeoField holds the geo point of a document, which Meilisearch calls _geo.
+const opensearchGeoField = "geo"
+
+// opensearchCropMarker joins the fragments of a cropped attribute, as Meilisearch does.
+const opensearchCropMarker = "…"
+
+// opensearchField maps an attribute to its field in OpenSearch.
+func opensearchField(attribute string) string {
+	if attribute == "_geo" {
+		return opensearchGeoField
+	}
+	return attribute
+}
+
+// opensearchBackend keeps the indexes in an OpenSearch (or Elasticsearch) cluster at
+// OPENSEARCH_URL, authenticated with OPENSEARCH_USERNAME and OPENSEARCH_PASSWORD. Index
+// names are lowercased and prefixed with OPENSEARCH_INDEX_PREFIX.
+type opensearchBackend struct {
+	url      string
+	username string
+	password string
+	prefix   string
+	client   *http.Client
+
+	mu sync.Mutex
+	// searchable caches the searchable attributes of the indexes, by uid.
+	searchable map[string][]string
+}
+
+func newOpensearchBackend() (*opensearchBackend, error) {
+	base := strings.TrimSuffix(os.Getenv("OPENSEARCH_URL"), "/")
+	if base == "" {
+		return nil, errors.New("OPENSEARCH_URL is required with SEARCH_BACKEND=opensearch")
+	}
+
+	timeout := 10 * time.Second
+	if value := os.Getenv("OPENSEARCH_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid OPENSEARCH_TIMEOUT: %s", value)
+		}
+		timeout = parsed
+	}
+
+	return &opensearchBackend{
+		url:        base,
+		username:   os.Getenv("OPENSEARCH_USERNAME"),
+		password:   os.Getenv("OPENSEARCH_PASSWORD"),
+		prefix:     os.Getenv("OPENSEARCH_INDEX_PREFIX"),
+		client:     &http.Client{Timeout: timeout, Transport: tracedTransport(http.DefaultTransport, "opensearch")},
+		searchable: map[string][]string{},
+	}, nil
+}
+
+type opensearchError struct {
+	StatusCode int
+	Type       string
+	Reason     string
+}
+
+func (e *opensearchError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("opensearch: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("opensearch: status %d: %s: %s", e.StatusCode, e.Type, e.Reason)
+}
+
+func isOpensearchNotFound(err error) bool {
+	var opensearchErr *opensearchError
+	return errors.As(err, &opensearchErr) && opensearchErr.StatusCode == http.StatusNotFound
+}
+
+// request sends a JSON body, or NDJSON when the body is already encoded, and decodes the
+// response into out.
+func (b *opensearchBackend) request(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	contentType := "application/json"
+	switch body := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(body)
+		contentType = "application/x-ndjson"
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, reader)
+	if err != nil {
+		return err
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		metrics.add("opensearch_errors_total", map[string]string{"status": "network"}, 1)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		if resp.StatusCode >= 500 {
+			metrics.add("opensearch_errors_total", map[string]string{"status": strconv.Itoa(resp.StatusCode)}, 1)
+		}
+		failure := &opensearchError{StatusCode: resp.StatusCode}
+		var document struct {
+			Error json.RawMessage `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&document) == nil && len(document.Error) > 0 {
+			var cause struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			}
+			if json.Unmarshal(document.Error, &cause) != nil {
+				cause.Type = "error"
+				cause.Reason = string(document.Error)
+			}
+			failure.Type, failure.Reason = cause.Type, cause.Reason
+		}
+		return failure
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *opensearchBackend) index(uid string) searchIndex {
+	return &opensearchIndex{backend: b, uid: uid, name: b.prefix + strings.ToLower(uid)}
+}
+
+// openIndex creates the index when it is missing. Strings keep the default dynamic
+// mapping, a text field with a keyword subfield that the filters match on.
+func (b *opensearchBackend) openIndex(uid string) (searchIndex, error) {
+	index := b.index(uid).(*opensearchIndex)
+	ctx := context.Background()
+
+	err := b.request(ctx, http.MethodHead, "/"+index.name, nil, nil)
+	if err == nil || !isOpensearchNotFound(err) {
+		return index, err
+	}
+
+	err = b.request(ctx, http.MethodPut, "/"+index.name, map[string]any{
+		"settings": map[string]any{
+			"index.mapping.ignore_malformed": true,
+		},
+		"mappings": map[string]any{
+			"date_detection": false,
+			"properties": map[string]any{
+				opensearchGeoField: map[string]any{"type": "geo_point"},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (b *opensearchBackend) deleteIndex(uid string) error {
+	index := b.index(uid).(*opensearchIndex)
+	err := b.request(context.Background(), http.MethodDelete, "/"+index.name, nil, nil)
+	if isOpensearchNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *opensearchBackend) health(ctx context.Context) error {
+	var health struct {
+		Status string `json:"status"`
+	}
+	err := b.request(ctx, http.MethodGet, "/_cluster/health", nil, &health)
+	if err != nil {
+		return err
+	}
+	if health.Status == "red" {
+		return errors.New("opensearch: cluster status is red")
+	}
+	return nil
+}
+
+// opensearchIndex is an OpenSearch index behind searchIndex: documents, searches, stats
+// and the attribute settings, which are kept in the _meta of the mapping. Writes are
+// applied by the time they return, so their tasks have already succeeded. Typo tolerance
+// and dictionaries are not supported.
+type opensearchIndex struct {
+	backend *opensearchBackend
+	uid     string
+	name    string
+}
+
+func (i *opensearchIndex) succeeded() *meilisearch.TaskInfo {
+	return &meilisearch.TaskInfo{Status: meilisearch.TaskStatusSucceeded, IndexUID: i.uid, EnqueuedAt: time.Now()}
+}
+
+// toOpensearch converts documents to OpenSearch documents, moving the geo point.
+func toOpensearch(documents any) ([]map[string]any, error) {
+	data, err := json.Marshal(documents)
+	if err != nil {
+		return nil, err
+	}
+	var converted []map[string]any
+	err = json.Unmarshal(data, &converted)
+	if err != nil {
+		return nil, err
+	}
+	for _, document := range converted {
+		if point, ok := document["_geo"].(map[string]any); ok {
+			document[opensearchGeoField] = map[string]any{"lat": point["lat"], "lon": point["lng"]}
+			delete(document, "_geo")
+		}
+	}
+	return converted, nil
+}
+
+// fromOpensearch converts an OpenSearch document back, with the geo point as _geo.
+func fromOpensearch(document map[string]any) map[string]any {
+	if point, ok := document[opensearchGeoField].(map[string]any); ok {
+		document["_geo"] = map[string]any{"lat": point["lat"], "lng": point["lon"]}
+		delete(document, opensearchGeoField)
+	}
+	return document
+}
+
+// bulk runs a bulk request and fails with the error of the first failed item.
+func (i *opensearchIndex) bulk(ctx context.Context, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	err := i.backend.request(ctx, http.MethodPost, "/"+i.name+"/_bulk", body, &result)
+	if err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for action, outcome := range item {
+			if len(outcome.Error) > 0 {
+				return &opensearchError{StatusCode: outcome.Status, Type: action + " " + outcome.ID, Reason: string(outcome.Error)}
+			}
+		}
+	}
+	return errors.New("opensearch: bulk request failed")
+}
+
+// write indexes the documents, replacing them, or with partial set merges them into the
+// existing ones.
+func (i *opensearchIndex) write(ctx context.Context, documentsPtr any, partial bool) (*meilisearch.TaskInfo, error) {
+	documents, err := toOpensearch(documentsPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, document := range documents {
+		id, ok := document["id"].(string)
+		if !ok || id == "" {
+			return nil, errors.New("opensearch: document without an id")
+		}
+		if partial {
+			encoder.Encode(map[string]any{"update": map[string]any{"_id": id}})
+			encoder.Encode(map[string]any{"doc": document, "doc_as_upsert": true})
+		} else {
+			encoder.Encode(map[string]any{"index": map[string]any{"_id": id}})
+			encoder.Encode(document)
+		}
+	}
+	err = i.bulk(ctx, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return i.succeeded(), nil
+}
+
+func (i *opensearchIndex) AddDocuments(documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(context.Background(), documentsPtr, false)
+}
+
+func (i *opensearchIndex) AddDocumentsWithContext(ctx context.Context, documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(ctx, documentsPtr, false)
+}
+
+func (i *opensearchIndex) UpdateDocuments(documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(context.Background(), documentsPtr, true)
+}
+
+func (i *opensearchIndex) UpdateDocumentsWithContext(ctx context.Context, documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(ctx, documentsPtr, true)
+}
+
+func (i *opensearchIndex) DeleteDocuments(identifiers []string) (*meilisearch.TaskInfo, error) {
+	return i.DeleteDocumentsWithContext(context.Background(), identifiers)
+}
+
+func (i *opensearchIndex) DeleteDocumentsWithContext(ctx context.Context, identifiers []string) (*meilisearch.TaskInfo, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, id := range identifiers {
+		encoder.Encode(map[string]any{"delete": map[string]any{"_id": id}})
+	}
+	err := i.bulk(ctx, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return i.succeeded(), nil
+}
+
+func (i *opensearchIndex) DeleteDocumentsByFilter(filter interface{}) (*meilisearch.TaskInfo, error) {
+	return i.DeleteDocumentsByFilterWithContext(context.Background(), filter)
+}
+
+func (i *opensearchIndex) DeleteDocumentsByFilterWithContext(ctx context.Context, filter interface{}) (*meilisearch.TaskInfo, error) {
+	query, err := translateFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		return nil, errors.New("opensearch: deleting by filter needs a filter")
+	}
+	return i.deleteByQuery(ctx, query)
+}
+
+func (i *opensearchIndex) DeleteAllDocuments() (*meilisearch.TaskInfo, error) {
+	return i.DeleteAllDocumentsWithContext(context.Background())
+}
+
+func (i *opensearchIndex) DeleteAllDocumentsWithContext(ctx context.Context) (*meilisearch.TaskInfo, error) {
+	return i.deleteByQuery(ctx, map[string]any{"match_all": map[string]any{}})
+}
+
+func (i *opensearchIndex) deleteByQuery(ctx context.Context, query map[string]any) (*meilisearch.TaskInfo, error) {
+	err := i.backend.request(ctx, http.MethodPost, "/"+i.name+"/_delete_by_query?conflicts=proceed&refresh=true", map[string]any{"query": query}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return i.succeeded(), nil
+}
+
+func (i *opensearchIndex) GetDocument(identifier string, request *meilisearch.DocumentQuery, documentPtr interface{}) error {
+	return i.GetDocumentWithContext(context.Background(), identifier, request, documentPtr)
+}
+
+func (i *opensearchIndex) GetDocumentWithContext(ctx context.Context, identifier string, request *meilisearch.DocumentQuery, documentPtr interface{}) error {
+	path := "/" + i.name + "/_doc/" + url.PathEscape(identifier)
+	if request != nil && len(request.Fields) > 0 {
+		fields := []string{}
+		for _, field := range request.Fields {
+			fields = append(fields, opensearchField(field))
+		}
+		path += "?_source_includes=" + url.QueryEscape(strings.Join(fields, ","))
+	}
+
+	var result struct {
+		Source map[string]any `json:"_source"`
+	}
+	err := i.backend.request(ctx, http.MethodGet, path, nil, &result)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fromOpensearch(result.Source))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, documentPtr)
+}
+
+type opensearchHits struct {
+	Total struct {
+		Value int64 `json:"value"`
+	} `json:"total"`
+	MaxScore float64 `json:"max_score"`
+	Hits     []struct {
+		Score     float64             `json:"_score"`
+		Source    map[string]any      `json:"_source"`
+		Highlight map[string][]string `json:"highlight"`
+	} `json:"hits"`
+}
+
+// GetDocuments pages through the documents matching the filter. Like any search, it
+// can't reach past the max_result_window of the index, 10000 documents by default.
+func (i *opensearchIndex) GetDocuments(param *meilisearch.DocumentsQuery, resp *meilisearch.DocumentsResult) error {
+	return i.GetDocumentsWithContext(context.Background(), param, resp)
+}
+
+func (i *opensearchIndex) GetDocumentsWithContext(ctx context.Context, param *meilisearch.DocumentsQuery, resp *meilisearch.DocumentsResult) error {
+	query := map[string]any{"match_all": map[string]any{}}
+	limit := int64(20)
+	body := map[string]any{"track_total_hits": true, "sort": []string{"_doc"}}
+	if param != nil {
+		filter, err := translateFilter(param.Filter)
+		if err != nil {
+			return err
+		}
+		if filter != nil {
+			query = filter
+		}
+		if param.Limit > 0 {
+			limit = param.Limit
+		}
+		body["from"] = param.Offset
+		if len(param.Fields) > 0 {
+			fields := []string{}
+			for _, field := range param.Fields {
+				fields = append(fields, opensearchField(field))
+			}
+			body["_source"] = fields
+		}
+	}
+	body["query"] = query
+	body["size"] = limit
+
+	var result struct {
+		Hits opensearchHits `json:"hits"`
+	}
+	err := i.backend.request(ctx, http.MethodPost, "/"+i.name+"/_search", body, &result)
+	if err != nil {
+		return err
+	}
+
+	resp.Results = []map[string]interface{}{}
+	for _, hit := range result.Hits.Hits {
+		resp.Results = append(resp.Results, fromOpensearch(hit.Source))
+	}
+	resp.Limit = limit
+	if param != nil {
+		resp.Offset = param.Offset
+	}
+	resp.Total = result.Hits.Total.Value
+	return nil
+}
+
+func (i *opensearchIndex) Search(query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+	return i.SearchWithContext(context.Background(), query, request)
+}
+
+// SearchWithContext translates a Meilisearch search. The words are matched on every
+// searchable attribute with typo tolerance; without a sort the hits come by relevance,
+// so the penalty ranking rule of the messages has no equivalent.
+func (i *opensearchIndex) SearchWithContext(ctx context.Context, query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+	if request == nil {
+		request = &meilisearch.SearchRequest{}
+	}
+
+	body, err := i.searchBody(ctx, query, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Took         int64          `json:"took"`
+		Hits         opensearchHits `json:"hits"`
+		Aggregations map[string]struct {
+			Buckets []struct {
+				Key      any   `json:"key"`
+				DocCount int64 `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"aggregations"`
+	}
+	err = i.backend.request(ctx, http.MethodPost, "/"+i.name+"/_search", body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &meilisearch.SearchResponse{
+		Hits:               []interface{}{},
+		EstimatedTotalHits: result.Hits.Total.Value,
+		Offset:             request.Offset,
+		Limit:              body["size"].(int64),
+		ProcessingTimeMs:   result.Took,
+		Query:              query,
+		IndexUID:           i.uid,
+	}
+	for _, hit := range result.Hits.Hits {
+		document := fromOpensearch(hit.Source)
+		if hit.Highlight != nil {
+			document["_formatted"] = formattedHit(document, hit.Highlight)
+		}
+		if request.ShowRankingScore && result.Hits.MaxScore > 0 {
+			document["_rankingScore"] = hit.Score / result.Hits.MaxScore
+		}
+		response.Hits = append(response.Hits, document)
+	}
+
+	if len(request.Facets) > 0 {
+		distribution := map[string]any{}
+		for _, attribute := range request.Facets {
+			counts := map[string]any{}
+			for _, bucket := range result.Aggregations[attribute].Buckets {
+				counts[fmt.Sprint(bucket.Key)] = float64(bucket.DocCount)
+			}
+			distribution[attribute] = counts
+		}
+		response.FacetDistribution = distribution
+	}
+	return response, nil
+}
+
+func (i *opensearchIndex) searchBody(ctx context.Context, query string, request *meilisearch.SearchRequest) (map[string]any, error) {
+	limit := request.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	body := map[string]any{
+		"from":             request.Offset,
+		"size":             limit,
+		"track_total_hits": true,
+	}
+
+	clauses := map[string]any{}
+	if strings.TrimSpace(query) != "" {
+		attributes := request.AttributesToSearchOn
+		if len(attributes) == 0 {
+			attributes = i.searchableAttributes(ctx)
+		}
+		fields := []string{}
+		for _, attribute := range attributes {
+			fields = append(fields, attribute, attribute+".*")
+		}
+		if len(fields) == 0 || slices.Contains(attributes, "*") {
+			fields = []string{"*"}
+		}
+		clauses["must"] = map[string]any{"multi_match": map[string]any{
+			"query":     query,
+			"fields":    fields,
+			"operator":  "and",
+			"fuzziness": "AUTO",
+			"lenient":   true,
+		}}
+	}
+	filter, err := translateFilter(request.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		clauses["filter"] = filter
+	}
+	if len(clauses) == 0 {
+		body["query"] = map[string]any{"match_all": map[string]any{}}
+	} else {
+		body["query"] = map[string]any{"bool": clauses}
+	}
+
+	if len(request.Sort) > 0 {
+		sort := []any{}
+		for _, rule := range request.Sort {
+			sortRule, err := opensearchSort(rule)
+			if err != nil {
+				return nil, err
+			}
+			sort = append(sort, sortRule)
+		}
+		body["sort"] = sort
+	}
+
+	if len(request.AttributesToRetrieve) > 0 && !slices.Contains(request.AttributesToRetrieve, "*") {
+		fields := []string{}
+		for _, attribute := range request.AttributesToRetrieve {
+			fields = append(fields, opensearchField(attribute))
+		}
+		body["_source"] = fields
+	}
+
+	if highlight := opensearchHighlight(request); highlight != nil {
+		body["highlight"] = highlight
+	}
+
+	if len(request.Facets) > 0 {
+		aggregations := map[string]any{}
+		for _, attribute := range request.Facets {
+			aggregations[attribute] = map[string]any{"terms": map[string]any{"field": attribute + ".keyword", "size": 100}}
+		}
+		body["aggs"] = aggregations
+	}
+	return body, nil
+}
+
+// opensearchSort translates a sort rule.
+func opensearchSort(rule string) (any, error) {
+	attribute, point, order, err := parseSort(rule)
+	if err != nil {
+		return nil, err
+	}
+	if point != nil {
+		return map[string]any{"_geo_distance": map[string]any{
+			opensearchGeoField: map[string]any{"lat": point[0], "lon": point[1]},
+			"order":            order,
+			"unit":             "m",
+		}}, nil
+	}
+	return map[string]any{attribute: map[string]any{"order": order, "unmapped_type": "long"}}, nil
+}
+
+// opensearchHighlight highlights the attributes to highlight in full, and the ones to
+// crop around the matches, about CropLength words long.
+func opensearchHighlight(request *meilisearch.SearchRequest) map[string]any {
+	attributes := slices.Clone(request.AttributesToHighlight)
+	for _, attribute := range request.AttributesToCrop {
+		if !slices.Contains(attributes, attribute) {
+			attributes = append(attributes, attribute)
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	cropLength := request.CropLength
+	if cropLength <= 0 {
+		cropLength = 10
+	}
+	fields := map[string]any{}
+	for _, attribute := range attributes {
+		field := map[string]any{"number_of_fragments": 0}
+		if slices.Contains(request.AttributesToCrop, attribute) {
+			// a word is about six characters with its space
+			size := cropLength * 6
+			field = map[string]any{"number_of_fragments": 1, "fragment_size": size, "no_match_size": size}
+		}
+		fields[attribute] = field
+		if attribute != "*" {
+			fields[attribute+".*"] = field
+		}
+	}
+
+	preTag, postTag := request.HighlightPreTag, request.HighlightPostTag
+	if preTag == "" {
+		preTag = "<em>"
+	}
+	if postTag == "" {
+		postTag = "</em>"
+	}
+	return map[string]any{
+		"pre_tags":  []string{preTag},
+		"post_tags": []string{postTag},
+		"fields":    fields,
+	}
+}
+
+// formattedHit builds the _formatted document of a hit: the document with the
+// highlighted fragments in place of the attributes they come from.
+func formattedHit(document map[string]any, highlight map[string][]string) map[string]any {
+	formatted := map[string]any{}
+	for key, value := range document {
+		formatted[key] = value
+	}
+	for field, fragments := range highlight {
+		setFormatted(formatted, strings.Split(field, "."), strings.Join(fragments, " "+opensearchCropMarker+" "))
+	}
+	return formatted
+}
+
+// setFormatted sets the value at the path, copying the objects on the way so that the
+// document itself is left alone. Fields inside arrays are not replaced.
+func setFormatted(object map[string]any, path []string, value any) {
+	if len(path) == 1 {
+		object[path[0]] = value
+		return
+	}
+	child, ok := object[path[0]].(map[string]any)
+	if !ok {
+		return
+	}
+	copied := make(map[string]any, len(child))
+	for key, value := range child {
+		copied[key] = value
+	}
+	object[path[0]] = copied
+	setFormatted(copied, path[1:], value)
+}
+
+// searchableAttributes are the searchable attributes of the index settings, read once.
+func (i *opensearchIndex) searchableAttributes(ctx context.Context) []string {
+	i.backend.mu.Lock()
+	attributes, ok := i.backend.searchable[i.uid]
+	i.backend.mu.Unlock()
+	if ok {
+		return attributes
+	}
+
+	loaded, err := i.attributes(ctx, "searchableAttributes")
+	if err != nil {
+		reportError("opensearch", err)
+		return nil
+	}
+	i.backend.mu.Lock()
+	i.backend.searchable[i.uid] = *loaded
+	i.backend.mu.Unlock()
+	return *loaded
+}
+
+func (i *opensearchIndex) meta(ctx context.Context) (map[string]any, error) {
+	var mappings map[string]struct {
+		Mappings struct {
+			Meta map[string]any `json:"_meta"`
+		} `json:"mappings"`
+	}
+	err := i.backend.request(ctx, http.MethodGet, "/"+i.name+"/_mapping", nil, &mappings)
+	if err != nil {
+		return nil, err
+	}
+	// an alias answers with the name of the index behind it
+	for _, mapping := range mappings {
+		if mapping.Mappings.Meta != nil {
+			return mapping.Mappings.Meta, nil
+		}
+	}
+	return map[string]any{}, nil
+}
+
+func (i *opensearchIndex) attributes(ctx context.Context, setting string) (*[]string, error) {
+	meta, err := i.meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := meta[setting].([]any)
+	attributes := []string{}
+	for _, value := range values {
+		if attribute, ok := value.(string); ok {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return &attributes, nil
+}
+
+func (i *opensearchIndex) setAttributes(ctx context.Context, setting string, attributes *[]string) (*meilisearch.TaskInfo, error) {
+	meta, err := i.meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meta[setting] = *attributes
+	err = i.backend.request(ctx, http.MethodPut, "/"+i.name+"/_mapping", map[string]any{"_meta": meta}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if setting == "searchableAttributes" {
+		i.backend.mu.Lock()
+		i.backend.searchable[i.uid] = slices.Clone(*attributes)
+		i.backend.mu.Unlock()
+	}
+	return i.succeeded(), nil
+}
+
+func (i *opensearchIndex) GetFilterableAttributes() (*[]string, error) {
+	return i.attributes(context.Background(), "filterableAttributes")
+}
+
+func (i *opensearchIndex) UpdateFilterableAttributes(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "filterableAttributes", request)
+}
+
+func (i *opensearchIndex) GetSortableAttributes() (*[]string, error) {
+	return i.attributes(context.Background(), "sortableAttributes")
+}
+
+func (i *opensearchIndex) UpdateSortableAttributes(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "sortableAttributes", request)
+}
+
+func (i *opensearchIndex) GetSearchableAttributes() (*[]string, error) {
+	return i.attributes(context.Background(), "searchableAttributes")
+}
+
+func (i *opensearchIndex) UpdateSearchableAttributes(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "searchableAttributes", request)
+}
+
+func (i *opensearchIndex) GetRankingRules() (*[]string, error) {
+	return i.attributes(context.Background(), "rankingRules")
+}
+
+func (i *opensearchIndex) UpdateRankingRules(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "rankingRules", request)
+}
+
+func (i *opensearchIndex) GetStats() (*meilisearch.StatsIndex, error) {
+	return i.GetStatsWithContext(context.Background())
+}
+
+func (i *opensearchIndex) GetStatsWithContext(ctx context.Context) (*meilisearch.StatsIndex, error) {
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	err := i.backend.request(ctx, http.MethodGet, "/"+i.name+"/_count", nil, &count)
+	if err != nil {
+		return nil, err
+	}
+	return &meilisearch.StatsIndex{NumberOfDocuments: count.Count}, nil
+}
+
+func (i *opensearchIndex) WaitForTask(taskUID int64, interval time.Duration) (*meilisearch.Task, error) {
+	return i.WaitForTaskWithContext(context.Background(), taskUID, interval)
+}
+
+func (i *opensearchIndex) WaitForTaskWithContext(ctx context.Context, taskUID int64, interval time.Duration) (*meilisearch.Task, error) {
+	return &meilisearch.Task{Status: meilisearch.TaskStatusSucceeded, TaskUID: taskUID, IndexUID: i.uid}, nil
+}
+
+func (i *opensearchIndex) ensureSettings(settings indexSettings) error {
+	err := untunable(settings, "opensearch")
+	if err != nil {
+		return err
+	}
+	return reconcileAttributes(i, settings)
+}
+
+func (i *opensearchIndex) settingsDrift(settings indexSettings) ([]string, error) {
+	err := untunable(settings, "opensearch")
+	if err != nil {
+		return nil, err
+	}
+	return attributeDrift(i, settings)
+}
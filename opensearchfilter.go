@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+)
+
+// translateFilter converts the filter of a search or a documents query into an
+// OpenSearch query, nil for no filter. String values are matched on the keyword
+// subfield that the default dynamic mapping adds to every string field.
+func translateFilter(filter any) (map[string]any, error) {
+	node, err := parseFilter(filter)
+	if err != nil || node == nil {
+		return nil, err
+	}
+	return opensearchQuery(node), nil
+}
+
+func opensearchQuery(node *filterNode) map[string]any {
+	switch node.kind {
+	case filterAnd, filterOr, filterNot:
+		clauses := []any{}
+		for _, child := range node.children {
+			clauses = append(clauses, opensearchQuery(child))
+		}
+		switch node.kind {
+		case filterAnd:
+			if len(clauses) == 0 {
+				return map[string]any{"match_all": map[string]any{}}
+			}
+			return boolQuery("filter", clauses)
+		case filterOr:
+			if len(clauses) == 0 {
+				return map[string]any{"match_none": map[string]any{}}
+			}
+			return boolQuery("should", clauses)
+		}
+		return boolQuery("must_not", clauses)
+	case filterEqual:
+		return termQuery(opensearchField(node.attribute), node.value)
+	case filterRange:
+		return map[string]any{"range": map[string]any{opensearchField(node.attribute): node.bounds}}
+	case filterExists:
+		return map[string]any{"exists": map[string]any{"field": opensearchField(node.attribute)}}
+	case filterGeoRadius:
+		return map[string]any{"geo_distance": map[string]any{
+			"distance":         fmt.Sprintf("%fm", node.args[2]),
+			opensearchGeoField: map[string]any{"lat": node.args[0], "lon": node.args[1]},
+		}}
+	case filterGeoBoundingBox:
+		return map[string]any{"geo_bounding_box": map[string]any{
+			opensearchGeoField: map[string]any{
+				"top_right":   map[string]any{"lat": node.args[0], "lon": node.args[1]},
+				"bottom_left": map[string]any{"lat": node.args[2], "lon": node.args[3]},
+			},
+		}}
+	}
+	return nil
+}
+
+func boolQuery(occur string, clauses []any) map[string]any {
+	if len(clauses) == 0 {
+		return nil
+	}
+	if len(clauses) == 1 && occur != "must_not" {
+		return clauses[0].(map[string]any)
+	}
+	query := map[string]any{occur: clauses}
+	if occur == "should" {
+		query["minimum_should_match"] = 1
+	}
+	return map[string]any{"bool": query}
+}
+
+func termQuery(attribute string, value any) map[string]any {
+	if _, ok := value.(string); ok {
+		attribute += ".keyword"
+	}
+	return map[string]any{"term": map[string]any{attribute: value}}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	optOutCacheSize = 100000
+	optOutCacheTTL  = 10 * time.Minute
+)
+
+var profileFieldPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+type optOutEntry struct {
+	optedOut  bool
+	checkedAt time.Time
+}
+
+// optOutFilter leaves the users who don't want to be searchable out of the index. A user
+// opts out by setting the OPTOUT_PROFILE_FIELD of the body of any of their profiles to
+// true, e.g. {"noindex": true}. The field is read from the profiles table of the
+// concurrent database, so that the latest profile counts whatever its schema.
+type optOutFilter struct {
+	db    *gorm.DB
+	field string
+
+	mu      sync.Mutex
+	checked map[string]optOutEntry
+}
+
+var optOuts = &optOutFilter{}
+
+// setupOptOut reads OPTOUT_PROFILE_FIELD. Without it nobody can opt out.
+func setupOptOut(db *gorm.DB) error {
+	field := strings.TrimSpace(os.Getenv("OPTOUT_PROFILE_FIELD"))
+	if field == "" {
+		return nil
+	}
+	if !profileFieldPattern.MatchString(field) {
+		return fmt.Errorf("invalid OPTOUT_PROFILE_FIELD: %s", field)
+	}
+
+	optOuts = &optOutFilter{
+		db:      db,
+		field:   field,
+		checked: map[string]optOutEntry{},
+	}
+	return nil
+}
+
+func (f *optOutFilter) enabled() bool {
+	return f.field != ""
+}
+
+// optedOut reports whether the entity has opted out. Answers are cached for a while, and
+// the sweep catches up with the documents indexed in the meantime.
+func (f *optOutFilter) optedOut(ctx context.Context, entity string) (bool, error) {
+	if !f.enabled() || entity == "" {
+		return false, nil
+	}
+
+	f.mu.Lock()
+	entry, ok := f.checked[entity]
+	f.mu.Unlock()
+	if ok && time.Since(entry.checkedAt) < optOutCacheTTL {
+		return entry.optedOut, nil
+	}
+
+	var count int64
+	err := f.db.WithContext(ctx).Table("profiles").
+		Where("author = ? AND document::jsonb -> 'body' ->> ? = 'true'", entity, f.field).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	if len(f.checked) >= optOutCacheSize {
+		f.checked = map[string]optOutEntry{}
+	}
+	f.checked[entity] = optOutEntry{optedOut: count > 0, checkedAt: time.Now()}
+	f.mu.Unlock()
+
+	return count > 0, nil
+}
+
+// list returns every entity that has opted out.
+func (f *optOutFilter) list(ctx context.Context) ([]string, error) {
+	entities := []string{}
+	err := f.db.WithContext(ctx).Table("profiles").
+		Where("document::jsonb -> 'body' ->> ? = 'true'", f.field).
+		Distinct().Pluck("author", &entities).Error
+	return entities, err
+}
+
+// sweep removes the documents of the users who have opted out from the message,
+// profile and timeline indexes, including the ones indexed before they did.
+func (f *optOutFilter) sweep(ctx context.Context) error {
+	if !f.enabled() {
+		return nil
+	}
+	entities, err := f.list(ctx)
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 {
+		return nil
+	}
+
+	purged := purgeSigners("optout", signerIndexes(), entities)
+	if purged > 0 {
+		moderationLog.Info("deleted documents of users who opted out of search", "count", purged)
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// actionTimelineRead is the policy statement that governs reading a timeline.
+const actionTimelineRead = "timeline.message.read"
+
+const policyCacheSize = 100000
+
+// Requester types set by the Concurrent gateway in the cc-requester-type header.
+const (
+	requesterUnknown    = 0
+	requesterLocalUser  = 1
+	requesterRemoteUser = 2
+)
+
+// requester is the identity the Concurrent gateway forwards with a request, or the one
+// authenticate verified. Requests with neither are guests.
+type requester struct {
+	Type   int
+	CCID   string
+	Domain string
+	Tags   []string
+}
+
+var guest = requester{}
+
+func requesterFrom(c echo.Context) requester {
+	if r, ok := c.Get(requesterKey).(requester); ok {
+		return r
+	}
+	if !auth.trustGateway || !fromTrustedProxy(c.Request()) {
+		return guest
+	}
+	header := c.Request().Header
+	r := requester{
+		CCID:   header.Get("cc-requester-ccid"),
+		Domain: header.Get("cc-requester-domain"),
+	}
+	r.Type, _ = strconv.Atoi(header.Get("cc-requester-type"))
+	for _, tag := range strings.Split(header.Get("cc-requester-tag"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			r.Tags = append(r.Tags, tag)
+		}
+	}
+	return r
+}
+
+func (r requester) key() string {
+	return fmt.Sprintf("%d|%s|%s|%s", r.Type, r.CCID, r.Domain, strings.Join(r.Tags, ","))
+}
+
+// policyExpr is a node of a Concurrent policy condition.
+type policyExpr struct {
+	Op    string       `json:"op"`
+	Const any          `json:"const,omitempty"`
+	Args  []policyExpr `json:"args,omitempty"`
+}
+
+type policyStatement struct {
+	Dominant       bool       `json:"dominant"`
+	DefaultOnTrue  bool       `json:"defaultOnTrue"`
+	DefaultOnFalse bool       `json:"defaultOnFalse"`
+	Condition      policyExpr `json:"condition"`
+}
+
+type policyDocument struct {
+	Statements map[string]policyStatement `json:"statements"`
+}
+
+type policyResult int
+
+const (
+	policyDefault policyResult = iota
+	policyAllow
+	policyDeny
+	policyAlwaysAllow
+	policyNever
+)
+
+type timelinePolicy struct {
+	found  bool
+	policy string
+	params map[string]any
+}
+
+type cachedEvaluation struct {
+	allowed   bool
+	expiresAt time.Time
+}
+
+type cachedPolicy struct {
+	document  *policyDocument
+	expiresAt time.Time
+}
+
+type cachedTimeline struct {
+	timeline  timelinePolicy
+	expiresAt time.Time
+}
+
+// policyEngine evaluates the read policies of timelines, together with the policy of the
+// domain, so that search results never reveal messages a requester couldn't read on the
+// platform. Messages whose timelines are all unreadable by guests are indexed as
+// restricted and only served through a timeline the requester may read.
+type policyEngine struct {
+	db      *gorm.DB
+	client  *http.Client
+	enabled bool
+	// skipRestricted leaves the messages no guest can read out of the index, instead of
+	// marking them restricted.
+	skipRestricted bool
+	ttl            time.Duration
+	domain         *policyDocument
+
+	mu          sync.Mutex
+	documents   map[string]cachedPolicy
+	timelines   map[string]cachedTimeline
+	evaluations map[string]cachedEvaluation
+}
+
+var policies = &policyEngine{}
+
+// setupPolicies reads POLICY_ENFORCEMENT, POLICY_SKIP_RESTRICTED, POLICY_CACHE_TTL
+// (default 5m) and POLICY_DOMAIN_FILE, the policy document of the domain.
+func setupPolicies(db *gorm.DB) error {
+	engine := &policyEngine{
+		db:             db,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		enabled:        os.Getenv("POLICY_ENFORCEMENT") == "true",
+		skipRestricted: os.Getenv("POLICY_SKIP_RESTRICTED") == "true",
+		ttl:            5 * time.Minute,
+		documents:      map[string]cachedPolicy{},
+		timelines:      map[string]cachedTimeline{},
+		evaluations:    map[string]cachedEvaluation{},
+	}
+	if engine.skipRestricted && !engine.enabled {
+		return fmt.Errorf("POLICY_SKIP_RESTRICTED needs POLICY_ENFORCEMENT=true")
+	}
+
+	if value := os.Getenv("POLICY_CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid POLICY_CACHE_TTL: %s", value)
+		}
+		engine.ttl = ttl
+	}
+
+	if path := os.Getenv("POLICY_DOMAIN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var document policyDocument
+		err = json.Unmarshal(data, &document)
+		if err != nil {
+			return fmt.Errorf("invalid POLICY_DOMAIN_FILE: %w", err)
+		}
+		engine.domain = &document
+	}
+
+	policies = engine
+	return nil
+}
+
+// canRead reports whether the requester may read the messages of the timeline. Timelines
+// that can't be resolved locally are treated as unreadable.
+func (e *policyEngine) canRead(ctx context.Context, timeline string, r requester) (bool, error) {
+	if !e.enabled {
+		return true, nil
+	}
+
+	key := timeline + "|" + r.key()
+	now := time.Now()
+	e.mu.Lock()
+	cached, ok := e.evaluations[key]
+	e.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.allowed, nil
+	}
+
+	allowed, err := e.evaluate(ctx, timeline, r)
+	if err != nil {
+		return false, err
+	}
+
+	e.mu.Lock()
+	if len(e.evaluations) >= policyCacheSize {
+		e.evaluations = map[string]cachedEvaluation{}
+	}
+	e.evaluations[key] = cachedEvaluation{allowed: allowed, expiresAt: now.Add(e.ttl)}
+	e.mu.Unlock()
+
+	return allowed, nil
+}
+
+// restricted reports whether none of the timelines is readable by guests.
+func (e *policyEngine) restricted(ctx context.Context, timelines []string) (bool, error) {
+	if !e.enabled {
+		return false, nil
+	}
+	for _, timeline := range timelines {
+		allowed, err := e.canRead(ctx, timeline, guest)
+		if err != nil {
+			return false, err
+		}
+		if allowed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (e *policyEngine) evaluate(ctx context.Context, timeline string, r requester) (bool, error) {
+	if e.domain != nil {
+		result := evaluateStatement(e.domain, actionTimelineRead, nil, r)
+		switch result {
+		case policyAlwaysAllow:
+			return true, nil
+		case policyNever, policyDeny:
+			return false, nil
+		}
+	}
+
+	resolved, err := e.lookupTimeline(timeline)
+	if err != nil {
+		return false, err
+	}
+	if !resolved.found {
+		return false, nil
+	}
+	if resolved.policy == "" {
+		// timelines without a policy are public
+		return true, nil
+	}
+
+	document, err := e.fetchPolicy(ctx, resolved.policy)
+	if err != nil {
+		return false, err
+	}
+
+	switch evaluateStatement(document, actionTimelineRead, resolved.params, r) {
+	case policyAllow, policyAlwaysAllow, policyDefault:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// evaluateStatement evaluates the statement of an action. A condition that can't be
+// evaluated (e.g. an unsupported operator) denies access.
+func evaluateStatement(document *policyDocument, action string, params map[string]any, r requester) policyResult {
+	statement, ok := document.Statements[action]
+	if !ok {
+		return policyDefault
+	}
+
+	value, err := evaluateExpr(statement.Condition, params, r)
+	if err != nil {
+		return policyNever
+	}
+	matched, _ := value.(bool)
+
+	switch {
+	case statement.Dominant && matched:
+		return policyAlwaysAllow
+	case statement.Dominant:
+		return policyNever
+	case matched && statement.DefaultOnTrue, !matched && statement.DefaultOnFalse:
+		return policyAllow
+	default:
+		return policyDeny
+	}
+}
+
+func evaluateExpr(expr policyExpr, params map[string]any, r requester) (any, error) {
+	args := func() ([]any, error) {
+		values := make([]any, len(expr.Args))
+		for i, arg := range expr.Args {
+			value, err := evaluateExpr(arg, params, r)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+
+	switch expr.Op {
+	case "And", "Or":
+		values, err := args()
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			b, _ := value.(bool)
+			if expr.Op == "And" && !b {
+				return false, nil
+			}
+			if expr.Op == "Or" && b {
+				return true, nil
+			}
+		}
+		return expr.Op == "And", nil
+	case "Not":
+		values, err := args()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("Not takes one argument")
+		}
+		b, _ := values[0].(bool)
+		return !b, nil
+	case "Eq":
+		values, err := args()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, fmt.Errorf("Eq takes two arguments")
+		}
+		return fmt.Sprint(values[0]) == fmt.Sprint(values[1]), nil
+	case "Contains":
+		values, err := args()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, fmt.Errorf("Contains takes two arguments")
+		}
+		list, _ := values[0].([]any)
+		return slices.ContainsFunc(list, func(item any) bool {
+			return fmt.Sprint(item) == fmt.Sprint(values[1])
+		}), nil
+	case "Const":
+		return expr.Const, nil
+	case "LoadParam":
+		name, _ := expr.Const.(string)
+		return params[name], nil
+	case "RequesterID":
+		return r.CCID, nil
+	case "RequesterDomain":
+		return r.Domain, nil
+	case "RequesterHasTag":
+		tag, _ := expr.Const.(string)
+		return slices.Contains(r.Tags, tag), nil
+	case "IsRequesterLocalUser":
+		return r.Type == requesterLocalUser, nil
+	case "IsRequesterRemoteUser":
+		return r.Type == requesterRemoteUser, nil
+	case "IsRequesterGuestUser":
+		return r.Type == requesterUnknown, nil
+	}
+
+	return nil, fmt.Errorf("unsupported policy operator %q", expr.Op)
+}
+
+// resolveTimelineID resolves a timeline reference ("t<id>", "t<id>@<host>" or
+// "<semantic id>@<owner>") to the ID of its row in the timelines table, or "" when the
+// timeline isn't known locally.
+func resolveTimelineID(db *gorm.DB, timeline string) (string, error) {
+	id, owner, _ := strings.Cut(timeline, "@")
+	if len(id) == 27 && strings.HasPrefix(id, "t") {
+		return id[1:], nil
+	}
+
+	var targets []string
+	err := db.Table("semantic_ids").Where("id = ? AND owner = ?", id, owner).Limit(1).Pluck("target", &targets).Error
+	if err != nil {
+		return "", err
+	}
+	if len(targets) == 0 {
+		return "", nil
+	}
+	return strings.TrimPrefix(targets[0], "t"), nil
+}
+
+// lookupTimeline looks up the policy of a timeline in the concurrent database.
+func (e *policyEngine) lookupTimeline(timeline string) (timelinePolicy, error) {
+	now := time.Now()
+	e.mu.Lock()
+	cached, ok := e.timelines[timeline]
+	e.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.timeline, nil
+	}
+
+	id, err := resolveTimelineID(e.db, timeline)
+	if err != nil {
+		return timelinePolicy{}, err
+	}
+
+	var resolved timelinePolicy
+	if id != "" {
+		var rows []struct {
+			Policy       string
+			PolicyParams *string
+		}
+		err := e.db.Table("timelines").
+			Select("schemas.url AS policy, timelines.policy_params").
+			Joins("LEFT JOIN schemas ON schemas.id = timelines.policy_id").
+			Where("timelines.id = ?", id).
+			Limit(1).
+			Scan(&rows).Error
+		if err != nil {
+			return timelinePolicy{}, err
+		}
+		if len(rows) > 0 {
+			resolved.found = true
+			resolved.policy = rows[0].Policy
+			if rows[0].PolicyParams != nil && *rows[0].PolicyParams != "" {
+				err = json.Unmarshal([]byte(*rows[0].PolicyParams), &resolved.params)
+				if err != nil {
+					return timelinePolicy{}, fmt.Errorf("invalid policy params of %s: %w", timeline, err)
+				}
+			}
+		}
+	}
+
+	e.mu.Lock()
+	if len(e.timelines) >= policyCacheSize {
+		e.timelines = map[string]cachedTimeline{}
+	}
+	e.timelines[timeline] = cachedTimeline{timeline: resolved, expiresAt: now.Add(e.ttl)}
+	e.mu.Unlock()
+
+	return resolved, nil
+}
+
+func (e *policyEngine) fetchPolicy(ctx context.Context, url string) (*policyDocument, error) {
+	now := time.Now()
+	e.mu.Lock()
+	cached, ok := e.documents[url]
+	e.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.document, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy %s returned %d", url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var document policyDocument
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", url, err)
+	}
+
+	e.mu.Lock()
+	e.documents[url] = cachedPolicy{document: &document, expiresAt: now.Add(e.ttl)}
+	e.mu.Unlock()
+
+	return &document, nil
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+	"gorm.io/gorm"
+)
+
+// postgresSchema creates the tables of the postgres backend. The settings of an index
+// are kept by name in its row, the documents with the tsvector of their searchable
+// attributes.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS ccsearch_indexes (
+		uid text PRIMARY KEY,
+		settings jsonb NOT NULL DEFAULT '{}'
+	)`,
+	`CREATE TABLE IF NOT EXISTS ccsearch_documents (
+		index_uid text NOT NULL,
+		id text NOT NULL,
+		document jsonb NOT NULL,
+		tsv tsvector NOT NULL,
+		PRIMARY KEY (index_uid, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS ccsearch_documents_tsv ON ccsearch_documents USING gin (tsv)`,
+	`CREATE INDEX IF NOT EXISTS ccsearch_documents_document ON ccsearch_documents USING gin (document jsonb_path_ops)`,
+}
+
+var errPostgresNotFound = errors.New("postgres: not found")
+
+func isPostgresNotFound(err error) bool {
+	return errors.Is(err, errPostgresNotFound)
+}
+
+// postgresBackend keeps the indexes in PostgreSQL, so that search works without a search
+// engine: in the database of POSTGRES_SEARCH_DSN, by default the concurrent database of
+// DB_DSN. The searchable attributes of the documents are kept as a tsvector of the text
+// search configuration POSTGRES_SEARCH_CONFIG, "simple" by default, and the words of a
+// search are parsed with websearch_to_tsquery. Words only match whole, after the
+// stemming of the configuration: there is no typo tolerance, and text without spaces
+// between its words, like Japanese, is only found by whole runs. Changing the
+// configuration takes a reindex.
+type postgresBackend struct {
+	db     *gorm.DB
+	config string
+
+	mu sync.Mutex
+	// searchable caches the searchable attributes of the indexes, by uid.
+	searchable map[string][]string
+}
+
+func newPostgresBackend() (*postgresBackend, error) {
+	db, err := openPostgres(cmp.Or(os.Getenv("POSTGRES_SEARCH_DSN"), db_dsn))
+	if err != nil {
+		return nil, err
+	}
+
+	config := cmp.Or(os.Getenv("POSTGRES_SEARCH_CONFIG"), "simple")
+	var valid bool
+	err = db.Raw("SELECT to_regconfig(?) IS NOT NULL", config).Row().Scan(&valid)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid POSTGRES_SEARCH_CONFIG: %s is not a text search configuration", config)
+	}
+
+	for _, statement := range postgresSchema {
+		err := db.Exec(statement).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the search tables: %w", err)
+		}
+	}
+
+	return &postgresBackend{
+		db:         db,
+		config:     config,
+		searchable: map[string][]string{},
+	}, nil
+}
+
+func (b *postgresBackend) index(uid string) searchIndex {
+	return &postgresIndex{backend: b, uid: uid}
+}
+
+func (b *postgresBackend) openIndex(uid string) (searchIndex, error) {
+	err := b.db.Exec("INSERT INTO ccsearch_indexes (uid) VALUES (?) ON CONFLICT DO NOTHING", uid).Error
+	if err != nil {
+		return nil, err
+	}
+	return b.index(uid), nil
+}
+
+func (b *postgresBackend) deleteIndex(uid string) error {
+	return b.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("DELETE FROM ccsearch_documents WHERE index_uid = ?", uid).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM ccsearch_indexes WHERE uid = ?", uid).Error
+	})
+}
+
+func (b *postgresBackend) health(ctx context.Context) error {
+	return b.db.WithContext(ctx).Exec("SELECT 1").Error
+}
+
+// postgresIndex is an index of the postgres backend behind searchIndex, with the same
+// support as opensearchIndex. Writes are committed by the time they return,
+// so their tasks have already succeeded.
+type postgresIndex struct {
+	backend *postgresBackend
+	uid     string
+}
+
+func (i *postgresIndex) succeeded() *meilisearch.TaskInfo {
+	return &meilisearch.TaskInfo{Status: meilisearch.TaskStatusSucceeded, IndexUID: i.uid, EnqueuedAt: time.Now()}
+}
+
+// tsvector is the expression of the tsvector of the document in column, made of the
+// strings in the attributes.
+func (i *postgresIndex) tsvector(column string, attributes []string) (string, []any) {
+	if len(attributes) == 0 || slices.Contains(attributes, "*") {
+		return "jsonb_to_tsvector(?::regconfig, " + column + `, '["string"]')`, []any{i.backend.config}
+	}
+	values := []string{}
+	args := []any{i.backend.config}
+	for _, attribute := range attributes {
+		values = append(values, column+" #> ?::text[]")
+		args = append(args, postgresPath(attribute))
+	}
+	return "jsonb_to_tsvector(?::regconfig, jsonb_build_array(" + strings.Join(values, ", ") + `), '["string"]')`, args
+}
+
+// write stores the documents, replacing them, or with partial set merges them into the
+// existing ones. Of the documents sharing an id the last one wins, as in Meilisearch.
+func (i *postgresIndex) write(ctx context.Context, documentsPtr any, partial bool) (*meilisearch.TaskInfo, error) {
+	data, err := json.Marshal(documentsPtr)
+	if err != nil {
+		return nil, err
+	}
+	var documents []map[string]any
+	err = json.Unmarshal(data, &documents)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]map[string]any{}
+	batch := []map[string]any{}
+	for _, document := range documents {
+		id, ok := document["id"].(string)
+		if !ok || id == "" {
+			return nil, errors.New("postgres: document without an id")
+		}
+		existing, ok := byID[id]
+		if !ok {
+			byID[id] = document
+			batch = append(batch, document)
+			continue
+		}
+		if !partial {
+			clear(existing)
+		}
+		for key, value := range document {
+			existing[key] = value
+		}
+	}
+	if len(batch) == 0 {
+		return i.succeeded(), nil
+	}
+	data, err = json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := i.searchableAttributes(ctx)
+	tsv, args := i.tsvector("input.document", attributes)
+	args = append([]any{i.uid}, args...)
+	args = append(args, string(data))
+	update := "document = EXCLUDED.document, tsv = EXCLUDED.tsv"
+	if partial {
+		merged, mergedArgs := i.tsvector("(ccsearch_documents.document || EXCLUDED.document)", attributes)
+		update = "document = ccsearch_documents.document || EXCLUDED.document, tsv = " + merged
+		args = append(args, mergedArgs...)
+	}
+
+	err = i.backend.db.WithContext(ctx).Exec(`INSERT INTO ccsearch_documents (index_uid, id, document, tsv)
+		SELECT ?, input.document ->> 'id', input.document, `+tsv+`
+		FROM jsonb_array_elements(?::jsonb) AS input(document)
+		ON CONFLICT (index_uid, id) DO UPDATE SET `+update, args...).Error
+	if err != nil {
+		return nil, err
+	}
+	return i.succeeded(), nil
+}
+
+func (i *postgresIndex) AddDocuments(documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(context.Background(), documentsPtr, false)
+}
+
+func (i *postgresIndex) AddDocumentsWithContext(ctx context.Context, documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(ctx, documentsPtr, false)
+}
+
+func (i *postgresIndex) UpdateDocuments(documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(context.Background(), documentsPtr, true)
+}
+
+func (i *postgresIndex) UpdateDocumentsWithContext(ctx context.Context, documentsPtr interface{}, primaryKey ...string) (*meilisearch.TaskInfo, error) {
+	return i.write(ctx, documentsPtr, true)
+}
+
+func (i *postgresIndex) DeleteDocuments(identifiers []string) (*meilisearch.TaskInfo, error) {
+	return i.DeleteDocumentsWithContext(context.Background(), identifiers)
+}
+
+func (i *postgresIndex) DeleteDocumentsWithContext(ctx context.Context, identifiers []string) (*meilisearch.TaskInfo, error) {
+	if len(identifiers) > 0 {
+		err := i.backend.db.WithContext(ctx).Exec("DELETE FROM ccsearch_documents WHERE index_uid = ? AND id IN ?", i.uid, identifiers).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return i.succeeded(), nil
+}
+
+func (i *postgresIndex) DeleteDocumentsByFilter(filter interface{}) (*meilisearch.TaskInfo, error) {
+	return i.DeleteDocumentsByFilterWithContext(context.Background(), filter)
+}
+
+func (i *postgresIndex) DeleteDocumentsByFilterWithContext(ctx context.Context, filter interface{}) (*meilisearch.TaskInfo, error) {
+	node, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, errors.New("postgres: deleting by filter needs a filter")
+	}
+	condition, args := postgresFilter(node)
+	err = i.backend.db.WithContext(ctx).Exec("DELETE FROM ccsearch_documents WHERE index_uid = ? AND ("+condition+")", append([]any{i.uid}, args...)...).Error
+	if err != nil {
+		return nil, err
+	}
+	return i.succeeded(), nil
+}
+
+func (i *postgresIndex) DeleteAllDocuments() (*meilisearch.TaskInfo, error) {
+	return i.DeleteAllDocumentsWithContext(context.Background())
+}
+
+func (i *postgresIndex) DeleteAllDocumentsWithContext(ctx context.Context) (*meilisearch.TaskInfo, error) {
+	err := i.backend.db.WithContext(ctx).Exec("DELETE FROM ccsearch_documents WHERE index_uid = ?", i.uid).Error
+	if err != nil {
+		return nil, err
+	}
+	return i.succeeded(), nil
+}
+
+// retrieveAttributes keeps the attributes of a document, nested ones by their first key.
+func retrieveAttributes(document map[string]any, attributes []string) map[string]any {
+	if len(attributes) == 0 || slices.Contains(attributes, "*") {
+		return document
+	}
+	retrieved := map[string]any{}
+	for _, attribute := range attributes {
+		key, _, _ := strings.Cut(attribute, ".")
+		if value, ok := document[key]; ok {
+			retrieved[key] = value
+		}
+	}
+	return retrieved
+}
+
+func (i *postgresIndex) GetDocument(identifier string, request *meilisearch.DocumentQuery, documentPtr interface{}) error {
+	return i.GetDocumentWithContext(context.Background(), identifier, request, documentPtr)
+}
+
+func (i *postgresIndex) GetDocumentWithContext(ctx context.Context, identifier string, request *meilisearch.DocumentQuery, documentPtr interface{}) error {
+	var data []byte
+	err := i.backend.db.WithContext(ctx).Raw("SELECT document FROM ccsearch_documents WHERE index_uid = ? AND id = ?", i.uid, identifier).Row().Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("document %s in index %s: %w", identifier, i.uid, errPostgresNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if request == nil || len(request.Fields) == 0 {
+		return json.Unmarshal(data, documentPtr)
+	}
+
+	var document map[string]any
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(retrieveAttributes(document, request.Fields))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, documentPtr)
+}
+
+func (i *postgresIndex) GetDocuments(param *meilisearch.DocumentsQuery, resp *meilisearch.DocumentsResult) error {
+	return i.GetDocumentsWithContext(context.Background(), param, resp)
+}
+
+func (i *postgresIndex) GetDocumentsWithContext(ctx context.Context, param *meilisearch.DocumentsQuery, resp *meilisearch.DocumentsResult) error {
+	if param == nil {
+		param = &meilisearch.DocumentsQuery{}
+	}
+	limit := param.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	where := "index_uid = ?"
+	args := []any{i.uid}
+	node, err := parseFilter(param.Filter)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		condition, filterArgs := postgresFilter(node)
+		where += " AND (" + condition + ")"
+		args = append(args, filterArgs...)
+	}
+
+	db := i.backend.db.WithContext(ctx)
+	var total int64
+	err = db.Raw("SELECT count(*) FROM ccsearch_documents WHERE "+where, args...).Row().Scan(&total)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Raw("SELECT document FROM ccsearch_documents WHERE "+where+" ORDER BY id LIMIT ? OFFSET ?", append(args, limit, param.Offset)...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	resp.Results = []map[string]interface{}{}
+	for rows.Next() {
+		var data []byte
+		err := rows.Scan(&data)
+		if err != nil {
+			return err
+		}
+		var document map[string]any
+		err = json.Unmarshal(data, &document)
+		if err != nil {
+			return err
+		}
+		resp.Results = append(resp.Results, retrieveAttributes(document, param.Fields))
+	}
+	resp.Limit = limit
+	resp.Offset = param.Offset
+	resp.Total = total
+	return rows.Err()
+}
+
+func (i *postgresIndex) Search(query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+	return i.SearchWithContext(context.Background(), query, request)
+}
+
+// SearchWithContext translates a Meilisearch search into SQL. Without a sort the hits
+// come by ts_rank, so like on OpenSearch the ranking rules of the settings have no
+// equivalent, and the facets are counted with a query each.
+func (i *postgresIndex) SearchWithContext(ctx context.Context, query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+	if request == nil {
+		request = &meilisearch.SearchRequest{}
+	}
+	start := time.Now()
+	limit := request.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	// the words are a relation of their own, so that every part of the query can use them
+	from := "ccsearch_documents, websearch_to_tsquery(?::regconfig, ?) AS query"
+	fromArgs := []any{i.backend.config, query}
+	where := "index_uid = ?"
+	whereArgs := []any{i.uid}
+	if strings.TrimSpace(query) != "" {
+		if len(request.AttributesToSearchOn) > 0 {
+			tsv, args := i.tsvector("document", request.AttributesToSearchOn)
+			where += " AND " + tsv + " @@ query"
+			whereArgs = append(whereArgs, args...)
+		} else {
+			where += " AND tsv @@ query"
+		}
+	}
+	node, err := parseFilter(request.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		condition, args := postgresFilter(node)
+		where += " AND (" + condition + ")"
+		whereArgs = append(whereArgs, args...)
+	}
+
+	columns := "document, ts_rank(tsv, query, 32), count(*) OVER ()"
+	columnArgs := []any{}
+	headlines := postgresHeadlines(request)
+	for _, attribute := range sortedKeys(headlines) {
+		source := "document #> ?::text[]"
+		args := []any{i.backend.config, postgresPath(attribute), headlines[attribute]}
+		if attribute == "*" {
+			source = "document"
+			args = []any{i.backend.config, headlines[attribute]}
+		}
+		columns += ", ts_headline(?::regconfig, " + source + ", query, ?)"
+		columnArgs = append(columnArgs, args...)
+	}
+
+	order := []string{}
+	orderArgs := []any{}
+	for _, rule := range request.Sort {
+		attribute, point, direction, err := parseSort(rule)
+		if err != nil {
+			return nil, err
+		}
+		if point != nil {
+			distance, args := postgresDistance(point[0], point[1])
+			order = append(order, distance+" "+strings.ToUpper(direction)+" NULLS LAST")
+			orderArgs = append(orderArgs, args...)
+			continue
+		}
+		order = append(order, "document #> ?::text[] "+strings.ToUpper(direction)+" NULLS LAST")
+		orderArgs = append(orderArgs, postgresPath(attribute))
+	}
+	if strings.TrimSpace(query) != "" {
+		order = append(order, "ts_rank(tsv, query, 32) DESC")
+	}
+	order = append(order, "id")
+
+	args := slices.Concat(columnArgs, fromArgs, whereArgs, orderArgs, []any{limit, request.Offset})
+	rows, err := i.backend.db.WithContext(ctx).Raw("SELECT "+columns+" FROM "+from+" WHERE "+where+" ORDER BY "+strings.Join(order, ", ")+" LIMIT ? OFFSET ?", args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	response := &meilisearch.SearchResponse{
+		Hits:     []interface{}{},
+		Offset:   request.Offset,
+		Limit:    limit,
+		Query:    query,
+		IndexUID: i.uid,
+	}
+	attributes := sortedKeys(headlines)
+	for rows.Next() {
+		var data []byte
+		var rank float64
+		formatted := make([][]byte, len(attributes))
+		targets := []any{&data, &rank, &response.EstimatedTotalHits}
+		for n := range formatted {
+			targets = append(targets, &formatted[n])
+		}
+		err := rows.Scan(targets...)
+		if err != nil {
+			return nil, err
+		}
+
+		var document map[string]any
+		err = json.Unmarshal(data, &document)
+		if err != nil {
+			return nil, err
+		}
+		hit := retrieveAttributes(document, request.AttributesToRetrieve)
+		if len(attributes) > 0 {
+			hit["_formatted"] = formattedDocument(document, attributes, formatted)
+		}
+		if request.ShowRankingScore {
+			hit["_rankingScore"] = rank
+		}
+		response.Hits = append(response.Hits, hit)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(request.Facets) > 0 {
+		distribution := map[string]any{}
+		for _, attribute := range request.Facets {
+			counts, err := i.facet(ctx, attribute, from, fromArgs, where, whereArgs)
+			if err != nil {
+				return nil, err
+			}
+			distribution[attribute] = counts
+		}
+		response.FacetDistribution = distribution
+	}
+	response.ProcessingTimeMs = time.Since(start).Milliseconds()
+	return response, nil
+}
+
+// postgresHeadlines are the ts_headline options of the attributes to highlight in full
+// and of the ones to crop around the matches, CropLength words long.
+func postgresHeadlines(request *meilisearch.SearchRequest) map[string]string {
+	preTag, postTag := cmp.Or(request.HighlightPreTag, "<em>"), cmp.Or(request.HighlightPostTag, "</em>")
+	tags := fmt.Sprintf(`StartSel="%s", StopSel="%s"`, strings.ReplaceAll(preTag, `"`, ""), strings.ReplaceAll(postTag, `"`, ""))
+
+	headlines := map[string]string{}
+	for _, attribute := range request.AttributesToHighlight {
+		headlines[attribute] = tags + ", HighlightAll=true"
+	}
+	cropLength := request.CropLength
+	if cropLength <= 0 {
+		cropLength = 10
+	}
+	for _, attribute := range request.AttributesToCrop {
+		headlines[attribute] = fmt.Sprintf("%s, MaxWords=%d, MinWords=%d", tags, max(cropLength, 2), max(cropLength/2, 1))
+	}
+	return headlines
+}
+
+// formattedDocument builds the _formatted document of a hit: the document with the
+// headlines in place of the attributes they come from.
+func formattedDocument(document map[string]any, attributes []string, headlines [][]byte) map[string]any {
+	formatted := map[string]any{}
+	for key, value := range document {
+		formatted[key] = value
+	}
+	for n, attribute := range attributes {
+		if headlines[n] == nil {
+			continue
+		}
+		var value any
+		if json.Unmarshal(headlines[n], &value) != nil {
+			continue
+		}
+		if attribute == "*" {
+			if object, ok := value.(map[string]any); ok {
+				formatted = object
+			}
+			continue
+		}
+		setFormatted(formatted, strings.Split(attribute, "."), value)
+	}
+	return formatted
+}
+
+// facet counts the values of an attribute among the hits, the most frequent 100.
+func (i *postgresIndex) facet(ctx context.Context, attribute, from string, fromArgs []any, where string, whereArgs []any) (map[string]any, error) {
+	args := slices.Concat(fromArgs, []any{jsonpath(attribute) + "[*]"}, whereArgs)
+	rows, err := i.backend.db.WithContext(ctx).Raw("SELECT value #>> '{}', count(*) FROM "+from+", jsonb_path_query(document, ?::jsonpath) AS value WHERE "+where+" GROUP BY 1 ORDER BY 2 DESC LIMIT 100", args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]any{}
+	for rows.Next() {
+		var value sql.NullString
+		var count int64
+		err := rows.Scan(&value, &count)
+		if err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			counts[value.String] = float64(count)
+		}
+	}
+	return counts, rows.Err()
+}
+
+// searchableAttributes are the searchable attributes of the index settings, read once.
+func (i *postgresIndex) searchableAttributes(ctx context.Context) []string {
+	i.backend.mu.Lock()
+	attributes, ok := i.backend.searchable[i.uid]
+	i.backend.mu.Unlock()
+	if ok {
+		return attributes
+	}
+
+	loaded, err := i.attributes(ctx, "searchableAttributes")
+	if err != nil {
+		if !isPostgresNotFound(err) {
+			reportError("postgres", err)
+		}
+		return nil
+	}
+	i.backend.mu.Lock()
+	i.backend.searchable[i.uid] = *loaded
+	i.backend.mu.Unlock()
+	return *loaded
+}
+
+func (i *postgresIndex) attributes(ctx context.Context, setting string) (*[]string, error) {
+	var data []byte
+	err := i.backend.db.WithContext(ctx).Raw("SELECT settings -> ? FROM ccsearch_indexes WHERE uid = ?", setting, i.uid).Row().Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("index %s: %w", i.uid, errPostgresNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	attributes := []string{}
+	if data != nil {
+		err = json.Unmarshal(data, &attributes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &attributes, nil
+}
+
+// setAttributes stores a setting, creating the index when it is missing. New searchable
+// attributes rebuild the tsvectors of the documents.
+func (i *postgresIndex) setAttributes(ctx context.Context, setting string, attributes *[]string) (*meilisearch.TaskInfo, error) {
+	data, err := json.Marshal(*attributes)
+	if err != nil {
+		return nil, err
+	}
+	err = i.backend.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO ccsearch_indexes (uid, settings) VALUES (?, jsonb_build_object(?::text, ?::jsonb))
+			ON CONFLICT (uid) DO UPDATE SET settings = ccsearch_indexes.settings || EXCLUDED.settings`, i.uid, setting, string(data)).Error
+		if err != nil || setting != "searchableAttributes" {
+			return err
+		}
+		tsv, args := i.tsvector("document", *attributes)
+		return tx.Exec("UPDATE ccsearch_documents SET tsv = "+tsv+" WHERE index_uid = ?", append(args, i.uid)...).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if setting == "searchableAttributes" {
+		i.backend.mu.Lock()
+		i.backend.searchable[i.uid] = slices.Clone(*attributes)
+		i.backend.mu.Unlock()
+	}
+	return i.succeeded(), nil
+}
+
+func (i *postgresIndex) GetFilterableAttributes() (*[]string, error) {
+	return i.attributes(context.Background(), "filterableAttributes")
+}
+
+func (i *postgresIndex) UpdateFilterableAttributes(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "filterableAttributes", request)
+}
+
+func (i *postgresIndex) GetSortableAttributes() (*[]string, error) {
+	return i.attributes(context.Background(), "sortableAttributes")
+}
+
+func (i *postgresIndex) UpdateSortableAttributes(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "sortableAttributes", request)
+}
+
+func (i *postgresIndex) GetSearchableAttributes() (*[]string, error) {
+	return i.attributes(context.Background(), "searchableAttributes")
+}
+
+func (i *postgresIndex) UpdateSearchableAttributes(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "searchableAttributes", request)
+}
+
+func (i *postgresIndex) GetRankingRules() (*[]string, error) {
+	return i.attributes(context.Background(), "rankingRules")
+}
+
+func (i *postgresIndex) UpdateRankingRules(request *[]string) (*meilisearch.TaskInfo, error) {
+	return i.setAttributes(context.Background(), "rankingRules", request)
+}
+
+func (i *postgresIndex) GetStats() (*meilisearch.StatsIndex, error) {
+	return i.GetStatsWithContext(context.Background())
+}
+
+func (i *postgresIndex) GetStatsWithContext(ctx context.Context) (*meilisearch.StatsIndex, error) {
+	var count int64
+	err := i.backend.db.WithContext(ctx).Raw("SELECT count(*) FROM ccsearch_documents WHERE index_uid = ?", i.uid).Row().Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	return &meilisearch.StatsIndex{NumberOfDocuments: count}, nil
+}
+
+func (i *postgresIndex) WaitForTask(taskUID int64, interval time.Duration) (*meilisearch.Task, error) {
+	return i.WaitForTaskWithContext(context.Background(), taskUID, interval)
+}
+
+func (i *postgresIndex) WaitForTaskWithContext(ctx context.Context, taskUID int64, interval time.Duration) (*meilisearch.Task, error) {
+	return &meilisearch.Task{Status: meilisearch.TaskStatusSucceeded, TaskUID: taskUID, IndexUID: i.uid}, nil
+}
+
+func (i *postgresIndex) ensureSettings(settings indexSettings) error {
+	err := untunable(settings, "postgres")
+	if err != nil {
+		return err
+	}
+	return reconcileAttributes(i, settings)
+}
+
+func (i *postgresIndex) settingsDrift(settings indexSettings) ([]string, error) {
+	err := untunable(settings, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	return attributeDrift(i, settings)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// postgresFilter converts a parsed filter into a condition on the document column.
+// Equality is tested by containment, so that the GIN index of the documents serves it,
+// both for a value and for an array holding it; the other comparisons go through
+// jsonpath.
+func postgresFilter(node *filterNode) (string, []any) {
+	switch node.kind {
+	case filterAnd, filterOr:
+		if len(node.children) == 0 {
+			if node.kind == filterAnd {
+				return "TRUE", nil
+			}
+			return "FALSE", nil
+		}
+		conditions := []string{}
+		args := []any{}
+		for _, child := range node.children {
+			condition, childArgs := postgresFilter(child)
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, childArgs...)
+		}
+		return strings.Join(conditions, " "+strings.ToUpper(node.kind)+" "), args
+	case filterNot:
+		condition, args := postgresFilter(node.children[0])
+		return "NOT (" + condition + ")", args
+	case filterEqual:
+		path := strings.Split(node.attribute, ".")
+		return "document @> ?::jsonb OR document @> ?::jsonb", []any{
+			containment(path, node.value),
+			containment(path, []any{node.value}),
+		}
+	case filterRange:
+		conditions := []string{}
+		for _, bound := range sortedKeys(node.bounds) {
+			operator := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[bound]
+			conditions = append(conditions, "@ "+operator+" "+jsonpathValue(node.bounds[bound]))
+		}
+		return "jsonb_path_exists(document, ?::jsonpath)", []any{jsonpath(node.attribute) + " ? (" + strings.Join(conditions, " && ") + ")"}
+	case filterExists:
+		return "document #> ?::text[] IS NOT NULL", []any{postgresPath(node.attribute)}
+	case filterGeoRadius:
+		distance, args := postgresDistance(node.args[0], node.args[1])
+		return "COALESCE(" + distance + " <= ?, FALSE)", append(args, node.args[2])
+	case filterGeoBoundingBox:
+		// a box crossing the antimeridian has its right edge west of its left one
+		longitude := postgresLongitude + " BETWEEN ? AND ?"
+		args := []any{node.args[2], node.args[0], node.args[3], node.args[1]}
+		if node.args[3] > node.args[1] {
+			longitude = "(" + postgresLongitude + " >= ? OR " + postgresLongitude + " <= ?)"
+		}
+		return "COALESCE(" + postgresLatitude + " BETWEEN ? AND ? AND " + longitude + ", FALSE)", args
+	}
+	return "FALSE", nil
+}
+
+// containment is the JSON of an object holding the value at the path.
+func containment(path []string, value any) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]any{path[i]: value}
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// jsonpath is the jsonpath of an attribute, with its keys quoted.
+func jsonpath(attribute string) string {
+	path := "$"
+	for _, key := range strings.Split(attribute, ".") {
+		path += "." + jsonpathValue(key)
+	}
+	return path
+}
+
+func jsonpathValue(value any) string {
+	switch value := value.(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	data, _ := json.Marshal(fmt.Sprint(value))
+	return string(data)
+}
+
+// postgresPath is the text array literal of the keys of an attribute, for the #> operator.
+func postgresPath(attribute string) string {
+	keys := []string{}
+	for _, key := range strings.Split(attribute, ".") {
+		key = strings.ReplaceAll(key, `\`, `\\`)
+		keys = append(keys, `"`+strings.ReplaceAll(key, `"`, `\"`)+`"`)
+	}
+	return "{" + strings.Join(keys, ",") + "}"
+}
+
+const (
+	postgresLatitude  = "(CASE WHEN jsonb_typeof(document #> '{_geo,lat}') = 'number' THEN (document #>> '{_geo,lat}')::float8 END)"
+	postgresLongitude = "(CASE WHEN jsonb_typeof(document #> '{_geo,lng}') = 'number' THEN (document #>> '{_geo,lng}')::float8 END)"
+)
+
+// postgresDistance is the haversine distance in meters between the geo point of the
+// document and a point, NULL for documents without one.
+func postgresDistance(lat, lng float64) (string, []any) {
+	return "(6371000 * 2 * asin(least(1, sqrt(power(sin(radians(" + postgresLatitude + " - ?) / 2), 2) + cos(radians(?)) * cos(radians(" + postgresLatitude + ")) * power(sin(radians(" + postgresLongitude + " - ?) / 2), 2)))))",
+		[]any{lat, lat, lng}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/totegamma/concurrent/core"
+)
+
+var profileSettings = indexSettings{
+	filterable: []string{"signer", "schema"},
+	sortable:   []string{"signedAt"},
+	searchable: []string{"username", "description", "body"},
+}
+
+// profileRecord is the indexed form of a profile. Profiles of schemas without a username
+// or a description keep their body to stay searchable.
+type profileRecord struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Schema      string `json:"schema"`
+	SignedAt    int64  `json:"signedAt"`
+	Signer      string `json:"signer"`
+	Username    string `json:"username,omitempty"`
+	Description string `json:"description,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	Body        any    `json:"body,omitempty"`
+}
+
+type profileResult struct {
+	ID          string `json:"id"`
+	CCID        string `json:"ccid"`
+	Schema      string `json:"schema"`
+	Username    string `json:"username,omitempty"`
+	Description string `json:"description,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+}
+
+// profileBatch indexes profile documents, for the pipelines with the "profiles"
+// transform, e.g. PIPELINES="messages:messages:messages;profiles:profiles:profiles".
+type profileBatch struct {
+	p       *pipeline
+	records []profileRecord
+	// deletions holds the IDs of the deleted profiles.
+	deletions []string
+	commits   map[string]uint
+}
+
+func newProfileBatch(p *pipeline) batchTransformer {
+	return &profileBatch{
+		p:       p,
+		records: []profileRecord{},
+		commits: map[string]uint{},
+	}
+}
+
+func (b *profileBatch) add(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cdidBase string) (string, error) {
+	switch doc.Type {
+	case "profile":
+		var profile core.ProfileDocument[any]
+		err := json.Unmarshal([]byte(commit.Document), &profile)
+		if err != nil {
+			return "", err
+		}
+
+		// an update carries the ID of the profile it replaces
+		id := profile.ID
+		if id == "" {
+			id = "p" + cdidBase
+		}
+		record := profileRecord{
+			ID:       id,
+			Type:     "profile",
+			Schema:   profile.Schema,
+			SignedAt: profile.SignedAt.UnixMilli(),
+			Signer:   profile.Signer,
+		}
+		if body, ok := profile.Body.(map[string]any); ok {
+			record.Username, _ = body["username"].(string)
+			record.Description, _ = body["description"].(string)
+			record.Avatar, _ = body["avatar"].(string)
+		}
+		if record.Username == "" && record.Description == "" {
+			record.Body = profile.Body
+		}
+
+		b.records = slices.DeleteFunc(b.records, func(other profileRecord) bool {
+			return other.ID == id
+		})
+		b.commits[id] = commit.ID
+		b.records = append(b.records, record)
+	case "delete":
+		var deletion core.DeleteDocument
+		err := json.Unmarshal([]byte(commit.Document), &deletion)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(deletion.Target, "p") {
+			return skipType, nil
+		}
+		b.records = slices.DeleteFunc(b.records, func(record profileRecord) bool {
+			return record.ID == deletion.Target
+		})
+		b.deletions = append(b.deletions, deletion.Target)
+	default:
+		return skipType, nil
+	}
+	return "", nil
+}
+
+func (b *profileBatch) commitOf(id string) (uint, bool) {
+	commit, ok := b.commits[id]
+	return commit, ok
+}
+
+func (b *profileBatch) documents(ctx context.Context) []documentSet {
+	documents := []any{}
+	for _, record := range b.records {
+		documents = append(documents, record)
+	}
+	return []documentSet{{index: b.p.index, documents: documents, deletions: b.deletions}}
+}
+
+func (b *profileBatch) finish(ctx context.Context) {
+	if completions != nil {
+		completions.recordProfiles(ctx, b.records)
+	}
+}
+
+// profileIndex returns the index of the first profiles pipeline, if there is one.
+func profileIndex() searchIndex {
+	return transformIndex("profiles")
+}
+
+// profilesHandler serves GET /v1/profiles?q=, searching profiles by username and
+// description.
+func profilesHandler(c echo.Context) error {
+	index := profileIndex()
+	if index == nil {
+		return respondError(c, http.StatusNotFound, codeFeatureDisabled, "profiles are not indexed")
+	}
+
+	query := c.QueryParam("q")
+	if query == "" {
+		return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "q", "query is empty")
+	}
+
+	offset, err := searchOffset(c)
+	if err != nil {
+		invalid := err.(*paramError)
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+	}
+
+	filter := []string{}
+	if schema := c.QueryParam("schema"); schema != "" {
+		filter = append(filter, fmt.Sprintf("schema = %s", quoteFilter(schema)))
+	}
+
+	limit, err := searchLimit(c)
+	if err != nil {
+		invalid := err.(*paramError)
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+	}
+
+	search, err := index.SearchWithContext(c.Request().Context(), query, &meilisearch.SearchRequest{
+		Limit:            limit,
+		Offset:           int64(offset),
+		Filter:           filter,
+		AttributesToCrop: []string{"description"},
+		CropLength:       30,
+	})
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+
+	results := []profileResult{}
+	for _, hit := range search.Hits {
+		hitDoc, ok := hit.(map[string]any)
+		if !ok {
+			continue
+		}
+		result := profileResult{}
+		result.ID, _ = hitDoc["id"].(string)
+		result.CCID, _ = hitDoc["signer"].(string)
+		result.Schema, _ = hitDoc["schema"].(string)
+		result.Username, _ = hitDoc["username"].(string)
+		result.Avatar, _ = hitDoc["avatar"].(string)
+		result.Description, _ = hitDoc["description"].(string)
+		if formatted, ok := hitDoc["_formatted"].(map[string]any); ok {
+			if description, ok := formatted["description"].(string); ok {
+				result.Description = description
+			}
+		}
+		results = append(results, result)
+	}
+
+	response := echo.Map{
+		"status":  "ok",
+		"content": results,
+		"limit":   limit,
+		"offset":  offset,
+	}
+	addPagination(response, offset, len(search.Hits), search.EstimatedTotalHits)
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const prometheusPrefix = "ccsearch_"
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabels(labels map[string]string, extra ...string) string {
+	parts := []string{}
+	for _, key := range sortedKeys(labels) {
+		parts = append(parts, key+`="`+prometheusEscaper.Replace(labels[key])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func prometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writePrometheus renders the metrics in the Prometheus text exposition format.
+func writePrometheus(b *strings.Builder, points []metricPoint, histograms []histogram) {
+	slices.SortFunc(points, func(a, b metricPoint) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(labelKey(a.Labels), labelKey(b.Labels)))
+	})
+	for i, point := range points {
+		name := prometheusPrefix + point.Name
+		if i == 0 || points[i-1].Name != point.Name {
+			kind := "gauge"
+			if point.Counter {
+				kind = "counter"
+			}
+			fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+		}
+		fmt.Fprintf(b, "%s%s %s\n", name, prometheusLabels(point.Labels), prometheusValue(point.Value))
+	}
+
+	slices.SortFunc(histograms, func(a, b histogram) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(labelKey(a.Labels), labelKey(b.Labels)))
+	})
+	for i, h := range histograms {
+		name := prometheusPrefix + h.Name
+		if i == 0 || histograms[i-1].Name != h.Name {
+			fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+		}
+		cumulative := uint64(0)
+		for j, bound := range h.Buckets {
+			cumulative += h.Counts[j]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", name, prometheusLabels(h.Labels, "le", prometheusValue(bound)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name, prometheusLabels(h.Labels, "le", "+Inf"), h.Count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", name, prometheusLabels(h.Labels), prometheusValue(h.Sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", name, prometheusLabels(h.Labels), h.Count)
+	}
+}
+
+// prometheusHandler serves GET /metrics for Prometheus to scrape. When METRICS_TOKEN is
+// set, scrapers must send it as a bearer token.
+func prometheusHandler(db *gorm.DB) echo.HandlerFunc {
+	token := os.Getenv("METRICS_TOKEN")
+	return func(c echo.Context) error {
+		if token != "" {
+			bearer, found := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				return respondError(c, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+			}
+		}
+
+		ctx := c.Request().Context()
+		var b strings.Builder
+		writePrometheus(&b, metrics.collect(ctx, db), metrics.histogramSnapshot())
+		return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// queryOperators are the `key:value` tokens recognized inside a search query.
+var queryOperators = []string{"has"}
+
+// parseOperators strips known `key:value` operators from a query and returns the remaining
+// free-text query alongside the operator values.
+func parseOperators(query string) (string, map[string][]string) {
+	operators := map[string][]string{}
+	terms := []string{}
+
+	for _, token := range strings.Fields(query) {
+		key, value, found := strings.Cut(token, ":")
+		if found && value != "" && slices.Contains(queryOperators, key) {
+			operators[key] = append(operators[key], strings.ToLower(value))
+			continue
+		}
+		terms = append(terms, token)
+	}
+
+	return strings.Join(terms, " "), operators
+}
+
+// quoteFilter quotes a value for use inside a Meilisearch filter expression.
+func quoteFilter(value string) string {
+	return strconv.Quote(value)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimitScript keeps a sliding window log per client in a sorted set: the requests of
+// the window are scored by time, and a request is let through while there are fewer than
+// the limit. It returns whether the request is allowed, the requests left, and the
+// milliseconds until the oldest request leaves the window.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {0, 0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, limit - count - 1, 0}
+`)
+
+type rateLimit struct {
+	requests int
+	window   time.Duration
+}
+
+// rateLimiter limits the requests of the search API in redis, so that the limits hold
+// across instances. Guests are limited per IP, and the requesters identified by a token
+// or by the gateway per CCID, usually with a higher limit.
+type rateLimiter struct {
+	rdb           *redis.Client
+	anonymous     *rateLimit
+	authenticated *rateLimit
+}
+
+var rateLimits = &rateLimiter{}
+
+// parseRateLimit reads a limit written as requests/window, e.g. 60/1m.
+func parseRateLimit(name, value string) (*rateLimit, error) {
+	if value == "" {
+		return nil, nil
+	}
+	count, window, found := strings.Cut(value, "/")
+	requests, err := strconv.Atoi(count)
+	if !found || err != nil || requests <= 0 {
+		return nil, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration < time.Second {
+		return nil, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return &rateLimit{requests: requests, window: duration}, nil
+}
+
+// setupRateLimits reads RATE_LIMIT_ANONYMOUS and RATE_LIMIT_AUTHENTICATED, the limit of
+// the requesters with a verified token. Without them requests are not limited.
+func setupRateLimits(rdb *redis.Client) error {
+	anonymous, err := parseRateLimit("RATE_LIMIT_ANONYMOUS", os.Getenv("RATE_LIMIT_ANONYMOUS"))
+	if err != nil {
+		return err
+	}
+	authenticated, err := parseRateLimit("RATE_LIMIT_AUTHENTICATED", os.Getenv("RATE_LIMIT_AUTHENTICATED"))
+	if err != nil {
+		return err
+	}
+
+	rateLimits = &rateLimiter{
+		rdb:           rdb,
+		anonymous:     anonymous,
+		authenticated: authenticated,
+	}
+	return nil
+}
+
+// trustedProxies holds the CIDRs of TRUSTED_PROXIES, the reverse proxies in front of the
+// service, whose forwarded headers are believed.
+var trustedProxies []*net.IPNet
+
+// setupTrustedProxies reads TRUSTED_PROXIES, comma-separated CIDRs.
+func setupTrustedProxies() error {
+	value := os.Getenv("TRUSTED_PROXIES")
+	if value == "" {
+		return nil
+	}
+	for _, cidr := range strings.Split(value, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES: %s", cidr)
+		}
+		trustedProxies = append(trustedProxies, ipRange)
+	}
+	return nil
+}
+
+// fromTrustedProxy reports whether the peer of the connection of a request is one of
+// the trusted proxies.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipRange := range trustedProxies {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipExtractor believes the X-Forwarded-For of the trusted proxies only; without them the
+// client is the peer of the connection, so that a forged header can't pick its rate
+// limit key.
+func ipExtractor() echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipRange := range trustedProxies {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// limitRequests rejects the requests over the limit of their client with 429 and a
+// Retry-After. When redis can't be reached requests are let through.
+func limitRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// only the requesters whose token was verified are limited by CCID; the others,
+		// the ones forwarded by the gateway included, are limited by IP, so that a forged
+		// or rotated identity doesn't lift the limit
+		limit, key := rateLimits.anonymous, "ip:"+c.RealIP()
+		if r, ok := c.Get(requesterKey).(requester); ok && r.CCID != "" && rateLimits.authenticated != nil {
+			limit, key = rateLimits.authenticated, "ccid:"+r.CCID
+		}
+		if limit == nil {
+			return next(c)
+		}
+
+		now := time.Now().UnixMilli()
+		member := strconv.FormatInt(now, 10) + "-" + strconv.FormatUint(rand.Uint64(), 36)
+		result, err := rateLimitScript.Run(c.Request().Context(), rateLimits.rdb,
+			[]string{"ccsearch:ratelimit:" + key},
+			now, limit.window.Milliseconds(), limit.requests, member,
+		).Int64Slice()
+		if err != nil {
+			reportError("ratelimit", err)
+			return next(c)
+		}
+
+		header := c.Response().Header()
+		header.Set("X-RateLimit-Limit", strconv.Itoa(limit.requests))
+		header.Set("X-RateLimit-Remaining", strconv.FormatInt(result[1], 10))
+		if result[0] == 0 {
+			retryAfter := max((result[2]+999)/1000, 1)
+			header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			return respondError(c, http.StatusTooManyRequests, codeRateLimited, "too many requests")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+)
+
+// schemaMapping describes which parts of a message body matter for search.
+// Paths are dot separated keys into the body; arrays are traversed transparently.
+type schemaMapping struct {
+	// Text lists the paths whose strings make up the searchable text.
+	Text []string `json:"text"`
+	// Markup is the format of the text, "markdown" or "html", indexed as plain text.
+	Markup string `json:"markup,omitempty"`
+	// Filterable maps a field name, exposed as `fields.<name>`, to the path of its value.
+	Filterable map[string]string `json:"filterable,omitempty"`
+	// Ignore lists paths left out of the text even when they sit under a text path.
+	Ignore []string `json:"ignore,omitempty"`
+	// Title and Media point to the title and the attached media shown in result previews.
+	Title string `json:"title,omitempty"`
+	Media string `json:"media,omitempty"`
+	// MediaURL, MediaType, MediaName and MediaAlt point, within each media item, to its
+	// URL, MIME type, file name and alt text, indexed as `media`. The file name defaults
+	// to the last segment of the URL.
+	MediaURL  string `json:"mediaURL,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	MediaName string `json:"mediaName,omitempty"`
+	MediaAlt  string `json:"mediaAlt,omitempty"`
+	// ContentWarning points to the content warning (spoiler) text. It is indexed on its own
+	// and never part of Text.
+	ContentWarning string `json:"contentWarning,omitempty"`
+	// Expires points to the time the message expires at, as unix milliseconds or RFC 3339.
+	// Expired messages are left out of results and deleted from the index.
+	Expires string `json:"expires,omitempty"`
+}
+
+// messagePreview is a schema independent summary of a message for rendering results.
+type messagePreview struct {
+	Title          string `json:"title,omitempty"`
+	ContentWarning string `json:"contentWarning,omitempty"`
+	Text           string `json:"text"`
+	MediaCount     int    `json:"mediaCount"`
+}
+
+const previewTextLength = 280
+
+func truncateRunes(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length]) + "…"
+}
+
+// schemaRegistry holds the mappings of the known schemas. Messages of a known schema are
+// indexed as extracted text and fields only; other messages keep their whole body.
+var schemaRegistry = map[string]schemaMapping{
+	"https://schema.concrnt.world/m/markdown.json": {
+		Text:   []string{"body"},
+		Markup: "markdown",
+	},
+	"https://schema.concrnt.world/m/plaintext.json": {
+		Text: []string{"body"},
+	},
+	"https://schema.concrnt.world/m/media.json": {
+		Text:       []string{"body"},
+		Markup:     "markdown",
+		Filterable: map[string]string{"mediaType": "medias.mediaType"},
+		Media:      "medias",
+		MediaURL:   "mediaURL",
+		MediaType:  "mediaType",
+		MediaName:  "name",
+		MediaAlt:   "alt",
+	},
+	"https://schema.concrnt.world/m/reply.json": {
+		Text:       []string{"body"},
+		Markup:     "markdown",
+		Filterable: map[string]string{"replyTo": "replyToMessageId"},
+	},
+	"https://schema.concrnt.world/m/reroute.json": {
+		Text:       []string{"body"},
+		Markup:     "markdown",
+		Filterable: map[string]string{"rerouteOf": "rerouteMessageId"},
+	},
+}
+
+// setupSchemaRegistry merges the mappings of the SCHEMA_REGISTRY file, a JSON object keyed
+// by schema URL, over the built-in ones. Keys ending with '*' match by prefix.
+func setupSchemaRegistry() error {
+	path := os.Getenv("SCHEMA_REGISTRY")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var mappings map[string]schemaMapping
+	err = json.Unmarshal(data, &mappings)
+	if err != nil {
+		return fmt.Errorf("invalid SCHEMA_REGISTRY: %w", err)
+	}
+	for schema, mapping := range mappings {
+		if len(mapping.Text) == 0 && len(mapping.Filterable) == 0 && mapping.ContentWarning == "" {
+			return fmt.Errorf("invalid SCHEMA_REGISTRY: %s maps no fields", schema)
+		}
+		if mapping.Markup != "" && mapping.Markup != "markdown" && mapping.Markup != "html" {
+			return fmt.Errorf("invalid SCHEMA_REGISTRY: %s has markup %q (expected markdown or html)", schema, mapping.Markup)
+		}
+	}
+
+	maps.Copy(schemaRegistry, mappings)
+	return nil
+}
+
+func lookupSchema(schema string) (schemaMapping, bool) {
+	if mapping, ok := schemaRegistry[schema]; ok {
+		return mapping, true
+	}
+	for pattern, mapping := range schemaRegistry {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(schema, prefix) {
+			return mapping, true
+		}
+	}
+	return schemaMapping{}, false
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// valuesAt returns every value found at path, descending into arrays along the way.
+func valuesAt(value any, path []string) []any {
+	if list, ok := value.([]any); ok {
+		values := []any{}
+		for _, item := range list {
+			values = append(values, valuesAt(item, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return []any{value}
+	}
+
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil
+	}
+	child, ok := fields[path[0]]
+	if !ok {
+		return nil
+	}
+	return valuesAt(child, path[1:])
+}
+
+// withoutPath returns a copy of value with path removed. value itself is left untouched.
+func withoutPath(value any, path []string) any {
+	if len(path) == 0 {
+		return nil
+	}
+
+	switch v := value.(type) {
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = withoutPath(item, path)
+		}
+		return list
+	case map[string]any:
+		child, ok := v[path[0]]
+		if !ok {
+			return v
+		}
+		fields := maps.Clone(v)
+		if len(path) == 1 {
+			delete(fields, path[0])
+		} else {
+			fields[path[0]] = withoutPath(child, path[1:])
+		}
+		return fields
+	}
+	return value
+}
+
+// extract builds the searchable text and the filterable fields of a message body.
+func (m schemaMapping) extract(body any) (string, map[string]any) {
+	pruned := body
+	for _, path := range m.Ignore {
+		pruned = withoutPath(pruned, splitPath(path))
+	}
+	if m.ContentWarning != "" {
+		pruned = withoutPath(pruned, splitPath(m.ContentWarning))
+	}
+
+	texts := []string{}
+	for _, path := range m.Text {
+		for _, value := range valuesAt(pruned, splitPath(path)) {
+			walkStrings(value, func(text string) {
+				text = plainText(m.Markup, text)
+				if strings.TrimSpace(text) != "" {
+					texts = append(texts, text)
+				}
+			})
+		}
+	}
+
+	var fields map[string]any
+	for name, path := range m.Filterable {
+		values := valuesAt(body, splitPath(path))
+		if len(values) == 0 {
+			continue
+		}
+		if fields == nil {
+			fields = map[string]any{}
+		}
+		if len(values) == 1 {
+			fields[name] = values[0]
+		} else {
+			fields[name] = values
+		}
+	}
+
+	return strings.Join(texts, "\n"), fields
+}
+
+// preview summarizes a message body given the text extracted from it.
+func (m schemaMapping) preview(body any, text string) *messagePreview {
+	preview := &messagePreview{
+		Text: truncateRunes(text, previewTextLength),
+	}
+	if m.Title != "" {
+		for _, value := range valuesAt(body, splitPath(m.Title)) {
+			if title, ok := value.(string); ok {
+				preview.Title = title
+				break
+			}
+		}
+	}
+	if m.Media != "" {
+		preview.MediaCount = len(valuesAt(body, splitPath(m.Media)))
+	}
+	preview.ContentWarning = truncateRunes(m.contentWarning(body), previewTextLength)
+	return preview
+}
+
+// contentWarning returns the content warning text of a message body.
+func (m schemaMapping) contentWarning(body any) string {
+	if m.ContentWarning == "" {
+		return ""
+	}
+	texts := []string{}
+	for _, value := range valuesAt(body, splitPath(m.ContentWarning)) {
+		walkStrings(value, func(text string) {
+			if strings.TrimSpace(text) != "" {
+				texts = append(texts, text)
+			}
+		})
+	}
+	return strings.Join(texts, "\n")
+}
+
+// fallbackPreview summarizes a message of an unknown schema from all of its strings.
+func fallbackPreview(body any) *messagePreview {
+	texts := []string{}
+	walkStrings(body, func(text string) {
+		if strings.TrimSpace(text) != "" {
+			texts = append(texts, text)
+		}
+	})
+	return &messagePreview{
+		Text: truncateRunes(strings.Join(texts, "\n"), previewTextLength),
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	relatedWindow    = 7 * 24 * time.Hour
+	relatedDocuments = 20000
+	relatedSize      = 10
+	relatedMinCount  = 2
+	relatedTTL       = 2 * time.Hour
+)
+
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/#])#([\p{L}\p{N}_]+)`)
+
+// hashtagNamePattern matches a hashtag as extractHashtags stores it.
+var hashtagNamePattern = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+
+// relatedStopwords are common words that co-occur with everything.
+var relatedStopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "that": true, "this": true, "with": true,
+	"you": true, "are": true, "was": true, "have": true, "not": true, "but": true,
+	"from": true, "they": true, "will": true, "just": true, "about": true, "what": true,
+	"https": true, "http": true, "www": true,
+}
+
+// extractHashtags collects the hashtags found in the string values of a message body,
+// lowercased and without the leading '#'.
+func extractHashtags(body any) []string {
+	tags := []string{}
+	walkStrings(body, func(text string) {
+		for _, match := range hashtagPattern.FindAllStringSubmatch(text, -1) {
+			tag := strings.ToLower(match[1])
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	})
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// relatedTerms returns the distinct words of the text worth suggesting: not hashtags,
+// not stopwords, and at least three characters long.
+func relatedTerms(text string) []string {
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '#' && r != '_'
+	}) {
+		if strings.HasPrefix(word, "#") || utf8.RuneCountInString(word) < 3 {
+			continue
+		}
+		word = strings.ToLower(word)
+		if relatedStopwords[word] || slices.Contains(terms, word) {
+			continue
+		}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+type relatedEntry struct {
+	Name  string  `json:"name"`
+	Count int64   `json:"count"`
+	Score float64 `json:"score"`
+}
+
+type relatedSearches struct {
+	Tag   string         `json:"tag"`
+	Tags  []relatedEntry `json:"tags"`
+	Terms []relatedEntry `json:"terms"`
+}
+
+func relatedKey(tag string) string {
+	return "ccsearch:related:" + tag
+}
+
+func getRelated(ctx context.Context, rdb *redis.Client, tag string) (*relatedSearches, error) {
+	relatedStr, err := rdb.Get(ctx, relatedKey(tag)).Result()
+	if err == redis.Nil {
+		return &relatedSearches{Tag: tag, Tags: []relatedEntry{}, Terms: []relatedEntry{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var related relatedSearches
+	err = json.Unmarshal([]byte(relatedStr), &related)
+	if err != nil {
+		return nil, err
+	}
+	return &related, nil
+}
+
+// topRelated ranks the co-occurrences of a tag. Scores divide by the square root of the
+// overall frequency so that ubiquitous tags and terms don't crowd out specific ones.
+func topRelated(counts map[string]int64, frequency map[string]int64) []relatedEntry {
+	entries := []relatedEntry{}
+	for name, count := range counts {
+		if count < relatedMinCount {
+			continue
+		}
+		entries = append(entries, relatedEntry{
+			Name:  name,
+			Count: count,
+			Score: float64(count) / math.Sqrt(float64(frequency[name])),
+		})
+	}
+	slices.SortFunc(entries, func(a, b relatedEntry) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.Name, b.Name))
+	})
+	if len(entries) > relatedSize {
+		entries = entries[:relatedSize]
+	}
+	return entries
+}
+
+// computeRelated counts which hashtags and terms appear together with each hashtag in
+// the recent messages, and stores the strongest associations per hashtag. Messages
+// indexed before hashtags were extracted are only counted after a reindex.
+func computeRelated(ctx context.Context, rdb *redis.Client, indexes []searchIndex) error {
+	filter := fmt.Sprintf("hashtags EXISTS AND signedAt > %d AND hidden != true AND spam != true AND flagged != true AND restricted != true",
+		time.Now().Add(-relatedWindow).UnixMilli())
+
+	tagFrequency := map[string]int64{}
+	termFrequency := map[string]int64{}
+	tagPairs := map[string]map[string]int64{}
+	tagTerms := map[string]map[string]int64{}
+
+	scanned := 0
+	for _, index := range indexes {
+		var offset int64
+		for scanned < relatedDocuments {
+			var result meilisearch.DocumentsResult
+			err := index.GetDocuments(&meilisearch.DocumentsQuery{
+				Fields: []string{"hashtags", "text", "body"},
+				Filter: filter,
+				Limit:  1000,
+				Offset: offset,
+			}, &result)
+			if err != nil {
+				return err
+			}
+
+			for _, doc := range result.Results {
+				var tags []string
+				if values, ok := doc["hashtags"].([]any); ok {
+					for _, value := range values {
+						if tag, ok := value.(string); ok {
+							tags = append(tags, tag)
+						}
+					}
+				}
+				texts := []string{}
+				walkStrings(doc["text"], func(text string) { texts = append(texts, text) })
+				walkStrings(doc["body"], func(text string) { texts = append(texts, text) })
+				terms := relatedTerms(strings.Join(texts, "\n"))
+
+				for _, term := range terms {
+					termFrequency[term]++
+				}
+				for _, tag := range tags {
+					tagFrequency[tag]++
+					if tagPairs[tag] == nil {
+						tagPairs[tag] = map[string]int64{}
+						tagTerms[tag] = map[string]int64{}
+					}
+					for _, other := range tags {
+						if other != tag {
+							tagPairs[tag][other]++
+						}
+					}
+					for _, term := range terms {
+						if term != tag {
+							tagTerms[tag][term]++
+						}
+					}
+				}
+			}
+
+			scanned += len(result.Results)
+			offset += int64(len(result.Results))
+			if len(result.Results) == 0 || offset >= result.Total {
+				break
+			}
+		}
+	}
+
+	pipe := rdb.Pipeline()
+	stored := 0
+	for tag := range tagPairs {
+		related := relatedSearches{
+			Tag:   tag,
+			Tags:  topRelated(tagPairs[tag], tagFrequency),
+			Terms: topRelated(tagTerms[tag], termFrequency),
+		}
+		if len(related.Tags) == 0 && len(related.Terms) == 0 {
+			continue
+		}
+		relatedJson, err := json.Marshal(related)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, relatedKey(tag), relatedJson, relatedTTL)
+		stored++
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	jobsLog.Info("related searches computed", "hashtags", stored, "messages", scanned)
+	return nil
+}
+
+func relatedHandler(rdb *redis.Client) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tag := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.QueryParam("tag")), "#"))
+		if tag == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "tag", "tag is empty")
+		}
+
+		related, err := getRelated(c.Request().Context(), rdb, tag)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": related})
+	}
+}
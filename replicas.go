@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// meilisearchReplica is a Meilisearch node serving search traffic only. Keeping its
+// indexes in sync with the primary (snapshots, dumps, or a second writer) is up to the
+// deployment.
+type meilisearchReplica struct {
+	url    string
+	client meilisearch.ServiceManager
+
+	mu        sync.Mutex
+	healthy   bool
+	lastError string
+	checkedAt time.Time
+}
+
+type replicaStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"lastError,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+func (r *meilisearchReplica) setHealth(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wasHealthy := r.healthy
+	r.healthy = err == nil
+	r.checkedAt = time.Now()
+	r.lastError = ""
+	if err != nil {
+		r.lastError = err.Error()
+	}
+
+	if wasHealthy && err != nil {
+		backendLog.Warn("meilisearch replica is down, failing over", "replica", r.url, "error", err)
+	} else if !wasHealthy && err == nil {
+		backendLog.Info("meilisearch replica is back", "replica", r.url)
+	}
+}
+
+func (r *meilisearchReplica) status() replicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return replicaStatus{URL: r.url, Healthy: r.healthy, LastError: r.lastError, CheckedAt: r.checkedAt}
+}
+
+// replicaSet spreads search requests over the healthy replicas.
+type replicaSet struct {
+	replicas []*meilisearchReplica
+	interval time.Duration
+	next     atomic.Uint64
+}
+
+// searchReplicas is nil when no replica is configured.
+var searchReplicas *replicaSet
+
+// setupReplicas reads MEILISEARCH_REPLICAS, a comma-separated list of Meilisearch URLs
+// that serve searches while MEILISEARCH_URL keeps taking the writes.
+// MEILISEARCH_REPLICA_KEY defaults to MEILISEARCH_KEY and only needs the search action.
+// MEILISEARCH_HEALTH_INTERVAL sets how often the replicas are checked (10s).
+func setupReplicas(config meilisearchConfig) error {
+	urls := os.Getenv("MEILISEARCH_REPLICAS")
+	if urls == "" {
+		return nil
+	}
+
+	key := os.Getenv("MEILISEARCH_REPLICA_KEY")
+	if key == "" {
+		key = meilisearch_key
+	}
+
+	set := &replicaSet{interval: 10 * time.Second}
+	if value := os.Getenv("MEILISEARCH_HEALTH_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid MEILISEARCH_HEALTH_INTERVAL: %s", value)
+		}
+		set.interval = interval
+	}
+
+	// the next replica is the retry
+	config.retries = 0
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		set.replicas = append(set.replicas, &meilisearchReplica{
+			url:     url,
+			client:  newMeilisearchClient(url, key, config),
+			healthy: true,
+		})
+	}
+	if len(set.replicas) == 0 {
+		return nil
+	}
+
+	searchReplicas = set
+	return nil
+}
+
+// healthy returns the healthy replicas, starting from the next one in turn.
+func (s *replicaSet) healthy() []*meilisearchReplica {
+	start := int(s.next.Add(1) % uint64(len(s.replicas)))
+	replicas := []*meilisearchReplica{}
+	for i := range s.replicas {
+		replica := s.replicas[(start+i)%len(s.replicas)]
+		if replica.status().Healthy {
+			replicas = append(replicas, replica)
+		}
+	}
+	return replicas
+}
+
+func (s *replicaSet) check(ctx context.Context) {
+	for _, replica := range s.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := replica.client.HealthWithContext(checkCtx)
+		cancel()
+		replica.setHealth(err)
+	}
+}
+
+// run checks the replicas until the context is done. Every instance checks its own view
+// of the replicas, as every instance serves searches.
+func (s *replicaSet) run(ctx context.Context) {
+	s.check(ctx)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		}
+	}
+}
+
+func (s *replicaSet) statuses() []replicaStatus {
+	statuses := []replicaStatus{}
+	for _, replica := range s.replicas {
+		statuses = append(statuses, replica.status())
+	}
+	return statuses
+}
+
+// replicaUnavailable tells whether a failed search is the replica's fault. Client errors
+// such as an invalid filter would fail on any node.
+func replicaUnavailable(err error) bool {
+	var meiliErr *meilisearch.Error
+	if errors.As(err, &meiliErr) && meiliErr.StatusCode >= 400 && meiliErr.StatusCode < 500 &&
+		meiliErr.StatusCode != http.StatusRequestTimeout && meiliErr.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	return true
+}
+
+// replicatedIndex sends searches to the healthy replicas and falls back to the primary
+// when none is left. Every other call goes to the primary.
+type replicatedIndex struct {
+	searchIndex
+	uid      string
+	replicas *replicaSet
+}
+
+// replicated wraps an index of the primary for the search paths when replicas are
+// configured. The indexer keeps the plain index, as it needs to read its own writes.
+func replicated(index searchIndex, uid string) searchIndex {
+	if searchReplicas == nil {
+		return index
+	}
+	return &replicatedIndex{searchIndex: index, uid: uid, replicas: searchReplicas}
+}
+
+func (i *replicatedIndex) Search(query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+	return i.SearchWithContext(context.Background(), query, request)
+}
+
+func (i *replicatedIndex) SearchWithContext(ctx context.Context, query string, request *meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+	for _, replica := range i.replicas.healthy() {
+		result, err := replica.client.Index(i.uid).SearchWithContext(ctx, query, request)
+		if err == nil {
+			return result, nil
+		}
+		if !replicaUnavailable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		replica.setHealth(err)
+	}
+	return i.searchIndex.SearchWithContext(ctx, query, request)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	reportsKey = "ccsearch:reports"
+	maxPenalty = 10
+)
+
+var (
+	// reportSchemas lists the association schemas that count as a report against their target.
+	reportSchemas     = []string{}
+	reportPenaltyStep = int64(3)
+)
+
+// setupReports reads REPORT_SCHEMAS (comma separated) and REPORT_PENALTY_STEP, the number
+// of reports that lower a message by one penalty level.
+func setupReports() error {
+	for _, schema := range strings.Split(os.Getenv("REPORT_SCHEMAS"), ",") {
+		schema = strings.TrimSpace(schema)
+		if schema != "" {
+			reportSchemas = append(reportSchemas, schema)
+		}
+	}
+
+	if value := os.Getenv("REPORT_PENALTY_STEP"); value != "" {
+		step, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || step <= 0 {
+			return fmt.Errorf("invalid REPORT_PENALTY_STEP: %s", value)
+		}
+		reportPenaltyStep = step
+	}
+
+	return nil
+}
+
+func isReportSchema(schema string) bool {
+	return slices.Contains(reportSchemas, schema)
+}
+
+func penaltyFor(reports int64) int {
+	return int(min(reports/reportPenaltyStep, maxPenalty))
+}
+
+// getReportCounts returns the number of reports received by each of the given messages.
+func getReportCounts(ctx context.Context, rdb *redis.Client, ids []string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	if len(ids) == 0 {
+		return counts, nil
+	}
+
+	scores, err := rdb.ZMScore(ctx, reportsKey, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, score := range scores {
+		if score > 0 {
+			counts[ids[i]] = int64(score)
+		}
+	}
+	return counts, nil
+}
+
+// recordReports adds the reports to the counters and updates the penalty of the reported
+// documents already in the indexes. Documents listed in pending are being written by the
+// caller with their penalty set, and are not updated here.
+func recordReports(ctx context.Context, rdb *redis.Client, indexes []searchIndex, reports map[string]int64, pending map[string]bool) error {
+	pipe := rdb.Pipeline()
+	counts := map[string]*redis.FloatCmd{}
+	for target, count := range reports {
+		counts[target] = pipe.ZIncrBy(ctx, reportsKey, float64(count), target)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	targets := []string{}
+	for target := range reports {
+		if !pending[target] {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	for _, index := range indexes {
+		updates := []map[string]any{}
+		for _, id := range existingDocuments(index, targets) {
+			updates = append(updates, map[string]any{
+				"id":      id,
+				"penalty": penaltyFor(int64(counts[id].Val())),
+			})
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		_, err := index.UpdateDocuments(updates)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clearReports drops the reports of a message and restores its ranking.
+func clearReports(ctx context.Context, rdb *redis.Client, indexes []searchIndex, id string) error {
+	err := rdb.ZRem(ctx, reportsKey, id).Err()
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if len(existingDocuments(index, []string{id})) == 0 {
+			continue
+		}
+		_, err := index.UpdateDocuments([]map[string]any{{"id": id, "penalty": 0}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillPenalties sets a zero penalty on documents indexed before penalties existed,
+// since the ranking rule places documents without the field last.
+func backfillPenalties(index searchIndex) error {
+	ids, err := findDocuments(index, "penalty NOT EXISTS")
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(ids); start += 1000 {
+		updates := []map[string]any{}
+		for _, id := range ids[start:min(start+1000, len(ids))] {
+			updates = append(updates, map[string]any{"id": id, "penalty": 0})
+		}
+		_, err := index.UpdateDocuments(updates)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(ids) > 0 {
+		moderationLog.Info("backfilled penalties", "count", len(ids))
+	}
+	return nil
+}
+
+func setupReportRoutes(admin *echo.Group, rdb *redis.Client) {
+
+	admin.POST("/reports", func(c echo.Context) error {
+		var request struct {
+			ID    string `json:"id"`
+			Count int64  `json:"count"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if request.ID == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "id", "id is required")
+		}
+		if request.Count <= 0 {
+			request.Count = 1
+		}
+
+		ctx := c.Request().Context()
+		err = recordReports(ctx, rdb, messageIndexes(), map[string]int64{request.ID: request.Count}, nil)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		counts, err := getReportCounts(ctx, rdb, []string{request.ID})
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		moderationLog.Info("report recorded", "id", request.ID, "count", request.Count)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{
+			"reports": counts[request.ID],
+			"penalty": penaltyFor(counts[request.ID]),
+		}})
+	})
+
+	admin.DELETE("/reports/:id", func(c echo.Context) error {
+		err := clearReports(c.Request().Context(), rdb, messageIndexes(), c.Param("id"))
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		moderationLog.Info("reports cleared", "id", c.Param("id"))
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// retentionWindow bounds the age of the searchable messages, so that the index only
+// holds recent content. Zero keeps everything.
+var retentionWindow time.Duration
+
+// setupRetention reads RETENTION_DAYS.
+func setupRetention() error {
+	value := os.Getenv("RETENTION_DAYS")
+	if value == "" {
+		return nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days <= 0 {
+		return fmt.Errorf("invalid RETENTION_DAYS: %s", value)
+	}
+	retentionWindow = time.Duration(days) * 24 * time.Hour
+	return nil
+}
+
+// pastRetention reports whether a message signed at t is older than the retention window.
+// Such messages are not indexed, so that a reindex doesn't bring them back.
+func pastRetention(t time.Time) bool {
+	return retentionWindow > 0 && time.Since(t) > retentionWindow
+}
+
+// pruneOldMessages deletes the messages signed before the retention window.
+func pruneOldMessages() error {
+	if retentionWindow == 0 {
+		return nil
+	}
+	filter := fmt.Sprintf("signedAt < %d", time.Now().Add(-retentionWindow).UnixMilli())
+
+	pruned := 0
+	for _, index := range messageIndexes() {
+		ids, err := findDocuments(index, filter)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		_, err = index.DeleteDocuments(ids)
+		if err != nil {
+			return err
+		}
+		pruned += len(ids)
+	}
+
+	if pruned > 0 {
+		jobsLog.Info("deleted messages past the retention window", "count", pruned)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/totegamma/concurrent/core"
+)
+
+// addRetraction takes a message out of a timeline it was posted to. The message itself
+// stays, so its document keeps its other timelines. A message of the batch is patched in
+// place, and an indexed one once the batch is written.
+func (b *messageBatch) addRetraction(ctx context.Context, document string) (string, error) {
+	var retraction core.RetractDocument
+	err := json.Unmarshal([]byte(document), &retraction)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(retraction.Target, "m") || retraction.Timeline == "" {
+		return skipType, nil
+	}
+
+	for i, record := range b.records {
+		if record.ID != retraction.Target {
+			continue
+		}
+		b.records[i] = retractTimeline(ctx, record, retraction.Timeline)
+		return "", nil
+	}
+
+	if b.retractions == nil {
+		b.retractions = map[string][]string{}
+	}
+	b.retractions[retraction.Target] = append(b.retractions[retraction.Target], retraction.Timeline)
+	return "", nil
+}
+
+// retractTimeline removes a timeline from a record, which is restricted again if the
+// timelines it is left in are.
+func retractTimeline(ctx context.Context, record messageRecord, timeline string) messageRecord {
+	record.Timelines = slices.DeleteFunc(slices.Clone(record.Timelines), func(other string) bool {
+		return other == timeline
+	})
+	restricted, err := policies.restricted(ctx, record.Timelines)
+	if err != nil {
+		// fail closed, as when indexing
+		reportError("indexer", err)
+		restricted = true
+	}
+	record.Restricted = restricted
+	return record
+}
+
+// applyRetractions patches the timelines of the indexed messages taken out of timelines.
+// The messages are looked up with one query per index, as most indexes hold few of them.
+func applyRetractions(ctx context.Context, indexes []searchIndex, retractions map[string][]string) error {
+	quoted := []string{}
+	for _, id := range sortedKeys(retractions) {
+		quoted = append(quoted, quoteFilter(id))
+	}
+	filter := fmt.Sprintf("id IN [%s]", strings.Join(quoted, ", "))
+
+	for _, index := range indexes {
+		var result meilisearch.DocumentsResult
+		err := index.GetDocumentsWithContext(ctx, &meilisearch.DocumentsQuery{
+			Fields: []string{"id", "timelines"},
+			Filter: filter,
+			Limit:  int64(len(retractions)),
+		}, &result)
+		if err != nil {
+			return err
+		}
+
+		updates := []map[string]any{}
+		for _, doc := range result.Results {
+			id, _ := doc["id"].(string)
+			if id == "" {
+				continue
+			}
+			record := messageRecord{Timelines: []string{}}
+			if values, ok := doc["timelines"].([]any); ok {
+				for _, value := range values {
+					if timeline, ok := value.(string); ok {
+						record.Timelines = append(record.Timelines, timeline)
+					}
+				}
+			}
+			for _, timeline := range retractions[id] {
+				record = retractTimeline(ctx, record, timeline)
+			}
+			updates = append(updates, map[string]any{
+				"id":         id,
+				"timelines":  record.Timelines,
+				"restricted": record.Restricted,
+			})
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		_, err = index.UpdateDocumentsWithContext(ctx, updates)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// indexRoute sends the messages of some schemas to a dedicated index, e.g. long-form
+// articles that want other search settings than microblog posts.
+type indexRoute struct {
+	Name    string   `json:"name"`
+	Index   string   `json:"index"`
+	Schemas []string `json:"schemas"`
+	// Searchable and RankingRules override the settings of the message index.
+	Searchable   []string `json:"searchable,omitempty"`
+	RankingRules []string `json:"rankingRules,omitempty"`
+
+	index searchIndex
+}
+
+var indexRoutes = []*indexRoute{}
+
+func (r *indexRoute) settings() indexSettings {
+	settings := messageSettings
+	if len(r.Searchable) > 0 {
+		settings.searchable = r.Searchable
+		if !slices.Contains(settings.searchable, "contentWarning") {
+			settings.searchable = append(slices.Clone(settings.searchable), "contentWarning")
+		}
+	}
+	if len(r.RankingRules) > 0 {
+		settings.rankingRules = r.RankingRules
+	}
+	return settings
+}
+
+// loadIndexRoutes reads the INDEX_ROUTES file, a JSON array of routes.
+func loadIndexRoutes() ([]*indexRoute, error) {
+	path := os.Getenv("INDEX_ROUTES")
+	if path == "" {
+		return []*indexRoute{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*indexRoute
+	err = json.Unmarshal(data, &routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INDEX_ROUTES: %w", err)
+	}
+
+	names := []string{}
+	for _, route := range routes {
+		if route.Name == "" || route.Index == "" || len(route.Schemas) == 0 {
+			return nil, fmt.Errorf("invalid INDEX_ROUTES: every route needs a name, an index and schemas")
+		}
+		if route.Name == "default" || slices.Contains(names, route.Name) {
+			return nil, fmt.Errorf("invalid INDEX_ROUTES: duplicate route name %q", route.Name)
+		}
+		names = append(names, route.Name)
+	}
+	return routes, nil
+}
+
+// setupIndexRoutes loads the routes and prepares their indexes.
+func setupIndexRoutes(backend searchBackend) error {
+	routes, err := loadIndexRoutes()
+	if err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		index, err := backend.openIndex(route.Index)
+		if err != nil {
+			return err
+		}
+
+		route.index = replicated(index, route.Index)
+		err = route.index.ensureSettings(route.settings())
+		if err != nil {
+			return err
+		}
+	}
+
+	indexRoutes = routes
+	return nil
+}
+
+// routeFor returns the route of the schema, or nil when it belongs in the pipeline index.
+func routeFor(schema string) *indexRoute {
+	for _, route := range indexRoutes {
+		if matchSchema(route.Schemas, schema) {
+			return route
+		}
+	}
+	return nil
+}
+
+func getIndexRoute(name string) *indexRoute {
+	for _, route := range indexRoutes {
+		if route.Name == name {
+			return route
+		}
+	}
+	return nil
+}
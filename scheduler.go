@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type job struct {
+	name     string
+	interval time.Duration
+	jitter   time.Duration
+	run      func(ctx context.Context) error
+	trigger  chan struct{}
+
+	mu           sync.Mutex
+	enabled      bool
+	running      bool
+	runs         int64
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+}
+
+type jobStatus struct {
+	Name         string     `json:"name"`
+	Enabled      bool       `json:"enabled"`
+	Running      bool       `json:"running"`
+	Interval     string     `json:"interval"`
+	Jitter       string     `json:"jitter"`
+	Runs         int64      `json:"runs"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration int64      `json:"lastDurationMs"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// jobScheduler runs named background jobs on independent intervals.
+// When a leader check is set, jobs only run on the instance that holds the leadership.
+type jobScheduler struct {
+	mu     sync.Mutex
+	jobs   []*job
+	leader func() bool
+	// running tracks the job runs in progress, for shutdown to wait on.
+	running sync.WaitGroup
+}
+
+var jobs = &jobScheduler{}
+
+// register adds a job. Its interval, jitter and enabled state can be overridden with
+// JOB_<NAME>_INTERVAL, JOB_<NAME>_JITTER and JOB_<NAME>_ENABLED.
+func (s *jobScheduler) register(name string, interval, jitter time.Duration, enabled bool, run func(ctx context.Context) error) {
+	envPrefix := "JOB_" + strings.ToUpper(name) + "_"
+
+	if value := os.Getenv(envPrefix + "INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			jobsLog.Warn("invalid job setting", "variable", envPrefix+"INTERVAL", "value", value)
+		} else {
+			interval = parsed
+		}
+	}
+	if value := os.Getenv(envPrefix + "JITTER"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			jobsLog.Warn("invalid job setting", "variable", envPrefix+"JITTER", "value", value)
+		} else {
+			jitter = parsed
+		}
+	}
+	if value := os.Getenv(envPrefix + "ENABLED"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			jobsLog.Warn("invalid job setting", "variable", envPrefix+"ENABLED", "value", value)
+		} else {
+			enabled = parsed
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		interval: interval,
+		jitter:   jitter,
+		enabled:  enabled,
+		run:      run,
+		trigger:  make(chan struct{}, 1),
+	})
+}
+
+func (s *jobScheduler) get(name string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *jobScheduler) start(ctx context.Context, leader func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leader = leader
+
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+}
+
+func (s *jobScheduler) loop(ctx context.Context, j *job) {
+	for {
+		wait := j.interval
+		if j.jitter > 0 {
+			wait += rand.N(j.jitter)
+		}
+
+		manual := false
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-j.trigger:
+			timer.Stop()
+			manual = true
+		}
+
+		j.mu.Lock()
+		enabled := j.enabled
+		j.mu.Unlock()
+		if !enabled && !manual {
+			continue
+		}
+
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			s.execute(ctx, j)
+		}()
+	}
+}
+
+// wait blocks until the job runs in progress are over, or the context is done. Jobs
+// stop being scheduled once the context given to start is done.
+func (s *jobScheduler) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *jobScheduler) execute(ctx context.Context, j *job) {
+	if s.leader != nil && !s.leader() {
+		return
+	}
+
+	j.mu.Lock()
+	if j.running {
+		j.mu.Unlock()
+		return
+	}
+	j.running = true
+	j.mu.Unlock()
+
+	start := time.Now()
+	err := j.run(ctx)
+	duration := time.Since(start)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.running = false
+	j.runs++
+	j.lastRun = start
+	j.lastDuration = duration
+	j.lastError = ""
+	if err != nil {
+		j.lastError = err.Error()
+		reportError("job "+j.name, err)
+	}
+}
+
+// runNow schedules an immediate run of the job, regardless of its interval and enabled state.
+func (s *jobScheduler) runNow(name string) error {
+	j := s.get(name)
+	if j == nil {
+		return errors.New("unknown job")
+	}
+
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *jobScheduler) setEnabled(name string, enabled bool) error {
+	j := s.get(name)
+	if j == nil {
+		return errors.New("unknown job")
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.enabled = enabled
+	return nil
+}
+
+func (s *jobScheduler) statuses() []jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := []jobStatus{}
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		status := jobStatus{
+			Name:         j.name,
+			Enabled:      j.enabled,
+			Running:      j.running,
+			Interval:     j.interval.String(),
+			Jitter:       j.jitter.String(),
+			Runs:         j.runs,
+			LastDuration: j.lastDuration.Milliseconds(),
+			LastError:    j.lastError,
+		}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			status.LastRun = &lastRun
+		}
+		j.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func setupJobRoutes(admin *echo.Group) {
+
+	admin.GET("/jobs", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": jobs.statuses()})
+	})
+
+	admin.PUT("/jobs/:name", func(c echo.Context) error {
+		var request struct {
+			Enabled *bool `json:"enabled"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if request.Enabled == nil {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "enabled", "enabled is required")
+		}
+
+		err = jobs.setEnabled(c.Param("name"), *request.Enabled)
+		if err != nil {
+			return respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+		}
+		adminLog.Info("job toggled", "job", c.Param("name"), "enabled", *request.Enabled)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+
+	admin.POST("/jobs/:name/run", func(c echo.Context) error {
+		err := jobs.runNow(c.Param("name"))
+		if err != nil {
+			return respondError(c, http.StatusNotFound, codeNotFound, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// schemaFilter decides which message schemas get indexed. Patterns match a schema exactly,
+// or as a prefix when they end with '*'.
+type schemaFilter struct {
+	allow []string
+	deny  []string
+}
+
+var messageSchemas schemaFilter
+
+func parseSchemaPatterns(config string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(config, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// setupSchemaFilter reads INDEX_SCHEMAS (allowlist) and EXCLUDE_SCHEMAS (denylist).
+// The denylist wins when a schema matches both.
+func setupSchemaFilter() {
+	messageSchemas = schemaFilter{
+		allow: parseSchemaPatterns(os.Getenv("INDEX_SCHEMAS")),
+		deny:  parseSchemaPatterns(os.Getenv("EXCLUDE_SCHEMAS")),
+	}
+}
+
+func matchSchema(patterns []string, schema string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(schema, prefix) {
+				return true
+			}
+		} else if pattern == schema {
+			return true
+		}
+	}
+	return false
+}
+
+func (f schemaFilter) allowed(schema string) bool {
+	if matchSchema(f.deny, schema) {
+		return false
+	}
+	return len(f.allow) == 0 || matchSchema(f.allow, schema)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+)
+
+// fieldNamePattern restricts the schema registry fields that can be filtered with a field.<name> parameter.
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// searchMessages runs the query of the request against the message index, restricted by
+// the given scope filters (e.g. a timeline or a thread) and the common search parameters.
+// Parameters missing from the request fall back to the given defaults.
+func searchMessages(c echo.Context, rdb *redis.Client, index searchIndex, scope []string, defaults searchDefaults) error {
+	query := c.QueryParam("q")
+	if query == "" && !defaults.browse {
+		return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "q", "query is empty")
+	}
+
+	offset, err := searchOffset(c)
+	if err != nil {
+		invalid := err.(*paramError)
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+	}
+
+	if query != "" {
+		recordQuery(c.Request().Context(), rdb, query)
+	}
+	metrics.add("search_requests_total", nil, 1)
+	start := time.Now()
+	defer func() {
+		metrics.observe("search_duration_seconds", nil, time.Since(start).Seconds())
+	}()
+
+	query, operators := parseOperators(query)
+
+	sort := c.QueryParam("sort")
+	if sort == "" {
+		sort = defaults.Sort
+	}
+	if sort == "" {
+		sort = "newest"
+	}
+	sortRules, ok := sortOrders[sort]
+	if !ok {
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "sort", "sort must be newest, oldest or relevance")
+	}
+
+	var cursor *searchCursor
+	if value := c.QueryParam("cursor"); value != "" {
+		if sort == "relevance" {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "cursor", "cursor needs sort newest or oldest")
+		}
+		if offset != 0 {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "cursor", "cursor and offset can't be combined")
+		}
+		// the ranking rules put the relevance of the words before the sort, so the hits
+		// of a query aren't in signedAt order and the cursor would skip some
+		if query != "" {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "cursor", "cursor can't be combined with a query; use offset")
+		}
+		decoded, err := decodeCursor(value)
+		if err != nil {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "cursor", err.Error())
+		}
+		cursor = &decoded
+	}
+
+	includeFlagged := defaults.IncludeFlagged != nil && *defaults.IncludeFlagged
+	if value := c.QueryParam("includeFlagged"); value != "" {
+		includeFlagged = value == "true"
+	}
+
+	filter := append(slices.Clone(scope), "hidden != true", "spam != true", notExpiredFilter(time.Now()))
+	if !includeFlagged {
+		filter = append(filter, "flagged != true")
+	}
+	if slices.Contains(operators["has"], "link") {
+		filter = append(filter, "links EXISTS")
+	}
+
+	signer := c.QueryParam("signer")
+	if signer != "" {
+		filter = append(filter, fmt.Sprintf("signer = %s", quoteFilter(signer)))
+	}
+
+	if schemas := c.QueryParams()["schema"]; len(schemas) > 0 {
+		quoted := []string{}
+		for _, schema := range schemas {
+			quoted = append(quoted, quoteFilter(schema))
+		}
+		filter = append(filter, fmt.Sprintf("schema IN [%s]", strings.Join(quoted, ", ")))
+	}
+
+	if langs := c.QueryParams()["lang"]; len(langs) > 0 {
+		quoted := []string{}
+		for _, lang := range langs {
+			quoted = append(quoted, quoteFilter(strings.ToLower(lang)))
+		}
+		filter = append(filter, fmt.Sprintf("lang IN [%s]", strings.Join(quoted, ", ")))
+	}
+
+	domain := c.QueryParam("domain")
+	if domain != "" {
+		filter = append(filter, fmt.Sprintf("linkDomains = %s", quoteFilter(normalizeDomain(domain))))
+	}
+
+	for param, values := range c.QueryParams() {
+		name, ok := strings.CutPrefix(param, "field.")
+		if !ok {
+			continue
+		}
+		if !fieldNamePattern.MatchString(name) {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, param, "invalid field name")
+		}
+		for _, value := range values {
+			filter = append(filter, fmt.Sprintf("fields.%s = %s", name, quoteFilter(value)))
+		}
+	}
+
+	geo, err := geoFilters(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+	filter = append(filter, geo...)
+
+	since, until, err := dateRange(c)
+	if err != nil {
+		var invalid *paramError
+		if errors.As(err, &invalid) {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+		}
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+	filter = append(filter, dateFilters(since, until)...)
+	if cursor != nil {
+		filter = append(filter, cursor.filter(sort))
+	}
+
+	targets := []searchIndex{index}
+	if messageShards != nil && index == messageShards.base {
+		// only the shards of the requested period are searched
+		targets = messageShards.between(since, until)
+	}
+	switch name := c.QueryParam("index"); name {
+	case "":
+		for _, route := range indexRoutes {
+			targets = append(targets, route.index)
+		}
+	case "default":
+	default:
+		route := getIndexRoute(name)
+		if route == nil {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "index", "unknown index")
+		}
+		targets = []searchIndex{route.index}
+	}
+
+	limit, err := searchLimit(c)
+	if err != nil {
+		invalid := err.(*paramError)
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+	}
+
+	facetAttributes := []string{"schema"}
+	if value := c.QueryParam("facets"); value != "" {
+		facetAttributes = []string{}
+		for _, attribute := range strings.Split(value, ",") {
+			attribute = strings.TrimSpace(attribute)
+			if !slices.Contains(facetableAttributes, attribute) {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "facets", "facets must be among "+strings.Join(facetableAttributes, ", "))
+			}
+			if !slices.Contains(facetAttributes, attribute) {
+				facetAttributes = append(facetAttributes, attribute)
+			}
+		}
+	}
+
+	includeDocument := false
+	if include := c.QueryParam("include"); include != "" {
+		for _, value := range strings.Split(include, ",") {
+			if strings.TrimSpace(value) != "document" {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "include", "include only accepts document")
+			}
+			includeDocument = true
+		}
+	}
+	attributes := resultAttributes
+	if includeDocument {
+		attributes = append(slices.Clone(resultAttributes), documentAttributes...)
+	}
+
+	hits, facets, total, err := searchIndexes(c.Request().Context(), targets, query, &meilisearch.SearchRequest{
+		Limit:                 limit,
+		Offset:                int64(offset),
+		Filter:                filter,
+		Sort:                  sortRules,
+		Facets:                facetAttributes,
+		AttributesToRetrieve:  attributes,
+		AttributesToHighlight: snippetAttributes,
+		AttributesToCrop:      snippetAttributes,
+		CropLength:            snippetLength,
+		HighlightPreTag:       highlightPreTag,
+		HighlightPostTag:      highlightPostTag,
+	}, c.QueryParam("search_cw") == "true")
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+
+	results := []searchResult{}
+	for _, hit := range hits {
+		hitDoc := hit.(map[string]any)
+		result := searchResult{
+			ID:      hitDoc["id"].(string),
+			Owner:   hitDoc["signer"].(string),
+			Preview: hitPreview(hitDoc),
+			Snippet: hitSnippet(hitDoc),
+		}
+		if includeDocument {
+			result.Document = hitDocument(hitDoc)
+		}
+		results = append(results, result)
+	}
+
+	response := echo.Map{
+		"status":  "ok",
+		"content": results,
+		"facets":  facets,
+		"limit":   limit,
+		"offset":  offset,
+	}
+	addPagination(response, offset, len(hits), total)
+	if sort != "relevance" && query == "" && int64(len(hits)) == limit {
+		response["nextCursor"] = encodeCursor(nextCursor(cursor, hits))
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// addPagination adds what clients need to render pagination to a search response: the
+// estimated total of hits, whether there are more, and the offset of the next page.
+// The estimate is exhaustive up to the maxTotalHits of the index.
+func addPagination(response echo.Map, offset, count int, total int64) {
+	next := offset + count
+	hasMore := count > 0 && int64(next) < total
+	response["estimatedTotalHits"] = total
+	response["hasMore"] = hasMore
+	if hasMore {
+		response["nextOffset"] = next
+	}
+}
+
+// facetableAttributes are the attributes the facets parameter can ask the distribution of.
+var facetableAttributes = []string{"schema", "signer", "hashtags", "lang"}
+
+// resultAttributes are the attributes a search retrieves: the ones of the result, the
+// ones the hits of several indexes are merged by, and the ones snippets are cut from.
+var resultAttributes = []string{"id", "signer", "preview", "signedAt", "text", "body"}
+
+// snippetAttributes are highlighted and cropped around the matched words to make the
+// snippet of a hit. The text is not HTML-escaped; only the highlight tags are markup.
+var snippetAttributes = []string{"text", "body"}
+
+const (
+	snippetLength    = 30
+	highlightPreTag  = "<em>"
+	highlightPostTag = "</em>"
+)
+
+// documentAttributes are the attributes added with include=document. Moderation and
+// policy attributes stay out of responses.
+var documentAttributes = []string{"schema", "timelines", "contentWarning"}
+
+const defaultSearchLimit = 10
+
+// searchMaxLimit caps the limit parameter; SEARCH_MAX_LIMIT overrides it.
+var searchMaxLimit = 50
+
+// searchOffset reads the number of hits to skip, a non-negative integer.
+func searchOffset(c echo.Context) (int, error) {
+	offsetStr := c.QueryParam("offset")
+	if offsetStr == "" {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(offsetStr)
+	if err != nil || offset < 0 {
+		return 0, &paramError{field: "offset", message: "offset must be a non-negative integer"}
+	}
+	return offset, nil
+}
+
+// searchLimit reads the page size of a search, clamped to searchMaxLimit.
+func searchLimit(c echo.Context) (int64, error) {
+	limitStr := c.QueryParam("limit")
+	if limitStr == "" {
+		return min(defaultSearchLimit, int64(searchMaxLimit)), nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, &paramError{field: "limit", message: "limit must be a positive integer"}
+	}
+	return int64(min(limit, searchMaxLimit)), nil
+}
+
+// facetCounts are the facet distributions of a search, per attribute and value.
+type facetCounts map[string]map[string]int64
+
+// add sums the facet distribution of a search response into the counts.
+func (f facetCounts) add(distribution any) {
+	attributes, _ := distribution.(map[string]any)
+	for attribute, values := range attributes {
+		counts, _ := values.(map[string]any)
+		for value, count := range counts {
+			number, _ := count.(float64)
+			if f[attribute] == nil {
+				f[attribute] = map[string]int64{}
+			}
+			f[attribute][value] += int64(number)
+		}
+	}
+}
+
+// searchIndexes runs the search on every index and merges the hits in the order of the
+// request: by signedAt, or by ranking score when it has no sort. The facet distributions
+// and the estimated total hits of the request are summed over the indexes.
+// With several indexes each one is asked for the whole window up to offset+limit.
+// Content warnings are only matched when searchCW is set.
+func searchIndexes(ctx context.Context, indexes []searchIndex, query string, request *meilisearch.SearchRequest, searchCW bool) ([]any, facetCounts, int64, error) {
+	facets := facetCounts{}
+	var total int64
+	search := func(index searchIndex, request meilisearch.SearchRequest) (*meilisearch.SearchResponse, error) {
+		if !searchCW {
+			request.AttributesToSearchOn = searchAttributes(index)
+		}
+		response, err := index.SearchWithContext(ctx, query, &request)
+		if err != nil {
+			return nil, err
+		}
+		facets.add(response.FacetDistribution)
+		total += response.EstimatedTotalHits
+		return response, nil
+	}
+
+	if len(indexes) == 1 {
+		search, err := search(indexes[0], *request)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return search.Hits, facets, total, nil
+	}
+
+	window := *request
+	window.Offset = 0
+	window.Limit = request.Offset + request.Limit
+	window.ShowRankingScore = len(request.Sort) == 0
+
+	hits := []any{}
+	for _, index := range indexes {
+		search, err := search(index, window)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		hits = append(hits, search.Hits...)
+	}
+
+	slices.SortStableFunc(hits, func(a, b any) int {
+		switch {
+		case len(request.Sort) == 0:
+			return cmp.Compare(hitNumber(b, "_rankingScore"), hitNumber(a, "_rankingScore"))
+		case request.Sort[0] == "signedAt:asc":
+			return cmp.Compare(hitNumber(a, "signedAt"), hitNumber(b, "signedAt"))
+		default:
+			return cmp.Compare(hitNumber(b, "signedAt"), hitNumber(a, "signedAt"))
+		}
+	})
+
+	start := min(int(request.Offset), len(hits))
+	end := min(start+int(request.Limit), len(hits))
+	return hits[start:end], facets, total, nil
+}
+
+// searchAttributes lists the searchable attributes of the index but the content warnings.
+func searchAttributes(index searchIndex) []string {
+	settings := messageSettings
+	for _, route := range indexRoutes {
+		if route.index == index {
+			settings = route.settings()
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(settings.searchable), func(attribute string) bool {
+		return attribute == "contentWarning"
+	})
+}
+
+func hitNumber(hit any, field string) float64 {
+	hitDoc, _ := hit.(map[string]any)
+	value, _ := hitDoc[field].(float64)
+	return value
+}
+
+// hitSnippet returns the cropped text of a hit with the matched words highlighted, or
+// the first highlighted string of its body for schemas without text.
+func hitSnippet(hitDoc map[string]any) string {
+	formatted, ok := hitDoc["_formatted"].(map[string]any)
+	if !ok {
+		return ""
+	}
+	if text, ok := formatted["text"].(string); ok && text != "" {
+		return text
+	}
+	snippet := ""
+	walkStrings(formatted["body"], func(value string) {
+		if snippet == "" && strings.Contains(value, highlightPreTag) {
+			snippet = value
+		}
+	})
+	return snippet
+}
+
+func hitDocument(hitDoc map[string]any) *searchDocument {
+	document := &searchDocument{
+		SignedAt:  int64(hitNumber(hitDoc, "signedAt")),
+		UpdatedAt: int64(hitNumber(hitDoc, "updatedAt")),
+		Body:      hitDoc["body"],
+	}
+	document.Schema, _ = hitDoc["schema"].(string)
+	document.Text, _ = hitDoc["text"].(string)
+	document.ContentWarning, _ = hitDoc["contentWarning"].(string)
+	timelines, _ := hitDoc["timelines"].([]any)
+	document.Timelines = []string{}
+	for _, timeline := range timelines {
+		if id, ok := timeline.(string); ok {
+			document.Timelines = append(document.Timelines, id)
+		}
+	}
+	return document
+}
+
+// hitPreview decodes the preview stored with a hit. Documents indexed before previews
+// existed have none.
+func hitPreview(hitDoc map[string]any) *messagePreview {
+	fields, ok := hitDoc["preview"].(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	preview := &messagePreview{}
+	preview.Title, _ = fields["title"].(string)
+	preview.Text, _ = fields["text"].(string)
+	if count, ok := fields["mediaCount"].(float64); ok {
+		preview.MediaCount = int(count)
+	}
+	return preview
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// indexSettings are the settings an index needs for its documents to be searchable.
+type indexSettings struct {
+	filterable []string
+	sortable   []string
+	// searchable and rankingRules are left empty to keep the engine defaults.
+	searchable   []string
+	rankingRules []string
+	// tuned marks the message indexes, which take the synonyms, stop words and typo
+	// tolerance of the service config.
+	tuned bool
+}
+
+var messageSettings = indexSettings{
+	filterable: []string{"id", "signer", "schema", "signedAt", "timelines", "links", "linkDomains", "hashtags", "mentions", "lang", "_geo", "threadRoot", "hidden", "hiddenAt", "penalty", "spam", "flagged", "restricted", "expiresAt", "fields"},
+	sortable:   []string{"signedAt", "_geo"},
+	// text is extracted from the body of known schemas, while other schemas keep their body.
+	searchable: []string{"text", "body", "linkPreviews", "media", "contentWarning"},
+	// penalty sits before sort so that reported messages sink below the others
+	// while everything else keeps its chronological order.
+	rankingRules: []string{"words", "typo", "proximity", "attribute", "penalty:asc", "sort", "exactness"},
+	tuned:        true,
+}
+
+func sameAttributes(current, desired []string) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	for _, attribute := range desired {
+		if !slices.Contains(current, attribute) {
+			return false
+		}
+	}
+	return true
+}
+
+// attributeIndex is the part of an index that holds the attribute settings, which every
+// backend has.
+type attributeIndex interface {
+	GetFilterableAttributes() (*[]string, error)
+	UpdateFilterableAttributes(request *[]string) (*meilisearch.TaskInfo, error)
+	GetSortableAttributes() (*[]string, error)
+	UpdateSortableAttributes(request *[]string) (*meilisearch.TaskInfo, error)
+	GetSearchableAttributes() (*[]string, error)
+	UpdateSearchableAttributes(request *[]string) (*meilisearch.TaskInfo, error)
+	GetRankingRules() (*[]string, error)
+	UpdateRankingRules(request *[]string) (*meilisearch.TaskInfo, error)
+}
+
+// reconcileAttributes updates the attribute settings of an index that differ.
+func reconcileAttributes(index attributeIndex, settings indexSettings) error {
+	filterables, err := index.GetFilterableAttributes()
+	if err != nil {
+		return err
+	}
+	if !sameAttributes(*filterables, settings.filterable) {
+		filters := slices.Clone(settings.filterable)
+		_, err := index.UpdateFilterableAttributes(&filters)
+		if err != nil {
+			return err
+		}
+		settingsLog.Info("filterables updated")
+	}
+
+	sortables, err := index.GetSortableAttributes()
+	if err != nil {
+		return err
+	}
+	if !sameAttributes(*sortables, settings.sortable) {
+		sorts := slices.Clone(settings.sortable)
+		_, err := index.UpdateSortableAttributes(&sorts)
+		if err != nil {
+			return err
+		}
+		settingsLog.Info("sortables updated")
+	}
+
+	if len(settings.searchable) > 0 {
+		searchables, err := index.GetSearchableAttributes()
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(*searchables, settings.searchable) {
+			searchable := slices.Clone(settings.searchable)
+			_, err := index.UpdateSearchableAttributes(&searchable)
+			if err != nil {
+				return err
+			}
+			settingsLog.Info("searchables updated")
+		}
+	}
+
+	if len(settings.rankingRules) > 0 {
+		rankingRules, err := index.GetRankingRules()
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(*rankingRules, settings.rankingRules) {
+			rules := slices.Clone(settings.rankingRules)
+			_, err := index.UpdateRankingRules(&rules)
+			if err != nil {
+				return err
+			}
+			settingsLog.Info("ranking rules updated")
+		}
+	}
+	return nil
+}
+
+// attributeDrift lists the attribute settings of an index that differ.
+func attributeDrift(index attributeIndex, settings indexSettings) ([]string, error) {
+	drift := []string{}
+
+	filterables, err := index.GetFilterableAttributes()
+	if err != nil {
+		return nil, err
+	}
+	if !sameAttributes(*filterables, settings.filterable) {
+		drift = append(drift, "filterableAttributes")
+	}
+
+	sortables, err := index.GetSortableAttributes()
+	if err != nil {
+		return nil, err
+	}
+	if !sameAttributes(*sortables, settings.sortable) {
+		drift = append(drift, "sortableAttributes")
+	}
+
+	if len(settings.searchable) > 0 {
+		searchables, err := index.GetSearchableAttributes()
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Equal(*searchables, settings.searchable) {
+			drift = append(drift, "searchableAttributes")
+		}
+	}
+
+	if len(settings.rankingRules) > 0 {
+		rankingRules, err := index.GetRankingRules()
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Equal(*rankingRules, settings.rankingRules) {
+			drift = append(drift, "rankingRules")
+		}
+	}
+	return drift, nil
+}
+
+// untunable is the error of the backends without typo tolerance and dictionaries for
+// the message indexes, when either is configured.
+func untunable(settings indexSettings, backend string) error {
+	if !settings.tuned {
+		return nil
+	}
+	if typoTolerance != nil {
+		return fmt.Errorf("the TYPO_ settings need SEARCH_BACKEND=meilisearch, not %s", backend)
+	}
+	if dictionary != nil {
+		return fmt.Errorf("SEARCH_DICTIONARY needs SEARCH_BACKEND=meilisearch, not %s", backend)
+	}
+	return nil
+}
+
+func (i *meilisearchIndex) ensureSettings(settings indexSettings) error {
+	err := reconcileAttributes(i, settings)
+	if err != nil {
+		return err
+	}
+
+	if settings.tuned && typoTolerance != nil {
+		current, err := i.GetTypoTolerance()
+		if err != nil {
+			return err
+		}
+		if !sameTypoTolerance(current, typoTolerance) {
+			tolerance := *typoTolerance
+			_, err := i.UpdateTypoTolerance(&tolerance)
+			if err != nil {
+				return err
+			}
+			settingsLog.Info("typo tolerance updated")
+		}
+	}
+
+	if settings.tuned && dictionary != nil {
+		return reconcileDictionary(i)
+	}
+	return nil
+}
+
+func (i *meilisearchIndex) settingsDrift(settings indexSettings) ([]string, error) {
+	drift, err := attributeDrift(i, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.tuned && typoTolerance != nil {
+		current, err := i.GetTypoTolerance()
+		if err != nil {
+			return nil, err
+		}
+		if !sameTypoTolerance(current, typoTolerance) {
+			drift = append(drift, "typoTolerance")
+		}
+	}
+
+	if settings.tuned && dictionary != nil {
+		dictionaryDrift, err := dictionaryDrift(i)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, dictionaryDrift...)
+	}
+
+	return drift, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/totegamma/concurrent/cdid"
+)
+
+// shardPeriodLayout names the period of a shard, a month.
+const shardPeriodLayout = "2006-01"
+
+// shardedIndex splits the message index into monthly shards by the signedAt of the
+// messages, e.g. messages-2024-09, so that a period can be dropped or rebuilt on its own
+// and each index stays a manageable size. A shard is created with the first message of
+// its month, and the rollover job creates the next one ahead of time. The shards are
+// recorded in redis, as the backends can't list their indexes, and the unsharded index
+// is still searched for the messages indexed before sharding was enabled.
+type shardedIndex struct {
+	backend searchBackend
+	rdb     *redis.Client
+	uid     string
+	base    searchIndex
+	// retention is the number of months kept, the current one included; 0 keeps all.
+	retention int
+
+	mu          sync.Mutex
+	shards      map[string]searchIndex
+	refreshedAt time.Time
+}
+
+const shardRefreshInterval = time.Minute
+
+// messageShards shards MEILISEARCH_IDX, nil without INDEX_SHARDING.
+var messageShards *shardedIndex
+
+func shardPeriod(t time.Time) string {
+	return t.UTC().Format(shardPeriodLayout)
+}
+
+// setupSharding reads INDEX_SHARDING, "monthly" to shard the message index, and
+// INDEX_SHARD_RETENTION, the number of months to keep. It opens the recorded shards.
+func setupSharding(ctx context.Context, backend searchBackend, rdb *redis.Client, base searchIndex) error {
+	switch mode := os.Getenv("INDEX_SHARDING"); mode {
+	case "":
+		return nil
+	case "monthly":
+	default:
+		return fmt.Errorf("invalid INDEX_SHARDING: %s (expected monthly)", mode)
+	}
+
+	s := &shardedIndex{
+		backend: backend,
+		rdb:     rdb,
+		uid:     meilisearch_idx,
+		base:    base,
+		shards:  map[string]searchIndex{},
+	}
+	if value := os.Getenv("INDEX_SHARD_RETENTION"); value != "" {
+		retention, err := strconv.Atoi(value)
+		if err != nil || retention < 0 {
+			return fmt.Errorf("invalid INDEX_SHARD_RETENTION: %s", value)
+		}
+		s.retention = retention
+	}
+
+	err := s.refresh(ctx)
+	if err != nil {
+		return err
+	}
+
+	messageShards = s
+	return nil
+}
+
+func (s *shardedIndex) key() string {
+	return "ccsearch:shards:" + s.uid
+}
+
+func (s *shardedIndex) shardUID(period string) string {
+	return s.uid + "-" + period
+}
+
+// recordedShardUIDs lists the uids of the shards of an index recorded in redis, for the
+// commands that reach the indexes without setting up sharding. It doesn't depend on
+// INDEX_SHARDING, as the shards outlive it.
+func recordedShardUIDs(ctx context.Context, rdb *redis.Client, uid string) ([]string, error) {
+	s := &shardedIndex{uid: uid}
+	periods, err := rdb.SMembers(ctx, s.key()).Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(periods)
+	uids := make([]string, 0, len(periods))
+	for _, period := range periods {
+		uids = append(uids, s.shardUID(period))
+	}
+	return uids, nil
+}
+
+// covers reports whether the index of that uid is sharded.
+func (s *shardedIndex) covers(uid string) bool {
+	return s != nil && s.uid == uid
+}
+
+// open returns the shard of a period, creating it with the message settings when it
+// doesn't exist yet.
+func (s *shardedIndex) open(ctx context.Context, period string) (searchIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if shard, ok := s.shards[period]; ok {
+		return shard, nil
+	}
+	_, err := time.Parse(shardPeriodLayout, period)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard period: %s", period)
+	}
+
+	uid := s.shardUID(period)
+	primary, err := s.backend.openIndex(uid)
+	if err != nil {
+		return nil, err
+	}
+	shard := replicated(primary, uid)
+	err = shard.ensureSettings(messageSettings)
+	if err != nil {
+		return nil, err
+	}
+	err = s.rdb.SAdd(ctx, s.key(), period).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	s.shards[period] = shard
+	return shard, nil
+}
+
+// refresh opens the shards recorded in redis, which another instance may have created or
+// dropped.
+func (s *shardedIndex) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	s.refreshedAt = time.Now()
+	s.mu.Unlock()
+
+	periods, err := s.rdb.SMembers(ctx, s.key()).Result()
+	if err != nil {
+		return err
+	}
+	for _, period := range periods {
+		_, err := s.open(ctx, period)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for period := range s.shards {
+		if !slices.Contains(periods, period) {
+			delete(s.shards, period)
+		}
+	}
+	return nil
+}
+
+// forTime returns the shard of the messages signed at t.
+func (s *shardedIndex) forTime(ctx context.Context, t time.Time) (searchIndex, error) {
+	return s.open(ctx, shardPeriod(t))
+}
+
+// shardOf returns the shard holding a message, found by the time in its ID, or nil when
+// the shard doesn't exist.
+func (s *shardedIndex) shardOf(id string) searchIndex {
+	if len(id) < 2 {
+		return nil
+	}
+	parsed, err := cdid.Parse(id[1:])
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shards[shardPeriod(parsed.Time())]
+}
+
+// periods lists the periods of the shards, newest first.
+func (s *shardedIndex) periods() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	periods := sortedKeys(s.shards)
+	slices.Reverse(periods)
+	return periods
+}
+
+// between returns the unsharded index and the shards of the periods overlapping
+// [since, until], newest first. Zero times leave the range open.
+func (s *shardedIndex) between(since, until time.Time) []searchIndex {
+	s.mu.Lock()
+	stale := time.Since(s.refreshedAt) > shardRefreshInterval
+	s.mu.Unlock()
+	if stale {
+		err := s.refresh(context.Background())
+		if err != nil {
+			reportError("sharding", err)
+		}
+	}
+
+	indexes := []searchIndex{s.base}
+	for _, period := range s.periods() {
+		start, _ := time.Parse(shardPeriodLayout, period)
+		end := start.AddDate(0, 1, 0)
+		if !since.IsZero() && !end.After(since) || !until.IsZero() && start.After(until) {
+			continue
+		}
+		s.mu.Lock()
+		indexes = append(indexes, s.shards[period])
+		s.mu.Unlock()
+	}
+	return indexes
+}
+
+// all returns the unsharded index and every shard.
+func (s *shardedIndex) all() []searchIndex {
+	return s.between(time.Time{}, time.Time{})
+}
+
+// retired reports whether messages signed at t are past the retention and stay out of
+// the index.
+func (s *shardedIndex) retired(t time.Time) bool {
+	if s.retention == 0 {
+		return false
+	}
+	now := time.Now().UTC()
+	oldest := time.Date(now.Year(), now.Month()-time.Month(s.retention-1), 1, 0, 0, 0, 0, time.UTC)
+	return t.Before(oldest)
+}
+
+// drop deletes the shard of a period with its documents.
+func (s *shardedIndex) drop(ctx context.Context, period string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.shards[period]; !ok {
+		return nil
+	}
+	err := s.backend.deleteIndex(s.shardUID(period))
+	if err != nil {
+		return err
+	}
+	err = s.rdb.SRem(ctx, s.key(), period).Err()
+	if err != nil {
+		return err
+	}
+	delete(s.shards, period)
+	return nil
+}
+
+// rollover creates the shards of this month and the next, and drops the ones past the
+// retention.
+func (s *shardedIndex) rollover(ctx context.Context) error {
+	now := time.Now().UTC()
+	for _, t := range []time.Time{now, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)} {
+		_, err := s.forTime(ctx, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, period := range s.periods() {
+		start, _ := time.Parse(shardPeriodLayout, period)
+		if !s.retired(start.AddDate(0, 1, 0).Add(-time.Millisecond)) {
+			continue
+		}
+		err := s.drop(ctx, period)
+		if err != nil {
+			return err
+		}
+		jobsLog.Info("shard dropped, past the retention", "shard", s.shardUID(period), "months", s.retention)
+	}
+	return nil
+}
+
+type shardStatus struct {
+	Period    string `json:"period"`
+	UID       string `json:"uid"`
+	Documents int64  `json:"documents"`
+}
+
+func setupShardRoutes(admin *echo.Group) {
+
+	admin.GET("/shards", func(c echo.Context) error {
+		if messageShards == nil {
+			return respondError(c, http.StatusNotFound, codeFeatureDisabled, "the message index is not sharded")
+		}
+
+		statuses := []shardStatus{}
+		for _, period := range messageShards.periods() {
+			shard, err := messageShards.open(c.Request().Context(), period)
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			stats, err := shard.GetStats()
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			statuses = append(statuses, shardStatus{
+				Period:    period,
+				UID:       messageShards.shardUID(period),
+				Documents: stats.NumberOfDocuments,
+			})
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": statuses})
+	})
+
+	admin.DELETE("/shards/:period", func(c echo.Context) error {
+		if messageShards == nil {
+			return respondError(c, http.StatusNotFound, codeFeatureDisabled, "the message index is not sharded")
+		}
+		period := c.Param("period")
+		if !slices.Contains(messageShards.periods(), period) {
+			return respondFieldError(c, http.StatusNotFound, codeNotFound, "period", "unknown shard")
+		}
+
+		err := messageShards.drop(c.Request().Context(), period)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		adminLog.Info("shard dropped", "shard", messageShards.shardUID(period))
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
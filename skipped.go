@@ -0,0 +1,177 @@
+package main
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Reasons a commit is left out of the index.
+const (
+	skipOwner     = "owner"
+	skipSchema    = "schema"
+	skipType      = "type"
+	skipSpam      = "spam"
+	skipExpired   = "expired"
+	skipPrivate   = "private"
+	skipOptOut    = "optout"
+	skipBlocked   = "blocked"
+	skipRetention = "retention"
+	skipTooLarge  = "size"
+	// skipForeignEdit is an edit of a message signed by someone else.
+	skipForeignEdit = "edit"
+)
+
+const skipSampleCapacity = 50
+
+type skipKey struct {
+	Type   string
+	Schema string
+	Reason string
+}
+
+type skipCount struct {
+	Type   string `json:"type"`
+	Schema string `json:"schema,omitempty"`
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+type skipSample struct {
+	Time     time.Time `json:"time"`
+	Pipeline string    `json:"pipeline"`
+	Commit   uint      `json:"commit"`
+	Reason   string    `json:"reason"`
+	Document string    `json:"document"`
+}
+
+// skipSampler keeps a sample of the payloads of skipped commits, for operators to see
+// what the index is not covering. It is off unless SKIP_SAMPLE_RATE is set.
+type skipSampler struct {
+	mu      sync.Mutex
+	rate    float64
+	samples []skipSample
+}
+
+var skippedSamples = &skipSampler{}
+
+func setupSkipSampling() {
+	value := os.Getenv("SKIP_SAMPLE_RATE")
+	if value == "" {
+		return
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		serverLog.Warn("invalid SKIP_SAMPLE_RATE", "value", value)
+		return
+	}
+	skippedSamples.setRate(rate)
+}
+
+func (s *skipSampler) setRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rate = rate
+}
+
+func (s *skipSampler) offer(sample skipSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rate <= 0 || rand.Float64() >= s.rate {
+		return
+	}
+	s.samples = append(s.samples, sample)
+	if len(s.samples) > skipSampleCapacity {
+		s.samples = s.samples[len(s.samples)-skipSampleCapacity:]
+	}
+}
+
+func (s *skipSampler) get() (float64, []skipSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := slices.Clone(s.samples)
+	slices.Reverse(samples)
+	return s.rate, samples
+}
+
+// recordSkipped counts a commit left out of the index and offers it to the sampler.
+func (p *pipeline) recordSkipped(commit uint, docType, schema, reason, document string) {
+	p.skippedMu.Lock()
+	if p.skipped == nil {
+		p.skipped = map[skipKey]int64{}
+	}
+	p.skipped[skipKey{Type: docType, Schema: schema, Reason: reason}]++
+	p.skippedMu.Unlock()
+	metrics.add("skipped_messages_total", map[string]string{"pipeline": p.name, "reason": reason}, 1)
+
+	skippedSamples.offer(skipSample{
+		Time:     time.Now(),
+		Pipeline: p.name,
+		Commit:   commit,
+		Reason:   reason,
+		Document: document,
+	})
+}
+
+func (p *pipeline) skipCounts() []skipCount {
+	p.skippedMu.Lock()
+	defer p.skippedMu.Unlock()
+
+	counts := []skipCount{}
+	for key, count := range p.skipped {
+		counts = append(counts, skipCount{
+			Type:   key.Type,
+			Schema: key.Schema,
+			Reason: key.Reason,
+			Count:  count,
+		})
+	}
+	slices.SortFunc(counts, func(a, b skipCount) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	return counts
+}
+
+func setupSkippedRoutes(admin *echo.Group) {
+
+	admin.GET("/skipped", func(c echo.Context) error {
+		counts := map[string][]skipCount{}
+		for _, p := range getPipelines() {
+			counts[p.name] = p.skipCounts()
+		}
+		rate, samples := skippedSamples.get()
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{
+			"counts":     counts,
+			"sampleRate": rate,
+			"samples":    samples,
+		}})
+	})
+
+	admin.PUT("/skipped", func(c echo.Context) error {
+		var request struct {
+			SampleRate *float64 `json:"sampleRate"`
+		}
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		if request.SampleRate == nil || *request.SampleRate < 0 || *request.SampleRate > 1 {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "sampleRate", "sampleRate must be between 0 and 1")
+		}
+
+		skippedSamples.setRate(*request.SampleRate)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// spamScorer rates how likely a message is to be spam, from 0 (ham) to 1 (spam).
+// Scorers are called for every message before it is indexed.
+type spamScorer interface {
+	name() string
+	score(ctx context.Context, record *messageRecord) (float64, error)
+}
+
+var (
+	spamScorers   = []spamScorer{}
+	spamThreshold = 0.8
+	// spamExclude drops spam from the index instead of indexing it with `spam: true`.
+	spamExclude = false
+)
+
+// setupSpamScoring reads SPAM_THRESHOLD, SPAM_ACTION (flag or exclude) and
+// SPAM_CLASSIFIER_URL, which adds an external classifier next to the built-in rules.
+func setupSpamScoring() error {
+	spamScorers = []spamScorer{ruleScorer{}}
+
+	if value := os.Getenv("SPAM_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("invalid SPAM_THRESHOLD: %s", value)
+		}
+		spamThreshold = threshold
+	}
+
+	switch action := os.Getenv("SPAM_ACTION"); action {
+	case "", "flag":
+	case "exclude":
+		spamExclude = true
+	default:
+		return fmt.Errorf("invalid SPAM_ACTION: %s", action)
+	}
+
+	if url := os.Getenv("SPAM_CLASSIFIER_URL"); url != "" {
+		spamScorers = append(spamScorers, &httpScorer{
+			url: url,
+			client: &http.Client{
+				Timeout: 3 * time.Second,
+			},
+		})
+	}
+
+	return nil
+}
+
+// scoreSpam returns the highest score given by the scorers. A failing scorer is ignored.
+func scoreSpam(ctx context.Context, record *messageRecord) float64 {
+	highest := 0.0
+	for _, scorer := range spamScorers {
+		score, err := scorer.score(ctx, record)
+		if err != nil {
+			reportError("spam "+scorer.name(), err)
+			continue
+		}
+		highest = max(highest, score)
+	}
+	return highest
+}
+
+// ruleScorer flags the usual patterns of low-effort spam.
+type ruleScorer struct{}
+
+func (ruleScorer) name() string {
+	return "rules"
+}
+
+func (ruleScorer) score(ctx context.Context, record *messageRecord) (float64, error) {
+	text := strings.Builder{}
+	text.WriteString(record.Text)
+	walkStrings(record.Body, func(s string) {
+		text.WriteString(" ")
+		text.WriteString(s)
+	})
+	body := text.String()
+
+	score := 0.0
+
+	if len(record.Links) > 3 {
+		score += 0.4
+	}
+	if len(record.LinkDomains) > 0 && len(strings.Fields(body)) <= len(record.Links) {
+		// nothing but links
+		score += 0.3
+	}
+	if strings.Count(body, "#") > 10 || strings.Count(body, "@") > 10 {
+		score += 0.3
+	}
+
+	letters, upper := 0, 0
+	for _, r := range body {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 20 && float64(upper)/float64(letters) > 0.8 {
+		score += 0.2
+	}
+
+	repeated, longest := 1, 1
+	var last rune
+	for i, r := range body {
+		if i > 0 && r == last && !unicode.IsSpace(r) {
+			repeated++
+			longest = max(longest, repeated)
+		} else {
+			repeated = 1
+		}
+		last = r
+	}
+	if longest >= 20 {
+		score += 0.3
+	}
+
+	return min(score, 1), nil
+}
+
+// httpScorer asks an external classifier. It POSTs {"id","signer","body"} and expects {"score"}.
+type httpScorer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpScorer) name() string {
+	return "http"
+}
+
+func (s *httpScorer) score(ctx context.Context, record *messageRecord) (float64, error) {
+	payload, err := json.Marshal(map[string]any{
+		"id":     record.ID,
+		"signer": record.Signer,
+		"body":   record.Body,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("classifier returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Score float64 `json:"score"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Score, nil
+}
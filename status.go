@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var startTime = time.Now()
+
+type batchStatus struct {
+	FinishedAt time.Time `json:"finishedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Commits    int       `json:"commits"`
+	Documents  int       `json:"documents"`
+	Cursor     uint      `json:"cursor"`
+}
+
+// hourlyCounter counts over the last hour, in minute buckets reused as time goes by.
+type hourlyCounter struct {
+	mu      sync.Mutex
+	counts  [60]int64
+	minutes [60]int64
+}
+
+func (h *hourlyCounter) add(t time.Time, n int64) {
+	minute := t.Unix() / 60
+	i := minute % 60
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.minutes[i] != minute {
+		h.minutes[i] = minute
+		h.counts[i] = 0
+	}
+	h.counts[i] += n
+}
+
+// total sums the buckets of the last 60 minutes.
+func (h *hourlyCounter) total(now time.Time) int64 {
+	minute := now.Unix() / 60
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := int64(0)
+	for i, count := range h.counts {
+		if minute-h.minutes[i] < 60 {
+			total += count
+		}
+	}
+	return total
+}
+
+type backendStatus struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+func checkBackend(fn func() error) backendStatus {
+	start := time.Now()
+	err := fn()
+	status := backendStatus{
+		Status:    "ok",
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		status.Status = "error"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// checkBackends pings every dependency of the service.
+func checkBackends(ctx context.Context, db *gorm.DB, rdb *redis.Client, backend searchBackend) map[string]backendStatus {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return map[string]backendStatus{
+		"postgres": checkBackend(func() error {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		}),
+		"redis": checkBackend(func() error {
+			return rdb.Ping(ctx).Err()
+		}),
+		searchBackendName: checkBackend(func() error {
+			return backend.health(ctx)
+		}),
+	}
+}
+
+func getTaskQueueDepth(client meilisearch.ServiceManager) (int64, error) {
+	tasks, err := client.GetTasks(&meilisearch.TasksQuery{
+		Statuses: []meilisearch.TaskStatus{meilisearch.TaskStatusEnqueued, meilisearch.TaskStatusProcessing},
+		Limit:    1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tasks.Total, nil
+}
+
+// statusHandler serves a machine-readable document describing the indexer progress and
+// its dead-letter queue, the health of each backend and the process uptime.
+func statusHandler(db *gorm.DB, rdb *redis.Client, backend searchBackend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		health := "ok"
+
+		document := echo.Map{
+			"version":       version,
+			"uptimeSeconds": int64(time.Since(startTime).Seconds()),
+			"startedAt":     startTime,
+		}
+
+		indexer := echo.Map{
+			"running": isIndexerRunning(),
+		}
+
+		latest, err := getLatestCommitID(db)
+		if err == nil {
+			indexer["latestCommit"] = latest
+			indexer["pipelines"] = pipelineStatuses(ctx, latest)
+		}
+
+		deadLetters, err := rdb.HLen(ctx, deadLetterKey).Result()
+		if err == nil {
+			indexer["deadLetters"] = deadLetters
+		}
+
+		errors := getRecentErrors()
+		if len(errors) > 0 {
+			indexer["lastError"] = errors[0]
+		}
+		document["indexer"] = indexer
+		document["maintenance"] = maintenance.get(ctx)
+		document["jobs"] = jobs.statuses()
+
+		leader := echo.Map{
+			"instance": elector.id,
+			"isLeader": elector.leader(),
+		}
+		currentLeader, err := elector.currentLeader(ctx)
+		if err == nil {
+			leader["leader"] = currentLeader
+		}
+		document["leader"] = leader
+
+		backends := checkBackends(ctx, db, rdb, backend)
+		for _, status := range backends {
+			if status.Status != "ok" {
+				health = "degraded"
+			}
+		}
+		document["backends"] = backends
+
+		meili := echo.Map{}
+		if meiliBackend, ok := backend.(*meilisearchBackend); ok {
+			queueDepth, err := getTaskQueueDepth(meiliBackend.client)
+			if err == nil {
+				meili["taskQueueDepth"] = queueDepth
+			}
+		}
+		if searchReplicas != nil {
+			meili["replicas"] = searchReplicas.statuses()
+		}
+		if len(meili) > 0 {
+			document["meilisearch"] = meili
+		}
+
+		document["health"] = health
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": document})
+	}
+}
+
+// probeHandler serves /healthz and /readyz for orchestrators and load balancers. Both
+// ping every backend and report the status and latency of each, without the error
+// details. /healthz answers 200 as long as the process serves requests, so that an
+// outage of a backend doesn't get the instance restarted; /readyz answers 503 when a
+// backend is down or search is under maintenance, so that traffic goes elsewhere.
+// A healthy search replica stands in for the Meilisearch primary.
+func probeHandler(db *gorm.DB, rdb *redis.Client, backend searchBackend, readiness bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		backends := checkBackends(ctx, db, rdb, backend)
+		ready := true
+		for name, checked := range backends {
+			if checked.Status != "ok" {
+				replicaUp := name == "meilisearch" && searchReplicas != nil && len(searchReplicas.healthy()) > 0
+				if !replicaUp {
+					ready = false
+				}
+			}
+			checked.Error = ""
+			backends[name] = checked
+		}
+		if maintenance.get(ctx).SearchMaintenance {
+			ready = false
+		}
+
+		status, statusText := http.StatusOK, "ok"
+		if readiness && !ready {
+			status, statusText = http.StatusServiceUnavailable, "error"
+		}
+		return c.JSON(status, echo.Map{
+			"status": statusText,
+			"content": echo.Map{
+				"ready":    ready,
+				"backends": backends,
+			},
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	streamHeartbeatInterval = 15 * time.Second
+	// streamRetry is the delay, in milliseconds, after which a client reconnects.
+	streamRetry = 3000
+)
+
+type streamHit struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+// streamHandler serves GET /v1/stream?q=&timeline=, a server-sent events stream of the
+// IDs of the messages matching a query as they are indexed, for the clients that can't use
+// the WebSocket of /v1/subscribe. The ID of an event is the commit of its message, so a
+// client reconnecting with Last-Event-ID gets the matches it missed, as long as this
+// instance still holds them; a "gap" event tells it when it may have missed some.
+func streamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if live == nil || !features.enabled(ctx, featureLive) {
+		return respondError(c, http.StatusNotFound, codeFeatureDisabled, "live search is disabled")
+	}
+
+	timeline := c.QueryParam("timeline")
+	if timeline != "" {
+		allowed, err := policies.canRead(ctx, timeline, requesterFrom(c))
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		if !allowed {
+			return respondFieldError(c, http.StatusForbidden, codeForbidden, "timeline", "timeline is not readable")
+		}
+	}
+
+	// EventSource sends the header on its own; the parameter is for the other clients
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("lastEventId")
+	}
+	var cursor uint64
+	if lastEventID != "" {
+		parsed, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "Last-Event-ID", "Last-Event-ID must be a commit cursor")
+		}
+		cursor = parsed
+	}
+
+	filter := newLiveFilter(c.QueryParam("q"), timeline, c.QueryParam("signer"), c.QueryParams()["schema"], c.QueryParam("hashtag"))
+	subscriber := live.subscribe()
+	defer live.unsubscribe(subscriber)
+	subscriber.setFilter("", filter)
+
+	response := c.Response()
+	header := response.Header()
+	header.Set(echo.HeaderContentType, "text/event-stream")
+	header.Set(echo.HeaderCacheControl, "no-cache")
+	header.Set(echo.HeaderConnection, "keep-alive")
+	// keep proxies such as nginx from buffering the events
+	header.Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	send := func(id uint, event string, data any) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if id > 0 {
+			_, err = fmt.Fprintf(response, "id: %d\n", id)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event, payload)
+		response.Flush()
+		return err
+	}
+
+	_, err := fmt.Fprintf(response, "retry: %d\n\n", streamRetry)
+	if err != nil {
+		return nil
+	}
+	response.Flush()
+
+	// the subscription started before the backlog is read, so the matches of both are
+	// told apart by their commit
+	replayed := uint(cursor)
+	if lastEventID != "" {
+		messages, complete := live.since(replayed)
+		if !complete {
+			err = send(0, "gap", echo.Map{"cursor": replayed})
+			if err != nil {
+				return nil
+			}
+		}
+		now := time.Now()
+		for _, message := range messages {
+			replayed = max(replayed, message.Commit)
+			if !filter.matches(message.Record, now) {
+				continue
+			}
+			err = send(message.Commit, "match", streamHit{ID: message.Record.ID, Owner: message.Record.Signer})
+			if err != nil {
+				return nil
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-live.done:
+			return nil
+		case match := <-subscriber.out:
+			if match.Commit <= replayed {
+				continue
+			}
+			if dropped := subscriber.takeDropped(); dropped > 0 {
+				err = send(0, "dropped", echo.Map{"dropped": dropped})
+				if err != nil {
+					return nil
+				}
+			}
+			err = send(match.Commit, "match", streamHit{ID: match.Result.ID, Owner: match.Result.Owner})
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(response, ": heartbeat\n\n")
+			response.Flush()
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
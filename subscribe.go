@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	subscribePingInterval = 30 * time.Second
+	subscribeWriteTimeout = 10 * time.Second
+	subscribeMaxMessage   = 4096
+)
+
+// subscribeRequest is a message of a client: a subscription to add or replace, or one
+// to remove, under the ID the client chose for it.
+type subscribeRequest struct {
+	Type     string   `json:"type"`
+	ID       string   `json:"id"`
+	Q        string   `json:"q,omitempty"`
+	Timeline string   `json:"timeline,omitempty"`
+	Signer   string   `json:"signer,omitempty"`
+	Schema   []string `json:"schema,omitempty"`
+	Hashtag  string   `json:"hashtag,omitempty"`
+}
+
+// subscribeEvent is a message to a client.
+type subscribeEvent struct {
+	Type         string        `json:"type"`
+	Subscription string        `json:"subscription,omitempty"`
+	Cursor       uint          `json:"cursor,omitempty"`
+	Content      *searchResult `json:"content,omitempty"`
+	Dropped      int64         `json:"dropped,omitempty"`
+	Code         string        `json:"code,omitempty"`
+	Message      string        `json:"message,omitempty"`
+}
+
+var subscribeUpgrader = websocket.Upgrader{
+	CheckOrigin: subscribeOriginAllowed,
+}
+
+// subscribeOriginAllowed accepts the origins allowed by CORS_ORIGINS, or any origin when
+// it is not set, as the other routes do.
+func subscribeOriginAllowed(r *http.Request) bool {
+	origins := os.Getenv("CORS_ORIGINS")
+	origin := r.Header.Get("Origin")
+	if origins == "" || origin == "" {
+		return true
+	}
+	return slices.Contains(strings.Split(origins, ","), origin)
+}
+
+// subscribeHandler serves GET /v1/subscribe, a WebSocket on which the client registers
+// queries, e.g. {"type":"subscribe","id":"cats","q":"cat","timeline":"..."}, and receives
+// the messages matching them as they are indexed, as {"type":"match","subscription":
+// "cats","cursor":<commit>,"content":<result>}. {"type":"unsubscribe","id":"cats"} stops a
+// subscription.
+func subscribeHandler(c echo.Context) error {
+	if live == nil || !features.enabled(c.Request().Context(), featureLive) {
+		return respondError(c, http.StatusNotFound, codeFeatureDisabled, "live search is disabled")
+	}
+	r := requesterFrom(c)
+
+	conn, err := subscribeUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// the upgrader has answered already
+		return nil
+	}
+	defer conn.Close()
+
+	subscriber := live.subscribe()
+	defer live.unsubscribe(subscriber)
+
+	// the reader handles the requests and reports back through replies, so that only the
+	// loop below writes to the connection
+	replies := make(chan subscribeEvent, maxLiveFilters)
+	closed := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	conn.SetReadLimit(subscribeMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(2 * subscribePingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * subscribePingInterval))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			var request subscribeRequest
+			err := conn.ReadJSON(&request)
+			if err != nil {
+				return
+			}
+			reply := subscribeEvent{Type: "subscribed", Subscription: request.ID}
+			switch {
+			case request.ID == "":
+				reply = subscribeEvent{Type: "error", Code: codeMissingParameter, Message: "id is empty"}
+			case request.Type == "unsubscribe":
+				subscriber.removeFilter(request.ID)
+				reply.Type = "unsubscribed"
+			case request.Type != "subscribe":
+				reply = subscribeEvent{Type: "error", Subscription: request.ID, Code: codeInvalidParameter, Message: "type must be subscribe or unsubscribe"}
+			default:
+				if request.Timeline != "" {
+					allowed, err := policies.canRead(c.Request().Context(), request.Timeline, r)
+					if err != nil {
+						reply = subscribeEvent{Type: "error", Subscription: request.ID, Code: codeInternal, Message: err.Error()}
+						break
+					}
+					if !allowed {
+						reply = subscribeEvent{Type: "error", Subscription: request.ID, Code: codeForbidden, Message: "timeline is not readable"}
+						break
+					}
+				}
+				filter := newLiveFilter(request.Q, request.Timeline, request.Signer, request.Schema, request.Hashtag)
+				if !subscriber.setFilter(request.ID, filter) {
+					reply = subscribeEvent{Type: "error", Subscription: request.ID, Code: codeInvalidParameter, Message: "too many subscriptions"}
+				}
+			}
+			select {
+			case replies <- reply:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	write := func(event subscribeEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(subscribeWriteTimeout))
+		return conn.WriteJSON(event)
+	}
+	ping := time.NewTicker(subscribePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-live.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(subscribeWriteTimeout))
+			return nil
+		case reply := <-replies:
+			err = write(reply)
+		case match := <-subscriber.out:
+			if dropped := subscriber.takeDropped(); dropped > 0 {
+				err = write(subscribeEvent{Type: "dropped", Dropped: dropped})
+				if err != nil {
+					return nil
+				}
+			}
+			err = write(subscribeEvent{Type: "match", Subscription: match.Subscription, Cursor: match.Commit, Content: &match.Result})
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(subscribeWriteTimeout))
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
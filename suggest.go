@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+)
+
+const (
+	defaultSuggestLimit = 5
+	maxSuggestLimit     = 10
+	suggestCropLength   = 10
+)
+
+// suggestTimeout bounds a suggestion search, as a late one is of no use to a client that
+// has typed on; SUGGEST_TIMEOUT overrides it.
+var suggestTimeout = 500 * time.Millisecond
+
+type suggestion struct {
+	ID      string `json:"id"`
+	Owner   string `json:"owner"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+func setupSuggest() error {
+	if value := os.Getenv("SUGGEST_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid SUGGEST_TIMEOUT: %s", value)
+		}
+		suggestTimeout = timeout
+	}
+	return nil
+}
+
+// suggestHandler serves GET /v1/suggest?q=, for search boxes that search while the user
+// types. The last word of the query matches as a prefix, as with any search, while the
+// hits come by relevance with a short snippet and without facets.
+func suggestHandler(index searchIndex) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query := c.QueryParam("q")
+		if query == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "q", "query is empty")
+		}
+
+		limit := defaultSuggestLimit
+		if value := c.QueryParam("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "limit", "limit must be a positive integer")
+			}
+			limit = min(parsed, maxSuggestLimit)
+		}
+
+		filter := []string{"hidden != true", "spam != true", "flagged != true", notExpiredFilter(time.Now())}
+		if policies.enabled {
+			filter = append(filter, "restricted != true")
+		}
+
+		targets := []searchIndex{index}
+		if messageShards != nil && index == messageShards.base {
+			targets = messageShards.all()
+		}
+		for _, route := range indexRoutes {
+			targets = append(targets, route.index)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), suggestTimeout)
+		defer cancel()
+		hits, _, _, err := searchIndexes(ctx, targets, query, &meilisearch.SearchRequest{
+			Limit:                 int64(limit),
+			Filter:                filter,
+			AttributesToRetrieve:  []string{"id", "signer"},
+			AttributesToCrop:      []string{"text"},
+			CropLength:            suggestCropLength,
+			AttributesToHighlight: []string{"text"},
+			HighlightPreTag:       highlightPreTag,
+			HighlightPostTag:      highlightPostTag,
+		}, false)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": []suggestion{}, "timedOut": true})
+		}
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		suggestions := []suggestion{}
+		for _, hit := range hits {
+			hitDoc, ok := hit.(map[string]any)
+			if !ok {
+				continue
+			}
+			result := suggestion{}
+			result.ID, _ = hitDoc["id"].(string)
+			result.Owner, _ = hitDoc["signer"].(string)
+			if formatted, ok := hitDoc["_formatted"].(map[string]any); ok {
+				result.Snippet, _ = formatted["text"].(string)
+			}
+			suggestions = append(suggestions, result)
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": suggestions})
+	}
+}
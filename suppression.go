@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// suppressionRules match messages that are indexed with `flagged: true` and left out of
+// search results unless the request asks for them.
+var suppressionRules = []*regexp.Regexp{}
+
+// termRule matches a term as a whole word, ignoring case.
+func termRule(term string) (*regexp.Regexp, error) {
+	return regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(term) + `($|\W)`)
+}
+
+// parseSuppressionRule reads a term, or a regular expression written as /pattern/.
+func parseSuppressionRule(line string) (*regexp.Regexp, error) {
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return regexp.Compile(line[1 : len(line)-1])
+	}
+	return termRule(line)
+}
+
+// setupSuppression loads the rules from SUPPRESSED_TERMS (comma separated) and from
+// SUPPRESSION_FILE, which holds one term or /regex/ per line and # comments.
+func setupSuppression() error {
+	rules := []*regexp.Regexp{}
+
+	for _, term := range strings.Split(os.Getenv("SUPPRESSED_TERMS"), ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		rule, err := parseSuppressionRule(term)
+		if err != nil {
+			return fmt.Errorf("invalid SUPPRESSED_TERMS entry %q: %w", term, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if path := os.Getenv("SUPPRESSION_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rule, err := parseSuppressionRule(line)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+			rules = append(rules, rule)
+		}
+		err = scanner.Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	suppressionRules = rules
+	return nil
+}
+
+// isSuppressed reports whether any string of the message body matches a suppression rule.
+func isSuppressed(body any) bool {
+	if len(suppressionRules) == 0 {
+		return false
+	}
+
+	matched := false
+	walkStrings(body, func(text string) {
+		if matched {
+			return
+		}
+		for _, rule := range suppressionRules {
+			if rule.MatchString(text) {
+				matched = true
+				return
+			}
+		}
+	})
+	return matched
+}
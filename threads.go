@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// resolveThreadRoot returns the id of the message that started the conversation
+// the given message belongs to. Replies inherit the root of the message they reply to,
+// looked up first among the messages of the current batch and then in the index indexOf
+// returns for the parent.
+func resolveThreadRoot(indexOf func(id string) searchIndex, batchRoots map[string]string, id string, body any) string {
+	fields, ok := body.(map[string]any)
+	if !ok {
+		return id
+	}
+
+	parent, ok := fields["replyToMessageId"].(string)
+	if !ok || parent == "" {
+		return id
+	}
+
+	if root, ok := batchRoots[parent]; ok {
+		return root
+	}
+
+	var parentDoc messageRecord
+	err := indexOf(parent).GetDocument(parent, &meilisearch.DocumentQuery{
+		Fields: []string{"id", "threadRoot"},
+	}, &parentDoc)
+	if err == nil && parentDoc.ThreadRoot != "" {
+		return parentDoc.ThreadRoot
+	}
+
+	return parent
+}
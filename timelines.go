@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/totegamma/concurrent/core"
+)
+
+var timelineIndexSettings = indexSettings{
+	filterable: []string{"signer", "schema", "domainOwned", "restricted"},
+	sortable:   []string{"signedAt"},
+	searchable: []string{"name", "shortname", "description", "body"},
+}
+
+// timelineRecord is the indexed form of a timeline. Like profiles, timelines of schemas
+// without a name or a description keep their body.
+type timelineRecord struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Schema      string `json:"schema"`
+	SignedAt    int64  `json:"signedAt"`
+	Signer      string `json:"signer"`
+	Name        string `json:"name,omitempty"`
+	Shortname   string `json:"shortname,omitempty"`
+	Description string `json:"description,omitempty"`
+	Banner      string `json:"banner,omitempty"`
+	DomainOwned bool   `json:"domainOwned"`
+	Restricted  bool   `json:"restricted"`
+	Body        any    `json:"body,omitempty"`
+}
+
+type timelineResult struct {
+	ID          string `json:"id"`
+	Signer      string `json:"signer"`
+	Schema      string `json:"schema"`
+	Name        string `json:"name,omitempty"`
+	Shortname   string `json:"shortname,omitempty"`
+	Description string `json:"description,omitempty"`
+	Banner      string `json:"banner,omitempty"`
+}
+
+// timelineBatch indexes the timelines marked indexable by their owner, for the pipelines
+// with the "timelines" transform, e.g. "timelines:timelines:timelines". A timeline that
+// stops being indexable is removed.
+type timelineBatch struct {
+	p       *pipeline
+	records []timelineRecord
+	// deletions holds the IDs of the deleted and no longer indexable timelines.
+	deletions []string
+	commits   map[string]uint
+}
+
+func newTimelineBatch(p *pipeline) batchTransformer {
+	return &timelineBatch{
+		p:       p,
+		records: []timelineRecord{},
+		commits: map[string]uint{},
+	}
+}
+
+func (b *timelineBatch) add(ctx context.Context, commit core.CommitLog, doc core.DocumentBase[any], cdidBase string) (string, error) {
+	switch doc.Type {
+	case "timeline":
+		var timeline core.TimelineDocument[any]
+		err := json.Unmarshal([]byte(commit.Document), &timeline)
+		if err != nil {
+			return "", err
+		}
+
+		// an update carries the ID of the timeline it replaces
+		id := timeline.ID
+		if id == "" {
+			id = "t" + cdidBase
+		}
+		b.records = slices.DeleteFunc(b.records, func(other timelineRecord) bool {
+			return other.ID == id
+		})
+		if !timeline.Indexable {
+			b.deletions = append(b.deletions, id)
+			return "", nil
+		}
+
+		record := timelineRecord{
+			ID:          id,
+			Type:        "timeline",
+			Schema:      timeline.Schema,
+			SignedAt:    timeline.SignedAt.UnixMilli(),
+			Signer:      timeline.Signer,
+			DomainOwned: timeline.DomainOwned,
+		}
+		if body, ok := timeline.Body.(map[string]any); ok {
+			record.Name, _ = body["name"].(string)
+			record.Shortname, _ = body["shortname"].(string)
+			record.Description, _ = body["description"].(string)
+			record.Banner, _ = body["banner"].(string)
+		}
+		if record.Name == "" && record.Description == "" {
+			record.Body = timeline.Body
+		}
+		record.Restricted, err = policies.restricted(ctx, []string{id})
+		if err != nil {
+			// fail closed, as for messages
+			reportError("indexer", err)
+			record.Restricted = true
+		}
+
+		b.deletions = slices.DeleteFunc(b.deletions, func(other string) bool {
+			return other == id
+		})
+		b.commits[id] = commit.ID
+		b.records = append(b.records, record)
+	case "delete":
+		var deletion core.DeleteDocument
+		err := json.Unmarshal([]byte(commit.Document), &deletion)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(deletion.Target, "t") {
+			return skipType, nil
+		}
+		b.records = slices.DeleteFunc(b.records, func(record timelineRecord) bool {
+			return record.ID == deletion.Target
+		})
+		b.deletions = append(b.deletions, deletion.Target)
+	default:
+		return skipType, nil
+	}
+	return "", nil
+}
+
+func (b *timelineBatch) commitOf(id string) (uint, bool) {
+	commit, ok := b.commits[id]
+	return commit, ok
+}
+
+func (b *timelineBatch) documents(ctx context.Context) []documentSet {
+	documents := []any{}
+	for _, record := range b.records {
+		documents = append(documents, record)
+	}
+	return []documentSet{{index: b.p.index, documents: documents, deletions: b.deletions}}
+}
+
+func (b *timelineBatch) finish(ctx context.Context) {}
+
+// timelineIndex returns the index of the first timelines pipeline, if there is one.
+func timelineIndex() searchIndex {
+	return transformIndex("timelines")
+}
+
+// timelinesHandler serves GET /v1/timelines?q=, searching timelines by name and
+// description.
+func timelinesHandler(c echo.Context) error {
+	index := timelineIndex()
+	if index == nil {
+		return respondError(c, http.StatusNotFound, codeFeatureDisabled, "timelines are not indexed")
+	}
+
+	query := c.QueryParam("q")
+	if query == "" {
+		return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "q", "query is empty")
+	}
+
+	offset, err := searchOffset(c)
+	if err != nil {
+		invalid := err.(*paramError)
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+	}
+
+	filter := []string{}
+	if schema := c.QueryParam("schema"); schema != "" {
+		filter = append(filter, fmt.Sprintf("schema = %s", quoteFilter(schema)))
+	}
+	if policies.enabled {
+		filter = append(filter, "restricted != true")
+	}
+
+	limit, err := searchLimit(c)
+	if err != nil {
+		invalid := err.(*paramError)
+		return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+	}
+
+	search, err := index.SearchWithContext(c.Request().Context(), query, &meilisearch.SearchRequest{
+		Limit:            limit,
+		Offset:           int64(offset),
+		Filter:           filter,
+		AttributesToCrop: []string{"description"},
+		CropLength:       30,
+	})
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+
+	results := []timelineResult{}
+	for _, hit := range search.Hits {
+		hitDoc, ok := hit.(map[string]any)
+		if !ok {
+			continue
+		}
+		result := timelineResult{}
+		result.ID, _ = hitDoc["id"].(string)
+		result.Signer, _ = hitDoc["signer"].(string)
+		result.Schema, _ = hitDoc["schema"].(string)
+		result.Name, _ = hitDoc["name"].(string)
+		result.Shortname, _ = hitDoc["shortname"].(string)
+		result.Banner, _ = hitDoc["banner"].(string)
+		result.Description, _ = hitDoc["description"].(string)
+		if formatted, ok := hitDoc["_formatted"].(map[string]any); ok {
+			if description, ok := formatted["description"].(string); ok {
+				result.Description = description
+			}
+		}
+		results = append(results, result)
+	}
+
+	response := echo.Map{
+		"status":  "ok",
+		"content": results,
+		"limit":   limit,
+		"offset":  offset,
+	}
+	addPagination(response, offset, len(search.Hits), search.EstimatedTotalHits)
+	return c.JSON(http.StatusOK, response)
+}
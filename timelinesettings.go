@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// sortOrders maps the values of the sort parameter to Meilisearch sort rules. Relevance
+// leaves the order to the ranking rules.
+var sortOrders = map[string][]string{
+	"newest":    {"signedAt:desc"},
+	"oldest":    {"signedAt:asc"},
+	"relevance": nil,
+}
+
+// searchDefaults are the search parameters a timeline applies when the request doesn't
+// set them.
+type searchDefaults struct {
+	Sort           string `json:"sort,omitempty"`
+	IncludeFlagged *bool  `json:"includeFlagged,omitempty"`
+	// browse lists the scope without a query, e.g. the messages of a hashtag.
+	browse bool
+}
+
+func (d searchDefaults) validate() error {
+	if _, ok := sortOrders[d.Sort]; d.Sort != "" && !ok {
+		return &paramError{field: "sort", message: "sort must be newest, oldest or relevance"}
+	}
+	return nil
+}
+
+// timelineSettingsRow stores the defaults pinned by a timeline owner.
+type timelineSettingsRow struct {
+	TimelineID     string `gorm:"primaryKey"`
+	Sort           string
+	IncludeFlagged *bool
+	UpdatedBy      string
+	UpdatedAt      time.Time
+}
+
+func (timelineSettingsRow) TableName() string {
+	return "ccsearch_timeline_settings"
+}
+
+type cachedDefaults struct {
+	defaults  searchDefaults
+	expiresAt time.Time
+}
+
+const timelineSettingsTTL = time.Minute
+
+// timelineSettingsStore resolves the search defaults of a timeline: the ones its owner
+// stored in postgres, else the ones of the TIMELINE_DEFAULTS file.
+type timelineSettingsStore struct {
+	db     *gorm.DB
+	config map[string]searchDefaults
+
+	mu    sync.Mutex
+	cache map[string]cachedDefaults
+}
+
+var timelineSettings *timelineSettingsStore
+
+// setupTimelineSettings creates the settings table and loads TIMELINE_DEFAULTS, a JSON
+// object of defaults keyed by timeline ID.
+func setupTimelineSettings(db *gorm.DB) error {
+	err := db.AutoMigrate(&timelineSettingsRow{})
+	if err != nil {
+		return err
+	}
+
+	store := &timelineSettingsStore{
+		db:     db,
+		config: map[string]searchDefaults{},
+		cache:  map[string]cachedDefaults{},
+	}
+
+	if path := os.Getenv("TIMELINE_DEFAULTS"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &store.config)
+		if err != nil {
+			return fmt.Errorf("invalid TIMELINE_DEFAULTS: %w", err)
+		}
+		for timeline, defaults := range store.config {
+			err = defaults.validate()
+			if err != nil {
+				return fmt.Errorf("invalid TIMELINE_DEFAULTS for %s: %w", timeline, err)
+			}
+		}
+	}
+
+	timelineSettings = store
+	return nil
+}
+
+func (s *timelineSettingsStore) get(timeline string) (searchDefaults, error) {
+	now := time.Now()
+	s.mu.Lock()
+	cached, ok := s.cache[timeline]
+	s.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.defaults, nil
+	}
+
+	var rows []timelineSettingsRow
+	err := s.db.Where("timeline_id = ?", timeline).Limit(1).Find(&rows).Error
+	if err != nil {
+		return searchDefaults{}, err
+	}
+
+	defaults := s.config[timeline]
+	if len(rows) > 0 {
+		defaults = searchDefaults{Sort: rows[0].Sort, IncludeFlagged: rows[0].IncludeFlagged}
+	}
+
+	s.mu.Lock()
+	s.cache[timeline] = cachedDefaults{defaults: defaults, expiresAt: now.Add(timelineSettingsTTL)}
+	s.mu.Unlock()
+
+	return defaults, nil
+}
+
+func (s *timelineSettingsStore) put(timeline string, defaults searchDefaults, updatedBy string) error {
+	err := s.db.Save(&timelineSettingsRow{
+		TimelineID:     timeline,
+		Sort:           defaults.Sort,
+		IncludeFlagged: defaults.IncludeFlagged,
+		UpdatedBy:      updatedBy,
+		UpdatedAt:      time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.cache, timeline)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *timelineSettingsStore) remove(timeline string) error {
+	err := s.db.Where("timeline_id = ?", timeline).Delete(&timelineSettingsRow{}).Error
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.cache, timeline)
+	s.mu.Unlock()
+	return nil
+}
+
+// ownsTimeline reports whether the requester is a local user owning the timeline.
+func (s *timelineSettingsStore) ownsTimeline(timeline string, r requester) (bool, error) {
+	if r.Type != requesterLocalUser || r.CCID == "" {
+		return false, nil
+	}
+
+	id, err := resolveTimelineID(s.db, timeline)
+	if err != nil || id == "" {
+		return false, err
+	}
+
+	var count int64
+	err = s.db.Table("timelines").Where("id = ? AND (owner = ? OR author = ?)", id, r.CCID, r.CCID).Count(&count).Error
+	return count > 0, err
+}
+
+// setupTimelineSettingsRoutes lets timeline owners, authenticated by the Concurrent
+// gateway, read and pin the search defaults of their timelines.
+func setupTimelineSettingsRoutes(v1 *echo.Group) {
+	v1.GET("/timeline/:id/settings", func(c echo.Context) error {
+		defaults, err := timelineSettings.get(c.Param("id"))
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": defaults})
+	})
+
+	ownerOnly := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			owner, err := timelineSettings.ownsTimeline(c.Param("id"), requesterFrom(c))
+			if err != nil {
+				return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			if !owner {
+				return respondError(c, http.StatusForbidden, codeForbidden, "only the owner of the timeline can change its settings")
+			}
+			return next(c)
+		}
+	}
+
+	v1.PUT("/timeline/:id/settings", ownerOnly(func(c echo.Context) error {
+		var defaults searchDefaults
+		err := c.Bind(&defaults)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+		err = defaults.validate()
+		if err != nil {
+			invalid := err.(*paramError)
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, invalid.field, invalid.message)
+		}
+
+		err = timelineSettings.put(c.Param("id"), defaults, requesterFrom(c).CCID)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": defaults})
+	}))
+
+	v1.DELETE("/timeline/:id/settings", ownerOnly(func(c echo.Context) error {
+		err := timelineSettings.remove(c.Param("id"))
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	}))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// tracer makes the spans of cc-search. Until setupTracing installs a provider it is a
+// no-op, so instrumented code runs the same with tracing disabled.
+var tracer = otel.Tracer("github.com/concrnt/cc-search")
+
+// setupTracing exports spans over OTLP/HTTP to TRACE_ENDPOINT, e.g.
+// http://localhost:4318, keeping the ratio TRACE_SAMPLE_RATIO (default 1) of the traces
+// that don't come with a sampling decision. The exporter also follows the standard
+// OTEL_EXPORTER_OTLP_* variables, e.g. for headers. It returns the function flushing the
+// spans at shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	endpoint := os.Getenv("TRACE_ENDPOINT")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	ratio := 1.0
+	if value := os.Getenv("TRACE_SAMPLE_RATIO"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return nil, fmt.Errorf("invalid TRACE_SAMPLE_RATIO: %s", value)
+		}
+		ratio = parsed
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("cc-search"),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a span per request, named after the route, continuing the trace of
+// the gateway when it sends one.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		request := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+
+		route := c.Path()
+		if route == "" {
+			route = request.URL.Path
+		}
+		ctx, span := tracer.Start(ctx, request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(request.URL.Path),
+			),
+		)
+		defer span.End()
+		c.SetRequest(request.WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			// let the error handler write the response, so its status is the one recorded
+			c.Error(err)
+			span.RecordError(err)
+		}
+		status := c.Response().Status
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return nil
+	}
+}
+
+// tracedTransport makes a client span of each request to a search engine.
+func tracedTransport(base http.RoundTripper, engine string) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		return engine + " " + r.Method + " " + r.URL.Path
+	}))
+}
+
+// traceRedis makes a span of each redis command.
+func traceRedis(rdb *redis.Client) error {
+	return redisotel.InstrumentTracing(rdb)
+}
+
+type spanKey struct{}
+
+// tracingPlugin makes a span of each gorm query, under the span of the context given
+// with WithContext.
+type tracingPlugin struct{}
+
+func (tracingPlugin) Name() string {
+	return "ccsearch:tracing"
+}
+
+func (tracingPlugin) Initialize(db *gorm.DB) error {
+	start := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			ctx, span := tracer.Start(tx.Statement.Context, "postgres "+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(semconv.DBSystemPostgreSQL),
+			)
+			tx.Statement.Context = context.WithValue(ctx, spanKey{}, span)
+		}
+	}
+	end := func(tx *gorm.DB) {
+		span, ok := tx.Statement.Context.Value(spanKey{}).(trace.Span)
+		if !ok {
+			return
+		}
+		span.SetAttributes(
+			attribute.String("db.statement", tx.Statement.SQL.String()),
+			attribute.String("db.sql.table", tx.Statement.Table),
+			attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+		)
+		if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
+			span.RecordError(tx.Error)
+			span.SetStatus(codes.Error, tx.Error.Error())
+		}
+		span.End()
+	}
+
+	callbacks := []struct {
+		operation string
+		before    func(string, func(*gorm.DB)) error
+		after     func(string, func(*gorm.DB)) error
+	}{
+		{"create", db.Callback().Create().Before("gorm:create").Register, db.Callback().Create().After("gorm:create").Register},
+		{"query", db.Callback().Query().Before("gorm:query").Register, db.Callback().Query().After("gorm:query").Register},
+		{"update", db.Callback().Update().Before("gorm:update").Register, db.Callback().Update().After("gorm:update").Register},
+		{"delete", db.Callback().Delete().Before("gorm:delete").Register, db.Callback().Delete().After("gorm:delete").Register},
+		{"row", db.Callback().Row().Before("gorm:row").Register, db.Callback().Row().After("gorm:row").Register},
+		{"raw", db.Callback().Raw().Before("gorm:raw").Register, db.Callback().Raw().After("gorm:raw").Register},
+	}
+	for _, callback := range callbacks {
+		err := callback.before("ccsearch:trace_before_"+callback.operation, start(callback.operation))
+		if err != nil {
+			return err
+		}
+		err = callback.after("ccsearch:trace_after_"+callback.operation, end)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/meilisearch/meilisearch-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	trendsWindow     = 48 * time.Hour
+	trendsSize       = 100
+	trendsCandidates = 500
+	trendsTTL        = 30 * time.Minute
+)
+
+var computingTrends int32 = 0
+
+type trendingMessage struct {
+	ID         string  `json:"id"`
+	Owner      string  `json:"owner"`
+	Engagement int64   `json:"engagement"`
+	Score      float64 `json:"score"`
+}
+
+// recordEngagements bumps the per-message engagement counters used by the trends job.
+// engagedAt holds the unix time of the latest association seen for each target.
+func recordEngagements(ctx context.Context, rdb *redis.Client, engagements map[string]int64, engagedAt map[string]int64) {
+	pipe := rdb.Pipeline()
+	for target, count := range engagements {
+		pipe.ZIncrBy(ctx, "ccsearch:engagement", float64(count), target)
+		pipe.ZAdd(ctx, "ccsearch:engagement:lastseen", redis.Z{
+			Score:  float64(engagedAt[target]),
+			Member: target,
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		reportError("trends", err)
+	}
+}
+
+func trendsKey(timeline string) string {
+	if timeline == "" {
+		return "ccsearch:trends:messages"
+	}
+	return "ccsearch:trends:messages:" + timeline
+}
+
+func getTrends(ctx context.Context, rdb *redis.Client, timeline string) ([]trendingMessage, error) {
+	trendsStr, err := rdb.Get(ctx, trendsKey(timeline)).Result()
+	if err == redis.Nil {
+		return []trendingMessage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var trends []trendingMessage
+	err = json.Unmarshal([]byte(trendsStr), &trends)
+	if err != nil {
+		return nil, err
+	}
+
+	return trends, nil
+}
+
+// computeTrends scores recently engaged messages by engagement decayed over their age,
+// and stores the top messages globally and per timeline.
+func computeTrends(ctx context.Context, rdb *redis.Client, indexes []searchIndex) {
+
+	if atomic.CompareAndSwapInt32(&computingTrends, 0, 1) {
+		defer atomic.StoreInt32(&computingTrends, 0)
+	} else {
+		return
+	}
+
+	cutoff := time.Now().Add(-trendsWindow)
+
+	stale, err := rdb.ZRangeByScore(ctx, "ccsearch:engagement:lastseen", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff.Unix(), 10),
+	}).Result()
+	if err != nil {
+		reportError("trends", err)
+		return
+	}
+	if len(stale) > 0 {
+		rdb.ZRem(ctx, "ccsearch:engagement", stale)
+		rdb.ZRem(ctx, "ccsearch:engagement:lastseen", stale)
+	}
+
+	candidates, err := rdb.ZRevRangeWithScores(ctx, "ccsearch:engagement", 0, trendsCandidates-1).Result()
+	if err != nil {
+		reportError("trends", err)
+		return
+	}
+
+	global := []trendingMessage{}
+	timelines := map[string][]trendingMessage{}
+	expired := []string{}
+
+	for _, candidate := range candidates {
+		id := candidate.Member.(string)
+
+		var message messageRecord
+		found := false
+		for _, index := range indexes {
+			err := index.GetDocument(id, &meilisearch.DocumentQuery{
+				Fields: []string{"id", "signer", "signedAt", "timelines", "hidden", "restricted", "expiresAt"},
+			}, &message)
+			if err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// not an indexed message (e.g. a profile, or not indexed yet)
+			continue
+		}
+		if message.Hidden || (message.ExpiresAt > 0 && message.ExpiresAt <= time.Now().UnixMilli()) {
+			continue
+		}
+
+		signedAt := time.UnixMilli(message.SignedAt)
+		if signedAt.Before(cutoff) {
+			expired = append(expired, id)
+			continue
+		}
+
+		trend := trendingMessage{
+			ID:         message.ID,
+			Owner:      message.Signer,
+			Engagement: int64(candidate.Score),
+			Score:      candidate.Score / math.Pow(time.Since(signedAt).Hours()+2, 1.5),
+		}
+
+		if !message.Restricted {
+			global = append(global, trend)
+		}
+		for _, timeline := range message.Timelines {
+			timelines[timeline] = append(timelines[timeline], trend)
+		}
+	}
+
+	if len(expired) > 0 {
+		rdb.ZRem(ctx, "ccsearch:engagement", expired)
+		rdb.ZRem(ctx, "ccsearch:engagement:lastseen", expired)
+	}
+
+	pipe := rdb.Pipeline()
+	storeTrends(ctx, pipe, "", global)
+	for timeline, trends := range timelines {
+		storeTrends(ctx, pipe, timeline, trends)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		reportError("trends", err)
+		return
+	}
+
+	jobsLog.Info("trends computed", "messages", len(global), "timelines", len(timelines))
+}
+
+func storeTrends(ctx context.Context, pipe redis.Pipeliner, timeline string, trends []trendingMessage) {
+	slices.SortFunc(trends, func(a, b trendingMessage) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	if len(trends) > trendsSize {
+		trends = trends[:trendsSize]
+	}
+
+	trendsJson, err := json.Marshal(trends)
+	if err != nil {
+		reportError("trends", err)
+		return
+	}
+
+	pipe.Set(ctx, trendsKey(timeline), trendsJson, trendsTTL)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/meilisearch/meilisearch-go"
+)
+
+// typoTolerance is the typo tolerance of the message indexes, nil to keep the engine
+// defaults.
+var typoTolerance *meilisearch.TypoTolerance
+
+// setupTypoTolerance reads the typo tolerance of the message indexes:
+// TYPO_MIN_WORD_SIZE_ONE and TYPO_MIN_WORD_SIZE_TWO, the length from which a word
+// matches with one and two typos (5 and 9 by default), TYPO_DISABLE_ON_ATTRIBUTES and
+// TYPO_DISABLE_ON_WORDS, comma separated attributes and words matched exactly. CCIDs
+// are long enough for two typos, so raising the sizes or disabling typos on the
+// attributes holding them keeps searches for one from matching others.
+func setupTypoTolerance() error {
+	one, two := os.Getenv("TYPO_MIN_WORD_SIZE_ONE"), os.Getenv("TYPO_MIN_WORD_SIZE_TWO")
+	attributes, words := os.Getenv("TYPO_DISABLE_ON_ATTRIBUTES"), os.Getenv("TYPO_DISABLE_ON_WORDS")
+	if one == "" && two == "" && attributes == "" && words == "" {
+		return nil
+	}
+
+	tolerance := &meilisearch.TypoTolerance{
+		Enabled: true,
+		MinWordSizeForTypos: meilisearch.MinWordSizeForTypos{
+			OneTypo:  5,
+			TwoTypos: 9,
+		},
+		DisableOnAttributes: splitList(attributes),
+		DisableOnWords:      splitList(words),
+	}
+	if one != "" {
+		size, err := strconv.ParseInt(one, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid TYPO_MIN_WORD_SIZE_ONE: %s", one)
+		}
+		tolerance.MinWordSizeForTypos.OneTypo = size
+	}
+	if two != "" {
+		size, err := strconv.ParseInt(two, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid TYPO_MIN_WORD_SIZE_TWO: %s", two)
+		}
+		tolerance.MinWordSizeForTypos.TwoTypos = size
+	}
+	if tolerance.MinWordSizeForTypos.TwoTypos < tolerance.MinWordSizeForTypos.OneTypo {
+		return fmt.Errorf("TYPO_MIN_WORD_SIZE_TWO must not be below TYPO_MIN_WORD_SIZE_ONE")
+	}
+
+	typoTolerance = tolerance
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sameTypoTolerance compares the typo tolerance of an index with the desired one.
+func sameTypoTolerance(current, desired *meilisearch.TypoTolerance) bool {
+	return current.Enabled == desired.Enabled &&
+		current.MinWordSizeForTypos == desired.MinWordSizeForTypos &&
+		sameAttributes(current.DisableOnAttributes, desired.DisableOnAttributes) &&
+		sameWords(current.DisableOnWords, desired.DisableOnWords)
+}
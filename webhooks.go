@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const webhooksKey = "ccsearch:webhooks"
+
+// Operational events delivered to webhooks.
+const (
+	eventReindexCompleted = "reindex.completed"
+	eventLagExceeded      = "indexing.lag_exceeded"
+	eventLagRecovered     = "indexing.lag_recovered"
+	eventDLQNonEmpty      = "dlq.non_empty"
+)
+
+var webhookEvents = []string{eventReindexCompleted, eventLagExceeded, eventLagRecovered, eventDLQNonEmpty}
+
+type webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+type webhookPayload struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Data     any       `json:"data,omitempty"`
+}
+
+// webhookNotifier delivers events to the webhooks registered in redis. Deliveries are
+// signed with the webhook secret in X-CC-Search-Signature (sha256 HMAC of the body).
+type webhookNotifier struct {
+	rdb    *redis.Client
+	client *http.Client
+
+	// lagThreshold is the number of commits behind at which eventLagExceeded fires.
+	lagThreshold uint
+
+	mu          sync.Mutex
+	lagging     map[string]bool
+	deadLetters bool
+}
+
+var webhooks *webhookNotifier
+
+func newWebhookNotifier(rdb *redis.Client) (*webhookNotifier, error) {
+	notifier := &webhookNotifier{
+		rdb: rdb,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		lagThreshold: 10000,
+		lagging:      map[string]bool{},
+	}
+
+	if value := os.Getenv("WEBHOOK_LAG_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || threshold == 0 {
+			return nil, fmt.Errorf("invalid WEBHOOK_LAG_THRESHOLD: %s", value)
+		}
+		notifier.lagThreshold = uint(threshold)
+	}
+
+	return notifier, nil
+}
+
+func (n *webhookNotifier) list(ctx context.Context) ([]webhook, error) {
+	values, err := n.rdb.HGetAll(ctx, webhooksKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []webhook{}
+	for _, value := range values {
+		var hook webhook
+		err := json.Unmarshal([]byte(value), &hook)
+		if err != nil {
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	slices.SortFunc(hooks, func(a, b webhook) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return hooks, nil
+}
+
+// notify sends the event to every webhook subscribed to it, in the background.
+func (n *webhookNotifier) notify(ctx context.Context, event string, data any) {
+	hooks, err := n.list(ctx)
+	if err != nil {
+		reportError("webhooks", err)
+		return
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		Event:    event,
+		Time:     time.Now(),
+		Instance: elector.id,
+		Data:     data,
+	})
+	if err != nil {
+		reportError("webhooks", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !slices.Contains(hook.Events, event) {
+			continue
+		}
+		go n.deliver(hook, payload)
+	}
+}
+
+// deliver posts the payload, retrying a few times with a growing delay.
+func (n *webhookNotifier) deliver(hook webhook, payload []byte) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+
+		err = n.post(hook, payload)
+		if err == nil {
+			return
+		}
+	}
+
+	reportError("webhooks", fmt.Errorf("delivery to %s failed: %w", hook.URL, err))
+}
+
+func (n *webhookNotifier) post(hook webhook, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-CC-Search-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkLag fires eventLagExceeded when a pipeline falls behind the threshold, and
+// eventLagRecovered once it has caught up again.
+func (n *webhookNotifier) checkLag(ctx context.Context, latest uint) {
+	for _, status := range pipelineStatuses(ctx, latest) {
+		exceeded := status.Lag > n.lagThreshold
+
+		n.mu.Lock()
+		changed := n.lagging[status.Name] != exceeded
+		n.lagging[status.Name] = exceeded
+		n.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		data := echo.Map{
+			"pipeline":  status.Name,
+			"lag":       status.Lag,
+			"threshold": n.lagThreshold,
+		}
+		if exceeded {
+			n.notify(ctx, eventLagExceeded, data)
+		} else {
+			n.notify(ctx, eventLagRecovered, data)
+		}
+	}
+}
+
+// checkDeadLetters fires eventDLQNonEmpty when commits land in the dead-letter queue
+// while it was empty.
+func (n *webhookNotifier) checkDeadLetters(ctx context.Context) error {
+	count, err := n.rdb.HLen(ctx, deadLetterKey).Result()
+	if err != nil {
+		return err
+	}
+	nonEmpty := count > 0
+
+	n.mu.Lock()
+	changed := n.deadLetters != nonEmpty
+	n.deadLetters = nonEmpty
+	n.mu.Unlock()
+
+	if changed && nonEmpty {
+		n.notify(ctx, eventDLQNonEmpty, echo.Map{"deadLetters": count})
+	}
+	return nil
+}
+
+func newWebhookID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func setupWebhookRoutes(admin *echo.Group) {
+
+	admin.GET("/webhooks", func(c echo.Context) error {
+		hooks, err := webhooks.list(c.Request().Context())
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		for i := range hooks {
+			if hooks[i].Secret != "" {
+				hooks[i].Secret = "********"
+			}
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": hooks, "events": webhookEvents})
+	})
+
+	admin.POST("/webhooks", func(c echo.Context) error {
+		var request webhook
+		err := c.Bind(&request)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, codeInvalidBody, err.Error())
+		}
+
+		parsed, err := url.Parse(request.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "url", "url must be an http(s) URL")
+		}
+		if len(request.Events) == 0 {
+			return respondFieldError(c, http.StatusBadRequest, codeMissingParameter, "events", "events is required")
+		}
+		for _, event := range request.Events {
+			if !slices.Contains(webhookEvents, event) {
+				return respondFieldError(c, http.StatusBadRequest, codeInvalidParameter, "events", "unknown event: "+event)
+			}
+		}
+
+		request.ID = newWebhookID()
+		hookJson, err := json.Marshal(request)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		err = webhooks.rdb.HSet(c.Request().Context(), webhooksKey, request.ID, hookJson).Err()
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		adminLog.Info("webhook registered", "id", request.ID, "url", request.URL, "events", request.Events)
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok", "content": echo.Map{"id": request.ID}})
+	})
+
+	admin.DELETE("/webhooks/:id", func(c echo.Context) error {
+		removed, err := webhooks.rdb.HDel(c.Request().Context(), webhooksKey, c.Param("id")).Result()
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		if removed == 0 {
+			return respondFieldError(c, http.StatusNotFound, codeNotFound, "id", "unknown webhook")
+		}
+		adminLog.Info("webhook removed", "id", c.Param("id"))
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+
+	admin.POST("/webhooks/:id/test", func(c echo.Context) error {
+		hookJson, err := webhooks.rdb.HGet(c.Request().Context(), webhooksKey, c.Param("id")).Result()
+		if err == redis.Nil {
+			return respondFieldError(c, http.StatusNotFound, codeNotFound, "id", "unknown webhook")
+		}
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		var hook webhook
+		err = json.Unmarshal([]byte(hookJson), &hook)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+
+		payload, _ := json.Marshal(webhookPayload{
+			Event:    "test",
+			Time:     time.Now(),
+			Instance: elector.id,
+		})
+		err = webhooks.post(hook, payload)
+		if err != nil {
+			return respondError(c, http.StatusBadGateway, codeInternal, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+	})
+}